@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/crc-org/vfkit/pkg/diskimage"
+	"github.com/spf13/cobra"
+)
+
+var diskCmd = &cobra.Command{
+	Use:   "disk",
+	Short: "Manage disk images",
+	Long: `Create, resize, inspect and convert disk images.
+The virtualization framework only supports raw disk images, qcow2 images can be converted to sparse raw images,
+or served to the virtual machine by the built-in NBD server with 'virtio-blk,path=disk.qcow2,type=nbd'.`,
+}
+
+var (
+	diskCreateSize        string
+	diskCreateFormat      string
+	diskCreateBackingFile string
+)
+
+var diskCreateCmd = &cobra.Command{
+	Use:   "create PATH --size SIZE",
+	Short: "Create a sparse raw disk image, or an empty qcow2 disk image",
+	Long: `Create a sparse raw disk image, or an empty qcow2 disk image with --format qcow2.
+qcow2 images can be copy on write overlays of a raw or qcow2 image with --backing-file, the size of the backing file is used when --size is not set.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		var size uint64
+		if diskCreateSize != "" {
+			var err error
+			size, err = diskimage.ParseSize(diskCreateSize)
+			if err != nil {
+				return err
+			}
+		}
+		switch diskimage.Format(diskCreateFormat) {
+		case diskimage.Raw:
+			if diskCreateBackingFile != "" {
+				return fmt.Errorf("raw disk images can't have a backing file, use --format qcow2")
+			}
+			if diskCreateSize == "" {
+				return fmt.Errorf("missing disk size, use --size")
+			}
+			return diskimage.Create(args[0], size)
+		case diskimage.QCOW2:
+			if diskCreateSize == "" && diskCreateBackingFile == "" {
+				return fmt.Errorf("missing disk size, use --size")
+			}
+			return diskimage.CreateQcow2(args[0], size, diskCreateBackingFile)
+		default:
+			return fmt.Errorf("unsupported disk image format: %s", diskCreateFormat)
+		}
+	},
+}
+
+var diskResizeShrink bool
+
+var diskResizeCmd = &cobra.Command{
+	Use:   "resize PATH [+|-]SIZE",
+	Short: "Resize a raw disk image",
+	Long: `Resize a raw disk image to SIZE, or grow/shrink it by SIZE when it starts with '+' or '-'.
+The partitions and filesystems of the disk image must be resized separately, usually from the guest.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(_ *cobra.Command, args []string) error {
+		info, err := diskimage.Inspect(args[0])
+		if err != nil {
+			return err
+		}
+		size, err := diskimage.ParseNewSize(info.VirtualSize, args[1])
+		if err != nil {
+			return err
+		}
+		err = diskimage.Resize(args[0], size, diskResizeShrink)
+		if errors.Is(err, diskimage.ErrShrink) {
+			return fmt.Errorf("%w, use --shrink to shrink it anyway", err)
+		}
+		return err
+	},
+}
+
+var diskInfoJSON bool
+
+var diskInfoCmd = &cobra.Command{
+	Use:   "info PATH",
+	Short: "Show the format and size of a disk image",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		info, err := diskimage.Inspect(args[0])
+		if err != nil {
+			return err
+		}
+		if diskInfoJSON {
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(info)
+		}
+		printDiskInfo(cmd.OutOrStdout(), args[0], info)
+		return nil
+	},
+}
+
+func printDiskInfo(out io.Writer, path string, info *diskimage.Info) {
+	fmt.Fprintf(out, "image: %s\n", path)
+	fmt.Fprintf(out, "format: %s\n", info.Format)
+	fmt.Fprintf(out, "virtual size: %s (%d bytes)\n", diskimage.FormatSize(info.VirtualSize), info.VirtualSize)
+	fmt.Fprintf(out, "disk size: %s\n", diskimage.FormatSize(info.AllocatedSize))
+	if info.ClusterSize != 0 {
+		fmt.Fprintf(out, "cluster size: %d\n", info.ClusterSize)
+	}
+	if info.BackingFile != "" {
+		fmt.Fprintf(out, "backing file: %s\n", info.BackingFile)
+	}
+}
+
+var diskConvertCmd = &cobra.Command{
+	Use:   "convert SOURCE DESTINATION",
+	Short: "Convert a qcow2 disk image to a sparse raw disk image",
+	Long: `Convert the qcow2 disk image SOURCE to a sparse raw disk image at DESTINATION, which must not exist.
+Compressed clusters and backing files are supported, encrypted qcow2 images are not.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(_ *cobra.Command, args []string) error {
+		return diskimage.Convert(args[0], args[1])
+	},
+}
+
+var diskSnapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manage snapshots of raw disk images",
+	Long: `Create, list, revert and delete named snapshots of raw disk images.
+Snapshots are clones of the disk image stored in the IMAGE.snapshots directory, they share their unmodified blocks with
+the disk image on APFS. Disk images in use by a running vfkit process can't be snapshotted or reverted, and their
+snapshots can't be deleted.`,
+}
+
+var (
+	diskSnapshotDescription string
+	diskSnapshotVMConfig    string
+)
+
+var diskSnapshotCreateCmd = &cobra.Command{
+	Use:   "create IMAGE NAME",
+	Short: "Create a snapshot of a raw disk image",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var vmConfigHash string
+		if diskSnapshotVMConfig != "" {
+			vmConfig, err := os.ReadFile(diskSnapshotVMConfig)
+			if err != nil {
+				return err
+			}
+			vmConfigHash = fmt.Sprintf("sha256:%x", sha256.Sum256(vmConfig))
+		}
+		snapshot, err := diskimage.CreateSnapshot(args[0], args[1], diskSnapshotDescription, vmConfigHash)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Created snapshot %s of %s\n", snapshot.Name, args[0])
+		return nil
+	},
+}
+
+var diskSnapshotListJSON bool
+
+var diskSnapshotListCmd = &cobra.Command{
+	Use:   "list IMAGE",
+	Short: "List the snapshots of a disk image",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		snapshots, err := diskimage.ListSnapshots(args[0])
+		if err != nil {
+			return err
+		}
+		if diskSnapshotListJSON {
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(snapshots)
+		}
+		printSnapshots(cmd.OutOrStdout(), snapshots)
+		return nil
+	},
+}
+
+func printSnapshots(out io.Writer, snapshots []diskimage.Snapshot) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCREATED\tVM CONFIG\tDESCRIPTION")
+	for _, snapshot := range snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", snapshot.Name, snapshot.Created.Local().Format(time.DateTime), snapshot.VMConfigHash, snapshot.Description)
+	}
+	_ = w.Flush()
+}
+
+var diskSnapshotRevertCmd = &cobra.Command{
+	Use:   "revert IMAGE NAME",
+	Short: "Revert a raw disk image to one of its snapshots",
+	Long:  `Revert the raw disk image IMAGE to its snapshot NAME, the changes made since the snapshot was created are lost. The snapshot is kept.`,
+	Args:  cobra.ExactArgs(2),
+	RunE: func(_ *cobra.Command, args []string) error {
+		return diskimage.RevertSnapshot(args[0], args[1])
+	},
+}
+
+var diskSnapshotDeleteCmd = &cobra.Command{
+	Use:   "delete IMAGE NAME",
+	Short: "Delete a snapshot of a disk image",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(_ *cobra.Command, args []string) error {
+		return diskimage.DeleteSnapshot(args[0], args[1])
+	},
+}
+
+func init() {
+	diskCreateCmd.Flags().StringVar(&diskCreateSize, "size", "", "size of the disk image, for example 20GiB")
+	diskCreateCmd.Flags().StringVar(&diskCreateFormat, "format", string(diskimage.Raw), "format of the disk image, raw or qcow2")
+	diskCreateCmd.Flags().StringVar(&diskCreateBackingFile, "backing-file", "", "backing file of the qcow2 disk image, relative to the directory of the new image")
+	diskResizeCmd.Flags().BoolVar(&diskResizeShrink, "shrink", false, "allow shrinking the disk image, the data at its end is lost")
+	diskInfoCmd.Flags().BoolVar(&diskInfoJSON, "json", false, "print the disk image information as JSON")
+
+	diskSnapshotCreateCmd.Flags().StringVar(&diskSnapshotDescription, "description", "", "description of the snapshot")
+	diskSnapshotCreateCmd.Flags().StringVar(&diskSnapshotVMConfig, "vm-config", "", "configuration file of the virtual machine using the disk image, its hash is stored with the snapshot")
+	diskSnapshotListCmd.Flags().BoolVar(&diskSnapshotListJSON, "json", false, "print the snapshots as JSON")
+	diskSnapshotCmd.AddCommand(diskSnapshotCreateCmd, diskSnapshotListCmd, diskSnapshotRevertCmd, diskSnapshotDeleteCmd)
+
+	diskCmd.AddCommand(diskCreateCmd, diskResizeCmd, diskInfoCmd, diskConvertCmd, diskSnapshotCmd)
+	rootCmd.AddCommand(diskCmd)
+}
@@ -0,0 +1,54 @@
+//go:build darwin
+
+package main
+
+import (
+	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/crc-org/vfkit/pkg/events"
+	"github.com/crc-org/vfkit/pkg/hostsleep"
+	"github.com/crc-org/vfkit/pkg/timesync"
+	"github.com/crc-org/vfkit/pkg/vf"
+	sleepnotifier "github.com/prashantgupta24/mac-sleep-notifier/notifier"
+	log "github.com/sirupsen/logrus"
+)
+
+// watchHostSleep applies the --on-host-sleep policy, and synchronizes the
+// guest time when the host wakes up. The sleep notifications are only watched
+// when one of them is enabled.
+func watchHostSleep(vm *vf.VirtualMachine, policy config.HostSleepPolicy, syncer *timesync.Syncer) {
+	pauseOnSleep := policy == config.HostSleepPause
+	if !pauseOnSleep && syncer == nil {
+		return
+	}
+
+	handler := hostsleep.NewHandler(vm, pauseOnSleep)
+	handler.OnTransition = func(transition hostsleep.Transition) {
+		kind := events.KindHostSleep
+		if transition.Event == hostsleep.Wake {
+			kind = events.KindHostWake
+		}
+		if transition.Error != "" {
+			log.Warnf("failed to handle host %s: %s", transition.Event, transition.Error)
+		}
+		vmEvents.Record(kind, transition, "host %s, virtual machine action: %s", transition.Event, transition.Action)
+	}
+	if syncer != nil {
+		// the guest time is synchronized after the VM is resumed
+		handler.OnWake = func() {
+			syncer.Trigger(timesync.ReasonWakeup)
+		}
+	}
+
+	go func() {
+		sleepNotifierCh := sleepnotifier.GetInstance().Start()
+		for activity := range sleepNotifierCh {
+			log.Debugf("Sleep notification: %s", activity)
+			switch activity.Type {
+			case sleepnotifier.Sleep:
+				handler.Handle(hostsleep.Sleep)
+			case sleepnotifier.Awake:
+				handler.Handle(hostsleep.Wake)
+			}
+		}
+	}()
+}
@@ -0,0 +1,67 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/crc-org/vfkit/pkg/events"
+	"github.com/crc-org/vfkit/pkg/ignition"
+	"github.com/crc-org/vfkit/pkg/util"
+	"github.com/crc-org/vfkit/pkg/vf"
+	log "github.com/sirupsen/logrus"
+)
+
+// newIgnitionServer creates the server of the ignition configuration of the
+// virtual machine, its fetches are recorded in vmEvents
+func newIgnitionServer(vmConfig *config.VirtualMachine) (*ignition.Server, error) {
+	ignitionConfig, err := vmConfig.IgnitionConfig()
+	if err != nil {
+		return nil, err
+	}
+	srv := ignition.NewServer(ignitionConfig)
+	srv.ShutdownAfterFetch = vmConfig.Ignition.ShutdownAfterFetch
+	srv.OnFetch = func(fetch ignition.Fetch) {
+		vmEvents.Record(events.KindIgnitionFetch, fetch, "ignition configuration fetched from the %s (status %d, %d bytes)", fetch.Source, fetch.Status, fetch.Bytes)
+	}
+	return srv, nil
+}
+
+// startIgnitionProvisionerServer serves the ignition configuration on the
+// ignition vsock port of the virtual machine, and on the unix socket of
+// config.Ignition.SocketPath when it's set
+func startIgnitionProvisionerServer(vm *vf.VirtualMachine, vmConfig *config.VirtualMachine, srv *ignition.Server) error {
+	if socketPath := vmConfig.Ignition.SocketPath; socketPath != "" {
+		hostListener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return err
+		}
+		util.RegisterExitHandler(func() { os.Remove(socketPath) })
+		log.Infof("Serving the ignition configuration on %s", socketPath)
+		go func() {
+			if err := srv.ServeHost(hostListener); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
+	vsockDevices := vm.SocketDevices()
+	if len(vsockDevices) != 1 {
+		return fmt.Errorf("VM has too many/not enough virtio-vsock devices (%d)", len(vsockDevices))
+	}
+	listener, err := vsockDevices[0].Listen(vmConfig.Ignition.VsockPort)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("ignition socket: %s", listener.Addr().String())
+	// the listener is closed by Serve
+	if err := srv.Serve(listener); err != nil {
+		return err
+	}
+	vmEvents.Record(events.KindIgnitionServerStopped, nil, "ignition server stopped after the guest fetched its configuration")
+	return nil
+}
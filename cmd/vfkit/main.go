@@ -19,14 +19,11 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net"
-	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"runtime"
 	"syscall"
 	"time"
@@ -34,11 +31,15 @@ import (
 	"github.com/Code-Hex/vz/v3"
 	"github.com/crc-org/vfkit/pkg/cmdline"
 	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/crc-org/vfkit/pkg/events"
+	"github.com/crc-org/vfkit/pkg/exitstatus"
+	"github.com/crc-org/vfkit/pkg/ignition"
 	"github.com/crc-org/vfkit/pkg/process"
 	"github.com/crc-org/vfkit/pkg/rest"
 	restvf "github.com/crc-org/vfkit/pkg/rest/vf"
+	"github.com/crc-org/vfkit/pkg/snapshot"
+	"github.com/crc-org/vfkit/pkg/timesync"
 	"github.com/crc-org/vfkit/pkg/vf"
-	"github.com/kdomanski/iso9660"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/crc-org/vfkit/pkg/util"
@@ -84,7 +85,15 @@ func newVMConfiguration(opts *cmdline.Options) (*config.VirtualMachine, error) {
 		return nil, fmt.Errorf("nested virtualization is not supported")
 	}
 	vmConfig.Nested = opts.Nested
+	vmConfig.Name = opts.Name
+	vmConfig.StateDir = opts.StateDir
 	log.Info("virtual machine parameters:")
+	if opts.Name != "" {
+		log.Infof("\tname: %s", opts.Name)
+	}
+	if opts.StateDir != "" {
+		log.Infof("\tstate directory: %s", opts.StateDir)
+	}
 	log.Infof("\tvCPUs: %d", opts.Vcpus)
 	log.Infof("\tmemory: %d MiB", opts.MemoryMiB)
 	log.Info()
@@ -93,16 +102,10 @@ func newVMConfiguration(opts *cmdline.Options) (*config.VirtualMachine, error) {
 		return nil, err
 	}
 
-	cloudInitISO, err := generateCloudInitImage(opts.CloudInitFiles.GetSlice())
-	if err != nil {
+	if err := vmConfig.AddCloudInitFromCmdLine(opts.CloudInitFiles.GetSlice(), opts.CloudInitNetworkConfig); err != nil {
 		return nil, err
 	}
 
-	// if it generated a valid cloudinit config ISO file we add it to the devices
-	if cloudInitISO != "" {
-		opts.Devices = append(opts.Devices, fmt.Sprintf("virtio-blk,path=%s", cloudInitISO))
-	}
-
 	if opts.PidFile != "" {
 		execPath, err := os.Executable()
 		if err != nil {
@@ -119,6 +122,15 @@ func newVMConfiguration(opts *cmdline.Options) (*config.VirtualMachine, error) {
 	if err := vmConfig.AddDevicesFromCmdLine(opts.Devices); err != nil {
 		return nil, err
 	}
+	if stateDir != nil {
+		// the console logs with a relative path are written to the
+		// state directory
+		for _, dev := range vmConfig.VirtioSerialDevices() {
+			if dev.LogFile != "" {
+				dev.LogFile = stateDir.Resolve(dev.LogFile)
+			}
+		}
+	}
 
 	if opts.UseGUI {
 		if len(vmConfig.VirtioGPUDevices()) == 0 {
@@ -149,9 +161,34 @@ func newVMConfiguration(opts *cmdline.Options) (*config.VirtualMachine, error) {
 	if err := vmConfig.AddIgnitionFileFromCmdLine(opts.IgnitionPath); err != nil {
 		return nil, fmt.Errorf("failed to add ignition file: %w", err)
 	}
+
+	if err := vmConfig.AddSSHKeyFromCmdLine(opts.SSHKey); err != nil {
+		return nil, err
+	}
+	if err := vmConfig.AddMetadataServiceFromCmdLine(opts.MetadataService); err != nil {
+		return nil, err
+	}
+	if err := vmConfig.AddHostSleepPolicyFromCmdLine(opts.OnHostSleep); err != nil {
+		return nil, err
+	}
+	if vmConfig.SSHKey != "" && vmConfig.Ignition == nil && vmConfig.CloudInit == nil && vmConfig.MetadataService == nil {
+		log.Warnf("--ssh-key is only provisioned with --cloud-init, --ignition or --metadata-service, it must already be authorized in the virtual machine")
+	}
 	return vmConfig, nil
 }
 
+// writeStateDirConfig writes the effective configuration of the VM to the
+// state directory
+func writeStateDirConfig(vmConfig *config.VirtualMachine) error {
+	data, err := json.MarshalIndent(vmConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	return stateDir.WriteConfigFile(data)
+}
+
+var errVMStateTimeout = errors.New("timeout waiting for VM state")
+
 func waitForVMState(vm *vf.VirtualMachine, state vz.VirtualMachineState, timeout <-chan time.Time) error {
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGPIPE)
@@ -161,14 +198,15 @@ func waitForVMState(vm *vf.VirtualMachine, state vz.VirtualMachineState, timeout
 		case s := <-signalCh:
 			log.Debugf("ignoring signal %v", s)
 		case newState := <-vm.StateChangedNotify():
+			vmStatus.SetState(newState.String())
 			if newState == state {
 				return nil
 			}
 			if newState == vz.VirtualMachineStateError {
-				return fmt.Errorf("hypervisor virtualization error")
+				return exitstatus.NewError(exitstatus.ReasonHypervisorError, fmt.Errorf("hypervisor virtualization error"))
 			}
 		case <-timeout:
-			return fmt.Errorf("timeout waiting for VM state")
+			return errVMStateTimeout
 		}
 	}
 }
@@ -182,15 +220,32 @@ func runVFKit(vmConfig *config.VirtualMachine, opts *cmdline.Options) error {
 		gpuDevs[0].UsesGUI = true
 	}
 
-	vfVM, err := vf.NewVirtualMachine(*vmConfig)
+	vfVM, err := newVirtualMachine(vmConfig, opts.RestoreFrom)
 	if err != nil {
 		return err
 	}
+	// the ignition configuration is rendered once the MAC addresses of the
+	// virtio-net devices are generated, and validated before the VM starts
+	var ignitionServer *ignition.Server
+	if vmConfig.Ignition != nil {
+		ignitionServer, err = newIgnitionServer(vmConfig)
+		if err != nil {
+			return err
+		}
+	}
+	if stateDir != nil {
+		// the configuration is written once it's complete, with the
+		// generated MAC addresses and pty names
+		if err := writeStateDirConfig(vmConfig); err != nil {
+			log.Warnf("failed to write the configuration to the state directory: %v", err)
+		}
+	}
+	timeSyncer := newTimeSyncer(vfVM, vmConfig.TimeSync())
 
 	// Do not enable the rests server if user sets scheme to None
 	if opts.RestfulURI != cmdline.DefaultRestfulURI {
-		restVM := restvf.NewVzVirtualMachine(vfVM)
-		srv, err := rest.NewServer(restVM, restVM, opts.RestfulURI)
+		restVM := restvf.NewVzVirtualMachine(vfVM, vmStatus, vmEvents, ignitionServer, timeSyncer)
+		srv, err := rest.NewServer(restVM, opts.RestfulURI)
 		if err != nil {
 			return err
 		}
@@ -199,6 +254,7 @@ func runVFKit(vmConfig *config.VirtualMachine, opts *cmdline.Options) error {
 
 	shutdownFunc := func() {
 		log.Debugf("shutting down...")
+		vmStatus.SetReason(exitstatus.ReasonSignal)
 		stopped, err := vfVM.RequestStop()
 		if err != nil {
 			log.Errorf("failed to shutdown VM: %v", err)
@@ -216,24 +272,72 @@ func runVFKit(vmConfig *config.VirtualMachine, opts *cmdline.Options) error {
 
 	}
 	util.SetupExitSignalHandling(shutdownFunc)
-	return runVirtualMachine(vmConfig, vfVM)
+	defer func() {
+		vmStatus.SetState(vfVM.State().String())
+	}()
+	return runVirtualMachine(vmConfig, vfVM, ignitionServer, timeSyncer, opts.RestoreFrom)
+}
+
+// newVirtualMachine creates the virtual machine. When its state is restored
+// from restoreFrom, it reuses the values generated for the saved virtual
+// machine.
+func newVirtualMachine(vmConfig *config.VirtualMachine, restoreFrom string) (*vf.VirtualMachine, error) {
+	if restoreFrom == "" {
+		return vf.NewVirtualMachine(*vmConfig)
+	}
+	metadata, err := snapshot.ReadMetadata(restoreFrom)
+	if err != nil {
+		return nil, err
+	}
+	return vf.NewRestoredVirtualMachine(*vmConfig, metadata.Generated)
+}
+
+// startVirtualMachine starts the virtual machine, or restores the state saved
+// in restoreFrom
+func startVirtualMachine(vm *vf.VirtualMachine, timeSyncer *timesync.Syncer, restoreFrom string) error {
+	if restoreFrom == "" {
+		return vm.Start()
+	}
+
+	log.Infof("restoring virtual machine state from %s", restoreFrom)
+	if err := snapshot.Restore(vm, restoreFrom); err != nil {
+		return err
+	}
+	vmEvents.Record(events.KindStateRestored, map[string]string{"path": restoreFrom}, "virtual machine state restored from %s", restoreFrom)
+	if timeSyncer != nil {
+		// the guest clock stopped when the state was saved
+		timeSyncer.Trigger(timesync.ReasonRestore)
+	}
+	return nil
 }
 
-func runVirtualMachine(vmConfig *config.VirtualMachine, vm *vf.VirtualMachine) error {
-	if vm.Config().Ignition != nil {
+func runVirtualMachine(vmConfig *config.VirtualMachine, vm *vf.VirtualMachine, ignitionServer *ignition.Server, timeSyncer *timesync.Syncer, restoreFrom string) error {
+	if ignitionServer != nil {
 		go func() {
-			if err := startIgnitionProvisionerServer(vm, vmConfig.Ignition.ConfigPath, vmConfig.Ignition.VsockPort); err != nil {
+			if err := startIgnitionProvisionerServer(vm, vmConfig, ignitionServer); err != nil {
 				log.Error(err)
 			}
 			log.Debug("ignition vsock server exited")
 		}()
 	}
 
-	if err := vm.Start(); err != nil {
+	if vmConfig.MetadataService != nil {
+		go func() {
+			if err := startMetadataServer(vm, vmConfig); err != nil {
+				log.Error(err)
+			}
+			log.Debug("metadata vsock server exited")
+		}()
+	}
+
+	if err := startVirtualMachine(vm, timeSyncer, restoreFrom); err != nil {
 		return err
 	}
 
 	if err := waitForVMState(vm, vz.VirtualMachineStateRunning, time.After(5*time.Second)); err != nil {
+		if errors.Is(err, errVMStateTimeout) {
+			return exitstatus.NewError(exitstatus.ReasonStartTimeout, err)
+		}
 		return err
 	}
 	log.Infof("virtual machine is running")
@@ -264,17 +368,18 @@ func runVirtualMachine(vmConfig *config.VirtualMachine, vm *vf.VirtualMachine) e
 		return err
 	}
 
-	if err := setupGuestTimeSync(vm, vmConfig.TimeSync()); err != nil {
+	if err := setupGuestTimeSync(timeSyncer); err != nil {
 		log.Warnf("Error configuring guest time synchronization")
 		log.Debugf("%v", err)
 	}
+	watchHostSleep(vm, vmConfig.OnHostSleep, timeSyncer)
 
 	log.Infof("waiting for VM to stop")
 
 	errCh := make(chan error, 1)
 	go func() {
 		if err := waitForVMState(vm, vz.VirtualMachineStateStopped, nil); err != nil {
-			errCh <- fmt.Errorf("virtualization error: %v", err)
+			errCh <- fmt.Errorf("virtualization error: %w", err)
 		} else {
 			log.Infof("VM is stopped")
 			errCh <- nil
@@ -295,137 +400,3 @@ func runVirtualMachine(vmConfig *config.VirtualMachine, vm *vf.VirtualMachine) e
 
 	return <-errCh
 }
-
-func startIgnitionProvisionerServer(vm *vf.VirtualMachine, configPath string, vsockPort uint32) error {
-	ignitionReader, err := os.Open(configPath)
-	if err != nil {
-		return err
-	}
-	defer ignitionReader.Close()
-
-	vsockDevices := vm.SocketDevices()
-	if len(vsockDevices) != 1 {
-		return fmt.Errorf("VM has too many/not enough virtio-vsock devices (%d)", len(vsockDevices))
-	}
-	listener, err := vsockDevices[0].Listen(vsockPort)
-	if err != nil {
-		return err
-	}
-
-	defer func() {
-		if err := listener.Close(); err != nil {
-			log.Error(err)
-		}
-	}()
-
-	return startIgnitionProvisionerServerInternal(ignitionReader, listener)
-}
-
-func startIgnitionProvisionerServerInternal(ignitionReader io.ReadSeeker, listener net.Listener) error {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		http.ServeContent(w, req, "", time.Time{}, ignitionReader)
-	})
-
-	srv := &http.Server{
-		Handler:           mux,
-		Addr:              listener.Addr().String(),
-		ReadHeaderTimeout: 10 * time.Second,
-		IdleTimeout:       60 * time.Second,
-	}
-
-	log.Debugf("ignition socket: %s", listener.Addr().String())
-	return srv.Serve(listener)
-}
-
-// it generates a cloud init image by taking the files passed by the user
-// as cloud-init expects files with a specific name (e.g user-data, meta-data) we check the filenames to retrieve the correct info
-// if some file is not passed by the user, an empty file will be copied to the cloud-init ISO to
-// guarantee it to work (user-data and meta-data files are mandatory and both must exists, even if they are empty)
-// if both files are missing it returns an error
-func generateCloudInitImage(files []string) (string, error) {
-	if len(files) == 0 {
-		return "", nil
-	}
-
-	configFiles := map[string]io.Reader{
-		"user-data":      nil,
-		"meta-data":      nil,
-		"network-config": nil,
-	}
-
-	hasConfigFile := false
-	for _, path := range files {
-		if path == "" {
-			continue
-		}
-		file, err := os.Open(path)
-		if err != nil {
-			return "", err
-		}
-		defer file.Close()
-
-		filename := filepath.Base(path)
-		if _, ok := configFiles[filename]; ok {
-			if filename == "user-data" || filename == "meta-data" {
-				hasConfigFile = true
-			}
-			configFiles[filename] = file
-		}
-	}
-
-	if !hasConfigFile {
-		return "", fmt.Errorf("cloud-init needs user-data and meta-data files to work")
-	}
-
-	return createCloudInitISO(configFiles)
-}
-
-// It generates a temp ISO file containing the files passed by the user
-// It also register an exit handler to delete the file when vfkit exits
-func createCloudInitISO(files map[string]io.Reader) (string, error) {
-	writer, err := iso9660.NewWriter()
-	if err != nil {
-		return "", fmt.Errorf("failed to create writer: %w", err)
-	}
-
-	defer func() {
-		if err := writer.Cleanup(); err != nil {
-			log.Error(err)
-		}
-	}()
-
-	for name, reader := range files {
-		// if reader is nil, we set it to an empty file
-		if reader == nil {
-			reader = bytes.NewReader([]byte{})
-		}
-		err = writer.AddFile(reader, name)
-		if err != nil {
-			return "", fmt.Errorf("failed to add %s file: %w", name, err)
-		}
-	}
-
-	isoFile, err := util.CreateCloudInitISOFile()
-	if err != nil {
-		return "", err
-	}
-
-	defer func() {
-		if err := isoFile.Close(); err != nil {
-			log.Error(fmt.Errorf("failed to close cloud-init ISO file: %w", err))
-		}
-	}()
-
-	// register handler to remove isoFile when exiting
-	util.RegisterExitHandler(func() {
-		os.Remove(isoFile.Name()) //#nosec G703 -- filename is created in `CreateCloudInitISOFile` but only from constants and random strings, no user-controlled strings
-	})
-
-	err = writer.WriteTo(isoFile, "cidata")
-	if err != nil {
-		return "", fmt.Errorf("failed to write cloud-init ISO image: %w", err)
-	}
-
-	return isoFile.Name(), nil
-}
@@ -0,0 +1,49 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/crc-org/vfkit/pkg/metadata"
+	"github.com/crc-org/vfkit/pkg/vf"
+	log "github.com/sirupsen/logrus"
+)
+
+// startMetadataServer serves the instance metadata of the virtual machine on
+// the vsock port of its metadata service
+func startMetadataServer(vm *vf.VirtualMachine, vmConfig *config.VirtualMachine) error {
+	md, err := vmConfig.InstanceMetadata()
+	if err != nil {
+		return err
+	}
+	handler, err := metadata.Handler(md)
+	if err != nil {
+		return err
+	}
+
+	vsockDevices := vm.SocketDevices()
+	if len(vsockDevices) != 1 {
+		return fmt.Errorf("VM has too many/not enough virtio-vsock devices (%d)", len(vsockDevices))
+	}
+	listener, err := vsockDevices[0].Listen(vmConfig.MetadataService.VsockPort)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := listener.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	log.Infof("Serving instance metadata on vsock port %d", vmConfig.MetadataService.VsockPort)
+	return srv.Serve(listener)
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/crc-org/vfkit/pkg/cmdline"
+	"github.com/crc-org/vfkit/pkg/events"
+	"github.com/crc-org/vfkit/pkg/exitstatus"
 	"github.com/crc-org/vfkit/pkg/util"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -12,12 +16,33 @@ import (
 
 var opts = &cmdline.Options{}
 
+// vmStatus tracks why the VM stopped, it's used to select the exit code
+var vmStatus = exitstatus.NewTracker()
+
+// vmEvents records what happens to the VM, it's reported by the REST API
+var vmEvents = events.NewLog()
+
+// stateDir is the directory of the runtime files of the VM, it's nil when
+// --state-dir is not used
+var stateDir *util.StateDir
+
+var (
+	finishOnce  sync.Once
+	finalStatus exitstatus.Status
+)
+
+// maxUnixSocketPathLen is the size of the path of unix sockets on macOS
+const maxUnixSocketPathLen = 104
+
 var rootCmd = &cobra.Command{
 	Use:   "vfkit",
 	Short: "vfkit is a simple hypervisor using Apple's Virtualization framework",
 	Long: `A hypervisor written in Go using Apple's Virtualization framework to run virtual machines.
                 Complete documentation is available at https://github.com/crc-org/vfkit`,
-	RunE: func(_ *cobra.Command, _ []string) error {
+	RunE: func(cmd *cobra.Command, _ []string) (err error) {
+		// the status file is written by the first exit handler, so that
+		// it's written before the state directory is unlocked
+		util.RegisterExitHandler(func() { finish(err) })
 		// if vfkit stop execution by itself, i.e. when VM stops by guest OS
 		// we need to call ExecuteExitHandlers to clean up
 		defer util.ExecuteExitHandlers()
@@ -28,9 +53,23 @@ var rootCmd = &cobra.Command{
 			}
 			logrus.SetLevel(ll)
 		}
+		if opts.StateDir != "" {
+			dir, err := util.OpenStateDir(opts.StateDir)
+			if err != nil {
+				return err
+			}
+			util.RegisterExitHandler(func() { _ = dir.Close() })
+			stateDir = dir
+			if err := useStateDir(cmd, opts, dir); err != nil {
+				return err
+			}
+		}
 		if err := util.CleanupStaleCloudInitISO(); err != nil {
 			logrus.Warnf("failed to cleanup stale cloud-init ISO: %v", err)
 		}
+		if err := util.CleanupStaleEphemeralDisks(); err != nil {
+			logrus.Warnf("failed to cleanup stale ephemeral disks: %v", err)
+		}
 		vmConfig, err := newVMConfiguration(opts)
 		if err != nil {
 			return err
@@ -49,6 +88,29 @@ func init() {
 	rootCmd.SetVersionTemplate(versionTmpl)
 }
 
+// useStateDir defaults the paths of the runtime files of vfkit and the name of
+// the VM from the state directory
+func useStateDir(cmd *cobra.Command, opts *cmdline.Options, dir *util.StateDir) error {
+	opts.StateDir = dir.Path
+	if opts.Name == "" {
+		opts.Name = filepath.Base(dir.Path)
+	}
+	if opts.PidFile == "" {
+		opts.PidFile = dir.PidFile()
+	}
+	if opts.StatusFile == "" {
+		opts.StatusFile = dir.StatusFile()
+	}
+	if !cmd.Flags().Changed("restful-uri") {
+		socket := dir.RESTSocket()
+		if len(socket) >= maxUnixSocketPathLen {
+			return fmt.Errorf("the path of the REST API socket %s is too long: %d >= %d bytes, use --restful-uri to set its URI", socket, len(socket), maxUnixSocketPathLen)
+		}
+		opts.RestfulURI = "unix://" + socket
+	}
+	return nil
+}
+
 func getLogLevel() (logrus.Level, error) {
 	switch opts.LogLevel {
 	case "error":
@@ -61,11 +123,38 @@ func getLogLevel() (logrus.Level, error) {
 	return 0, fmt.Errorf("unknown log level: %s", opts.LogLevel)
 }
 
+// finish records err as the final error of vfkit and writes the status file.
+// Only the first call has an effect, it returns the final status.
+func finish(err error) exitstatus.Status {
+	finishOnce.Do(func() {
+		finalStatus = vmStatus.Finish(err)
+		if opts.StatusFile != "" {
+			if err := finalStatus.WriteFile(opts.StatusFile); err != nil {
+				logrus.Warnf("failed to write status file: %v", err)
+			}
+		}
+	})
+	return finalStatus
+}
+
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	cmd, err := rootCmd.ExecuteC()
+	if cmd != rootCmd {
+		// subcommands such as 'disk' don't run a VM, the exit codes and the
+		// status file only apply to the root command
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	// the status is already final when RunE ran its exit handlers, it's
+	// only written here when the command line is invalid
+	status := finish(err)
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
 	}
+	os.Exit(status.ExitCode)
 }
 
 func main() {
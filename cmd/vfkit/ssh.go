@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/crc-org/vfkit/pkg/cmdline"
+	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/crc-org/vfkit/pkg/dhcp"
+	"github.com/crc-org/vfkit/pkg/ignition"
+	"github.com/crc-org/vfkit/pkg/process"
+	"github.com/crc-org/vfkit/pkg/rest"
+	"github.com/crc-org/vfkit/pkg/sshkey"
+	"github.com/crc-org/vfkit/pkg/util"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	sshPort = 22
+	// sshInspectTimeout is the timeout of the REST API requests getting the
+	// configuration of the virtual machines
+	sshInspectTimeout = 5 * time.Second
+)
+
+var (
+	sshPID   int32
+	sshUser  string
+	sshProxy string
+)
+
+var sshCmd = &cobra.Command{
+	Use:   "ssh [COMMAND [ARG...]]",
+	Short: "Connect with SSH to a running virtual machine",
+	Long: `Connect with SSH to a virtual machine started with --ssh-key, using the ssh client of the host.
+The SSH server is reached through a virtio-vsock device exposing the guest port 22 ('virtio-vsock,port=22,socketURL=PATH,connect'),
+or through the IP address leased to a NAT virtio-net device.
+The user is 'core' for virtual machines using ignition, it must be set with --user otherwise.`,
+	RunE: func(_ *cobra.Command, args []string) error {
+		if sshProxy != "" {
+			return proxyUnixSocket(sshProxy)
+		}
+		target, err := findSSHTarget(sshPID)
+		if err != nil {
+			return err
+		}
+		if sshUser != "" {
+			target.user = sshUser
+		}
+		sshArgs, err := target.sshArgs(args)
+		if err != nil {
+			return err
+		}
+		sshPath, err := exec.LookPath("ssh")
+		if err != nil {
+			return err
+		}
+		logrus.Debugf("running %s", strings.Join(sshArgs, " "))
+		return syscall.Exec(sshPath, sshArgs, os.Environ()) //#nosec G204 -- the arguments come from the vfkit command line
+	},
+}
+
+// sshTarget describes how to connect to the SSH server of a virtual machine
+type sshTarget struct {
+	pid     int32
+	keyPath string
+	user    string
+	// vsockPath is the unix socket connected to the guest port 22
+	vsockPath string
+	// mac is the MAC address of a NAT virtio-net device
+	mac net.HardwareAddr
+}
+
+// findSSHTarget looks for the virtual machine to connect to in the running
+// vfkit processes started with --ssh-key, pid selects one of them
+func findSSHTarget(pid int32) (*sshTarget, error) {
+	instances, err := process.Instances()
+	if err != nil {
+		return nil, err
+	}
+	targets := []*sshTarget{}
+	for _, instance := range instances {
+		if pid != 0 && instance.PID != pid {
+			continue
+		}
+		target, err := newSSHTarget(&instance)
+		if err != nil {
+			if pid != 0 {
+				return nil, err
+			}
+			logrus.Debugf("ignoring vfkit process %d: %v", instance.PID, err)
+			continue
+		}
+		targets = append(targets, target)
+	}
+
+	switch len(targets) {
+	case 0:
+		if pid != 0 {
+			return nil, fmt.Errorf("no running vfkit process with pid %d", pid)
+		}
+		return nil, fmt.Errorf("no running virtual machine was started with --ssh-key")
+	case 1:
+		return targets[0], nil
+	default:
+		pids := []string{}
+		for _, target := range targets {
+			pids = append(pids, fmt.Sprint(target.pid))
+		}
+		return nil, fmt.Errorf("several virtual machines were started with --ssh-key (pids %s), use --pid to select one", strings.Join(pids, ", "))
+	}
+}
+
+func newSSHTarget(instance *process.Instance) (*sshTarget, error) {
+	opts, err := cmdline.Parse(instance.Args)
+	if err != nil {
+		return nil, err
+	}
+	if opts.SSHKey == "" {
+		return nil, fmt.Errorf("vfkit process %d was not started with --ssh-key", instance.PID)
+	}
+	keyPath, err := sshkey.ResolvePath(opts.SSHKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPath, err = instance.AbsPath(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	target := &sshTarget{pid: instance.PID, keyPath: keyPath}
+	if opts.IgnitionPath != "" {
+		target.user = ignition.DefaultUser
+	}
+
+	vm, err := effectiveConfig(instance, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, dev := range vm.VirtioVsockDevices() {
+		if dev.Port == sshPort && !dev.Listen && dev.SocketURL != "" && target.vsockPath == "" {
+			target.vsockPath, err = instance.AbsPath(dev.SocketURL)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, dev := range vm.VirtioNetDevices() {
+		if dev.Nat && len(dev.MacAddress) != 0 && target.mac == nil {
+			target.mac = dev.MacAddress
+		}
+	}
+	if target.vsockPath == "" && target.mac == nil {
+		return nil, fmt.Errorf("the SSH server of vfkit process %d can't be reached, it needs a 'virtio-vsock,port=22,socketURL=PATH,connect' device or a NAT 'virtio-net' device", instance.PID)
+	}
+	return target, nil
+}
+
+// effectiveConfig returns the configuration of the virtual machine of a vfkit
+// process, with the MAC addresses vfkit generated. It's read from the state
+// directory or from the REST API of the process. For the other processes, the
+// devices giving access to the guest are parsed from the command line, which
+// only has the MAC addresses set by the user.
+func effectiveConfig(instance *process.Instance, opts *cmdline.Options) (*config.VirtualMachine, error) {
+	var (
+		data []byte
+		err  error
+	)
+	switch {
+	case opts.StateDir != "":
+		var path string
+		path, err = instance.AbsPath(opts.StateDir)
+		if err != nil {
+			return nil, err
+		}
+		data, err = os.ReadFile((&util.StateDir{Path: path}).ConfigFile())
+	case opts.RestfulURI != cmdline.DefaultRestfulURI:
+		data, err = inspectVM(instance, opts.RestfulURI)
+	default:
+		return cmdLineConfig(opts), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the configuration of vfkit process %d: %w", instance.PID, err)
+	}
+	vm := &config.VirtualMachine{}
+	if err := json.Unmarshal(data, vm); err != nil {
+		return nil, fmt.Errorf("failed to get the configuration of vfkit process %d: %w", instance.PID, err)
+	}
+	return vm, nil
+}
+
+// cmdLineConfig returns a configuration with the devices of the command line
+// giving access to the guest, the others can't always be parsed outside of
+// the vfkit process
+func cmdLineConfig(opts *cmdline.Options) *config.VirtualMachine {
+	vm := &config.VirtualMachine{}
+	for _, deviceOpts := range opts.Devices {
+		kind, _, _ := strings.Cut(deviceOpts, ",")
+		if kind != "virtio-vsock" && kind != "virtio-net" {
+			continue
+		}
+		if err := vm.AddDevicesFromCmdLine([]string{deviceOpts}); err != nil {
+			logrus.Debugf("ignoring device %s: %v", deviceOpts, err)
+		}
+	}
+	return vm
+}
+
+// inspectVM returns the configuration of the virtual machine reported by the
+// /vm/inspect endpoint of the REST API at restfulURI
+func inspectVM(instance *process.Instance, restfulURI string) ([]byte, error) {
+	ep, err := rest.NewEndpoint(restfulURI)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: sshInspectTimeout}
+	var url string
+	switch ep.Scheme {
+	case rest.TCP:
+		url = "http://" + ep.Host + "/vm/inspect"
+	case rest.Unix:
+		socketPath, err := instance.AbsPath(ep.Path)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		}
+		// the host is unused, the connection goes to the unix socket
+		url = "http://vfkit/vm/inspect"
+	default:
+		return nil, fmt.Errorf("unsupported REST API URI: %s", restfulURI)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected REST API response: %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// sshArgs returns the ssh command line running command in the virtual
+// machine, or an interactive shell when command is empty
+func (target *sshTarget) sshArgs(command []string) ([]string, error) {
+	if target.user == "" {
+		return nil, fmt.Errorf("the user of the virtual machine must be set with --user")
+	}
+	args := []string{"ssh",
+		"-i", target.keyPath,
+		"-o", "IdentitiesOnly=yes",
+		// the host keys of virtual machines change when they are recreated
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=ERROR",
+		"-l", target.user,
+	}
+	if target.vsockPath != "" {
+		executable, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		// the host name is unused, the proxy command connects to the guest
+		args = append(args, "-o", "ProxyCommand="+sshProxyCommand(executable, target.vsockPath), "vsock")
+	} else {
+		ip, err := dhcp.IPAddress(target.mac)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the IP address of the virtual machine: %w", err)
+		}
+		args = append(args, "-p", fmt.Sprint(sshPort), ip)
+	}
+	return append(args, command...), nil
+}
+
+// sshProxyCommand returns the ssh ProxyCommand connecting to the unix socket
+// at socketPath with 'vfkit ssh --proxy'
+func sshProxyCommand(executable string, socketPath string) string {
+	quote := func(s string) string {
+		// ssh expands the '%' tokens of proxy commands before running
+		// them with the shell
+		s = strings.ReplaceAll(s, "%", "%%")
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+	return fmt.Sprintf("%s ssh --proxy %s", quote(executable), quote(socketPath))
+}
+
+// proxyUnixSocket copies stdin to the unix socket at socketPath, and its
+// output to stdout
+func proxyUnixSocket(socketPath string) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		if _, err := io.Copy(conn, os.Stdin); err != nil {
+			logrus.Debugf("ssh proxy: %v", err)
+		}
+		_ = conn.(*net.UnixConn).CloseWrite()
+	}()
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
+
+func init() {
+	sshCmd.Flags().Int32Var(&sshPID, "pid", 0, "pid of the vfkit process running the virtual machine")
+	sshCmd.Flags().StringVarP(&sshUser, "user", "l", "", "user to log in as in the virtual machine")
+	sshCmd.Flags().StringVar(&sshProxy, "proxy", "", "connect stdin and stdout to a unix socket, used as ssh proxy command")
+	_ = sshCmd.Flags().MarkHidden("proxy")
+	// the flags after the command belong to the command
+	sshCmd.Flags().SetInterspersed(false)
+	rootCmd.AddCommand(sshCmd)
+}
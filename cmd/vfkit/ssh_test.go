@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/crc-org/vfkit/pkg/cmdline"
+	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/crc-org/vfkit/pkg/process"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSHProxyCommand(t *testing.T) {
+	assert.Equal(t, `'/usr/local/bin/vfkit' ssh --proxy '/tmp/vm'\''s 100%% ssh.sock'`, sshProxyCommand("/usr/local/bin/vfkit", "/tmp/vm's 100% ssh.sock"))
+}
+
+func TestSSHArgs(t *testing.T) {
+	target := &sshTarget{keyPath: "/keys/id_ed25519", vsockPath: "/tmp/ssh.sock"}
+	_, err := target.sshArgs(nil)
+	require.EqualError(t, err, "the user of the virtual machine must be set with --user")
+
+	target.user = "core"
+	args, err := target.sshArgs([]string{"uname", "-a"})
+	require.NoError(t, err)
+	executable, err := os.Executable()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ssh",
+		"-i", "/keys/id_ed25519",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=ERROR",
+		"-l", "core",
+		"-o", "ProxyCommand=" + sshProxyCommand(executable, "/tmp/ssh.sock"), "vsock",
+		"uname", "-a",
+	}, args)
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	mac, err := net.ParseMAC("5a:94:ef:e4:0c:dd")
+	require.NoError(t, err)
+	vm := &config.VirtualMachine{}
+	require.NoError(t, vm.AddDevicesFromCmdLine([]string{"virtio-net,nat,mac=" + mac.String()}))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/vm/inspect", r.URL.Path)
+		assert.NoError(t, json.NewEncoder(w).Encode(vm))
+	}))
+	defer server.Close()
+
+	// the MAC address generated by the vfkit process is reported by its
+	// REST API
+	opts := &cmdline.Options{
+		RestfulURI: "tcp://" + server.Listener.Addr().String(),
+		Devices:    []string{"virtio-net,nat"},
+	}
+	effective, err := effectiveConfig(&process.Instance{PID: 1234}, opts)
+	require.NoError(t, err)
+	require.Len(t, effective.VirtioNetDevices(), 1)
+	assert.Equal(t, mac, effective.VirtioNetDevices()[0].MacAddress)
+
+	// without REST API, only the command line is known
+	opts.RestfulURI = cmdline.DefaultRestfulURI
+	effective, err = effectiveConfig(&process.Instance{PID: 1234}, opts)
+	require.NoError(t, err)
+	require.Len(t, effective.VirtioNetDevices(), 1)
+	assert.Empty(t, effective.VirtioNetDevices()[0].MacAddress)
+}
@@ -1,74 +1,39 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
+	"context"
 	"net"
-	"time"
 
 	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/crc-org/vfkit/pkg/timesync"
 	"github.com/crc-org/vfkit/pkg/vf"
-	sleepnotifier "github.com/prashantgupta24/mac-sleep-notifier/notifier"
 	log "github.com/sirupsen/logrus"
 )
 
-func syncGuestTime(conn net.Conn) error {
-	qemugaCmdTemplate := `{"execute": "guest-set-time", "arguments":{"time": %d}}` + "\n"
-	qemugaCmd := fmt.Sprintf(qemugaCmdTemplate, time.Now().UnixNano())
-
-	log.Debugf("sending %s to qemu-guest-agent", qemugaCmd)
-	_, err := conn.Write([]byte(qemugaCmd))
-	if err != nil {
-		return err
-	}
-	response, err := bufio.NewReader(conn).ReadString('\n')
-	if err != nil {
-		return err
-	}
-
-	if response != `{"return": {}}`+"\n" {
-		return fmt.Errorf("unexpected response from qemu-guest-agent: %s", response)
+// newTimeSyncer creates the syncer of the guest clock, it returns nil when
+// time synchronization is disabled
+func newTimeSyncer(vm *vf.VirtualMachine, ts *config.TimeSync) *timesync.Syncer {
+	if ts == nil {
+		return nil
 	}
-
-	return nil
-}
-
-func watchWakeupNotifications(vm *vf.VirtualMachine, vsockPort uint32) {
-	var vsockConn net.Conn
-	defer func() {
-		if vsockConn != nil {
-			_ = vsockConn.Close()
-		}
-	}()
-
-	sleepNotifierCh := sleepnotifier.GetInstance().Start()
-	for activity := range sleepNotifierCh {
-		log.Debugf("Sleep notification: %s", activity)
-		if activity.Type == sleepnotifier.Awake {
-			log.Infof("machine awake")
-			if vsockConn == nil {
-				var err error
-				vsockConn, err = vf.ConnectVsockSync(vm, vsockPort)
-				if err != nil {
-					log.Debugf("error connecting to vsock port %d: %v", vsockPort, err)
-					break
-				}
-			}
-			if err := syncGuestTime(vsockConn); err != nil {
-				log.Debugf("error syncing guest time: %v", err)
-			}
-		}
+	dial := func() (net.Conn, error) {
+		return vf.ConnectVsockSync(vm, ts.VsockPort)
 	}
+	return timesync.NewSyncer(dial, timesync.Policy{
+		Interval: ts.Interval,
+		OnBoot:   ts.OnBoot,
+		OnResume: ts.OnResume,
+	})
 }
 
-func setupGuestTimeSync(vm *vf.VirtualMachine, timesync *config.TimeSync) error {
-	if timesync == nil {
+func setupGuestTimeSync(syncer *timesync.Syncer) error {
+	if syncer == nil {
 		return nil
 	}
 
 	log.Infof("Setting up host/guest time synchronization")
 
-	go watchWakeupNotifications(vm, timesync.VsockPort)
+	go syncer.Run(context.Background())
 
 	return nil
 }
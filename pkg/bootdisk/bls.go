@@ -0,0 +1,131 @@
+package bootdisk
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// blsEntry is a boot loader specification entry, as described in
+// https://uapi-group.org/specifications/specs/boot_loader_specification/
+type blsEntry struct {
+	fileName string
+	title    string
+	version  string
+	linux    string
+	initrd   []string
+	options  []string
+}
+
+func parseBLSEntry(fileName string, data []byte) blsEntry {
+	entry := blsEntry{
+		fileName: fileName,
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value := line, ""
+		if i := strings.IndexFunc(line, unicode.IsSpace); i != -1 {
+			key, value = line[:i], strings.TrimSpace(line[i:])
+		}
+		switch key {
+		case "title":
+			entry.title = value
+		case "version":
+			entry.version = value
+		case "linux":
+			entry.linux = value
+		case "initrd":
+			entry.initrd = append(entry.initrd, strings.Fields(value)...)
+		case "options":
+			entry.options = append(entry.options, value)
+		}
+	}
+	if entry.version == "" {
+		entry.version = strings.TrimSuffix(fileName, ".conf")
+	}
+	return entry
+}
+
+// readBLSEntries returns the entries found in the loader/entries directory of
+// bootDir. Entries which can't be booted with a Linux bootloader are ignored.
+func readBLSEntries(fsys filesystem, bootDir string) ([]blsEntry, error) {
+	entriesDir := path.Join(bootDir, "loader", "entries")
+	names, err := fsys.readDir(entriesDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []blsEntry{}
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".conf") {
+			continue
+		}
+		data, err := readFile(fsys, path.Join(entriesDir, name))
+		if err != nil {
+			return nil, err
+		}
+		entry := parseBLSEntry(name, data)
+		if entry.linux == "" {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// readGrubEnv returns the variables stored in the grub environment block of
+// bootDir. Some distributions, such as older Fedora releases, use them in the
+// options of their boot loader entries.
+func readGrubEnv(fsys filesystem, bootDir string) map[string]string {
+	env := map[string]string{}
+	for _, envPath := range []string{"grub2/grubenv", "grub/grubenv"} {
+		data, err := readFile(fsys, path.Join(bootDir, envPath))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			if key, value, found := strings.Cut(line, "="); found {
+				env[key] = value
+			}
+		}
+		break
+	}
+	return env
+}
+
+// kernelCmdLine returns the kernel command line of entry, expanding the grub
+// environment variables it uses
+func (entry *blsEntry) kernelCmdLine(fsys filesystem, bootDir string) string {
+	cmdline := strings.Join(entry.options, " ")
+	if strings.Contains(cmdline, "$") {
+		env := readGrubEnv(fsys, bootDir)
+		cmdline = os.Expand(cmdline, func(key string) string {
+			return env[key]
+		})
+	}
+	return strings.Join(strings.Fields(cmdline), " ")
+}
+
+func readFile(fsys filesystem, filePath string) ([]byte, error) {
+	reader, err := fsys.open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
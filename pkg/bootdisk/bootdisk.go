@@ -0,0 +1,331 @@
+// Package bootdisk finds and extracts the Linux kernel, initrd and kernel
+// command line installed in a disk image, so that the image can be started
+// with a Linux bootloader without shipping these files separately.
+//
+// Raw disk images are supported, either using a GPT partition table, or
+// directly containing a filesystem. The kernels are searched in the ext2,
+// ext3, ext4 and FAT partitions of the disk image, in their root directory or
+// in their /boot directory. When boot loader specification entries are
+// present (loader/entries/*.conf), they are used to find the initrd and the
+// kernel command line.
+package bootdisk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var errNoKernel = errors.New("no kernel found")
+
+var (
+	kernelPrefixes = []string{"vmlinuz-", "vmlinux-"}
+	// initrd names used by the various distributions, %s is the kernel version
+	initrdNames = []string{"initramfs-%s.img", "initrd.img-%s", "initrd-%s", "initramfs-%s"}
+	qcow2Magic  = []byte{'Q', 'F', 'I', 0xfb}
+)
+
+// Options selects the kernel to boot from a disk image.
+type Options struct {
+	// Partition is the number of the partition containing the kernels, as
+	// listed in the GPT partition table, starting at 1. When it's 0, all
+	// partitions are searched.
+	Partition uint
+	// Kernel is the file name or the version of the kernel to use. The
+	// newest kernel is used when it's empty.
+	Kernel string
+	// Initrd is the path of the initrd to use, relative to the directory
+	// containing the kernel. When it's empty, the initrd from the boot loader
+	// entry is used, or the initrd matching the kernel version.
+	Initrd string
+}
+
+// BootEntry describes the kernel extracted from a disk image.
+type BootEntry struct {
+	// Title is the title of the boot loader entry, it can be empty
+	Title   string
+	Version string
+	// KernelPath is the path to the kernel extracted from the disk image
+	KernelPath string
+	// InitrdPath is the path to the initrd extracted from the disk image,
+	// it's empty if no initrd was found
+	InitrdPath string
+	// CmdLine is the kernel command line from the boot loader entry, it's
+	// empty when no boot loader entry was found
+	CmdLine string
+}
+
+// bootEntry is the same as [BootEntry], but with paths relative to the
+// filesystem containing the kernel
+type bootEntry struct {
+	title   string
+	version string
+	kernel  string
+	initrds []string
+	cmdline string
+}
+
+// Extract finds the kernel to boot in the disk image at diskPath, and
+// extracts it and its initrd to destDir.
+func Extract(diskPath string, opts Options, destDir string) (*BootEntry, error) {
+	disk, err := os.Open(diskPath)
+	if err != nil {
+		return nil, err
+	}
+	defer disk.Close()
+	stat, err := disk.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	fsys, entry, err := findBootEntry(disk, stat.Size(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find kernel in %s: %w", diskPath, err)
+	}
+
+	bootEntry := BootEntry{
+		Title:      entry.title,
+		Version:    entry.version,
+		KernelPath: filepath.Join(destDir, "vmlinuz"),
+		CmdLine:    entry.cmdline,
+	}
+	if err := extractFiles(fsys, []string{entry.kernel}, bootEntry.KernelPath); err != nil {
+		return nil, fmt.Errorf("failed to extract kernel from %s: %w", diskPath, err)
+	}
+	if len(entry.initrds) > 0 {
+		bootEntry.InitrdPath = filepath.Join(destDir, "initrd")
+		if err := extractFiles(fsys, entry.initrds, bootEntry.InitrdPath); err != nil {
+			return nil, fmt.Errorf("failed to extract initrd from %s: %w", diskPath, err)
+		}
+	}
+
+	return &bootEntry, nil
+}
+
+// extractFiles concatenates the files at srcPaths in fsys to destPath. The
+// kernel supports initrds made of several concatenated cpio archives, this is
+// used when a boot loader entry has more than one initrd.
+func extractFiles(fsys filesystem, srcPaths []string, destPath string) error {
+	dest, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	for _, srcPath := range srcPaths {
+		src, err := fsys.open(srcPath)
+		if err != nil {
+			_ = dest.Close()
+			return err
+		}
+		if _, err := io.Copy(dest, src); err != nil {
+			_ = dest.Close()
+			return fmt.Errorf("failed to copy %s: %w", srcPath, err)
+		}
+	}
+	return dest.Close()
+}
+
+func findBootEntry(disk io.ReaderAt, diskSize int64, opts Options) (filesystem, *bootEntry, error) {
+	magic := make([]byte, len(qcow2Magic))
+	if _, err := disk.ReadAt(magic, 0); err == nil && bytes.Equal(magic, qcow2Magic) {
+		return nil, nil, fmt.Errorf("qcow2 disk images are not supported, only raw disk images can be used")
+	}
+
+	partitions, err := readGPT(disk)
+	switch {
+	case errors.Is(err, errNoGPT) && opts.Partition != 0:
+		return nil, nil, fmt.Errorf("cannot use partition %d: %w", opts.Partition, err)
+	case errors.Is(err, errNoGPT):
+		// the disk image can directly contain a filesystem
+		partitions = []partition{{size: diskSize}}
+	case err != nil:
+		return nil, nil, err
+	}
+
+	if opts.Partition != 0 {
+		var selected []partition
+		for _, p := range partitions {
+			if p.number == opts.Partition {
+				selected = append(selected, p)
+			}
+		}
+		if len(selected) == 0 {
+			return nil, nil, fmt.Errorf("partition %d not found", opts.Partition)
+		}
+		partitions = selected
+	}
+	// when present, the extended boot loader partition is where the kernels
+	// are installed
+	sort.SliceStable(partitions, func(i, j int) bool {
+		return partitions[i].typeGUID == xbootldrTypeGUID && partitions[j].typeGUID != xbootldrTypeGUID
+	})
+
+	for _, p := range partitions {
+		fsys, err := openFilesystem(io.NewSectionReader(disk, p.offset, p.size))
+		if err != nil {
+			if opts.Partition != 0 {
+				return nil, nil, fmt.Errorf("partition %d: %w", p.number, err)
+			}
+			// when searching all partitions, skip the ones with
+			// unsupported filesystems, for example the btrfs root
+			// partition of Fedora images
+			continue
+		}
+		entry, err := findKernel(fsys, opts)
+		switch {
+		case err == nil:
+			return fsys, entry, nil
+		case opts.Partition != 0:
+			return nil, nil, fmt.Errorf("partition %d: %w", p.number, err)
+		case errors.Is(err, errNoKernel):
+			continue
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return nil, nil, errNoKernel
+}
+
+// findKernel searches the kernel to boot in the root directory or the /boot
+// directory of fsys
+func findKernel(fsys filesystem, opts Options) (*bootEntry, error) {
+	for _, bootDir := range []string{"/", "/boot"} {
+		blsEntries, err := readBLSEntries(fsys, bootDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(blsEntries) > 0 {
+			return selectBLSEntry(fsys, bootDir, blsEntries, opts)
+		}
+
+		names, err := fsys.readDir(bootDir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry, err := selectKernelFile(bootDir, names, opts)
+		if errors.Is(err, errNoKernel) {
+			continue
+		}
+		return entry, err
+	}
+	return nil, errNoKernel
+}
+
+func selectBLSEntry(fsys filesystem, bootDir string, blsEntries []blsEntry, opts Options) (*bootEntry, error) {
+	sort.SliceStable(blsEntries, func(i, j int) bool {
+		return compareVersions(blsEntries[i].version, blsEntries[j].version) > 0
+	})
+	blsEntry := &blsEntries[0]
+	if opts.Kernel != "" {
+		blsEntry = nil
+		for i := range blsEntries {
+			if path.Base(blsEntries[i].linux) == opts.Kernel || blsEntries[i].version == opts.Kernel {
+				blsEntry = &blsEntries[i]
+				break
+			}
+		}
+		if blsEntry == nil {
+			return nil, fmt.Errorf("no boot loader entry found for kernel %s", opts.Kernel)
+		}
+	}
+
+	entry := bootEntry{
+		title:   blsEntry.title,
+		version: blsEntry.version,
+		kernel:  resolvePath(fsys, bootDir, blsEntry.linux),
+		cmdline: blsEntry.kernelCmdLine(fsys, bootDir),
+	}
+	if opts.Initrd != "" {
+		entry.initrds = []string{path.Join(bootDir, opts.Initrd)}
+	} else {
+		for _, initrd := range blsEntry.initrd {
+			entry.initrds = append(entry.initrds, resolvePath(fsys, bootDir, initrd))
+		}
+	}
+	return &entry, nil
+}
+
+// resolvePath returns the path of filePath, which comes from a boot loader
+// entry stored in bootDir. These paths are relative to bootDir, but when
+// /boot is not a separate partition, they sometimes include the /boot prefix.
+func resolvePath(fsys filesystem, bootDir string, filePath string) string {
+	resolved := path.Join(bootDir, filePath)
+	if _, err := fsys.open(resolved); err != nil && bootDir != "/" {
+		if _, err := fsys.open(filePath); err == nil {
+			return filePath
+		}
+	}
+	return resolved
+}
+
+func kernelVersion(name string) (string, bool) {
+	for _, prefix := range kernelPrefixes {
+		if version, found := strings.CutPrefix(name, prefix); found && version != "" {
+			return version, true
+		}
+	}
+	return "", false
+}
+
+// selectKernelFile selects the kernel to boot from the files in bootDir when
+// there are no boot loader entries
+func selectKernelFile(bootDir string, names []string, opts Options) (*bootEntry, error) {
+	var kernels []string
+	for _, name := range names {
+		if _, ok := kernelVersion(name); ok {
+			kernels = append(kernels, name)
+		}
+	}
+	if len(kernels) == 0 {
+		return nil, errNoKernel
+	}
+	sort.SliceStable(kernels, func(i, j int) bool {
+		versionI, _ := kernelVersion(kernels[i])
+		versionJ, _ := kernelVersion(kernels[j])
+		return compareVersions(versionI, versionJ) > 0
+	})
+
+	kernel := kernels[0]
+	if opts.Kernel != "" {
+		kernel = ""
+		for _, name := range kernels {
+			if version, _ := kernelVersion(name); name == opts.Kernel || version == opts.Kernel {
+				kernel = name
+				break
+			}
+		}
+		if kernel == "" {
+			return nil, fmt.Errorf("kernel %s not found in %s", opts.Kernel, bootDir)
+		}
+	}
+	version, _ := kernelVersion(kernel)
+
+	entry := bootEntry{
+		version: version,
+		kernel:  path.Join(bootDir, kernel),
+	}
+	if opts.Initrd != "" {
+		entry.initrds = []string{path.Join(bootDir, opts.Initrd)}
+		return &entry, nil
+	}
+	for _, initrdName := range initrdNames {
+		initrd := fmt.Sprintf(initrdName, version)
+		for _, name := range names {
+			if name == initrd {
+				entry.initrds = []string{path.Join(bootDir, initrd)}
+				return &entry, nil
+			}
+		}
+	}
+	return &entry, nil
+}
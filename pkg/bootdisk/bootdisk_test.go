@@ -0,0 +1,314 @@
+package bootdisk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The disk images in testdata were created with mkfs.ext4/mke2fs -d for the
+// ext2/ext4 filesystems, and with an independent FAT32/GPT implementation for
+// the other filesystems and the partition table:
+//   - fedora.img: GPT disk with a BIOS boot partition, a FAT32 ESP, an ext4
+//     /boot partition with boot loader entries, and a partition with no
+//     filesystem, similar to the Fedora cloud images
+//   - debian.img: ext2 filesystem with 1024 bytes blocks and no partition
+//     table, with kernels in /boot but no boot loader entries
+//   - esp.img: FAT32 filesystem with no partition table, using the
+//     systemd-boot layout
+//
+// The content of the files is their name repeated until they have the
+// expected size, see fileContent.
+
+const (
+	machineID     = "0123456789abcdef0123456789abcdef"
+	fedoraNew     = "6.10.3-200.fc40.aarch64"
+	fedoraOld     = "6.8.5-301.fc40.aarch64"
+	fedoraCmdLine = "root=UUID=5f6ad2d1-cbd0-4d9f-9e0e-0d2f4d5b2a10 ro rootflags=subvol=root no_timer_check console=tty1 console=ttyS0,115200n8"
+)
+
+func fileContent(name string, size int) []byte {
+	line := []byte(name + "\n")
+	return bytes.Repeat(line, size/len(line)+1)[:size]
+}
+
+func sparseContent(islands, stride, islandSize int) []byte {
+	data := make([]byte, islands*stride)
+	for i := 0; i < islands; i++ {
+		copy(data[i*stride:], fileContent(fmt.Sprintf("sparse-%d", i), islandSize))
+	}
+	return data
+}
+
+func uncompressDisk(t *testing.T, name string) string {
+	compressed, err := os.Open(filepath.Join("testdata", name+".gz"))
+	require.NoError(t, err)
+	defer compressed.Close()
+	reader, err := gzip.NewReader(compressed)
+	require.NoError(t, err)
+
+	diskPath := filepath.Join(t.TempDir(), name)
+	disk, err := os.Create(diskPath)
+	require.NoError(t, err)
+	defer disk.Close()
+	_, err = io.Copy(disk, reader)
+	require.NoError(t, err)
+	return diskPath
+}
+
+type expectedFile struct {
+	name string
+	size int
+}
+
+type extractTest struct {
+	disk          string
+	opts          Options
+	version       string
+	title         string
+	cmdline       string
+	kernel        expectedFile
+	initrds       []expectedFile
+	expectedError string
+}
+
+var extractTests = map[string]extractTest{
+	"FedoraNewest": {
+		disk:    "fedora.img",
+		version: fedoraNew,
+		title:   fmt.Sprintf("Fedora Linux (%s) 40 (Cloud Edition)", fedoraNew),
+		cmdline: fedoraCmdLine,
+		kernel:  expectedFile{"vmlinuz-" + fedoraNew, 300000},
+		initrds: []expectedFile{{"initramfs-" + fedoraNew + ".img", 150000}},
+	},
+	"FedoraPartition": {
+		disk:    "fedora.img",
+		opts:    Options{Partition: 3},
+		version: fedoraNew,
+		title:   fmt.Sprintf("Fedora Linux (%s) 40 (Cloud Edition)", fedoraNew),
+		cmdline: fedoraCmdLine,
+		kernel:  expectedFile{"vmlinuz-" + fedoraNew, 300000},
+		initrds: []expectedFile{{"initramfs-" + fedoraNew + ".img", 150000}},
+	},
+	"FedoraKernelVersion": {
+		disk:    "fedora.img",
+		opts:    Options{Kernel: fedoraOld},
+		version: fedoraOld,
+		title:   fmt.Sprintf("Fedora Linux (%s) 40 (Cloud Edition)", fedoraOld),
+		// this entry uses variables from grubenv
+		cmdline: "root=UUID=5f6ad2d1-cbd0-4d9f-9e0e-0d2f4d5b2a10 ro",
+		kernel:  expectedFile{"vmlinuz-" + fedoraOld, 20000},
+		initrds: []expectedFile{{"initramfs-" + fedoraOld + ".img", 10000}},
+	},
+	"FedoraKernelName": {
+		disk:    "fedora.img",
+		opts:    Options{Kernel: "vmlinuz-" + fedoraOld, Initrd: "initramfs-" + fedoraNew + ".img"},
+		version: fedoraOld,
+		title:   fmt.Sprintf("Fedora Linux (%s) 40 (Cloud Edition)", fedoraOld),
+		cmdline: "root=UUID=5f6ad2d1-cbd0-4d9f-9e0e-0d2f4d5b2a10 ro",
+		kernel:  expectedFile{"vmlinuz-" + fedoraOld, 20000},
+		initrds: []expectedFile{{"initramfs-" + fedoraNew + ".img", 150000}},
+	},
+	"FedoraUnknownKernel": {
+		disk:          "fedora.img",
+		opts:          Options{Kernel: "5.0.0"},
+		expectedError: "no boot loader entry found for kernel 5.0.0",
+	},
+	"FedoraESPPartition": {
+		disk:          "fedora.img",
+		opts:          Options{Partition: 2},
+		expectedError: "partition 2: no kernel found",
+	},
+	"FedoraNoFilesystem": {
+		disk:          "fedora.img",
+		opts:          Options{Partition: 4},
+		expectedError: "partition 4: unsupported filesystem",
+	},
+	"FedoraMissingPartition": {
+		disk:          "fedora.img",
+		opts:          Options{Partition: 9},
+		expectedError: "partition 9 not found",
+	},
+	"DebianNewest": {
+		disk:    "debian.img",
+		version: "6.1.0-18-arm64",
+		kernel:  expectedFile{"vmlinuz-6.1.0-18-arm64", 300000},
+		initrds: []expectedFile{{"initrd.img-6.1.0-18-arm64", 5000}},
+	},
+	"DebianKernelVersion": {
+		disk:    "debian.img",
+		opts:    Options{Kernel: "6.1.0-9-arm64"},
+		version: "6.1.0-9-arm64",
+		kernel:  expectedFile{"vmlinuz-6.1.0-9-arm64", 1000},
+		initrds: []expectedFile{{"initrd.img-6.1.0-9-arm64", 1000}},
+	},
+	"DebianPartition": {
+		disk:          "debian.img",
+		opts:          Options{Partition: 1},
+		expectedError: "cannot use partition 1: no GPT partition table found",
+	},
+	"SystemdBoot": {
+		disk:    "esp.img",
+		version: "6.9.1-100.fc40.aarch64",
+		title:   "Fedora Linux 40 (Workstation Edition)",
+		cmdline: "root=LABEL=root console=hvc0",
+		kernel:  expectedFile{"linux", 100000},
+		// the initrds of the boot loader entry are concatenated
+		initrds: []expectedFile{{"microcode", 700}, {"initrd", 5000}},
+	},
+}
+
+func TestExtract(t *testing.T) {
+	disks := map[string]string{}
+	for _, disk := range []string{"fedora.img", "debian.img", "esp.img"} {
+		disks[disk] = uncompressDisk(t, disk)
+	}
+	for name, test := range extractTests {
+		t.Run(name, func(t *testing.T) {
+			diskPath := disks[test.disk]
+
+			destDir := t.TempDir()
+			entry, err := Extract(diskPath, test.opts, destDir)
+			if test.expectedError != "" {
+				require.ErrorContains(t, err, test.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.version, entry.Version)
+			assert.Equal(t, test.title, entry.Title)
+			assert.Equal(t, test.cmdline, entry.CmdLine)
+
+			assert.Equal(t, filepath.Join(destDir, "vmlinuz"), entry.KernelPath)
+			kernel, err := os.ReadFile(entry.KernelPath)
+			require.NoError(t, err)
+			assert.Equal(t, fileContent(test.kernel.name, test.kernel.size), kernel)
+
+			assert.Equal(t, filepath.Join(destDir, "initrd"), entry.InitrdPath)
+			var expectedInitrd []byte
+			for _, initrd := range test.initrds {
+				expectedInitrd = append(expectedInitrd, fileContent(initrd.name, initrd.size)...)
+			}
+			initrd, err := os.ReadFile(entry.InitrdPath)
+			require.NoError(t, err)
+			assert.Equal(t, expectedInitrd, initrd)
+		})
+	}
+}
+
+func TestExtractErrors(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	qcow2Path := filepath.Join(tmpDir, "disk.qcow2")
+	require.NoError(t, os.WriteFile(qcow2Path, append([]byte{'Q', 'F', 'I', 0xfb}, make([]byte, 4096)...), 0600))
+	_, err := Extract(qcow2Path, Options{}, tmpDir)
+	require.ErrorContains(t, err, "qcow2 disk images are not supported")
+
+	emptyPath := filepath.Join(tmpDir, "empty.img")
+	require.NoError(t, os.WriteFile(emptyPath, make([]byte, 1024*1024), 0600))
+	_, err = Extract(emptyPath, Options{}, tmpDir)
+	require.ErrorIs(t, err, errNoKernel)
+}
+
+func TestGPTInvalidEntries(t *testing.T) {
+	for _, entrySize := range []uint32{64, 130, 8192, 0x80000000} {
+		disk := make([]byte, 2*512)
+		header := disk[512:]
+		copy(header, gptSignature)
+		binary.LittleEndian.PutUint32(header[12:16], 92)
+		binary.LittleEndian.PutUint64(header[72:80], 2)
+		binary.LittleEndian.PutUint32(header[80:84], 128)
+		binary.LittleEndian.PutUint32(header[84:88], entrySize)
+		binary.LittleEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(header[:92]))
+
+		_, err := readGPT(bytes.NewReader(disk))
+		require.ErrorContains(t, err, fmt.Sprintf("invalid GPT partition entries: 128 entries of %d bytes", entrySize))
+	}
+}
+
+func TestFilesystems(t *testing.T) {
+	fedoraPath := uncompressDisk(t, "fedora.img")
+	fedora, err := os.Open(fedoraPath)
+	require.NoError(t, err)
+	defer fedora.Close()
+	partitions, err := readGPT(fedora)
+	require.NoError(t, err)
+	require.Len(t, partitions, 4)
+	assert.Equal(t, "c12a7328-f81f-11d2-ba4b-00a0c93ec93b", partitions[1].typeGUID)
+	assert.Equal(t, "p.lxboot", partitions[2].name)
+	assert.Equal(t, uint(3), partitions[2].number)
+
+	debianPath := uncompressDisk(t, "debian.img")
+	debian, err := os.Open(debianPath)
+	require.NoError(t, err)
+	defer debian.Close()
+
+	for name, r := range map[string]io.ReaderAt{
+		"ext4": io.NewSectionReader(fedora, partitions[2].offset, partitions[2].size),
+		"ext2": debian,
+	} {
+		t.Run(name, func(t *testing.T) {
+			fsys, err := openFilesystem(r)
+			require.NoError(t, err)
+
+			// the ext4 file uses a 2 levels extent tree, and the ext2
+			// file uses indirect blocks, both have holes
+			sparse, err := readFile(fsys, "/sparse")
+			require.NoError(t, err)
+			assert.Equal(t, sparseContent(12, 65536, 4096), sparse)
+
+			_, err = fsys.open("/missing")
+			require.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+
+	fsys, err := openFilesystem(debian)
+	require.NoError(t, err)
+	names, err := fsys.readDir("/")
+	require.NoError(t, err)
+	assert.Subset(t, names, []string{"boot", "etc", "vmlinuz", "sparse"})
+	_, err = fsys.open("/vmlinuz")
+	require.ErrorContains(t, err, "/vmlinuz is not a regular file")
+	_, err = fsys.open("/boot")
+	require.ErrorContains(t, err, "/boot is not a regular file")
+
+	fsys, err = openFilesystem(io.NewSectionReader(fedora, partitions[1].offset, partitions[1].size))
+	require.NoError(t, err)
+	names, err = fsys.readDir("/efi/BOOT")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"BOOTAA64.EFI"}, names)
+	grub, err := readFile(fsys, "/EFI/fedora/grubaa64.efi")
+	require.NoError(t, err)
+	assert.Equal(t, fileContent("grubaa64.efi", 2000), grub)
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"6.10.3-200.fc40.aarch64", "6.8.5-301.fc40.aarch64", 1},
+		{"6.8.5-301.fc40.aarch64", "6.8.5-301.fc40.aarch64", 0},
+		{"6.8.5-301.fc40.aarch64", "0-rescue-" + machineID, 1},
+		{"6.1.0-9-arm64", "6.1.0-18-arm64", -1},
+		{"6.1.0", "6.1.0.1", -1},
+		{"6.1.0a", "6.1.0", 1},
+		{"6.1.010", "6.1.9", 1},
+		{"6.1", "6.rc1", 1},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join([]string{test.a, test.b}, "/"), func(t *testing.T) {
+			assert.Equal(t, test.expected, compareVersions(test.a, test.b))
+			assert.Equal(t, -test.expected, compareVersions(test.b, test.a))
+		})
+	}
+}
@@ -0,0 +1,368 @@
+package bootdisk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// Read-only support for ext2, ext3 and ext4 filesystems. The on-disk format
+// is described in https://docs.kernel.org/filesystems/ext4/index.html
+
+const (
+	extSuperblockOffset = 1024
+	extSuperblockSize   = 1024
+	extMagic            = 0xef53
+	extRootInode        = 2
+	extExtentMagic      = 0xf30a
+	// the extent tree depth is limited to 5 by the kernel
+	extMaxExtentDepth = 5
+
+	extIncompatFiletype   = 0x2
+	extIncompatRecover    = 0x4
+	extIncompatExtents    = 0x40
+	extIncompat64Bit      = 0x80
+	extIncompatMMP        = 0x100
+	extIncompatFlexBG     = 0x200
+	extIncompatEAInode    = 0x400
+	extIncompatCsumSeed   = 0x2000
+	extIncompatLargeDir   = 0x4000
+	extIncompatInlineData = 0x8000
+	extIncompatCasefold   = 0x20000
+
+	// features which don't change how files are read
+	extIncompatSupported = extIncompatFiletype | extIncompatRecover | extIncompatExtents |
+		extIncompat64Bit | extIncompatMMP | extIncompatFlexBG | extIncompatEAInode |
+		extIncompatCsumSeed | extIncompatLargeDir | extIncompatInlineData | extIncompatCasefold
+
+	extInodeFlagExtents    = 0x80000
+	extInodeFlagInlineData = 0x10000000
+
+	extModeTypeMask = 0xf000
+	extModeDir      = 0x4000
+	extModeRegular  = 0x8000
+
+	// number of block pointers in the i_block field of inodes using
+	// indirect block maps
+	extDirectBlocks = 12
+)
+
+type extFS struct {
+	r               io.ReaderAt
+	blockSize       int64
+	inodeSize       int64
+	inodesPerGroup  uint32
+	descSize        int64
+	groupDescOffset int64
+	incompat        uint32
+}
+
+type extInode struct {
+	number uint32
+	mode   uint16
+	size   int64
+	flags  uint32
+	block  []byte
+}
+
+func openExt(r io.ReaderAt, superblock []byte) (*extFS, error) {
+	incompat := binary.LittleEndian.Uint32(superblock[96:])
+	if incompat&^extIncompatSupported != 0 {
+		return nil, fmt.Errorf("unsupported ext4 features: 0x%x", incompat&^extIncompatSupported)
+	}
+	logBlockSize := binary.LittleEndian.Uint32(superblock[24:])
+	if logBlockSize > 6 {
+		return nil, fmt.Errorf("invalid ext4 block size")
+	}
+	extFS := extFS{
+		r:              r,
+		blockSize:      1024 << logBlockSize,
+		inodeSize:      128,
+		inodesPerGroup: binary.LittleEndian.Uint32(superblock[40:]),
+		descSize:       32,
+		incompat:       incompat,
+	}
+	if extFS.inodesPerGroup == 0 {
+		return nil, fmt.Errorf("invalid ext4 inodes per group count")
+	}
+	// dynamic revision filesystems can have bigger inodes
+	if binary.LittleEndian.Uint32(superblock[76:]) >= 1 {
+		extFS.inodeSize = int64(binary.LittleEndian.Uint16(superblock[88:]))
+	}
+	if incompat&extIncompat64Bit != 0 {
+		extFS.descSize = int64(binary.LittleEndian.Uint16(superblock[254:]))
+	}
+	if extFS.inodeSize < 128 || extFS.descSize < 32 {
+		return nil, fmt.Errorf("invalid ext4 inode or group descriptor size")
+	}
+	// the group descriptor table starts in the block following the superblock
+	firstDataBlock := int64(binary.LittleEndian.Uint32(superblock[20:]))
+	extFS.groupDescOffset = (firstDataBlock + 1) * extFS.blockSize
+
+	return &extFS, nil
+}
+
+func (extFS *extFS) readInode(number uint32) (*extInode, error) {
+	if number == 0 {
+		return nil, fmt.Errorf("invalid inode number 0")
+	}
+	group := int64((number - 1) / extFS.inodesPerGroup)
+	index := int64((number - 1) % extFS.inodesPerGroup)
+
+	desc := make([]byte, extFS.descSize)
+	if _, err := extFS.r.ReadAt(desc, extFS.groupDescOffset+group*extFS.descSize); err != nil {
+		return nil, fmt.Errorf("failed to read group descriptor %d: %w", group, err)
+	}
+	inodeTable := uint64(binary.LittleEndian.Uint32(desc[8:]))
+	if extFS.descSize >= 64 {
+		inodeTable |= uint64(binary.LittleEndian.Uint32(desc[0x28:])) << 32
+	}
+
+	data := make([]byte, 128)
+	if _, err := extFS.r.ReadAt(data, int64(inodeTable)*extFS.blockSize+index*extFS.inodeSize); err != nil {
+		return nil, fmt.Errorf("failed to read inode %d: %w", number, err)
+	}
+	sizeLow := uint64(binary.LittleEndian.Uint32(data[4:]))
+	sizeHigh := uint64(binary.LittleEndian.Uint32(data[0x6c:]))
+	return &extInode{
+		number: number,
+		mode:   binary.LittleEndian.Uint16(data[0:]),
+		size:   int64(sizeHigh<<32 | sizeLow),
+		flags:  binary.LittleEndian.Uint32(data[0x20:]),
+		block:  data[0x28 : 0x28+60],
+	}, nil
+}
+
+func (extFS *extFS) blockOffset(block uint64) int64 {
+	return int64(block) * extFS.blockSize
+}
+
+func (extFS *extFS) readBlock(block uint64) ([]byte, error) {
+	data := make([]byte, extFS.blockSize)
+	if _, err := extFS.r.ReadAt(data, extFS.blockOffset(block)); err != nil {
+		return nil, fmt.Errorf("failed to read block %d: %w", block, err)
+	}
+	return data, nil
+}
+
+// extentTreeExtents walks the extent tree stored in node and returns the
+// extents it describes
+func (extFS *extFS) extentTreeExtents(node []byte, depth int, extents []extent) ([]extent, error) {
+	if depth > extMaxExtentDepth {
+		return nil, fmt.Errorf("ext4 extent tree is too deep")
+	}
+	if len(node) < 12 || binary.LittleEndian.Uint16(node[0:]) != extExtentMagic {
+		return nil, fmt.Errorf("invalid ext4 extent tree node")
+	}
+	entries := int(binary.LittleEndian.Uint16(node[2:]))
+	nodeDepth := binary.LittleEndian.Uint16(node[6:])
+	if 12+entries*12 > len(node) {
+		return nil, fmt.Errorf("invalid ext4 extent tree entry count")
+	}
+	for i := 0; i < entries; i++ {
+		entry := node[12+i*12 : 12+(i+1)*12]
+		if nodeDepth == 0 {
+			length := uint64(binary.LittleEndian.Uint16(entry[4:]))
+			start := uint64(binary.LittleEndian.Uint16(entry[6:]))<<32 | uint64(binary.LittleEndian.Uint32(entry[8:]))
+			// lengths greater than 32768 are used for preallocated
+			// (uninitialized) extents
+			zero := length > 32768
+			if zero {
+				length -= 32768
+			}
+			extents = append(extents, extent{
+				logical: uint64(binary.LittleEndian.Uint32(entry[0:])),
+				length:  length,
+				offset:  extFS.blockOffset(start),
+				zero:    zero,
+			})
+			continue
+		}
+		leaf := uint64(binary.LittleEndian.Uint16(entry[8:]))<<32 | uint64(binary.LittleEndian.Uint32(entry[4:]))
+		child, err := extFS.readBlock(leaf)
+		if err != nil {
+			return nil, err
+		}
+		extents, err = extFS.extentTreeExtents(child, depth+1, extents)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return extents, nil
+}
+
+type blockMapWalker struct {
+	extFS       *extFS
+	blockCount  uint64
+	nextLogical uint64
+	extents     []extent
+}
+
+// walk adds to the extents the blocks referenced by the block pointer
+// block. level is 0 for data blocks, 1 for indirect blocks, 2 for double
+// indirect blocks, ...
+func (w *blockMapWalker) walk(block uint32, level int) error {
+	if w.nextLogical >= w.blockCount {
+		return nil
+	}
+	pointersPerBlock := uint64(w.extFS.blockSize / 4)
+	if block == 0 {
+		// sparse file, this part of the file is read as zeros
+		span := uint64(1)
+		for i := 0; i < level; i++ {
+			span *= pointersPerBlock
+		}
+		w.nextLogical += span
+		return nil
+	}
+	if level == 0 {
+		w.extents = appendExtent(w.extents, w.nextLogical, w.extFS.blockOffset(uint64(block)), w.extFS.blockSize)
+		w.nextLogical++
+		return nil
+	}
+	data, err := w.extFS.readBlock(uint64(block))
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < pointersPerBlock; i++ {
+		if err := w.walk(binary.LittleEndian.Uint32(data[i*4:]), level-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockMapExtents returns the extents of a file using the ext2/ext3 indirect
+// block map
+func (extFS *extFS) blockMapExtents(inode *extInode) ([]extent, error) {
+	walker := blockMapWalker{
+		extFS:      extFS,
+		blockCount: uint64((inode.size + extFS.blockSize - 1) / extFS.blockSize),
+	}
+	for i := 0; i < extDirectBlocks+3; i++ {
+		level := max(i-extDirectBlocks+1, 0)
+		if err := walker.walk(binary.LittleEndian.Uint32(inode.block[i*4:]), level); err != nil {
+			return nil, err
+		}
+	}
+	return walker.extents, nil
+}
+
+func (extFS *extFS) inodeReader(inode *extInode) (*io.SectionReader, error) {
+	if inode.flags&extInodeFlagInlineData != 0 {
+		return nil, fmt.Errorf("inode %d: ext4 inline data is not supported", inode.number)
+	}
+	var (
+		extents []extent
+		err     error
+	)
+	if inode.flags&extInodeFlagExtents != 0 {
+		extents, err = extFS.extentTreeExtents(inode.block, 0, nil)
+	} else {
+		extents, err = extFS.blockMapExtents(inode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("inode %d: %w", inode.number, err)
+	}
+	reader := &mappedReader{
+		r:        extFS.r,
+		unitSize: extFS.blockSize,
+		extents:  extents,
+	}
+	return io.NewSectionReader(reader, 0, inode.size), nil
+}
+
+type extDirEntry struct {
+	name  string
+	inode uint32
+}
+
+func (extFS *extFS) readDirInode(inode *extInode) ([]extDirEntry, error) {
+	if inode.mode&extModeTypeMask != extModeDir {
+		return nil, fmt.Errorf("inode %d is not a directory", inode.number)
+	}
+	reader, err := extFS.inodeReader(inode)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// directories using hashed b-trees (dir_index) can also be read
+	// linearly, their internal nodes look like deleted entries
+	entries := []extDirEntry{}
+	for offset := 0; offset+8 <= len(data); {
+		entryInode := binary.LittleEndian.Uint32(data[offset:])
+		recLen := int(binary.LittleEndian.Uint16(data[offset+4:]))
+		nameLen := int(data[offset+6])
+		if extFS.incompat&extIncompatFiletype == 0 {
+			nameLen |= int(data[offset+7]) << 8
+		}
+		if recLen < 8 || offset+recLen > len(data) || 8+nameLen > recLen {
+			return nil, fmt.Errorf("inode %d: invalid directory entry at offset %d", inode.number, offset)
+		}
+		name := string(data[offset+8 : offset+8+nameLen])
+		if entryInode != 0 && name != "." && name != ".." {
+			entries = append(entries, extDirEntry{name: name, inode: entryInode})
+		}
+		offset += recLen
+	}
+	return entries, nil
+}
+
+func (extFS *extFS) lookup(filePath string) (*extInode, error) {
+	inode, err := extFS.readInode(extRootInode)
+	if err != nil {
+		return nil, err
+	}
+	for _, component := range splitPath(filePath) {
+		entries, err := extFS.readDirInode(inode)
+		if err != nil {
+			return nil, err
+		}
+		var next uint32
+		for _, entry := range entries {
+			if entry.name == component {
+				next = entry.inode
+				break
+			}
+		}
+		if next == 0 {
+			return nil, &fs.PathError{Op: "open", Path: filePath, Err: fs.ErrNotExist}
+		}
+		if inode, err = extFS.readInode(next); err != nil {
+			return nil, err
+		}
+	}
+	return inode, nil
+}
+
+func (extFS *extFS) readDir(dirPath string) ([]string, error) {
+	inode, err := extFS.lookup(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := extFS.readDirInode(inode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", dirPath, err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.name)
+	}
+	return names, nil
+}
+
+func (extFS *extFS) open(filePath string) (*io.SectionReader, error) {
+	inode, err := extFS.lookup(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if inode.mode&extModeTypeMask != extModeRegular {
+		return nil, fmt.Errorf("%s is not a regular file", filePath)
+	}
+	return extFS.inodeReader(inode)
+}
@@ -0,0 +1,369 @@
+package bootdisk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"unicode/utf16"
+)
+
+// Read-only support for FAT12, FAT16 and FAT32 filesystems, including long
+// file names. EFI system partitions use one of these filesystems.
+
+const (
+	fatBootSectorSize = 512
+	fatDirEntrySize   = 32
+
+	fatAttrDirectory = 0x10
+	fatAttrVolumeID  = 0x08
+	fatAttrLongName  = 0x0f
+
+	fatDeletedEntry = 0xe5
+	fatLastLFNEntry = 0x40
+	// number of UTF-16 characters in a long file name entry
+	fatLFNEntryChars = 13
+
+	// flags used by Windows NT to store lower case 8.3 names
+	fatCaseLowerBase = 0x08
+	fatCaseLowerExt  = 0x10
+)
+
+type fatFS struct {
+	r           io.ReaderAt
+	fatBits     int
+	clusterSize int64
+	// fat is the content of the first file allocation table
+	fat          []byte
+	clusterCount uint32
+	dataOffset   int64
+	// rootDirOffset and rootDirSize are only used by FAT12/FAT16, the
+	// root directory of FAT32 filesystems is a cluster chain starting at
+	// rootCluster
+	rootDirOffset int64
+	rootDirSize   int64
+	rootCluster   uint32
+}
+
+type fatDirEntry struct {
+	name    string
+	isDir   bool
+	cluster uint32
+	size    int64
+}
+
+func isFAT(bootSector []byte) bool {
+	if bootSector[510] != 0x55 || bootSector[511] != 0xaa {
+		return false
+	}
+	// filesystem type strings of FAT12/FAT16 and FAT32 boot sectors
+	return strings.HasPrefix(string(bootSector[54:62]), "FAT") || strings.HasPrefix(string(bootSector[82:90]), "FAT32")
+}
+
+func openFAT(r io.ReaderAt, bootSector []byte) (*fatFS, error) {
+	bytesPerSector := int64(binary.LittleEndian.Uint16(bootSector[11:]))
+	sectorsPerCluster := int64(bootSector[13])
+	reservedSectors := int64(binary.LittleEndian.Uint16(bootSector[14:]))
+	fatCount := int64(bootSector[16])
+	rootEntries := int64(binary.LittleEndian.Uint16(bootSector[17:]))
+	totalSectors := int64(binary.LittleEndian.Uint16(bootSector[19:]))
+	if totalSectors == 0 {
+		totalSectors = int64(binary.LittleEndian.Uint32(bootSector[32:]))
+	}
+	fatSectors := int64(binary.LittleEndian.Uint16(bootSector[22:]))
+	if fatSectors == 0 {
+		fatSectors = int64(binary.LittleEndian.Uint32(bootSector[36:]))
+	}
+	if bytesPerSector < 512 || bytesPerSector&(bytesPerSector-1) != 0 || sectorsPerCluster == 0 || fatCount == 0 || fatSectors == 0 {
+		return nil, fmt.Errorf("invalid FAT boot sector")
+	}
+
+	rootDirSectors := (rootEntries*fatDirEntrySize + bytesPerSector - 1) / bytesPerSector
+	dataSector := reservedSectors + fatCount*fatSectors + rootDirSectors
+	if totalSectors <= dataSector {
+		return nil, fmt.Errorf("invalid FAT boot sector")
+	}
+	fatFS := fatFS{
+		r:             r,
+		clusterSize:   sectorsPerCluster * bytesPerSector,
+		clusterCount:  uint32((totalSectors - dataSector) / sectorsPerCluster),
+		dataOffset:    dataSector * bytesPerSector,
+		rootDirOffset: (reservedSectors + fatCount*fatSectors) * bytesPerSector,
+		rootDirSize:   rootDirSectors * bytesPerSector,
+	}
+	// the FAT type is only determined by the number of clusters
+	switch {
+	case fatFS.clusterCount < 4085:
+		fatFS.fatBits = 12
+	case fatFS.clusterCount < 65525:
+		fatFS.fatBits = 16
+	default:
+		fatFS.fatBits = 32
+		fatFS.rootCluster = binary.LittleEndian.Uint32(bootSector[44:])
+	}
+
+	fatFS.fat = make([]byte, fatSectors*bytesPerSector)
+	if _, err := r.ReadAt(fatFS.fat, reservedSectors*bytesPerSector); err != nil {
+		return nil, fmt.Errorf("failed to read file allocation table: %w", err)
+	}
+
+	return &fatFS, nil
+}
+
+// nextCluster returns the cluster following cluster in its chain, and false
+// if cluster is the last one
+func (fatFS *fatFS) nextCluster(cluster uint32) (uint32, bool, error) {
+	var next, endOfChain uint32
+	switch fatFS.fatBits {
+	case 12:
+		offset := cluster + cluster/2
+		if int(offset)+2 > len(fatFS.fat) {
+			return 0, false, fmt.Errorf("invalid FAT cluster %d", cluster)
+		}
+		next = uint32(binary.LittleEndian.Uint16(fatFS.fat[offset:]))
+		if cluster%2 == 1 {
+			next >>= 4
+		}
+		next &= 0xfff
+		endOfChain = 0xff8
+	case 16:
+		if int(cluster)*2+2 > len(fatFS.fat) {
+			return 0, false, fmt.Errorf("invalid FAT cluster %d", cluster)
+		}
+		next = uint32(binary.LittleEndian.Uint16(fatFS.fat[cluster*2:]))
+		endOfChain = 0xfff8
+	default:
+		if int(cluster)*4+4 > len(fatFS.fat) {
+			return 0, false, fmt.Errorf("invalid FAT cluster %d", cluster)
+		}
+		next = binary.LittleEndian.Uint32(fatFS.fat[cluster*4:]) & 0x0fffffff
+		endOfChain = 0x0ffffff8
+	}
+	if next >= endOfChain {
+		return 0, false, nil
+	}
+	if next < 2 || next >= fatFS.clusterCount+2 {
+		return 0, false, fmt.Errorf("invalid FAT cluster chain: cluster %d is followed by %d", cluster, next)
+	}
+	return next, true, nil
+}
+
+func (fatFS *fatFS) clusterChainReader(cluster uint32, size int64) (*io.SectionReader, error) {
+	extents := []extent{}
+	if cluster != 0 {
+		for logical := uint64(0); ; logical++ {
+			// a chain can't be longer than the number of clusters
+			if logical > uint64(fatFS.clusterCount) {
+				return nil, fmt.Errorf("loop in FAT cluster chain")
+			}
+			if cluster < 2 || cluster >= fatFS.clusterCount+2 {
+				return nil, fmt.Errorf("invalid FAT cluster %d", cluster)
+			}
+			offset := fatFS.dataOffset + int64(cluster-2)*fatFS.clusterSize
+			extents = appendExtent(extents, logical, offset, fatFS.clusterSize)
+			next, ok, err := fatFS.nextCluster(cluster)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+			cluster = next
+		}
+	}
+	if size < 0 {
+		// directories don't have a size, they use their whole cluster chain
+		size = 0
+		if len(extents) > 0 {
+			last := extents[len(extents)-1]
+			size = int64(last.logical+last.length) * fatFS.clusterSize
+		}
+	}
+	reader := &mappedReader{
+		r:        fatFS.r,
+		unitSize: fatFS.clusterSize,
+		extents:  extents,
+	}
+	return io.NewSectionReader(reader, 0, size), nil
+}
+
+func shortName(entry []byte) string {
+	name := make([]byte, 11)
+	copy(name, entry[0:11])
+	if name[0] == 0x05 {
+		name[0] = fatDeletedEntry
+	}
+	base := strings.TrimRight(string(name[0:8]), " ")
+	ext := strings.TrimRight(string(name[8:11]), " ")
+	if entry[12]&fatCaseLowerBase != 0 {
+		base = strings.ToLower(base)
+	}
+	if entry[12]&fatCaseLowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+func shortNameChecksum(entry []byte) byte {
+	var sum byte
+	for _, c := range entry[0:11] {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+func lfnChars(entry []byte) []uint16 {
+	chars := make([]uint16, 0, fatLFNEntryChars)
+	for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+		for i := r[0]; i < r[1]; i += 2 {
+			chars = append(chars, binary.LittleEndian.Uint16(entry[i:]))
+		}
+	}
+	return chars
+}
+
+func parseFATDir(data []byte) []fatDirEntry {
+	entries := []fatDirEntry{}
+	var (
+		lfn         []uint16
+		lfnChecksum byte
+	)
+	for offset := 0; offset+fatDirEntrySize <= len(data); offset += fatDirEntrySize {
+		entry := data[offset : offset+fatDirEntrySize]
+		if entry[0] == 0x00 {
+			// end of directory
+			break
+		}
+		if entry[0] == fatDeletedEntry {
+			lfn = nil
+			continue
+		}
+		attr := entry[11]
+		if attr&0x3f == fatAttrLongName {
+			// long file name entries are stored in reverse order before
+			// the 8.3 entry they belong to
+			sequence := int(entry[0] &^ fatLastLFNEntry)
+			if entry[0]&fatLastLFNEntry != 0 {
+				lfn = make([]uint16, sequence*fatLFNEntryChars)
+				lfnChecksum = entry[13]
+			}
+			if sequence == 0 || lfn == nil || sequence*fatLFNEntryChars > len(lfn) || entry[13] != lfnChecksum {
+				lfn = nil
+				continue
+			}
+			copy(lfn[(sequence-1)*fatLFNEntryChars:], lfnChars(entry))
+			continue
+		}
+		if attr&fatAttrVolumeID != 0 {
+			lfn = nil
+			continue
+		}
+
+		name := shortName(entry)
+		if lfn != nil && shortNameChecksum(entry) == lfnChecksum {
+			for i, c := range lfn {
+				if c == 0x0000 {
+					lfn = lfn[:i]
+					break
+				}
+			}
+			name = string(utf16.Decode(lfn))
+		}
+		lfn = nil
+		if name == "." || name == ".." {
+			continue
+		}
+		entries = append(entries, fatDirEntry{
+			name:    name,
+			isDir:   attr&fatAttrDirectory != 0,
+			cluster: uint32(binary.LittleEndian.Uint16(entry[20:]))<<16 | uint32(binary.LittleEndian.Uint16(entry[26:])),
+			size:    int64(binary.LittleEndian.Uint32(entry[28:])),
+		})
+	}
+	return entries
+}
+
+func (fatFS *fatFS) readDirEntries(entry *fatDirEntry) ([]fatDirEntry, error) {
+	var reader *io.SectionReader
+	switch {
+	case entry != nil:
+		var err error
+		reader, err = fatFS.clusterChainReader(entry.cluster, -1)
+		if err != nil {
+			return nil, err
+		}
+	case fatFS.fatBits == 32:
+		var err error
+		reader, err = fatFS.clusterChainReader(fatFS.rootCluster, -1)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		reader = io.NewSectionReader(fatFS.r, fatFS.rootDirOffset, fatFS.rootDirSize)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return parseFATDir(data), nil
+}
+
+// lookup returns the directory entry for filePath, or nil for the root
+// directory. Names are case-insensitive.
+func (fatFS *fatFS) lookup(filePath string) (*fatDirEntry, error) {
+	var current *fatDirEntry
+	for _, component := range splitPath(filePath) {
+		if current != nil && !current.isDir {
+			return nil, &fs.PathError{Op: "open", Path: filePath, Err: fs.ErrNotExist}
+		}
+		entries, err := fatFS.readDirEntries(current)
+		if err != nil {
+			return nil, err
+		}
+		current = nil
+		for i := range entries {
+			if strings.EqualFold(entries[i].name, component) {
+				current = &entries[i]
+				break
+			}
+		}
+		if current == nil {
+			return nil, &fs.PathError{Op: "open", Path: filePath, Err: fs.ErrNotExist}
+		}
+	}
+	return current, nil
+}
+
+func (fatFS *fatFS) readDir(dirPath string) ([]string, error) {
+	entry, err := fatFS.lookup(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && !entry.isDir {
+		return nil, fmt.Errorf("%s is not a directory", dirPath)
+	}
+	entries, err := fatFS.readDirEntries(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", dirPath, err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.name)
+	}
+	return names, nil
+}
+
+func (fatFS *fatFS) open(filePath string) (*io.SectionReader, error) {
+	entry, err := fatFS.lookup(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil || entry.isDir {
+		return nil, fmt.Errorf("%s is not a regular file", filePath)
+	}
+	return fatFS.clusterChainReader(entry.cluster, entry.size)
+}
@@ -0,0 +1,116 @@
+package bootdisk
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+var errUnsupportedFilesystem = errors.New("unsupported filesystem")
+
+// filesystem is a read-only view of a filesystem stored in a disk partition.
+// Paths are slash-separated and relative to the root of the filesystem.
+type filesystem interface {
+	// readDir returns the names of the entries of the directory at path
+	readDir(path string) ([]string, error)
+	// open returns a reader for the content of the regular file at path
+	open(path string) (*io.SectionReader, error)
+}
+
+// openFilesystem detects the type of the filesystem stored in r, and returns
+// a filesystem instance which can read it.
+func openFilesystem(r io.ReaderAt) (filesystem, error) {
+	// the superblock is big enough to hold the boot sector of FAT filesystems
+	superblock := make([]byte, extSuperblockOffset+extSuperblockSize)
+	if _, err := r.ReadAt(superblock, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errUnsupportedFilesystem
+		}
+		return nil, err
+	}
+	switch {
+	case binary.LittleEndian.Uint16(superblock[extSuperblockOffset+56:]) == extMagic:
+		return openExt(r, superblock[extSuperblockOffset:])
+	case isFAT(superblock[:fatBootSectorSize]):
+		return openFAT(r, superblock[:fatBootSectorSize])
+	default:
+		return nil, errUnsupportedFilesystem
+	}
+}
+
+// splitPath returns the components of path, ignoring empty ones
+func splitPath(path string) []string {
+	return strings.FieldsFunc(path, func(c rune) bool { return c == '/' })
+}
+
+// extent maps a range of units (filesystem blocks or clusters) of a file to
+// their location on disk
+type extent struct {
+	// logical is the index of the first unit of the extent in the file
+	logical uint64
+	length  uint64
+	// offset is the location of the first unit of the extent on disk
+	offset int64
+	// zero is set for preallocated extents which must be read as zeros
+	zero bool
+}
+
+// mappedReader reads the content of a file which is spread over several
+// extents. Parts of the file which are not covered by an extent are read as
+// zeros.
+type mappedReader struct {
+	r        io.ReaderAt
+	unitSize int64
+	// extents must be sorted by logical unit
+	extents []extent
+}
+
+func (m *mappedReader) findExtent(unit uint64) *extent {
+	i := sort.Search(len(m.extents), func(i int) bool {
+		return m.extents[i].logical+m.extents[i].length > unit
+	})
+	if i == len(m.extents) || m.extents[i].logical > unit {
+		return nil
+	}
+	return &m.extents[i]
+}
+
+func (m *mappedReader) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		unit := uint64(off / m.unitSize)
+		unitOffset := off % m.unitSize
+		chunkSize := int64(len(p) - read)
+
+		ext := m.findExtent(unit)
+		if ext == nil || ext.zero {
+			chunkSize = min(chunkSize, m.unitSize-unitOffset)
+			clear(p[read : read+int(chunkSize)])
+		} else {
+			extentEnd := int64(ext.logical+ext.length) * m.unitSize
+			chunkSize = min(chunkSize, extentEnd-off)
+			diskOffset := ext.offset + int64(unit-ext.logical)*m.unitSize + unitOffset
+			if _, err := m.r.ReadAt(p[read:read+int(chunkSize)], diskOffset); err != nil {
+				return read, err
+			}
+		}
+		read += int(chunkSize)
+		off += chunkSize
+	}
+	return read, nil
+}
+
+// appendExtent adds a single unit extent to extents, merging it with the last
+// extent when they are contiguous
+func appendExtent(extents []extent, logical uint64, offset int64, unitSize int64) []extent {
+	if len(extents) > 0 {
+		last := &extents[len(extents)-1]
+		if !last.zero && last.logical+last.length == logical && last.offset+int64(last.length)*unitSize == offset {
+			last.length++
+			return extents
+		}
+	}
+	return append(extents, extent{logical: logical, length: 1, offset: offset})
+}
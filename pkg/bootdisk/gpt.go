@@ -0,0 +1,134 @@
+package bootdisk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+var errNoGPT = errors.New("no GPT partition table found")
+
+var gptSignature = []byte("EFI PART")
+
+const (
+	// partition type of the boot partition defined by the boot loader
+	// specification, when present it contains the kernels
+	xbootldrTypeGUID = "bc13c2ff-59e6-4262-a352-b275fd6f7172"
+
+	gptEntryMinSize = 128
+	gptEntryMaxSize = 4096
+	gptMaxEntries   = 1024
+)
+
+type partition struct {
+	// number is the 1-based index of the partition in the partition table
+	number   uint
+	typeGUID string
+	name     string
+	offset   int64
+	size     int64
+}
+
+// formatGUID converts a GUID stored in its on-disk mixed-endian format to
+// its string representation
+func formatGUID(guid []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(guid[0:4]),
+		binary.LittleEndian.Uint16(guid[4:6]),
+		binary.LittleEndian.Uint16(guid[6:8]),
+		guid[8:10],
+		guid[10:16])
+}
+
+func decodeUTF16Name(data []byte) string {
+	name := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		c := binary.LittleEndian.Uint16(data[i:])
+		if c == 0 {
+			break
+		}
+		name = append(name, c)
+	}
+	return string(utf16.Decode(name))
+}
+
+// readGPT returns the partitions listed in the GUID partition table of disk.
+// Both 512 bytes and 4096 bytes sectors are supported.
+func readGPT(disk io.ReaderAt) ([]partition, error) {
+	for _, sectorSize := range []int64{512, 4096} {
+		partitions, err := readGPTWithSectorSize(disk, sectorSize)
+		if errors.Is(err, errNoGPT) {
+			continue
+		}
+		return partitions, err
+	}
+	return nil, errNoGPT
+}
+
+func readGPTWithSectorSize(disk io.ReaderAt, sectorSize int64) ([]partition, error) {
+	// the primary GPT header is stored in the second sector of the disk
+	header := make([]byte, sectorSize)
+	if _, err := disk.ReadAt(header, sectorSize); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errNoGPT
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[0:8], gptSignature) {
+		return nil, errNoGPT
+	}
+
+	headerSize := binary.LittleEndian.Uint32(header[12:16])
+	if headerSize < 92 || int64(headerSize) > sectorSize {
+		return nil, fmt.Errorf("invalid GPT header size: %d", headerSize)
+	}
+	headerCRC := binary.LittleEndian.Uint32(header[16:20])
+	binary.LittleEndian.PutUint32(header[16:20], 0)
+	if crc32.ChecksumIEEE(header[:headerSize]) != headerCRC {
+		return nil, fmt.Errorf("invalid GPT header checksum")
+	}
+
+	entriesLBA := binary.LittleEndian.Uint64(header[72:80])
+	entryCount := binary.LittleEndian.Uint32(header[80:84])
+	entrySize := binary.LittleEndian.Uint32(header[84:88])
+	entriesCRC := binary.LittleEndian.Uint32(header[88:92])
+	if entrySize < gptEntryMinSize || entrySize > gptEntryMaxSize || entrySize%8 != 0 || entryCount > gptMaxEntries {
+		return nil, fmt.Errorf("invalid GPT partition entries: %d entries of %d bytes", entryCount, entrySize)
+	}
+
+	entries := make([]byte, uint64(entryCount)*uint64(entrySize))
+	if _, err := disk.ReadAt(entries, int64(entriesLBA)*sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read GPT partition entries: %w", err)
+	}
+	if crc32.ChecksumIEEE(entries) != entriesCRC {
+		return nil, fmt.Errorf("invalid GPT partition entries checksum")
+	}
+
+	partitions := []partition{}
+	for i := uint64(0); i < uint64(entryCount); i++ {
+		entry := entries[i*uint64(entrySize) : (i+1)*uint64(entrySize)]
+		// unused entries have an all-zero partition type
+		if bytes.Equal(entry[0:16], make([]byte, 16)) {
+			continue
+		}
+		firstLBA := binary.LittleEndian.Uint64(entry[32:40])
+		lastLBA := binary.LittleEndian.Uint64(entry[40:48])
+		if lastLBA < firstLBA {
+			return nil, fmt.Errorf("invalid GPT partition %d: last LBA %d is before first LBA %d", i+1, lastLBA, firstLBA)
+		}
+		partitions = append(partitions, partition{
+			number:   uint(i + 1),
+			typeGUID: strings.ToLower(formatGUID(entry[0:16])),
+			name:     decodeUTF16Name(entry[56:128]),
+			offset:   int64(firstLBA) * sectorSize,
+			size:     int64(lastLBA-firstLBA+1) * sectorSize,
+		})
+	}
+
+	return partitions, nil
+}
@@ -0,0 +1,73 @@
+package bootdisk
+
+import (
+	"strings"
+	"unicode"
+)
+
+// versionSegments splits version in alternating runs of digits and letters,
+// all other characters are separators
+func versionSegments(version string) []string {
+	segments := []string{}
+	start := -1
+	isDigitSegment := false
+	for i, c := range version {
+		isAlnum := c < unicode.MaxASCII && (unicode.IsDigit(c) || unicode.IsLetter(c))
+		if start != -1 && (!isAlnum || unicode.IsDigit(c) != isDigitSegment) {
+			segments = append(segments, version[start:i])
+			start = -1
+		}
+		if isAlnum && start == -1 {
+			start = i
+			isDigitSegment = unicode.IsDigit(c)
+		}
+	}
+	if start != -1 {
+		segments = append(segments, version[start:])
+	}
+	return segments
+}
+
+func isNumeric(segment string) bool {
+	return segment != "" && unicode.IsDigit(rune(segment[0]))
+}
+
+// compareVersions compares kernel versions such as "6.8.5-301.fc40.aarch64"
+// using the same rules as rpm: numeric segments are compared as numbers,
+// alphabetic segments are compared as strings, and numeric segments are newer
+// than alphabetic ones. It returns -1 if a is older than b, 0 if they are
+// equal, and 1 if a is newer than b.
+func compareVersions(a, b string) int {
+	segmentsA := versionSegments(a)
+	segmentsB := versionSegments(b)
+	for i := 0; i < len(segmentsA) && i < len(segmentsB); i++ {
+		segA, segB := segmentsA[i], segmentsB[i]
+		numA, numB := isNumeric(segA), isNumeric(segB)
+		switch {
+		case numA && !numB:
+			return 1
+		case !numA && numB:
+			return -1
+		case numA && numB:
+			segA = strings.TrimLeft(segA, "0")
+			segB = strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				if len(segA) > len(segB) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if cmp := strings.Compare(segA, segB); cmp != 0 {
+			return cmp
+		}
+	}
+	switch {
+	case len(segmentsA) > len(segmentsB):
+		return 1
+	case len(segmentsA) < len(segmentsB):
+		return -1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,118 @@
+// Package cloudinit creates the ISO images cloud-init reads its configuration
+// from in virtual machines, as described by its NoCloud datasource:
+// https://cloudinit.readthedocs.io/en/latest/reference/datasources/nocloud.html
+package cloudinit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/kdomanski/iso9660"
+)
+
+// Names of the NoCloud configuration files.
+const (
+	UserData      = "user-data"
+	MetaData      = "meta-data"
+	NetworkConfig = "network-config"
+	VendorData    = "vendor-data"
+)
+
+// volumeLabel is the label of the filesystems the NoCloud datasource reads
+// its configuration from
+const volumeLabel = "cidata"
+
+// DefaultHostname is the hostname set by the meta-data generated by
+// GenerateMetaData.
+const DefaultHostname = "vfkit"
+
+// FileNames returns the names of the NoCloud configuration files.
+func FileNames() []string {
+	return []string{UserData, MetaData, NetworkConfig, VendorData}
+}
+
+// IsFileName returns true if name is the name of a NoCloud configuration
+// file.
+func IsFileName(name string) bool {
+	return slices.Contains(FileNames(), name)
+}
+
+// GenerateMetaData returns meta-data for a virtual machine configured by
+// files, with the instance-id returned by InstanceID.
+func GenerateMetaData(files map[string][]byte, hostname string) []byte {
+	return fmt.Appendf(nil, "instance-id: %s\nlocal-hostname: %s\n", InstanceID(files), hostname)
+}
+
+// InstanceID returns an instance-id derived from the content of files, except
+// meta-data. cloud-init only runs its per-instance modules again when the
+// configuration changes.
+func InstanceID(files map[string][]byte) string {
+	hash := sha256.New()
+	for _, name := range FileNames() {
+		if name == MetaData {
+			continue
+		}
+		// the name separates the files and distinguishes empty files
+		// from missing files
+		if content, ok := files[name]; ok {
+			fmt.Fprintf(hash, "%s %d\n", name, len(content))
+			hash.Write(content)
+		}
+	}
+	return "iid-vfkit-" + hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// AddPublicKeys adds SSH public keys to metaData, cloud-init authorizes them
+// for the default user of the virtual machine.
+func AddPublicKeys(metaData []byte, keys []string) ([]byte, error) {
+	for _, line := range strings.Split(string(metaData), "\n") {
+		if strings.HasPrefix(line, "public-keys:") {
+			return nil, fmt.Errorf("meta-data already has public-keys")
+		}
+	}
+	if len(metaData) != 0 && !bytes.HasSuffix(metaData, []byte("\n")) {
+		metaData = append(metaData, '\n')
+	}
+	metaData = append(metaData, "public-keys:\n"...)
+	for _, key := range keys {
+		metaData = fmt.Appendf(metaData, "  - %q\n", key)
+	}
+	return metaData, nil
+}
+
+// WriteISO writes to w an ISO image with the NoCloud configuration files. The
+// user-data and meta-data files are required by cloud-init, they are empty
+// when they are missing from files.
+func WriteISO(w io.Writer, files map[string][]byte) error {
+	for name := range files {
+		if !IsFileName(name) {
+			return fmt.Errorf("unexpected cloud-init file: %s", name)
+		}
+	}
+	writer, err := iso9660.NewWriter()
+	if err != nil {
+		return fmt.Errorf("failed to create writer: %w", err)
+	}
+	defer func() {
+		_ = writer.Cleanup()
+	}()
+
+	for _, name := range FileNames() {
+		content, ok := files[name]
+		if !ok && name != UserData && name != MetaData {
+			continue
+		}
+		if err := writer.AddFile(bytes.NewReader(content), name); err != nil {
+			return fmt.Errorf("failed to add %s file: %w", name, err)
+		}
+	}
+	if err := writer.WriteTo(w, volumeLabel); err != nil {
+		return fmt.Errorf("failed to write cloud-init ISO image: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package cloudinit
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/kdomanski/iso9660"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readISO returns the files of the ISO image
+func readISO(t *testing.T, data []byte) (string, map[string]string) {
+	img, err := iso9660.OpenImage(bytes.NewReader(data))
+	require.NoError(t, err)
+	label, err := img.Label()
+	require.NoError(t, err)
+	root, err := img.RootDir()
+	require.NoError(t, err)
+	children, err := root.GetChildren()
+	require.NoError(t, err)
+	files := map[string]string{}
+	for _, child := range children {
+		content, err := io.ReadAll(child.Reader())
+		require.NoError(t, err)
+		files[child.Name()] = string(content)
+	}
+	return label, files
+}
+
+func TestWriteISO(t *testing.T) {
+	var iso bytes.Buffer
+	err := WriteISO(&iso, map[string][]byte{
+		UserData:      []byte("#cloud-config\nusers:\n  - name: core\n"),
+		NetworkConfig: []byte("version: 2\n"),
+	})
+	require.NoError(t, err)
+	label, files := readISO(t, iso.Bytes())
+	assert.Equal(t, "cidata", label)
+	assert.Equal(t, map[string]string{
+		UserData:      "#cloud-config\nusers:\n  - name: core\n",
+		MetaData:      "",
+		NetworkConfig: "version: 2\n",
+	}, files)
+
+	err = WriteISO(io.Discard, map[string][]byte{"seed.img": nil})
+	require.EqualError(t, err, "unexpected cloud-init file: seed.img")
+}
+
+func TestGenerateMetaData(t *testing.T) {
+	files := map[string][]byte{UserData: []byte("#cloud-config\n")}
+	metaData := string(GenerateMetaData(files, DefaultHostname))
+	assert.Regexp(t, "^instance-id: iid-vfkit-[0-9a-f]{16}\nlocal-hostname: vfkit\n$", metaData)
+	assert.Equal(t, metaData, string(GenerateMetaData(files, DefaultHostname)))
+
+	// the instance-id changes with the configuration
+	files[VendorData] = []byte{}
+	changed := string(GenerateMetaData(files, "fedora"))
+	assert.NotEqual(t, strings.Split(metaData, "\n")[0], strings.Split(changed, "\n")[0])
+	assert.Contains(t, changed, "local-hostname: fedora\n")
+}
+
+func TestGenerateNetworkConfig(t *testing.T) {
+	mac1, err := net.ParseMAC("5a:94:ef:e4:0c:dd")
+	require.NoError(t, err)
+	mac2, err := net.ParseMAC("5a:94:ef:e4:0c:ee")
+	require.NoError(t, err)
+	networkConfig, err := GenerateNetworkConfig([]Interface{
+		{MACAddress: mac1},
+		{
+			MACAddress: mac2,
+			Addresses:  []netip.Prefix{netip.MustParsePrefix("192.168.100.10/24"), netip.MustParsePrefix("fd00::10/64")},
+			Routes: []Route{
+				{To: netip.MustParsePrefix("0.0.0.0/0"), Via: netip.MustParseAddr("192.168.100.1")},
+				{To: netip.MustParsePrefix("10.0.0.0/8"), Via: netip.MustParseAddr("192.168.100.254")},
+			},
+			Nameservers: []netip.Addr{netip.MustParseAddr("192.168.100.1")},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, `version: 2
+ethernets:
+  net0:
+    match:
+      macaddress: "5a:94:ef:e4:0c:dd"
+    dhcp4: true
+  net1:
+    match:
+      macaddress: "5a:94:ef:e4:0c:ee"
+    addresses:
+      - "192.168.100.10/24"
+      - "fd00::10/64"
+    routes:
+      - to: "0.0.0.0/0"
+        via: "192.168.100.1"
+      - to: "10.0.0.0/8"
+        via: "192.168.100.254"
+    nameservers:
+      addresses:
+        - "192.168.100.1"
+`, string(networkConfig))
+
+	_, err = GenerateNetworkConfig([]Interface{{MACAddress: mac1}, {}})
+	require.EqualError(t, err, "network interface 1 has no MAC address")
+}
+
+func TestAddPublicKeys(t *testing.T) {
+	metaData, err := AddPublicKeys([]byte("instance-id: iid-local01"), []string{"ssh-ed25519 AAAA vfkit", "ssh-rsa BBBB user"})
+	require.NoError(t, err)
+	assert.Equal(t, "instance-id: iid-local01\npublic-keys:\n  - \"ssh-ed25519 AAAA vfkit\"\n  - \"ssh-rsa BBBB user\"\n", string(metaData))
+
+	_, err = AddPublicKeys(metaData, []string{"ssh-ed25519 CCCC other"})
+	require.EqualError(t, err, "meta-data already has public-keys")
+}
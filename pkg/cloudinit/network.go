@@ -0,0 +1,60 @@
+package cloudinit
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// Interface is the configuration of a network interface of the virtual
+// machine, which is matched by its MAC address. Interfaces without addresses
+// are configured with DHCP.
+type Interface struct {
+	MACAddress  net.HardwareAddr
+	Addresses   []netip.Prefix
+	Routes      []Route
+	Nameservers []netip.Addr
+}
+
+// Route is a static route, To is 0.0.0.0/0 or ::/0 for default routes.
+type Route struct {
+	To  netip.Prefix
+	Via netip.Addr
+}
+
+// GenerateNetworkConfig returns a network-config file configuring interfaces,
+// in the netplan v2 format:
+// https://cloudinit.readthedocs.io/en/latest/reference/network-config-format-v2.html
+func GenerateNetworkConfig(interfaces []Interface) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("version: 2\nethernets:\n")
+	for i, iface := range interfaces {
+		if len(iface.MACAddress) == 0 {
+			return nil, fmt.Errorf("network interface %d has no MAC address", i)
+		}
+		fmt.Fprintf(&buf, "  net%d:\n", i)
+		fmt.Fprintf(&buf, "    match:\n      macaddress: %q\n", iface.MACAddress.String())
+		if len(iface.Addresses) == 0 {
+			buf.WriteString("    dhcp4: true\n")
+		} else {
+			buf.WriteString("    addresses:\n")
+			for _, address := range iface.Addresses {
+				fmt.Fprintf(&buf, "      - %q\n", address.String())
+			}
+		}
+		if len(iface.Routes) != 0 {
+			buf.WriteString("    routes:\n")
+			for _, route := range iface.Routes {
+				fmt.Fprintf(&buf, "      - to: %q\n        via: %q\n", route.To.String(), route.Via.String())
+			}
+		}
+		if len(iface.Nameservers) != 0 {
+			buf.WriteString("    nameservers:\n      addresses:\n")
+			for _, nameserver := range iface.Nameservers {
+				fmt.Fprintf(&buf, "        - %q\n", nameserver.String())
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -5,6 +5,8 @@ import (
 )
 
 type Options struct {
+	Name string
+
 	Vcpus     uint
 	MemoryMiB uint
 
@@ -28,9 +30,23 @@ type Options struct {
 
 	CloudInitFiles stringSliceValue
 
+	CloudInitNetworkConfig bool
+
+	SSHKey string
+
+	MetadataService string
+
 	Nested bool
 
+	OnHostSleep string
+
+	RestoreFrom string
+
 	PidFile string
+
+	StatusFile string
+
+	StateDir string
 }
 
 const DefaultRestfulURI = "none://"
@@ -48,6 +64,7 @@ func AddFlags(cmd *cobra.Command, opts *Options) {
 	cmd.MarkFlagsMutuallyExclusive("kernel-cmdline", "bootloader")
 	cmd.MarkFlagsRequiredTogether("kernel", "initrd", "kernel-cmdline")
 
+	cmd.Flags().StringVar(&opts.Name, "name", "", "name of the virtual machine")
 	cmd.Flags().UintVarP(&opts.Vcpus, "cpus", "c", 1, "number of virtual CPUs")
 	// FIXME: use go-units for parsing
 	cmd.Flags().UintVarP(&opts.MemoryMiB, "memory", "m", 512, "virtual machine RAM size in mibibytes")
@@ -60,6 +77,28 @@ func AddFlags(cmd *cobra.Command, opts *Options) {
 
 	cmd.Flags().StringVar(&opts.IgnitionPath, "ignition", "", "path to the ignition file")
 	cmd.Flags().VarP(&opts.CloudInitFiles, "cloud-init", "", "path to user-data and meta-data cloud-init configuration files")
+	cmd.Flags().BoolVar(&opts.CloudInitNetworkConfig, "cloud-init-network-config", false, "generate the cloud-init network-config from the virtio-net devices")
+	cmd.Flags().StringVar(&opts.SSHKey, "ssh-key", "", "SSH key to provision through cloud-init or ignition, 'auto' or the path of a private key")
+	cmd.Flags().StringVar(&opts.MetadataService, "metadata-service", "", "serve the instance metadata to the guest over vsock")
 	cmd.Flags().BoolVarP(&opts.Nested, "nested", "n", false, "enable nested virtualization")
+	cmd.Flags().StringVar(&opts.OnHostSleep, "on-host-sleep", "", "what to do with the virtual machine when the host sleeps, 'none' or 'pause'")
+	cmd.Flags().StringVar(&opts.RestoreFrom, "restore-from", "", "restore the virtual machine state saved with the /vm/snapshot REST API from this file")
 	cmd.Flags().StringVar(&opts.PidFile, "pidfile", "", "path to the pid file")
+	cmd.Flags().StringVar(&opts.StatusFile, "status-file", "", "path to a JSON file describing why vfkit exited")
+	cmd.Flags().StringVar(&opts.StateDir, "state-dir", "", "directory in which vfkit places the runtime files of the virtual machine")
+}
+
+// Parse parses the command line args of a vfkit process, args[0] is the name
+// of the executable
+func Parse(args []string) (*Options, error) {
+	opts := &Options{}
+	cmd := &cobra.Command{}
+	AddFlags(cmd, opts)
+	if len(args) == 0 {
+		return opts, nil
+	}
+	if err := cmd.ParseFlags(args[1:]); err != nil {
+		return nil, err
+	}
+	return opts, nil
 }
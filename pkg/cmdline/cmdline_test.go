@@ -0,0 +1,22 @@
+package cmdline
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	opts, err := Parse([]string{"vfkit", "--cpus", "2", "--device", "virtio-net,nat,mac=5a:94:ef:e4:0c:ee", "-d", "virtio-vsock,port=22,socketURL=/tmp/ssh.sock", "--ignition", "config.ign", "--ssh-key", "auto", "--state-dir", "/tmp/vm"})
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), opts.Vcpus)
+	assert.Equal(t, uint(512), opts.MemoryMiB)
+	assert.Equal(t, []string{"virtio-net,nat,mac=5a:94:ef:e4:0c:ee", "virtio-vsock,port=22,socketURL=/tmp/ssh.sock"}, opts.Devices)
+	assert.Equal(t, "config.ign", opts.IgnitionPath)
+	assert.Equal(t, "auto", opts.SSHKey)
+	assert.Equal(t, "/tmp/vm", opts.StateDir)
+
+	_, err = Parse([]string{"vfkit", "--unknown"})
+	require.EqualError(t, err, "unknown flag: --unknown")
+}
@@ -185,6 +185,29 @@ func TestSSWithComma(t *testing.T) {
 	}
 }
 
+func TestSSWithNestedQuotes(t *testing.T) {
+	var ss stringSliceValue
+	f := setUpSSFlagSet(&ss)
+
+	arg := `--ss=linux,cmdline="console=ttyS0,115200 dyndbg="file virtio.c +p"",autoConsole`
+	expected := []string{"linux", `cmdline="console=ttyS0,115200 dyndbg="file virtio.c +p""`, "autoConsole"}
+	err := f.Parse([]string{arg})
+	if err != nil {
+		t.Fatal("expected no error; got", err)
+	}
+
+	values := ss.GetSlice()
+
+	if len(expected) != len(values) {
+		t.Fatalf("expected number of values to be %d but got: %d", len(expected), len(values))
+	}
+	for i, v := range values {
+		if expected[i] != v {
+			t.Fatalf("expected got ss[%d] to be %s but got: %s", i, expected[i], v)
+		}
+	}
+}
+
 func TestSSWithSquareBrackets(t *testing.T) {
 	var ss stringSliceValue
 	f := setUpSSFlagSet(&ss)
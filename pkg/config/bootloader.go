@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/crc-org/vfkit/pkg/util"
@@ -21,6 +22,17 @@ type LinuxBootloader struct {
 	VmlinuzPath   string `json:"vmlinuzPath"`
 	KernelCmdLine string `json:"kernelCmdLine"`
 	InitrdPath    string `json:"initrdPath"`
+	// FromDisk is the path to a raw disk image containing the kernel to
+	// boot. When it's set, VmlinuzPath and InitrdPath are optional and are
+	// file names relative to the kernel directory of the disk image, and
+	// KernelCmdLine is appended to the command line of the boot loader entry.
+	FromDisk string `json:"fromDisk,omitempty"`
+	// Partition is the number of the partition of FromDisk containing the
+	// kernel, all partitions are searched when it's 0.
+	Partition uint `json:"partition,omitempty"`
+	// AutoConsole appends the console= parameter matching the virtio-serial
+	// devices of the virtual machine to the kernel command line.
+	AutoConsole bool `json:"autoConsole,omitempty"`
 }
 
 // EFIBootloader allows to set a few options related to EFI variable storage
@@ -30,6 +42,17 @@ type EFIBootloader struct {
 	CreateVariableStore bool `json:"createVariableStore"`
 }
 
+// UKIBootloader boots a Unified Kernel Image without EFI firmware. The kernel,
+// initrd and kernel command line are extracted from the UKI and used with the
+// virtualization framework Linux bootloader.
+type UKIBootloader struct {
+	UKIPath string `json:"ukiPath"`
+	// ExtraKernelCmdLine is appended to the command line embedded in the UKI
+	ExtraKernelCmdLine string `json:"extraKernelCmdLine,omitempty"`
+	// AutoConsole has the same meaning as in [LinuxBootloader]
+	AutoConsole bool `json:"autoConsole,omitempty"`
+}
+
 // MacOSBootloader provides necessary objects for booting macOS guests
 type MacOSBootloader struct {
 	MachineIdentifierPath string `json:"machineIdentifierPath"`
@@ -39,8 +62,8 @@ type MacOSBootloader struct {
 
 // NewLinuxBootloader creates a new bootloader to start a VM with the file at
 // vmlinuzPath as the kernel, kernelCmdLine as the kernel command line, and the
-// file at initrdPath as the initrd. On ARM64, the kernel must be uncompressed
-// otherwise the VM will fail to boot.
+// file at initrdPath as the initrd. On ARM64, compressed kernels are
+// decompressed by vfkit before starting the VM.
 func NewLinuxBootloader(vmlinuzPath, kernelCmdLine, initrdPath string) *LinuxBootloader {
 	return &LinuxBootloader{
 		VmlinuzPath:   vmlinuzPath,
@@ -49,6 +72,27 @@ func NewLinuxBootloader(vmlinuzPath, kernelCmdLine, initrdPath string) *LinuxBoo
 	}
 }
 
+// NewLinuxBootloaderFromDisk creates a new bootloader to start a VM with the
+// newest kernel and initrd found in the raw disk image at diskPath, using the
+// kernel command line of its boot loader entry. kernelCmdLine is appended to
+// this command line, it can be empty.
+func NewLinuxBootloaderFromDisk(diskPath, kernelCmdLine string) *LinuxBootloader {
+	return &LinuxBootloader{
+		FromDisk:      diskPath,
+		KernelCmdLine: kernelCmdLine,
+	}
+}
+
+// CmdLine returns the parsed kernel command line of bootloader.
+func (bootloader *LinuxBootloader) CmdLine() (*KernelCmdLine, error) {
+	return ParseKernelCmdLine(bootloader.KernelCmdLine)
+}
+
+// SetCmdLine sets the kernel command line of bootloader to cmdline.
+func (bootloader *LinuxBootloader) SetCmdLine(cmdline *KernelCmdLine) {
+	bootloader.KernelCmdLine = cmdline.String()
+}
+
 func (bootloader *LinuxBootloader) FromOptions(options []option) error {
 	for _, option := range options {
 		switch option.key {
@@ -58,14 +102,34 @@ func (bootloader *LinuxBootloader) FromOptions(options []option) error {
 			bootloader.KernelCmdLine = util.TrimQuotes(option.value)
 		case "initrd":
 			bootloader.InitrdPath = option.value
+		case "fromDisk":
+			bootloader.FromDisk = option.value
+		case "partition":
+			partition, err := strconv.ParseUint(option.value, 10, 32)
+			if err != nil || partition == 0 {
+				return fmt.Errorf("invalid partition number for Linux bootloader: %s", option.value)
+			}
+			bootloader.Partition = uint(partition)
+		case "autoConsole":
+			if option.value != "" {
+				return fmt.Errorf("unexpected value for Linux bootloader 'autoConsole' option: %s", option.value)
+			}
+			bootloader.AutoConsole = true
 		default:
 			return fmt.Errorf("unknown option for Linux bootloaders: %s", option.key)
 		}
 	}
+	if bootloader.Partition != 0 && bootloader.FromDisk == "" {
+		return fmt.Errorf("'partition' can only be used with 'fromDisk' for Linux bootloaders")
+	}
 	return nil
 }
 
 func (bootloader *LinuxBootloader) ToCmdLine() ([]string, error) {
+	if bootloader.FromDisk != "" || bootloader.AutoConsole {
+		return bootloader.bootloaderToCmdLine()
+	}
+
 	args := []string{}
 	if bootloader.VmlinuzPath == "" {
 		return nil, fmt.Errorf("missing kernel path")
@@ -85,6 +149,38 @@ func (bootloader *LinuxBootloader) ToCmdLine() ([]string, error) {
 	return args, nil
 }
 
+// bootloaderToCmdLine is used when the kernel comes from a disk image or when
+// autoConsole is set, as this can't be expressed with the legacy
+// --kernel/--initrd/--kernel-cmdline arguments
+func (bootloader *LinuxBootloader) bootloaderToCmdLine() ([]string, error) {
+	if bootloader.FromDisk == "" && bootloader.VmlinuzPath == "" {
+		return nil, fmt.Errorf("missing kernel path")
+	}
+
+	builder := strings.Builder{}
+	builder.WriteString("linux")
+	if bootloader.FromDisk != "" {
+		fmt.Fprintf(&builder, ",fromDisk=%s", bootloader.FromDisk)
+	}
+	if bootloader.Partition != 0 {
+		fmt.Fprintf(&builder, ",partition=%d", bootloader.Partition)
+	}
+	if bootloader.VmlinuzPath != "" {
+		fmt.Fprintf(&builder, ",kernel=%s", bootloader.VmlinuzPath)
+	}
+	if bootloader.InitrdPath != "" {
+		fmt.Fprintf(&builder, ",initrd=%s", bootloader.InitrdPath)
+	}
+	if bootloader.KernelCmdLine != "" {
+		fmt.Fprintf(&builder, ",cmdline=\"%s\"", bootloader.KernelCmdLine)
+	}
+	if bootloader.AutoConsole {
+		builder.WriteString(",autoConsole")
+	}
+
+	return []string{"--bootloader", builder.String()}, nil
+}
+
 // NewEFIBootloader creates a new bootloader to start a VM using EFI
 // efiVariableStorePath is the path to a file for EFI storage
 // create is a boolean indicating if the file for the store should be created or not
@@ -127,6 +223,53 @@ func (bootloader *EFIBootloader) ToCmdLine() ([]string, error) {
 	return []string{"--bootloader", builder.String()}, nil
 }
 
+// NewUKIBootloader creates a new bootloader to start a VM using the unified
+// kernel image at ukiPath. extraKernelCmdLine is appended to the kernel command
+// line embedded in the UKI, it can be empty.
+func NewUKIBootloader(ukiPath, extraKernelCmdLine string) *UKIBootloader {
+	return &UKIBootloader{
+		UKIPath:            ukiPath,
+		ExtraKernelCmdLine: extraKernelCmdLine,
+	}
+}
+
+func (bootloader *UKIBootloader) FromOptions(options []option) error {
+	for _, option := range options {
+		switch option.key {
+		case "path":
+			bootloader.UKIPath = option.value
+		case "cmdline":
+			bootloader.ExtraKernelCmdLine = util.TrimQuotes(option.value)
+		case "autoConsole":
+			if option.value != "" {
+				return fmt.Errorf("unexpected value for UKI bootloader 'autoConsole' option: %s", option.value)
+			}
+			bootloader.AutoConsole = true
+		default:
+			return fmt.Errorf("unknown option for UKI bootloaders: %s", option.key)
+		}
+	}
+	return nil
+}
+
+func (bootloader *UKIBootloader) ToCmdLine() ([]string, error) {
+	if bootloader.UKIPath == "" {
+		return nil, fmt.Errorf("missing UKI path")
+	}
+
+	builder := strings.Builder{}
+	builder.WriteString("uki")
+	fmt.Fprintf(&builder, ",path=%s", bootloader.UKIPath)
+	if bootloader.ExtraKernelCmdLine != "" {
+		fmt.Fprintf(&builder, ",cmdline=\"%s\"", bootloader.ExtraKernelCmdLine)
+	}
+	if bootloader.AutoConsole {
+		builder.WriteString(",autoConsole")
+	}
+
+	return []string{"--bootloader", builder.String()}, nil
+}
+
 func (bootloader *MacOSBootloader) FromOptions(options []option) error {
 	for _, option := range options {
 		switch option.key {
@@ -163,6 +306,8 @@ func BootloaderFromCmdLine(optsStrv []string) (Bootloader, error) {
 		bootloader = &LinuxBootloader{}
 	case "macos":
 		bootloader = &MacOSBootloader{}
+	case "uki":
+		bootloader = &UKIBootloader{}
 	default:
 		return nil, fmt.Errorf("unknown bootloader type: %s", bootloaderType)
 	}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUKIBootloaderCmdLine(t *testing.T) {
+	bootloader, err := BootloaderFromCmdLine([]string{"uki", "path=/uki.efi", `cmdline="console=hvc0 quiet"`})
+	require.NoError(t, err)
+	require.IsType(t, &UKIBootloader{}, bootloader)
+	assert.Equal(t, NewUKIBootloader("/uki.efi", "console=hvc0 quiet"), bootloader)
+
+	cmdLine, err := bootloader.ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--bootloader", `uki,path=/uki.efi,cmdline="console=hvc0 quiet"`}, cmdLine)
+
+	cmdLine, err = NewUKIBootloader("/uki.efi", "").ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--bootloader", "uki,path=/uki.efi"}, cmdLine)
+
+	_, err = NewUKIBootloader("", "").ToCmdLine()
+	require.EqualError(t, err, "missing UKI path")
+
+	_, err = BootloaderFromCmdLine([]string{"uki", "kernel=/vmlinuz"})
+	require.EqualError(t, err, "unknown option for UKI bootloaders: kernel")
+}
+
+func TestLinuxBootloaderFromDiskCmdLine(t *testing.T) {
+	bootloader, err := BootloaderFromCmdLine([]string{"linux", "fromDisk=/disk.img", "partition=3", "kernel=vmlinuz-6.8.5-301.fc40.aarch64", `cmdline="console=hvc0"`})
+	require.NoError(t, err)
+	expected := NewLinuxBootloaderFromDisk("/disk.img", "console=hvc0")
+	expected.Partition = 3
+	expected.VmlinuzPath = "vmlinuz-6.8.5-301.fc40.aarch64"
+	assert.Equal(t, expected, bootloader)
+
+	cmdLine, err := bootloader.ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--bootloader", `linux,fromDisk=/disk.img,partition=3,kernel=vmlinuz-6.8.5-301.fc40.aarch64,cmdline="console=hvc0"`}, cmdLine)
+
+	cmdLine, err = NewLinuxBootloaderFromDisk("/disk.img", "").ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--bootloader", "linux,fromDisk=/disk.img"}, cmdLine)
+
+	_, err = BootloaderFromCmdLine([]string{"linux", "fromDisk=/disk.img", "partition=0"})
+	require.EqualError(t, err, "invalid partition number for Linux bootloader: 0")
+	_, err = BootloaderFromCmdLine([]string{"linux", "kernel=/vmlinuz", "partition=1"})
+	require.EqualError(t, err, "'partition' can only be used with 'fromDisk' for Linux bootloaders")
+}
+
+func TestLinuxBootloaderAutoConsole(t *testing.T) {
+	bootloader, err := BootloaderFromCmdLine([]string{"linux", "kernel=/vmlinuz", `cmdline="root=LABEL=root dyndbg="file virtio.c +p""`, "autoConsole"})
+	require.NoError(t, err)
+	expected := NewLinuxBootloader("/vmlinuz", `root=LABEL=root dyndbg="file virtio.c +p"`, "")
+	expected.AutoConsole = true
+	assert.Equal(t, expected, bootloader)
+
+	cmdLine, err := bootloader.ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--bootloader", `linux,kernel=/vmlinuz,cmdline="root=LABEL=root dyndbg="file virtio.c +p"",autoConsole`}, cmdLine)
+
+	cmdLine, err = NewLinuxBootloader("", "", "").ToCmdLine()
+	require.EqualError(t, err, "missing kernel path")
+	require.Nil(t, cmdLine)
+
+	_, err = BootloaderFromCmdLine([]string{"linux", "kernel=/vmlinuz", "autoConsole=hvc0"})
+	require.EqualError(t, err, "unexpected value for Linux bootloader 'autoConsole' option: hvc0")
+
+	ukiBootloader, err := BootloaderFromCmdLine([]string{"uki", "path=/uki.efi", "autoConsole"})
+	require.NoError(t, err)
+	cmdLine, err = ukiBootloader.ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--bootloader", "uki,path=/uki.efi,autoConsole"}, cmdLine)
+}
+
+func TestLinuxBootloaderSetCmdLine(t *testing.T) {
+	bootloader := NewLinuxBootloader("/vmlinuz", "root=/dev/vda1 console=ttyS0", "/initrd")
+	cmdline, err := bootloader.CmdLine()
+	require.NoError(t, err)
+	cmdline.Set("console", "hvc0")
+	cmdline.Append("quiet", "")
+	bootloader.SetCmdLine(cmdline)
+	assert.Equal(t, "root=/dev/vda1 console=hvc0 quiet", bootloader.KernelCmdLine)
+}
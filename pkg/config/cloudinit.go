@@ -0,0 +1,209 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/crc-org/vfkit/pkg/cloudinit"
+)
+
+// CloudInit configures the virtual machine with cloud-init. vfkit generates an
+// ISO image with the cloud-init configuration files, which is attached to the
+// virtual machine as a read-only virtio-blk device.
+//
+// The configuration files can be given as paths in Files, which must be named
+// after the configuration files they contain (user-data, meta-data,
+// network-config or vendor-data), or inline. Inline content overrides the
+// content of files with the same name.
+// When meta-data is missing, vfkit generates it with an instance-id derived
+// from the configuration and the 'vfkit' local-hostname.
+// When GenerateNetworkConfig is true, vfkit generates the network-config
+// from the virtio-net devices of the virtual machine.
+type CloudInit struct {
+	Files                 []string `json:"files,omitempty"`
+	UserData              string   `json:"userData,omitempty"`
+	MetaData              string   `json:"metaData,omitempty"`
+	NetworkConfig         string   `json:"networkConfig,omitempty"`
+	VendorData            string   `json:"vendorData,omitempty"`
+	GenerateNetworkConfig bool     `json:"generateNetworkConfig,omitempty"`
+}
+
+// CloudInitNew creates a new CloudInit configuration using the cloud-init
+// configuration files at paths.
+func CloudInitNew(paths ...string) (*CloudInit, error) {
+	cloudInit := &CloudInit{Files: paths}
+	if !cloudInit.hasUserOrMetaData() {
+		return nil, fmt.Errorf("cloud-init needs user-data and meta-data files to work")
+	}
+	return cloudInit, nil
+}
+
+func (cloudInit *CloudInit) inlineFiles() map[string]string {
+	return map[string]string{
+		cloudinit.UserData:      cloudInit.UserData,
+		cloudinit.MetaData:      cloudInit.MetaData,
+		cloudinit.NetworkConfig: cloudInit.NetworkConfig,
+		cloudinit.VendorData:    cloudInit.VendorData,
+	}
+}
+
+func (cloudInit *CloudInit) hasInlineData() bool {
+	for _, content := range cloudInit.inlineFiles() {
+		if content != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUserOrMetaData returns true if the configuration has user-data or
+// meta-data, or a generated network-config, without which cloud-init has
+// nothing to do
+func (cloudInit *CloudInit) hasUserOrMetaData() bool {
+	if cloudInit.UserData != "" || cloudInit.MetaData != "" || cloudInit.GenerateNetworkConfig {
+		return true
+	}
+	for _, path := range cloudInit.Files {
+		switch filepath.Base(path) {
+		case cloudinit.UserData, cloudinit.MetaData:
+			return true
+		}
+	}
+	return false
+}
+
+// CloudInitConfigFiles returns the content of the cloud-init configuration
+// files of the virtual machine, indexed by their names. Files which are not
+// named after a cloud-init configuration file are ignored. The SSH key of the
+// virtual machine is added to the meta-data.
+func (vm *VirtualMachine) CloudInitConfigFiles() (map[string][]byte, error) {
+	cloudInit := vm.CloudInit
+	if cloudInit == nil {
+		return nil, fmt.Errorf("the virtual machine has no cloud-init configuration")
+	}
+	if !cloudInit.hasUserOrMetaData() {
+		return nil, fmt.Errorf("cloud-init needs user-data and meta-data files to work")
+	}
+	files := map[string][]byte{}
+	for _, path := range cloudInit.Files {
+		if path == "" {
+			continue
+		}
+		name := filepath.Base(path)
+		if !cloudinit.IsFileName(name) {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = content
+	}
+	for name, content := range cloudInit.inlineFiles() {
+		if content != "" {
+			files[name] = []byte(content)
+		}
+	}
+	if cloudInit.GenerateNetworkConfig {
+		if _, ok := files[cloudinit.NetworkConfig]; ok {
+			return nil, fmt.Errorf("network-config can't be generated when it is provided in the cloud-init configuration")
+		}
+		networkConfig, err := vm.cloudInitNetworkConfig()
+		if err != nil {
+			return nil, err
+		}
+		files[cloudinit.NetworkConfig] = networkConfig
+	}
+	if _, ok := files[cloudinit.MetaData]; !ok {
+		files[cloudinit.MetaData] = cloudinit.GenerateMetaData(files, cloudinit.DefaultHostname)
+	}
+	if vm.SSHKey != "" {
+		key, err := vm.sshAuthorizedKey()
+		if err != nil {
+			return nil, err
+		}
+		metaData, err := cloudinit.AddPublicKeys(files[cloudinit.MetaData], []string{key})
+		if err != nil {
+			return nil, fmt.Errorf("failed to add the SSH key to cloud-init: %w", err)
+		}
+		files[cloudinit.MetaData] = metaData
+	}
+	return files, nil
+}
+
+// cloudInitNetworkConfig generates a network-config configuring the
+// interfaces of the virtio-net devices, which are matched by MAC address
+func (vm *VirtualMachine) cloudInitNetworkConfig() ([]byte, error) {
+	interfaces := []cloudinit.Interface{}
+	for _, dev := range vm.VirtioNetDevices() {
+		if len(dev.MacAddress) == 0 {
+			return nil, fmt.Errorf("virtio-net devices need a 'mac' option to generate the cloud-init network-config")
+		}
+		iface, err := dev.cloudInitInterface()
+		if err != nil {
+			return nil, err
+		}
+		interfaces = append(interfaces, *iface)
+	}
+	return cloudinit.GenerateNetworkConfig(interfaces)
+}
+
+func (dev *VirtioNet) cloudInitInterface() (*cloudinit.Interface, error) {
+	if err := dev.validateGuestConfig(); err != nil {
+		return nil, err
+	}
+	iface := cloudinit.Interface{MACAddress: dev.MacAddress}
+	for _, address := range dev.Addresses {
+		iface.Addresses = append(iface.Addresses, netip.MustParsePrefix(address))
+	}
+	if dev.Gateway != "" {
+		gateway := netip.MustParseAddr(dev.Gateway)
+		defaultRoute := netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		if gateway.Is6() {
+			defaultRoute = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+		}
+		iface.Routes = append(iface.Routes, cloudinit.Route{To: defaultRoute, Via: gateway})
+	}
+	for _, route := range dev.Routes {
+		iface.Routes = append(iface.Routes, cloudinit.Route{To: netip.MustParsePrefix(route.To), Via: netip.MustParseAddr(route.Via)})
+	}
+	for _, nameserver := range dev.Nameservers {
+		iface.Nameservers = append(iface.Nameservers, netip.MustParseAddr(nameserver))
+	}
+	return &iface, nil
+}
+
+func (cloudInit *CloudInit) ToCmdLine() ([]string, error) {
+	if cloudInit.hasInlineData() {
+		return nil, fmt.Errorf("inline cloud-init configuration can't be passed on the command line, use configuration files")
+	}
+	if !cloudInit.hasUserOrMetaData() {
+		return nil, fmt.Errorf("cloud-init needs user-data and meta-data files to work")
+	}
+	args := []string{}
+	if len(cloudInit.Files) != 0 {
+		args = append(args, "--cloud-init", strings.Join(cloudInit.Files, ","))
+	}
+	if cloudInit.GenerateNetworkConfig {
+		args = append(args, "--cloud-init-network-config")
+	}
+	return args, nil
+}
+
+// AddCloudInitFromCmdLine sets the cloud-init configuration of the virtual
+// machine from the --cloud-init and --cloud-init-network-config command line
+// options.
+func (vm *VirtualMachine) AddCloudInitFromCmdLine(paths []string, generateNetworkConfig bool) error {
+	if len(paths) == 0 && !generateNetworkConfig {
+		return nil
+	}
+	cloudInit := &CloudInit{Files: paths, GenerateNetworkConfig: generateNetworkConfig}
+	if !cloudInit.hasUserOrMetaData() {
+		return fmt.Errorf("cloud-init needs user-data and meta-data files to work")
+	}
+	vm.CloudInit = cloudInit
+	return nil
+}
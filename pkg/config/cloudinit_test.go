@@ -0,0 +1,111 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/crc-org/vfkit/pkg/cloudinit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloudInitConfigFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	for name, content := range map[string]string{
+		"user-data":      "#cloud-config\n",
+		"network-config": "version: 2\n",
+		"seed.img":       "ignored",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0600))
+	}
+
+	cloudInit, err := CloudInitNew(filepath.Join(tmpDir, "user-data"), filepath.Join(tmpDir, "network-config"), filepath.Join(tmpDir, "seed.img"))
+	require.NoError(t, err)
+	vm := newLinuxVM(t)
+	vm.CloudInit = cloudInit
+	files, err := vm.CloudInitConfigFiles()
+	require.NoError(t, err)
+	assert.Equal(t, "#cloud-config\n", string(files[cloudinit.UserData]))
+	assert.Equal(t, "version: 2\n", string(files[cloudinit.NetworkConfig]))
+	assert.Regexp(t, "^instance-id: iid-vfkit-[0-9a-f]+\nlocal-hostname: vfkit\n$", string(files[cloudinit.MetaData]))
+	assert.Len(t, files, 3)
+
+	// inline content overrides the files
+	cloudInit.MetaData = "instance-id: fedora\n"
+	cloudInit.VendorData = "#cloud-config\npackages: [git]\n"
+	files, err = vm.CloudInitConfigFiles()
+	require.NoError(t, err)
+	assert.Equal(t, "instance-id: fedora\n", string(files[cloudinit.MetaData]))
+	assert.Equal(t, "#cloud-config\npackages: [git]\n", string(files[cloudinit.VendorData]))
+
+	_, err = CloudInitNew(filepath.Join(tmpDir, "seed.img"))
+	require.EqualError(t, err, "cloud-init needs user-data and meta-data files to work")
+	vm.CloudInit = &CloudInit{Files: []string{filepath.Join(tmpDir, "missing", "user-data")}}
+	_, err = vm.CloudInitConfigFiles()
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCloudInitToCmdLine(t *testing.T) {
+	cloudInit, err := CloudInitNew("/cloud-init/user-data", "/cloud-init/meta-data")
+	require.NoError(t, err)
+	args, err := cloudInit.ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--cloud-init", "/cloud-init/user-data,/cloud-init/meta-data"}, args)
+
+	vm := newLinuxVM(t)
+	require.NoError(t, vm.AddCloudInitFromCmdLine([]string{"/cloud-init/user-data", "/cloud-init/meta-data"}, false))
+	assert.Equal(t, cloudInit, vm.CloudInit)
+	args, err = vm.ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--cloud-init", "/cloud-init/user-data,/cloud-init/meta-data"}, args[len(args)-2:])
+
+	_, err = (&CloudInit{UserData: "#cloud-config\n"}).ToCmdLine()
+	require.Error(t, err)
+}
+
+func TestCloudInitNetworkConfig(t *testing.T) {
+	vm := newLinuxVM(t)
+	require.NoError(t, vm.AddDevicesFromCmdLine([]string{
+		"virtio-net,nat,mac=5a:94:ef:e4:0c:dd",
+		"virtio-net,nat,mac=5a:94:ef:e4:0c:ee,address=192.168.100.10/24,gateway=192.168.100.1,route=10.0.0.0/8@192.168.100.254,dns=192.168.100.1,dns=1.1.1.1",
+	}))
+	require.NoError(t, vm.AddCloudInitFromCmdLine(nil, true))
+	files, err := vm.CloudInitConfigFiles()
+	require.NoError(t, err)
+	assert.Equal(t, `version: 2
+ethernets:
+  net0:
+    match:
+      macaddress: "5a:94:ef:e4:0c:dd"
+    dhcp4: true
+  net1:
+    match:
+      macaddress: "5a:94:ef:e4:0c:ee"
+    addresses:
+      - "192.168.100.10/24"
+    routes:
+      - to: "0.0.0.0/0"
+        via: "192.168.100.1"
+      - to: "10.0.0.0/8"
+        via: "192.168.100.254"
+    nameservers:
+      addresses:
+        - "192.168.100.1"
+        - "1.1.1.1"
+`, string(files[cloudinit.NetworkConfig]))
+	assert.Contains(t, string(files[cloudinit.MetaData]), "instance-id: iid-vfkit-")
+	args, err := vm.CloudInit.ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--cloud-init-network-config"}, args)
+
+	vm.CloudInit.NetworkConfig = "version: 2\n"
+	_, err = vm.CloudInitConfigFiles()
+	require.EqualError(t, err, "network-config can't be generated when it is provided in the cloud-init configuration")
+
+	vm = newLinuxVM(t)
+	require.NoError(t, vm.AddDevicesFromCmdLine([]string{"virtio-net,nat"}))
+	require.NoError(t, vm.AddCloudInitFromCmdLine(nil, true))
+	_, err = vm.CloudInitConfigFiles()
+	require.EqualError(t, err, "virtio-net devices need a 'mac' option to generate the cloud-init network-config")
+}
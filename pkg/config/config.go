@@ -18,6 +18,7 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 
 	"go.podman.io/common/pkg/strongunits"
 )
@@ -25,25 +26,51 @@ import (
 // VirtualMachine is the top-level type. It describes the virtual machine
 // configuration (bootloader, devices, ...).
 type VirtualMachine struct {
+	// Name identifies the virtual machine, it's used in the templates of
+	// its ignition configuration.
+	Name       string         `json:"name,omitempty"`
 	Vcpus      uint           `json:"vcpus"`
 	Memory     strongunits.B  `json:"memoryBytes"`
 	Bootloader Bootloader     `json:"bootloader"`
 	Devices    []VirtioDevice `json:"devices,omitempty"`
 	Timesync   *TimeSync      `json:"timesync,omitempty"`
 	Ignition   *Ignition      `json:"ignition,omitempty"`
+	CloudInit  *CloudInit     `json:"cloudInit,omitempty"`
 	Nested     bool           `json:"nested,omitempty"`
+	// SSHKey is the SSH key provisioned in the virtual machine through
+	// cloud-init, ignition or the metadata service. It's either the path of a private key, or
+	// "auto" to use a key pair generated by vfkit.
+	SSHKey          string           `json:"sshKey,omitempty"`
+	MetadataService *MetadataService `json:"metadataService,omitempty"`
+	// OnHostSleep is what vfkit does with the virtual machine when the host
+	// sleeps, it defaults to HostSleepNone.
+	OnHostSleep HostSleepPolicy `json:"onHostSleep,omitempty"`
+	// StateDir is the directory in which vfkit places the runtime files of
+	// the virtual machine: pid file, REST socket, generated ISO images, ...
+	StateDir string `json:"stateDir,omitempty"`
 }
 
+// HostSleepPolicy is what vfkit does with the virtual machine when the host
+// sleeps
+type HostSleepPolicy string
+
+const (
+	// HostSleepNone leaves the virtual machine running
+	HostSleepNone HostSleepPolicy = "none"
+	// HostSleepPause pauses the virtual machine before the host sleeps, and
+	// resumes it when the host wakes up
+	HostSleepPause HostSleepPolicy = "pause"
+)
+
 // TimeSync enables synchronization of the host time to the linux guest after the host was suspended.
 // This requires qemu-guest-agent to be running in the guest, and to be listening on a vsock socket
+// The time can also be synchronized periodically (Interval), once the guest agent answers after
+// boot (OnBoot), and when the VM is resumed (OnResume).
 type TimeSync struct {
-	VsockPort uint32 `json:"vsockPort"`
-}
-
-type Ignition struct {
-	ConfigPath string `json:"configPath"`
-	SocketPath string `json:"socketPath,omitempty"`
-	VsockPort  uint32 `json:"-"`
+	VsockPort uint32        `json:"vsockPort"`
+	Interval  time.Duration `json:"interval,omitempty"`
+	OnBoot    bool          `json:"onBoot,omitempty"`
+	OnResume  bool          `json:"onResume,omitempty"`
 }
 
 // The VMComponent interface represents a VM element (device, bootloader, ...)
@@ -86,6 +113,12 @@ func (vm *VirtualMachine) ToCmdLine() ([]string, error) {
 	// TODO: missing binary name/path
 	args := []string{}
 
+	if vm.Name != "" {
+		args = append(args, "--name", vm.Name)
+	}
+	if vm.StateDir != "" {
+		args = append(args, "--state-dir", vm.StateDir)
+	}
 	if vm.Vcpus != 0 {
 		args = append(args, "--cpus", strconv.FormatUint(uint64(vm.Vcpus), 10))
 	}
@@ -111,13 +144,41 @@ func (vm *VirtualMachine) ToCmdLine() ([]string, error) {
 	}
 
 	if vm.Ignition != nil {
-		args = append(args, "--ignition", vm.Ignition.ConfigPath)
+		ignitionArgs, err := vm.Ignition.ToCmdLine()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, ignitionArgs...)
+	}
+
+	if vm.CloudInit != nil {
+		cloudInitArgs, err := vm.CloudInit.ToCmdLine()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, cloudInitArgs...)
 	}
 
 	if vm.Nested {
 		args = append(args, "--nested")
 	}
 
+	if vm.SSHKey != "" {
+		args = append(args, "--ssh-key", vm.SSHKey)
+	}
+
+	if vm.MetadataService != nil {
+		metadataArgs, err := vm.MetadataService.ToCmdLine()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, metadataArgs...)
+	}
+
+	if vm.OnHostSleep != "" {
+		args = append(args, "--on-host-sleep", string(vm.OnHostSleep))
+	}
+
 	return args, nil
 }
 
@@ -184,6 +245,10 @@ func (vm *VirtualMachine) VirtioInputDevices() []*VirtioInput {
 	return FilterDevices[*VirtioInput](vm)
 }
 
+func (vm *VirtualMachine) VirtioSerialDevices() []*VirtioSerial {
+	return FilterDevices[*VirtioSerial](vm)
+}
+
 func (vm *VirtualMachine) VirtioNetDevices() []*VirtioNet {
 	return FilterDevices[*VirtioNet](vm)
 }
@@ -227,31 +292,18 @@ func (vm *VirtualMachine) TimeSync() *TimeSync {
 	return vm.Timesync
 }
 
-func IgnitionNew(configPath string, _ string) (*Ignition, error) {
-	if configPath == "" {
-		return nil, fmt.Errorf("config path cannot be empty")
-	}
-	return &Ignition{
-		ConfigPath: configPath,
-		VsockPort:  ignitionVsockPort,
-	}, nil
-}
-
-func (vm *VirtualMachine) AddIgnitionFileFromCmdLine(cmdlineOpts string) error {
-	if cmdlineOpts == "" {
+// AddHostSleepPolicyFromCmdLine sets what vfkit does with the virtual machine
+// when the host sleeps from the --on-host-sleep command line option.
+func (vm *VirtualMachine) AddHostSleepPolicyFromCmdLine(policy string) error {
+	switch HostSleepPolicy(policy) {
+	case "":
 		return nil
+	case HostSleepNone, HostSleepPause:
+		vm.OnHostSleep = HostSleepPolicy(policy)
+		return nil
+	default:
+		return fmt.Errorf("invalid --on-host-sleep value %q, valid values are %q and %q", policy, HostSleepNone, HostSleepPause)
 	}
-	opts := strings.Split(cmdlineOpts, ",")
-	if len(opts) != 1 {
-		return fmt.Errorf("ignition only accepts one option in command line argument")
-	}
-
-	ignition, err := IgnitionNew(opts[0], "")
-	if err != nil {
-		return err
-	}
-	vm.Ignition = ignition
-	return nil
 }
 
 func TimeSyncNew(vsockPort uint) (VMComponent, error) {
@@ -269,6 +321,15 @@ func (ts *TimeSync) ToCmdLine() ([]string, error) {
 	if ts.VsockPort != 0 {
 		args = append(args, fmt.Sprintf("vsockPort=%d", ts.VsockPort))
 	}
+	if ts.Interval != 0 {
+		args = append(args, "interval="+ts.Interval.String())
+	}
+	if ts.OnBoot {
+		args = append(args, "onBoot")
+	}
+	if ts.OnResume {
+		args = append(args, "onResume")
+	}
 	return []string{"--timesync", strings.Join(args, ",")}, nil
 }
 
@@ -281,6 +342,22 @@ func (ts *TimeSync) FromOptions(options []option) error {
 				return err
 			}
 			ts.VsockPort = uint32(vsockPort)
+		case "interval":
+			interval, err := time.ParseDuration(option.value)
+			if err != nil {
+				return err
+			}
+			ts.Interval = interval
+		case "onBoot":
+			if option.value != "" {
+				return fmt.Errorf("unexpected value for 'onBoot' option of timesync parameter: %s", option.value)
+			}
+			ts.OnBoot = true
+		case "onResume":
+			if option.value != "" {
+				return fmt.Errorf("unexpected value for 'onResume' option of timesync parameter: %s", option.value)
+			}
+			ts.OnResume = true
 		default:
 			return fmt.Errorf("unknown option for timesync parameter: %s", option.key)
 		}
@@ -289,6 +366,9 @@ func (ts *TimeSync) FromOptions(options []option) error {
 	if ts.VsockPort == 0 {
 		return fmt.Errorf("missing 'vsockPort' option for timesync parameter")
 	}
+	if ts.Interval < 0 || (ts.Interval > 0 && ts.Interval < time.Second) {
+		return fmt.Errorf("invalid 'interval' option for timesync parameter, it must be at least 1s: %s", ts.Interval)
+	}
 
 	return nil
 }
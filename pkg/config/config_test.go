@@ -1,11 +1,15 @@
 package config
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/crc-org/vfkit/pkg/diskimage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -24,6 +28,181 @@ func TestAddIgnitionFile_OneOption(t *testing.T) {
 	assert.Equal(t, ignitionVsockPort, vm.Ignition.VsockPort)
 }
 
+func TestAddIgnitionFile_Options(t *testing.T) {
+	vm := &VirtualMachine{}
+	err := vm.AddIgnitionFileFromCmdLine("file1,fragment=users.ign,fragment=files.ign,shutdownAfterFetch,template,socketPath=/tmp/ignition.sock")
+	require.NoError(t, err)
+	assert.Equal(t, &Ignition{
+		ConfigPath:         "file1",
+		SocketPath:         "/tmp/ignition.sock",
+		Fragments:          []string{"users.ign", "files.ign"},
+		ShutdownAfterFetch: true,
+		Template:           true,
+		VsockPort:          ignitionVsockPort,
+	}, vm.Ignition)
+	args, err := vm.Ignition.ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--ignition", "file1,fragment=users.ign,fragment=files.ign,shutdownAfterFetch,template,socketPath=/tmp/ignition.sock"}, args)
+
+	// fragments can be used without a configuration file
+	vm = &VirtualMachine{}
+	require.NoError(t, vm.AddIgnitionFileFromCmdLine("fragment=users.ign"))
+	assert.Empty(t, vm.Ignition.ConfigPath)
+	assert.Equal(t, ignitionVsockPort, vm.Ignition.VsockPort)
+
+	vm = &VirtualMachine{}
+	assert.EqualError(t, vm.AddIgnitionFileFromCmdLine("shutdownAfterFetch"), "missing ignition configuration")
+	assert.EqualError(t, vm.AddIgnitionFileFromCmdLine("file1,foo=bar"), "unknown option for ignition parameter: foo")
+	assert.EqualError(t, vm.AddIgnitionFileFromCmdLine("file1,fragment="), "missing value for 'fragment' option of ignition parameter")
+
+	assert.EqualError(t, vm.AddIgnitionFileFromCmdLine("inline=e30"), "invalid 'inline' option of ignition parameter: illegal base64 data at input byte 0")
+	assert.EqualError(t, vm.AddIgnitionFileFromCmdLine("inline=Zm9v"), "invalid 'inline' option of ignition parameter: not a JSON document")
+
+	// inline configurations are base64-encoded on the command line
+	vm.Ignition = &Ignition{Config: json.RawMessage(`{"ignition":{"version":"3.4.0"}}`)}
+	args, err = vm.Ignition.ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--ignition", "inline=eyJpZ25pdGlvbiI6eyJ2ZXJzaW9uIjoiMy40LjAifX0="}, args)
+	vm = &VirtualMachine{}
+	require.NoError(t, vm.AddIgnitionFileFromCmdLine(args[1]))
+	assert.JSONEq(t, `{"ignition":{"version":"3.4.0"}}`, string(vm.Ignition.Config))
+}
+
+func TestIgnitionConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.ign")
+	require.NoError(t, os.WriteFile(configPath, []byte(`{"ignition":{"version":"3.4.0"}}`), 0600))
+	fragment := []byte(`{"ignition":{"version":"3.2.0"},"passwd":{"users":[{"name":"core"}]}}`)
+	fragmentPath := filepath.Join(tmpDir, "users.ign")
+	require.NoError(t, os.WriteFile(fragmentPath, fragment, 0600))
+	fragmentURL := "data:;base64," + base64.StdEncoding.EncodeToString(fragment)
+
+	vm := &VirtualMachine{Ignition: &Ignition{ConfigPath: configPath}}
+	config, err := vm.IgnitionConfig()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ignition":{"version":"3.4.0"}}`, string(config))
+
+	vm.Ignition.Fragments = []string{fragmentPath}
+	config, err = vm.IgnitionConfig()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ignition":{"version":"3.4.0","config":{"merge":[{"source":"`+fragmentURL+`"}]}}}`, string(config))
+
+	vm.Ignition = &Ignition{Config: json.RawMessage(`{"ignition":{"version":"3.3.0"}}`), Fragments: []string{fragmentPath}}
+	config, err = vm.IgnitionConfig()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ignition":{"version":"3.3.0","config":{"merge":[{"source":"`+fragmentURL+`"}]}}}`, string(config))
+
+	vm.Ignition = &Ignition{Fragments: []string{fragmentPath}}
+	config, err = vm.IgnitionConfig()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ignition":{"version":"3.2.0","config":{"merge":[{"source":"`+fragmentURL+`"}]}}}`, string(config))
+
+	vm.Ignition = &Ignition{ConfigPath: configPath, Config: json.RawMessage(`{}`)}
+	_, err = vm.IgnitionConfig()
+	require.EqualError(t, err, "ignition configuration cannot be both a file and inline")
+
+	emptyPath := filepath.Join(tmpDir, "empty.ign")
+	require.NoError(t, os.WriteFile(emptyPath, nil, 0600))
+	vm.Ignition = &Ignition{ConfigPath: emptyPath}
+	_, err = vm.IgnitionConfig()
+	require.EqualError(t, err, "empty ignition configuration: "+emptyPath)
+
+	// the configuration and its fragments are validated
+	vm.Ignition = &Ignition{Config: json.RawMessage(`{"ignition":{"version":"3.4.0"},"passwd":{"users":[{}]}}`)}
+	_, err = vm.IgnitionConfig()
+	require.EqualError(t, err, "invalid ignition configuration: missing 'passwd.users[0].name'")
+	invalidPath := filepath.Join(tmpDir, "invalid.ign")
+	require.NoError(t, os.WriteFile(invalidPath, []byte(`{"ignition":{"version":"2.2.0"}}`), 0600))
+	vm.Ignition = &Ignition{ConfigPath: configPath, Fragments: []string{fragmentPath, invalidPath}}
+	_, err = vm.IgnitionConfig()
+	require.EqualError(t, err, invalidPath+": invalid ignition configuration: unsupported 'ignition.version': 2.2.0 (supported versions: 3.0.0 to 3.5.0)")
+}
+
+func TestIgnitionConfigTemplate(t *testing.T) {
+	vm := &VirtualMachine{Name: "fedora"}
+	require.NoError(t, vm.AddDevicesFromCmdLine([]string{"virtio-net,nat,mac=5a:94:ef:e4:0c:ee", "virtio-vsock,port=2222,socketURL=/tmp/vsock.sock"}))
+	template := `{"ignition":{"version":"3.4.0"},"storage":{"files":[{"path":"/etc/vfkit","contents":{"source":"data:,{{ .Name }}-{{ index .MACAddresses 0 }}-{{ index .VsockPorts 0 }}"}}]}}`
+	vm.Ignition = &Ignition{Config: json.RawMessage(template)}
+
+	// templates are only rendered when enabled
+	config, err := vm.IgnitionConfig()
+	require.NoError(t, err)
+	assert.JSONEq(t, template, string(config))
+
+	vm.Ignition.Template = true
+	config, err = vm.IgnitionConfig()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ignition":{"version":"3.4.0"},"storage":{"files":[{"path":"/etc/vfkit","contents":{"source":"data:,fedora-5a:94:ef:e4:0c:ee-2222"}}]}}`, string(config))
+
+	vm.Ignition.Config = json.RawMessage(`{"ignition":{"version":"3.4.0"},"passwd":{"users":[{"name":"{{ .User }}"}]}}`)
+	_, err = vm.IgnitionConfig()
+	require.ErrorContains(t, err, "failed to render ignition template in 'passwd.users[0].name': ")
+}
+
+func TestIgnitionConfigTemplateGeneratedMAC(t *testing.T) {
+	vm := &VirtualMachine{}
+	require.NoError(t, vm.AddDevicesFromCmdLine([]string{"virtio-net,nat", "virtio-net,nat,mac=5a:94:ef:e4:0c:ee"}))
+	template := `{"ignition":{"version":"3.4.0"},"storage":{"files":[{"path":"/etc/vfkit","contents":{"source":"data:,{{ index .MACAddresses 0 }}-{{ index .MACAddresses 1 }}"}}]}}`
+	vm.Ignition = &Ignition{Config: json.RawMessage(template), Template: true}
+
+	// the indexes follow the order of the devices
+	config, err := vm.IgnitionConfig()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ignition":{"version":"3.4.0"},"storage":{"files":[{"path":"/etc/vfkit","contents":{"source":"data:,-5a:94:ef:e4:0c:ee"}}]}}`, string(config))
+
+	// vfkit generates the missing MAC addresses before rendering the
+	// configuration
+	vm.VirtioNetDevices()[0].MacAddress = net.HardwareAddr{0x5a, 0x94, 0xef, 0xe4, 0x0c, 0x01}
+	config, err = vm.IgnitionConfig()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ignition":{"version":"3.4.0"},"storage":{"files":[{"path":"/etc/vfkit","contents":{"source":"data:,5a:94:ef:e4:0c:01-5a:94:ef:e4:0c:ee"}}]}}`, string(config))
+}
+
+func TestTimeSyncOptions(t *testing.T) {
+	vm := &VirtualMachine{}
+	require.NoError(t, vm.AddTimeSyncFromCmdLine("vsockPort=1234,interval=5m,onBoot,onResume"))
+	assert.Equal(t, &TimeSync{
+		VsockPort: 1234,
+		Interval:  5 * time.Minute,
+		OnBoot:    true,
+		OnResume:  true,
+	}, vm.TimeSync())
+	args, err := vm.TimeSync().ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--timesync", "vsockPort=1234,interval=5m0s,onBoot,onResume"}, args)
+
+	vm = &VirtualMachine{}
+	require.NoError(t, vm.AddTimeSyncFromCmdLine("vsockPort=1234"))
+	assert.Equal(t, &TimeSync{VsockPort: 1234}, vm.TimeSync())
+
+	assert.EqualError(t, vm.AddTimeSyncFromCmdLine("interval=5m"), "missing 'vsockPort' option for timesync parameter")
+	assert.EqualError(t, vm.AddTimeSyncFromCmdLine("vsockPort=1234,interval=10ms"), "invalid 'interval' option for timesync parameter, it must be at least 1s: 10ms")
+	assert.EqualError(t, vm.AddTimeSyncFromCmdLine("vsockPort=1234,interval=5"), `time: missing unit in duration "5"`)
+	assert.EqualError(t, vm.AddTimeSyncFromCmdLine("vsockPort=1234,onBoot=false"), "unexpected value for 'onBoot' option of timesync parameter: false")
+}
+
+func TestHostSleepPolicy(t *testing.T) {
+	vm := &VirtualMachine{}
+	require.NoError(t, vm.AddHostSleepPolicyFromCmdLine(""))
+	assert.Empty(t, vm.OnHostSleep)
+	require.NoError(t, vm.AddHostSleepPolicyFromCmdLine("pause"))
+	assert.Equal(t, HostSleepPause, vm.OnHostSleep)
+	require.EqualError(t, vm.AddHostSleepPolicyFromCmdLine("stop"), `invalid --on-host-sleep value "stop", valid values are "none" and "pause"`)
+
+	vm.Bootloader = NewEFIBootloader("efi-store", false)
+	args, err := vm.ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--on-host-sleep", "pause"}, args[len(args)-2:])
+}
+
+func TestStateDirCmdLine(t *testing.T) {
+	vm := &VirtualMachine{Name: "fedora", StateDir: "/var/run/vfkit/fedora"}
+	vm.Bootloader = NewEFIBootloader("efi-store", false)
+	args, err := vm.ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--name", "fedora", "--state-dir", "/var/run/vfkit/fedora"}, args[:4])
+}
+
 func TestNetworkBlockDevice(t *testing.T) {
 	vm := &VirtualMachine{}
 	gpu, _ := VirtioGPUNew()
@@ -52,13 +231,8 @@ func TestVirtualMachine_ValidateBlockDevices(t *testing.T) {
 
 	tmpDir := t.TempDir()
 	imagePath := filepath.Join(tmpDir, "disk.qcow2")
-	size := "1G"
-
-	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", imagePath, size)
-	err := cmd.Run()
-
+	err := diskimage.CreateQcow2(imagePath, 1024*1024*1024, "")
 	require.NoError(t, err)
-	defer os.Remove(imagePath)
 
 	dev, err := VirtioBlkNew(imagePath)
 	require.NoError(t, err)
@@ -67,5 +241,62 @@ func TestVirtualMachine_ValidateBlockDevices(t *testing.T) {
 	err = dev.validate()
 	require.Error(t, err)
 
-	require.ErrorContains(t, err, "vfkit does not support qcow2 image format")
+	require.ErrorContains(t, err, "qcow2 images can only be used with 'type=nbd'")
+
+	dev.Type = DiskBackendNBD
+	require.NoError(t, dev.validate())
+}
+
+func TestVirtioBlkEphemeral(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, diskimage.Create(imagePath, 1024*1024))
+
+	dev, err := deviceFromCmdLine("virtio-blk,path=" + imagePath + ",ephemeral")
+	require.NoError(t, err)
+	assert.True(t, dev.(*VirtioBlk).Ephemeral)
+
+	_, err = deviceFromCmdLine("virtio-blk,path=" + imagePath + ",ephemeral=true")
+	require.EqualError(t, err, "unexpected value for virtio-blk 'ephemeral' option: true")
+	_, err = deviceFromCmdLine("virtio-blk,path=" + imagePath + ",type=dev,ephemeral")
+	require.EqualError(t, err, "'ephemeral' can only be used with disk images")
+}
+
+func TestDiskLockOption(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, diskimage.Create(imagePath, 1024*1024))
+
+	dev, err := deviceFromCmdLine("usb-mass-storage,path=" + imagePath + ",lock=off")
+	require.NoError(t, err)
+	assert.True(t, dev.(*USBMassStorage).NoLock)
+	dev, err = deviceFromCmdLine("virtio-blk,path=" + imagePath + ",lock=on")
+	require.NoError(t, err)
+	assert.False(t, dev.(*VirtioBlk).NoLock)
+
+	_, err = deviceFromCmdLine("nvme,path=" + imagePath + ",lock")
+	require.EqualError(t, err, "unexpected value for nvme 'lock' option: ")
+}
+
+func TestDiskCacheSyncOptions(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, diskimage.Create(imagePath, 1024*1024))
+
+	dev, err := deviceFromCmdLine("virtio-blk,path=" + imagePath + ",cache=automatic,sync=fsync")
+	require.NoError(t, err)
+	assert.Equal(t, DiskCachingAutomatic, dev.(*VirtioBlk).CachingMode)
+	assert.Equal(t, DiskSynchronizationFsync, dev.(*VirtioBlk).SynchronizationMode)
+	dev, err = deviceFromCmdLine("usb-mass-storage,path=" + imagePath + ",sync=none")
+	require.NoError(t, err)
+	assert.Equal(t, DiskSynchronizationNone, dev.(*USBMassStorage).SynchronizationMode)
+	dev, err = deviceFromCmdLine("nvme,path=/dev/disk4,type=dev,sync=none")
+	require.NoError(t, err)
+	assert.Equal(t, DiskSynchronizationNone, dev.(*NVMExpressController).SynchronizationMode)
+
+	_, err = deviceFromCmdLine("nvme,path=" + imagePath + ",cache=writeback")
+	require.EqualError(t, err, "unexpected value for disk 'cache' option: writeback, must be 'automatic', 'cached' or 'uncached'")
+	_, err = deviceFromCmdLine("nvme,path=" + imagePath + ",sync")
+	require.EqualError(t, err, "unexpected value for disk 'sync' option: , must be 'full', 'fsync' or 'none'")
+	_, err = deviceFromCmdLine("nvme,path=/dev/disk4,type=dev,cache=uncached")
+	require.EqualError(t, err, "'cache' can only be used with disk images")
+	_, err = deviceFromCmdLine("virtio-blk,path=" + imagePath + ",type=nbd,sync=fsync")
+	require.EqualError(t, err, "'sync=fsync' can only be used with disk images")
 }
@@ -0,0 +1,246 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	ign "github.com/crc-org/vfkit/pkg/ignition"
+)
+
+// Ignition configures the ignition configuration served to the virtual
+// machine. The configuration is read from ConfigPath, or is the inline Config,
+// and the configurations from the Fragments files are merged into it. They are
+// validated before the virtual machine starts.
+// When SocketPath is set, the configuration is also served on this unix
+// socket, so that host processes can check what the guest gets.
+type Ignition struct {
+	ConfigPath         string          `json:"configPath,omitempty"`
+	SocketPath         string          `json:"socketPath,omitempty"`
+	Config             json.RawMessage `json:"config,omitempty"`
+	Fragments          []string        `json:"fragments,omitempty"`
+	ShutdownAfterFetch bool            `json:"shutdownAfterFetch,omitempty"`
+	// Template enables the expansion of the templates of the configuration
+	// and its fragments, see ignition.Render for the available variables.
+	Template  bool   `json:"template,omitempty"`
+	VsockPort uint32 `json:"-"`
+}
+
+func IgnitionNew(configPath string, socketPath string) (*Ignition, error) {
+	if configPath == "" {
+		return nil, fmt.Errorf("config path cannot be empty")
+	}
+	return &Ignition{
+		ConfigPath: configPath,
+		SocketPath: socketPath,
+		VsockPort:  ignitionVsockPort,
+	}, nil
+}
+
+func (ignition *Ignition) ToCmdLine() ([]string, error) {
+	args := []string{}
+	if ignition.ConfigPath != "" {
+		args = append(args, ignition.ConfigPath)
+	}
+	if len(ignition.Config) != 0 {
+		// the configuration is base64-encoded as JSON uses ',' and '='
+		args = append(args, "inline="+base64.StdEncoding.EncodeToString(ignition.Config))
+	}
+	for _, fragment := range ignition.Fragments {
+		args = append(args, "fragment="+fragment)
+	}
+	if ignition.ShutdownAfterFetch {
+		args = append(args, "shutdownAfterFetch")
+	}
+	if ignition.Template {
+		args = append(args, "template")
+	}
+	if ignition.SocketPath != "" {
+		args = append(args, "socketPath="+ignition.SocketPath)
+	}
+	return []string{"--ignition", strings.Join(args, ",")}, nil
+}
+
+func (ignition *Ignition) FromOptions(options []option) error {
+	for _, option := range options {
+		switch option.key {
+		case "fragment":
+			if option.value == "" {
+				return fmt.Errorf("missing value for 'fragment' option of ignition parameter")
+			}
+			ignition.Fragments = append(ignition.Fragments, option.value)
+		case "shutdownAfterFetch":
+			if option.value != "" {
+				return fmt.Errorf("unexpected value for 'shutdownAfterFetch' option of ignition parameter: %s", option.value)
+			}
+			ignition.ShutdownAfterFetch = true
+		case "template":
+			if option.value != "" {
+				return fmt.Errorf("unexpected value for 'template' option of ignition parameter: %s", option.value)
+			}
+			ignition.Template = true
+		case "socketPath":
+			ignition.SocketPath = option.value
+		case "inline":
+			config, err := base64.StdEncoding.DecodeString(option.value)
+			if err != nil {
+				return fmt.Errorf("invalid 'inline' option of ignition parameter: %w", err)
+			}
+			if !json.Valid(config) {
+				return fmt.Errorf("invalid 'inline' option of ignition parameter: not a JSON document")
+			}
+			ignition.Config = config
+		default:
+			// the configuration file is the only option without a key
+			if option.value != "" {
+				return fmt.Errorf("unknown option for ignition parameter: %s", option.key)
+			}
+			if ignition.ConfigPath != "" {
+				return fmt.Errorf("ignition only accepts one option in command line argument")
+			}
+			ignition.ConfigPath = option.key
+		}
+	}
+
+	return ignition.validate()
+}
+
+func (ignition *Ignition) validate() error {
+	if ignition.ConfigPath != "" && len(ignition.Config) != 0 {
+		return fmt.Errorf("ignition configuration cannot be both a file and inline")
+	}
+	if ignition.ConfigPath == "" && len(ignition.Config) == 0 && len(ignition.Fragments) == 0 {
+		return fmt.Errorf("missing ignition configuration")
+	}
+	return nil
+}
+
+func (vm *VirtualMachine) AddIgnitionFileFromCmdLine(cmdlineOpts string) error {
+	if cmdlineOpts == "" {
+		return nil
+	}
+	ignition := Ignition{
+		VsockPort: ignitionVsockPort,
+	}
+	if err := ignition.FromOptions(strvToOptions(strings.Split(cmdlineOpts, ","))); err != nil {
+		return err
+	}
+	vm.Ignition = &ignition
+	return nil
+}
+
+// IgnitionConfig returns the ignition configuration served to the virtual
+// machine, with its fragments merged in, and which authorizes its SSH key for
+// the 'core' user. The configuration and its fragments are rendered when they
+// are templates, and validated.
+func (vm *VirtualMachine) IgnitionConfig() ([]byte, error) {
+	if vm.Ignition == nil {
+		return nil, fmt.Errorf("the virtual machine has no ignition configuration")
+	}
+	if err := vm.Ignition.validate(); err != nil {
+		return nil, err
+	}
+	var config []byte
+	switch {
+	case vm.Ignition.ConfigPath != "":
+		var err error
+		config, err = vm.ignitionConfigFile(vm.Ignition.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+	case len(vm.Ignition.Config) != 0:
+		var err error
+		config, err = vm.prepareIgnitionConfig(vm.Ignition.Config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fragments := make([][]byte, 0, len(vm.Ignition.Fragments))
+	for _, path := range vm.Ignition.Fragments {
+		fragment, err := vm.ignitionConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, fragment)
+	}
+	config, err := ign.Merge(config, fragments...)
+	if err != nil {
+		return nil, err
+	}
+
+	if vm.SSHKey == "" {
+		return config, nil
+	}
+	key, err := vm.sshAuthorizedKey()
+	if err != nil {
+		return nil, err
+	}
+	return ign.AddSSHAuthorizedKeys(config, ign.DefaultUser, key)
+}
+
+// ignitionConfigFile reads the ignition configuration file at path, and
+// prepares it with prepareIgnitionConfig
+func (vm *VirtualMachine) ignitionConfigFile(path string) ([]byte, error) {
+	config, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(config) == 0 {
+		return nil, fmt.Errorf("empty ignition configuration: %s", path)
+	}
+	config, err = vm.prepareIgnitionConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// prepareIgnitionConfig renders config when it's a template, and validates it
+func (vm *VirtualMachine) prepareIgnitionConfig(config []byte) ([]byte, error) {
+	if vm.Ignition.Template {
+		vars, err := vm.ignitionVariables()
+		if err != nil {
+			return nil, err
+		}
+		config, err = ign.Render(config, vars)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := ign.Validate(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ignitionVariables returns the values of the variables of the ignition
+// configuration templates. The MAC addresses follow the order of the
+// virtio-net devices, the address of a device is empty until vfkit generates
+// it when creating the virtual machine.
+func (vm *VirtualMachine) ignitionVariables() (ign.Variables, error) {
+	vars := ign.Variables{
+		Name:         vm.Name,
+		MACAddresses: []string{},
+		VsockPorts:   []uint32{},
+	}
+	for _, dev := range vm.VirtioNetDevices() {
+		mac := ""
+		if len(dev.MacAddress) != 0 {
+			mac = dev.MacAddress.String()
+		}
+		vars.MACAddresses = append(vars.MACAddresses, mac)
+	}
+	for _, dev := range vm.VirtioVsockDevices() {
+		vars.VsockPorts = append(vars.VsockPorts, dev.Port)
+	}
+	if vm.SSHKey != "" {
+		key, err := vm.sshAuthorizedKey()
+		if err != nil {
+			return ign.Variables{}, err
+		}
+		vars.SSHKey = key
+	}
+	return vars, nil
+}
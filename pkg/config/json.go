@@ -15,6 +15,7 @@ const (
 	// Bootloader kinds
 	efiBootloader   vmComponentKind = "efiBootloader"
 	linuxBootloader vmComponentKind = "linuxBootloader"
+	ukiBootloader   vmComponentKind = "ukiBootloader"
 
 	// VirtIO device kinds
 	vfNet          vmComponentKind = "virtionet"
@@ -63,6 +64,12 @@ func unmarshalBootloader(rawMsg json.RawMessage) (Bootloader, error) {
 		if err == nil {
 			bootloader = &linux
 		}
+	case ukiBootloader:
+		var uki UKIBootloader
+		err = json.Unmarshal(rawMsg, &uki)
+		if err == nil {
+			bootloader = &uki
+		}
 	default:
 		err = fmt.Errorf("unknown 'kind' field: '%s'", kind)
 	}
@@ -99,6 +106,10 @@ func unmarshalIgnition(rawMsg json.RawMessage) (Ignition, error) {
 	if err != nil {
 		return Ignition{}, err
 	}
+	// the vsock port is not serialized, it's always the default one
+	if ignition.VsockPort == 0 {
+		ignition.VsockPort = ignitionVsockPort
+	}
 
 	return ignition, nil
 }
@@ -124,8 +135,8 @@ func unmarshalVirtioNet(rawMsg json.RawMessage) (*VirtioNet, error) {
 		}
 		dev.VirtioNet.MacAddress = macAddr
 	}
-	// vfkitMagic is only useful in combination with unixSocketPath
-	if dev.UnixSocketPath == "" {
+	// vfkitMagic is only useful in combination with unixgram sockets
+	if dev.UnixSocketPath == "" || dev.Type == VirtioNetUnixstream {
 		dev.VfkitMagic = false
 	}
 	return &dev.VirtioNet, nil
@@ -242,6 +253,18 @@ func (vm *VirtualMachine) UnmarshalJSON(b []byte) error {
 			if err == nil {
 				vm.Ignition = &ignition
 			}
+		case "cloudInit":
+			err = json.Unmarshal(*rawMsg, &vm.CloudInit)
+		case "name":
+			err = json.Unmarshal(*rawMsg, &vm.Name)
+		case "sshKey":
+			err = json.Unmarshal(*rawMsg, &vm.SSHKey)
+		case "metadataService":
+			err = json.Unmarshal(*rawMsg, &vm.MetadataService)
+		case "onHostSleep":
+			err = json.Unmarshal(*rawMsg, &vm.OnHostSleep)
+		case "stateDir":
+			err = json.Unmarshal(*rawMsg, &vm.StateDir)
 		}
 
 		if err != nil {
@@ -273,6 +296,17 @@ func (bootloader *LinuxBootloader) MarshalJSON() ([]byte, error) {
 	})
 }
 
+func (bootloader *UKIBootloader) MarshalJSON() ([]byte, error) {
+	type blWithKind struct {
+		jsonKind
+		UKIBootloader
+	}
+	return json.Marshal(blWithKind{
+		jsonKind:      kind(ukiBootloader),
+		UKIBootloader: *bootloader,
+	})
+}
+
 type virtioNetForMarshalling struct {
 	VirtioNet
 	MacAddress string `json:"macAddress,omitempty"`
@@ -41,11 +41,14 @@ func fillStruct(t *testing.T, obj interface{}, skipFields []string) {
 			// ignore the embedded struct, reflect.VisibleFields iterates over its fields
 		case reflect.Slice:
 			elemKind := fieldVal.Type().Elem().Kind()
-			if elemKind != reflect.Uint8 {
-				// SetBytes will panic on non-uint8 slices
+			switch elemKind {
+			case reflect.Uint8:
+				fieldVal.SetBytes([]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55})
+			case reflect.String:
+				fieldVal.Set(reflect.ValueOf([]string{field.Name}))
+			default:
 				t.Fatalf("unsupported slice element kind '%s' for %s", elemKind, typeName)
 			}
-			fieldVal.SetBytes([]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55})
 		default:
 			t.Fatalf("unknown field kind '%s' for %s", fieldVal.Kind(), typeName)
 		}
@@ -66,6 +69,40 @@ var jsonTests = map[string]jsonTest{
 		newVM:        newUEFIVM,
 		expectedJSON: `{"vcpus":3,"memoryBytes":4194304000,"bootloader":{"kind":"efiBootloader","efiVariableStorePath":"/variable-store","createVariableStore":false}}`,
 	},
+	"TestUKIVM": {
+		newVM: func(_ *testing.T) *VirtualMachine {
+			return NewVirtualMachine(3, 4_000, NewUKIBootloader("/uki.efi", "console=hvc0"))
+		},
+		expectedJSON: `{"vcpus":3,"memoryBytes":4194304000,"bootloader":{"kind":"ukiBootloader","ukiPath":"/uki.efi","extraKernelCmdLine":"console=hvc0"}}`,
+	},
+	"TestAutoConsole": {
+		newVM: func(_ *testing.T) *VirtualMachine {
+			bootloader := NewLinuxBootloader("/vmlinuz", `root=LABEL=root dyndbg="file virtio.c +p"`, "/initrd")
+			bootloader.AutoConsole = true
+			return NewVirtualMachine(3, 4_000, bootloader)
+		},
+		expectedJSON: `{"vcpus":3,"memoryBytes":4194304000,"bootloader":{"kind":"linuxBootloader","vmlinuzPath":"/vmlinuz","initrdPath":"/initrd","kernelCmdLine":"root=LABEL=root dyndbg=\"file virtio.c +p\"","autoConsole":true}}`,
+	},
+	"TestVirtioNetCapture": {
+		newVM: func(t *testing.T) *VirtualMachine {
+			vm := newLinuxVM(t)
+			dev, err := deviceFromCmdLine("virtio-net,type=unixstream,path=/tmp/passt.sock,mac=00:11:22:33:44:55,pcap=/tmp/vm.pcap,pcapMaxSize=1")
+			require.NoError(t, err)
+			require.NoError(t, vm.AddDevice(dev))
+			return vm
+		},
+		expectedJSON: `{"vcpus":3,"memoryBytes":4194304000,"bootloader":{"kind":"linuxBootloader","vmlinuzPath":"/vmlinuz","initrdPath":"/initrd","kernelCmdLine":"console=hvc0"},"devices":[{"kind":"virtionet","nat":false,"type":"unixstream","unixSocketPath":"/tmp/passt.sock","capture":{"path":"/tmp/vm.pcap","maxSizeBytes":1048576},"macAddress":"00:11:22:33:44:55"}]}`,
+	},
+	"TestVirtioNetUsermode": {
+		newVM: func(t *testing.T) *VirtualMachine {
+			vm := newLinuxVM(t)
+			dev, err := deviceFromCmdLine("virtio-net,type=usermode,mac=00:11:22:33:44:55,forward=tcp:8080:80,forward=udp:0.0.0.0:5353:53")
+			require.NoError(t, err)
+			require.NoError(t, vm.AddDevice(dev))
+			return vm
+		},
+		expectedJSON: `{"vcpus":3,"memoryBytes":4194304000,"bootloader":{"kind":"linuxBootloader","vmlinuzPath":"/vmlinuz","initrdPath":"/initrd","kernelCmdLine":"console=hvc0"},"devices":[{"kind":"virtionet","nat":false,"type":"usermode","forwards":[{"protocol":"tcp","hostPort":8080,"guestPort":80},{"protocol":"udp","hostAddress":"0.0.0.0","hostPort":5353,"guestPort":53}],"macAddress":"00:11:22:33:44:55"}]}`,
+	},
 	"TestTimeSync": {
 		newVM: func(t *testing.T) *VirtualMachine {
 			vm := newLinuxVM(t)
@@ -82,10 +119,50 @@ var jsonTests = map[string]jsonTest{
 			ignition, err := IgnitionNew("config", "socket")
 			require.NoError(t, err)
 			vm.Ignition = ignition
-			ignition.VsockPort = 0 // slight hack for the test to pass as VsockPort is not serialized
 			return vm
 		},
-		expectedJSON: `{"vcpus":3,"memoryBytes":4194304000,"bootloader":{"kind":"linuxBootloader","vmlinuzPath":"/vmlinuz","initrdPath":"/initrd","kernelCmdLine":"console=hvc0"}, "ignition":{"kind":"ignition","configPath":"config"}}`,
+		expectedJSON: `{"vcpus":3,"memoryBytes":4194304000,"bootloader":{"kind":"linuxBootloader","vmlinuzPath":"/vmlinuz","initrdPath":"/initrd","kernelCmdLine":"console=hvc0"}, "ignition":{"kind":"ignition","configPath":"config","socketPath":"socket"}}`,
+	},
+	"TestInlineIgnition": {
+		newVM: func(t *testing.T) *VirtualMachine {
+			vm := newLinuxVM(t)
+			vm.Ignition = &Ignition{
+				Config:             json.RawMessage(`{"ignition":{"version":"3.4.0"}}`),
+				Fragments:          []string{"users.ign"},
+				ShutdownAfterFetch: true,
+				// the default port is set when unmarshalling
+				VsockPort: ignitionVsockPort,
+			}
+			return vm
+		},
+		expectedJSON: `{"vcpus":3,"memoryBytes":4194304000,"bootloader":{"kind":"linuxBootloader","vmlinuzPath":"/vmlinuz","initrdPath":"/initrd","kernelCmdLine":"console=hvc0"}, "ignition":{"kind":"ignition","config":{"ignition":{"version":"3.4.0"}},"fragments":["users.ign"],"shutdownAfterFetch":true}}`,
+	},
+	"TestCloudInit": {
+		newVM: func(t *testing.T) *VirtualMachine {
+			vm := newLinuxVM(t)
+			vm.CloudInit = &CloudInit{
+				Files:    []string{"/cloud-init/user-data"},
+				MetaData: "instance-id: fedora\n",
+			}
+			return vm
+		},
+		expectedJSON: `{"vcpus":3,"memoryBytes":4194304000,"bootloader":{"kind":"linuxBootloader","vmlinuzPath":"/vmlinuz","initrdPath":"/initrd","kernelCmdLine":"console=hvc0"},"cloudInit":{"files":["/cloud-init/user-data"],"metaData":"instance-id: fedora\n"}}`,
+	},
+	"TestSSHKey": {
+		newVM: func(t *testing.T) *VirtualMachine {
+			vm := newLinuxVM(t)
+			require.NoError(t, vm.AddSSHKeyFromCmdLine("auto"))
+			return vm
+		},
+		expectedJSON: `{"vcpus":3,"memoryBytes":4194304000,"bootloader":{"kind":"linuxBootloader","vmlinuzPath":"/vmlinuz","initrdPath":"/initrd","kernelCmdLine":"console=hvc0"},"sshKey":"auto"}`,
+	},
+	"TestMetadataService": {
+		newVM: func(t *testing.T) *VirtualMachine {
+			vm := newLinuxVM(t)
+			require.NoError(t, vm.AddMetadataServiceFromCmdLine("vsockPort=1025,hostname=fedora,tag.role=web"))
+			return vm
+		},
+		expectedJSON: `{"vcpus":3,"memoryBytes":4194304000,"bootloader":{"kind":"linuxBootloader","vmlinuzPath":"/vmlinuz","initrdPath":"/initrd","kernelCmdLine":"console=hvc0"},"metadataService":{"vsockPort":1025,"hostname":"fedora","tags":{"role":"web"}}}`,
 	},
 	"TestVirtioRNG": {
 		newVM: func(t *testing.T) *VirtualMachine {
@@ -223,8 +300,17 @@ var jsonStabilityTests = map[string]jsonStabilityTest{
 
 			return vm
 		},
-		skipFields:   []string{"Bootloader", "Devices", "Timesync", "Ignition", "Nested", "PidFile"},
-		expectedJSON: `{"vcpus":3,"memoryBytes":3,"bootloader":{"kind":"linuxBootloader","vmlinuzPath":"/vmlinuz","kernelCmdLine":"console=hvc0","initrdPath":"/initrd"},"devices":[{"kind":"virtiorng"}],"timesync":{"vsockPort":1234}}`,
+		skipFields:   []string{"Bootloader", "Devices", "Timesync", "Ignition", "CloudInit", "MetadataService", "Nested", "PidFile"},
+		expectedJSON: `{"vcpus":3,"memoryBytes":3,"bootloader":{"kind":"linuxBootloader","vmlinuzPath":"/vmlinuz","kernelCmdLine":"console=hvc0","initrdPath":"/initrd"},"devices":[{"kind":"virtiorng"}],"timesync":{"vsockPort":1234},"sshKey":"SSHKey","name":"Name","onHostSleep":"OnHostSleep","stateDir":"StateDir"}`,
+	},
+	"CloudInit": {
+		obj:          &CloudInit{},
+		expectedJSON: `{"files":["Files"],"userData":"UserData","metaData":"MetaData","networkConfig":"NetworkConfig","vendorData":"VendorData","generateNetworkConfig":true}`,
+	},
+	"MetadataService": {
+		obj:          &MetadataService{},
+		skipFields:   []string{"Tags"},
+		expectedJSON: `{"vsockPort":3,"instanceID":"InstanceID","hostname":"Hostname"}`,
 	},
 	"RosettaShare": {
 		obj:          &RosettaShare{},
@@ -240,8 +326,8 @@ var jsonStabilityTests = map[string]jsonStabilityTest{
 	},
 	"VirtioNet": {
 		obj:          &VirtioNet{},
-		skipFields:   []string{"Socket"},
-		expectedJSON: `{"kind":"virtionet","nat":true,"unixSocketPath":"UnixSocketPath","vfkitMagic":true,"macAddress":"00:11:22:33:44:55"}`,
+		skipFields:   []string{"Socket", "Routes", "Capture", "Forwards"},
+		expectedJSON: `{"kind":"virtionet","nat":true,"type":"Type","unixSocketPath":"UnixSocketPath","vfkitMagic":true,"runtimeCapture":true,"macAddress":"00:11:22:33:44:55","addresses":["Addresses"],"gateway":"Gateway","nameservers":["Nameservers"]}`,
 	},
 	"VirtioRNG": {
 		obj:          &VirtioRng{},
@@ -278,43 +364,53 @@ var jsonStabilityTests = map[string]jsonStabilityTest{
 			blk, err := VirtioBlkNew("")
 			require.NoError(t, err)
 			blk.Type = DiskBackendImage
+			blk.CachingMode = DiskCachingCached
+			blk.SynchronizationMode = DiskSynchronizationFull
 			return blk
 		},
 
-		skipFields:   []string{"DevName", "URI", "Type"},
-		expectedJSON: `{"kind":"virtioblk","devName":"virtio-blk","imagePath":"ImagePath","readOnly":true,"type":"image","deviceIdentifier":"DeviceIdentifier"}`,
+		skipFields:   []string{"DevName", "URI", "Type", "CachingMode", "SynchronizationMode"},
+		expectedJSON: `{"kind":"virtioblk","devName":"virtio-blk","imagePath":"ImagePath","readOnly":true,"type":"image","cachingMode":"cached","synchronizationMode":"full","noLock":true,"deviceIdentifier":"DeviceIdentifier","ephemeral":true}`,
 	},
 	"USBMassStorage": {
 		newObjectFunc: func(t *testing.T) any {
 			usb, err := USBMassStorageNew("")
 			require.NoError(t, err)
 			usb.Type = DiskBackendImage
+			usb.CachingMode = DiskCachingCached
+			usb.SynchronizationMode = DiskSynchronizationFull
 			return usb
 		},
-		skipFields:   []string{"DevName", "URI", "Type"},
-		expectedJSON: `{"kind":"usbmassstorage","devName":"usb-mass-storage","imagePath":"ImagePath","readOnly":true,"type":"image"}`,
+		skipFields:   []string{"DevName", "URI", "Type", "CachingMode", "SynchronizationMode"},
+		expectedJSON: `{"kind":"usbmassstorage","devName":"usb-mass-storage","imagePath":"ImagePath","readOnly":true,"type":"image","cachingMode":"cached","synchronizationMode":"full","noLock":true}`,
 	},
 	"NVMExpressController": {
 		newObjectFunc: func(t *testing.T) any {
 			nvme, err := NVMExpressControllerNew("")
 			require.NoError(t, err)
 			nvme.Type = DiskBackendImage
+			nvme.CachingMode = DiskCachingCached
+			nvme.SynchronizationMode = DiskSynchronizationFull
 			return nvme
 		},
-		skipFields:   []string{"DevName", "URI", "Type"},
-		expectedJSON: `{"kind":"nvme","devName":"nvme","imagePath":"ImagePath","readOnly":true,"type":"image"}`,
+		skipFields:   []string{"DevName", "URI", "Type", "CachingMode", "SynchronizationMode"},
+		expectedJSON: `{"kind":"nvme","devName":"nvme","imagePath":"ImagePath","readOnly":true,"type":"image","cachingMode":"cached","synchronizationMode":"full","noLock":true}`,
 	},
 	"LinuxBootloader": {
 		obj:          &LinuxBootloader{},
-		expectedJSON: `{"kind":"linuxBootloader","vmlinuzPath":"VmlinuzPath","kernelCmdLine":"KernelCmdLine","initrdPath":"InitrdPath"}`,
+		expectedJSON: `{"kind":"linuxBootloader","vmlinuzPath":"VmlinuzPath","kernelCmdLine":"KernelCmdLine","initrdPath":"InitrdPath","fromDisk":"FromDisk","partition":3,"autoConsole":true}`,
 	},
 	"EFIBootloader": {
 		obj:          &EFIBootloader{},
 		expectedJSON: `{"kind":"efiBootloader","efiVariableStorePath":"EFIVariableStorePath","createVariableStore":true}`,
 	},
+	"UKIBootloader": {
+		obj:          &UKIBootloader{},
+		expectedJSON: `{"kind":"ukiBootloader","ukiPath":"UKIPath","extraKernelCmdLine":"ExtraKernelCmdLine","autoConsole":true}`,
+	},
 	"TimeSync": {
 		obj:          &TimeSync{},
-		expectedJSON: `{"vsockPort":3}`,
+		expectedJSON: `{"vsockPort":3,"interval":2,"onBoot":true,"onResume":true}`,
 	},
 	"NetworkBlockDevice": {
 		newObjectFunc: func(t *testing.T) any {
@@ -0,0 +1,261 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// initArgsSeparator separates the kernel parameters from the arguments passed
+// to init on the kernel command line
+const initArgsSeparator = "--"
+
+// KernelParam is a parameter of the kernel command line, such as `quiet` or
+// `console=hvc0`.
+type KernelParam struct {
+	Key   string
+	Value string
+	// HasValue is false for parameters without a '=' sign, such as `quiet`
+	HasValue bool
+}
+
+func (param KernelParam) String() string {
+	if !param.HasValue {
+		return quoteKernelArg(param.Key)
+	}
+	return param.Key + "=" + quoteKernelArg(param.Value)
+}
+
+// quoteKernelArg adds double quotes around arg if it contains whitespace. The
+// kernel has no escaping mechanism, so arg must not contain double quotes.
+func quoteKernelArg(arg string) string {
+	if arg == "" || !strings.ContainsAny(arg, " \t\n") {
+		return arg
+	}
+	return `"` + arg + `"`
+}
+
+// KernelCmdLine is a Linux kernel command line, parsed as a list of
+// parameters so that they can be added, overridden or removed without string
+// manipulations. Parameters can be repeated, for example when several
+// `console=` parameters are used. Arguments following `--` are passed to init
+// and are kept unchanged.
+//
+// It is marshalled to JSON as a string.
+type KernelCmdLine struct {
+	params   []KernelParam
+	initArgs []string
+}
+
+// ParseKernelCmdLine parses cmdline using the same rules as the kernel:
+// parameters are separated by whitespace, and values containing whitespace
+// can be enclosed in double quotes, such as `dyndbg="file foo.c +p"`.
+func ParseKernelCmdLine(cmdline string) (*KernelCmdLine, error) {
+	args, err := splitKernelCmdLine(cmdline)
+	if err != nil {
+		return nil, err
+	}
+
+	kernelCmdLine := KernelCmdLine{}
+	for i, arg := range args {
+		if arg == initArgsSeparator {
+			kernelCmdLine.initArgs = args[i+1:]
+			break
+		}
+		kernelCmdLine.params = append(kernelCmdLine.params, parseKernelParam(arg))
+	}
+	return &kernelCmdLine, nil
+}
+
+// splitKernelCmdLine splits cmdline on whitespace which is not enclosed in
+// double quotes. The quotes are kept in the returned arguments.
+func splitKernelCmdLine(cmdline string) ([]string, error) {
+	args := []string{}
+	builder := strings.Builder{}
+	withinQuotes := false
+	inArg := false
+	for _, c := range cmdline {
+		switch {
+		case c == '"':
+			withinQuotes = !withinQuotes
+		case !withinQuotes && (c == ' ' || c == '\t' || c == '\n'):
+			if inArg {
+				args = append(args, builder.String())
+				builder.Reset()
+				inArg = false
+			}
+			continue
+		}
+		builder.WriteRune(c)
+		inArg = true
+	}
+	if withinQuotes {
+		return nil, fmt.Errorf("mismatched \" in kernel command line: %s", cmdline)
+	}
+	if inArg {
+		args = append(args, builder.String())
+	}
+	return args, nil
+}
+
+// parseKernelParam removes the quotes from arg the same way as the kernel,
+// which accepts both `"key=some value"` and `key="some value"`
+func parseKernelParam(arg string) KernelParam {
+	if strings.HasPrefix(arg, `"`) {
+		arg = strings.TrimSuffix(arg[1:], `"`)
+	}
+	key, value, hasValue := strings.Cut(arg, "=")
+	if strings.HasPrefix(value, `"`) {
+		value = strings.TrimSuffix(value[1:], `"`)
+	}
+	return KernelParam{
+		Key:      key,
+		Value:    value,
+		HasValue: hasValue,
+	}
+}
+
+// Params returns the parameters of cmdline, in the order in which they are
+// passed to the kernel.
+func (cmdline *KernelCmdLine) Params() []KernelParam {
+	return append([]KernelParam{}, cmdline.params...)
+}
+
+// Has returns true if cmdline contains at least one parameter named key.
+func (cmdline *KernelCmdLine) Has(key string) bool {
+	return len(cmdline.Values(key)) != 0
+}
+
+// Get returns the value of the last parameter named key. When a parameter is
+// repeated, the kernel usually uses its last value.
+func (cmdline *KernelCmdLine) Get(key string) (string, bool) {
+	values := cmdline.Values(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
+
+// Values returns the values of all the parameters named key.
+func (cmdline *KernelCmdLine) Values(key string) []string {
+	values := []string{}
+	for _, param := range cmdline.params {
+		if param.Key == key {
+			values = append(values, param.Value)
+		}
+	}
+	return values
+}
+
+// Append adds the `key=value` parameter at the end of cmdline, before the
+// init arguments. Existing parameters named key are kept. When value is
+// empty, a parameter without value such as `quiet` is added.
+func (cmdline *KernelCmdLine) Append(key, value string) {
+	cmdline.params = append(cmdline.params, KernelParam{
+		Key:      key,
+		Value:    value,
+		HasValue: value != "",
+	})
+}
+
+// Set overrides the value of the parameter named key. The first parameter
+// named key is updated and the other ones are removed. The parameter is
+// appended if cmdline does not contain it.
+func (cmdline *KernelCmdLine) Set(key, value string) {
+	param := KernelParam{
+		Key:      key,
+		Value:    value,
+		HasValue: value != "",
+	}
+	params := []KernelParam{}
+	found := false
+	for _, p := range cmdline.params {
+		if p.Key != key {
+			params = append(params, p)
+			continue
+		}
+		if !found {
+			params = append(params, param)
+			found = true
+		}
+	}
+	if !found {
+		params = append(params, param)
+	}
+	cmdline.params = params
+}
+
+// Remove removes all the parameters named key from cmdline.
+func (cmdline *KernelCmdLine) Remove(key string) {
+	params := []KernelParam{}
+	for _, param := range cmdline.params {
+		if param.Key != key {
+			params = append(params, param)
+		}
+	}
+	cmdline.params = params
+}
+
+// AppendCmdLine appends the parameters and init arguments of other to
+// cmdline.
+func (cmdline *KernelCmdLine) AppendCmdLine(other *KernelCmdLine) {
+	cmdline.params = append(cmdline.params, other.params...)
+	cmdline.initArgs = append(cmdline.initArgs, other.initArgs...)
+}
+
+// String returns the kernel command line, as passed to the kernel.
+func (cmdline *KernelCmdLine) String() string {
+	args := []string{}
+	for _, param := range cmdline.params {
+		args = append(args, param.String())
+	}
+	if len(cmdline.initArgs) != 0 {
+		args = append(args, initArgsSeparator)
+		args = append(args, cmdline.initArgs...)
+	}
+	return strings.Join(args, " ")
+}
+
+func (cmdline *KernelCmdLine) MarshalText() ([]byte, error) {
+	return []byte(cmdline.String()), nil
+}
+
+func (cmdline *KernelCmdLine) UnmarshalText(text []byte) error {
+	parsed, err := ParseKernelCmdLine(string(text))
+	if err != nil {
+		return err
+	}
+	*cmdline = *parsed
+	return nil
+}
+
+// AddConsole appends a `console=` parameter for the serial devices in
+// devices, which are the devices of the virtual machine. Nothing is added
+// when there are no virtio-serial devices, or when cmdline already uses the
+// virtio console. The kernel uses the last `console=` parameter for
+// /dev/console, so the virtio console takes precedence over the consoles set
+// in disk images, such as `console=ttyS0`.
+func (cmdline *KernelCmdLine) AddConsole(devices []VirtioDevice) {
+	console := serialConsole(devices)
+	if console == "" {
+		return
+	}
+	for _, value := range cmdline.Values("console") {
+		if strings.HasPrefix(value, "hvc") {
+			return
+		}
+	}
+	cmdline.Append("console", console)
+}
+
+// serialConsole returns the name of the guest console device of the first
+// virtio-serial device in devices, or an empty string if there are none.
+// Serial ports and PTY consoles are both virtio consoles, which are named
+// hvc0, hvc1, ... in the guest.
+func serialConsole(devices []VirtioDevice) string {
+	for _, dev := range devices {
+		if _, ok := dev.(*VirtioSerial); ok {
+			return "hvc0"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKernelCmdLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmdline  string
+		params   []KernelParam
+		expected string
+	}{
+		{
+			name:     "empty",
+			cmdline:  "  ",
+			params:   []KernelParam{},
+			expected: "",
+		},
+		{
+			name:    "simple",
+			cmdline: "root=/dev/vda1  ro\tquiet",
+			params: []KernelParam{
+				{Key: "root", Value: "/dev/vda1", HasValue: true},
+				{Key: "ro"},
+				{Key: "quiet"},
+			},
+			expected: "root=/dev/vda1 ro quiet",
+		},
+		{
+			name:    "quoted value",
+			cmdline: `dyndbg="file virtio.c +p" console=ttyS0,115200n8`,
+			params: []KernelParam{
+				{Key: "dyndbg", Value: "file virtio.c +p", HasValue: true},
+				{Key: "console", Value: "ttyS0,115200n8", HasValue: true},
+			},
+			expected: `dyndbg="file virtio.c +p" console=ttyS0,115200n8`,
+		},
+		{
+			name:    "quoted parameter",
+			cmdline: `"dyndbg=file virtio.c +p" empty= ""`,
+			params: []KernelParam{
+				{Key: "dyndbg", Value: "file virtio.c +p", HasValue: true},
+				{Key: "empty", HasValue: true},
+				{},
+			},
+			expected: `dyndbg="file virtio.c +p" empty= `,
+		},
+		{
+			name:    "init arguments",
+			cmdline: "root=/dev/vda1 -- single root=keep",
+			params: []KernelParam{
+				{Key: "root", Value: "/dev/vda1", HasValue: true},
+			},
+			expected: "root=/dev/vda1 -- single root=keep",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmdline, err := ParseKernelCmdLine(test.cmdline)
+			require.NoError(t, err)
+			assert.Equal(t, test.params, cmdline.Params())
+			assert.Equal(t, test.expected, cmdline.String())
+		})
+	}
+
+	_, err := ParseKernelCmdLine(`root=/dev/vda1 dyndbg="file virtio.c`)
+	require.EqualError(t, err, `mismatched " in kernel command line: root=/dev/vda1 dyndbg="file virtio.c`)
+}
+
+func TestKernelCmdLineEdit(t *testing.T) {
+	cmdline, err := ParseKernelCmdLine("root=UUID=1234 console=tty1 ro console=ttyS0 -- single")
+	require.NoError(t, err)
+
+	assert.True(t, cmdline.Has("ro"))
+	assert.False(t, cmdline.Has("quiet"))
+	value, found := cmdline.Get("console")
+	assert.True(t, found)
+	assert.Equal(t, "ttyS0", value)
+	assert.Equal(t, []string{"tty1", "ttyS0"}, cmdline.Values("console"))
+	_, found = cmdline.Get("rootflags")
+	assert.False(t, found)
+
+	cmdline.Append("quiet", "")
+	cmdline.Append("console", "hvc0")
+	assert.Equal(t, "root=UUID=1234 console=tty1 ro console=ttyS0 quiet console=hvc0 -- single", cmdline.String())
+
+	cmdline.Set("console", "hvc1")
+	cmdline.Set("rootflags", "subvol=root")
+	assert.Equal(t, "root=UUID=1234 console=hvc1 ro quiet rootflags=subvol=root -- single", cmdline.String())
+
+	cmdline.Remove("ro")
+	cmdline.Remove("missing")
+	cmdline.Set("dyndbg", "file virtio.c +p")
+	assert.Equal(t, `root=UUID=1234 console=hvc1 quiet rootflags=subvol=root dyndbg="file virtio.c +p" -- single`, cmdline.String())
+
+	other, err := ParseKernelCmdLine("rw -- emergency")
+	require.NoError(t, err)
+	cmdline.AppendCmdLine(other)
+	assert.Equal(t, `root=UUID=1234 console=hvc1 quiet rootflags=subvol=root dyndbg="file virtio.c +p" rw -- single emergency`, cmdline.String())
+}
+
+func TestKernelCmdLineJSON(t *testing.T) {
+	cmdline, err := ParseKernelCmdLine(`root=LABEL=root dyndbg="file virtio.c +p"`)
+	require.NoError(t, err)
+	data, err := json.Marshal(cmdline)
+	require.NoError(t, err)
+	assert.Equal(t, `"root=LABEL=root dyndbg=\"file virtio.c +p\""`, string(data))
+
+	var unmarshalled KernelCmdLine
+	require.NoError(t, json.Unmarshal(data, &unmarshalled))
+	assert.Equal(t, cmdline, &unmarshalled)
+}
+
+func TestKernelCmdLineAddConsole(t *testing.T) {
+	serial, err := VirtioSerialNew("/serial.log")
+	require.NoError(t, err)
+	rng, err := VirtioRngNew()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		cmdline  string
+		devices  []VirtioDevice
+		expected string
+	}{
+		{
+			name:     "no serial device",
+			cmdline:  "root=/dev/vda1",
+			devices:  []VirtioDevice{rng},
+			expected: "root=/dev/vda1",
+		},
+		{
+			name:     "serial device",
+			cmdline:  "root=/dev/vda1",
+			devices:  []VirtioDevice{rng, serial},
+			expected: "root=/dev/vda1 console=hvc0",
+		},
+		{
+			name:     "other consoles",
+			cmdline:  "root=/dev/vda1 console=tty1 console=ttyS0,115200n8",
+			devices:  []VirtioDevice{serial},
+			expected: "root=/dev/vda1 console=tty1 console=ttyS0,115200n8 console=hvc0",
+		},
+		{
+			name:     "existing virtio console",
+			cmdline:  "console=hvc0 root=/dev/vda1",
+			devices:  []VirtioDevice{serial},
+			expected: "console=hvc0 root=/dev/vda1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmdline, err := ParseKernelCmdLine(test.cmdline)
+			require.NoError(t, err)
+			cmdline.AddConsole(test.devices)
+			assert.Equal(t, test.expected, cmdline.String())
+		})
+	}
+}
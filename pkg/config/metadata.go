@@ -0,0 +1,134 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/crc-org/vfkit/pkg/cloudinit"
+	"github.com/crc-org/vfkit/pkg/metadata"
+)
+
+// MetadataService serves information about the virtual machine to the guest
+// over HTTP on a vsock port: its instance ID, hostname, SSH key, cloud-init
+// configuration and custom key/values (Tags).
+// The instance ID defaults to the one vfkit generates for cloud-init, and the
+// hostname to 'vfkit'.
+type MetadataService struct {
+	VsockPort  uint32            `json:"vsockPort"`
+	InstanceID string            `json:"instanceID,omitempty"`
+	Hostname   string            `json:"hostname,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+func (svc *MetadataService) ToCmdLine() ([]string, error) {
+	args := []string{fmt.Sprintf("vsockPort=%d", svc.VsockPort)}
+	if svc.InstanceID != "" {
+		args = append(args, "instanceID="+svc.InstanceID)
+	}
+	if svc.Hostname != "" {
+		args = append(args, "hostname="+svc.Hostname)
+	}
+	for _, key := range slices.Sorted(maps.Keys(svc.Tags)) {
+		args = append(args, fmt.Sprintf("tag.%s=%s", key, svc.Tags[key]))
+	}
+	return []string{"--metadata-service", strings.Join(args, ",")}, nil
+}
+
+func (svc *MetadataService) FromOptions(options []option) error {
+	for _, option := range options {
+		switch option.key {
+		case "vsockPort":
+			vsockPort, err := strconv.ParseUint(option.value, 10, 32)
+			if err != nil {
+				return err
+			}
+			svc.VsockPort = uint32(vsockPort)
+		case "instanceID":
+			svc.InstanceID = option.value
+		case "hostname":
+			svc.Hostname = option.value
+		default:
+			key, ok := strings.CutPrefix(option.key, "tag.")
+			if !ok {
+				return fmt.Errorf("unknown option for metadata service parameter: %s", option.key)
+			}
+			if svc.Tags == nil {
+				svc.Tags = map[string]string{}
+			}
+			svc.Tags[key] = option.value
+		}
+	}
+
+	return svc.validate()
+}
+
+func (svc *MetadataService) validate() error {
+	if svc.VsockPort == 0 {
+		return fmt.Errorf("missing 'vsockPort' option for metadata service parameter")
+	}
+	for key := range svc.Tags {
+		if key == "" || strings.Contains(key, "/") {
+			return fmt.Errorf("invalid metadata service tag name: %q", key)
+		}
+	}
+	return nil
+}
+
+// AddMetadataServiceFromCmdLine enables the metadata service of the virtual
+// machine from the --metadata-service command line option.
+func (vm *VirtualMachine) AddMetadataServiceFromCmdLine(cmdlineOpts string) error {
+	if cmdlineOpts == "" {
+		return nil
+	}
+	var svc MetadataService
+	if err := svc.FromOptions(strvToOptions(strings.Split(cmdlineOpts, ","))); err != nil {
+		return err
+	}
+	vm.MetadataService = &svc
+	return nil
+}
+
+// InstanceMetadata returns the metadata served by the metadata service of the
+// virtual machine.
+func (vm *VirtualMachine) InstanceMetadata() (*metadata.Metadata, error) {
+	svc := vm.MetadataService
+	if svc == nil {
+		return nil, fmt.Errorf("the virtual machine has no metadata service")
+	}
+	if err := svc.validate(); err != nil {
+		return nil, err
+	}
+	md := &metadata.Metadata{
+		InstanceID: svc.InstanceID,
+		Hostname:   svc.Hostname,
+		Tags:       svc.Tags,
+	}
+	files := map[string][]byte{}
+	if vm.CloudInit != nil {
+		var err error
+		files, err = vm.CloudInitConfigFiles()
+		if err != nil {
+			return nil, err
+		}
+		md.UserData = files[cloudinit.UserData]
+		md.VendorData = files[cloudinit.VendorData]
+		md.NetworkConfig = files[cloudinit.NetworkConfig]
+	}
+	if md.InstanceID == "" {
+		md.InstanceID = cloudinit.InstanceID(files)
+	}
+	if md.Hostname == "" {
+		md.Hostname = cloudinit.DefaultHostname
+	}
+	if vm.SSHKey != "" {
+		key, err := vm.sshAuthorizedKey()
+		if err != nil {
+			return nil, err
+		}
+		md.PublicKeys = []string{key}
+	}
+	return md, nil
+}
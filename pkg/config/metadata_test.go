@@ -0,0 +1,64 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/crc-org/vfkit/pkg/cloudinit"
+	"github.com/crc-org/vfkit/pkg/sshkey"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataServiceOptions(t *testing.T) {
+	vm := newLinuxVM(t)
+	require.NoError(t, vm.AddMetadataServiceFromCmdLine("vsockPort=1025,instanceID=i-0123,hostname=fedora,tag.role=web,tag.env=dev"))
+	assert.Equal(t, &MetadataService{
+		VsockPort:  1025,
+		InstanceID: "i-0123",
+		Hostname:   "fedora",
+		Tags:       map[string]string{"role": "web", "env": "dev"},
+	}, vm.MetadataService)
+	args, err := vm.MetadataService.ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--metadata-service", "vsockPort=1025,instanceID=i-0123,hostname=fedora,tag.env=dev,tag.role=web"}, args)
+
+	require.EqualError(t, vm.AddMetadataServiceFromCmdLine("hostname=fedora"), "missing 'vsockPort' option for metadata service parameter")
+	require.EqualError(t, vm.AddMetadataServiceFromCmdLine("vsockPort=1025,role=web"), "unknown option for metadata service parameter: role")
+	require.EqualError(t, vm.AddMetadataServiceFromCmdLine("vsockPort=1025,tag.a/b=c"), `invalid metadata service tag name: "a/b"`)
+}
+
+func TestInstanceMetadata(t *testing.T) {
+	tmpDir := t.TempDir()
+	keyPath := filepath.Join(tmpDir, "id_ed25519")
+	require.NoError(t, sshkey.Generate(keyPath))
+	key, err := sshkey.AuthorizedKey(keyPath)
+	require.NoError(t, err)
+	userData := filepath.Join(tmpDir, "user-data")
+	require.NoError(t, os.WriteFile(userData, []byte("#cloud-config\n"), 0600))
+
+	vm := newLinuxVM(t)
+	_, err = vm.InstanceMetadata()
+	require.EqualError(t, err, "the virtual machine has no metadata service")
+
+	require.NoError(t, vm.AddMetadataServiceFromCmdLine("vsockPort=1025,tag.role=web"))
+	md, err := vm.InstanceMetadata()
+	require.NoError(t, err)
+	assert.Equal(t, cloudinit.InstanceID(map[string][]byte{}), md.InstanceID)
+	assert.Equal(t, "vfkit", md.Hostname)
+	assert.Nil(t, md.UserData)
+	assert.Empty(t, md.PublicKeys)
+	assert.Equal(t, map[string]string{"role": "web"}, md.Tags)
+
+	// the cloud-init configuration and the SSH key are served too
+	require.NoError(t, vm.AddCloudInitFromCmdLine([]string{userData}, false))
+	require.NoError(t, vm.AddSSHKeyFromCmdLine(keyPath))
+	md, err = vm.InstanceMetadata()
+	require.NoError(t, err)
+	files, err := vm.CloudInitConfigFiles()
+	require.NoError(t, err)
+	assert.Equal(t, cloudinit.InstanceID(files), md.InstanceID)
+	assert.Equal(t, []byte("#cloud-config\n"), md.UserData)
+	assert.Equal(t, []string{key}, md.PublicKeys)
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/crc-org/vfkit/pkg/sshkey"
+)
+
+// AddSSHKeyFromCmdLine sets the SSH key of the virtual machine from the
+// --ssh-key command line option, which is either "auto" or the path of a
+// private key.
+func (vm *VirtualMachine) AddSSHKeyFromCmdLine(key string) error {
+	if key == "" {
+		return nil
+	}
+	if key != sshkey.Auto {
+		if _, err := os.Stat(key); err != nil {
+			return fmt.Errorf("invalid SSH key: %w", err)
+		}
+	}
+	vm.SSHKey = key
+	return nil
+}
+
+// SSHKeyPath returns the path of the private SSH key of the virtual machine,
+// or an empty string when it has none.
+func (vm *VirtualMachine) SSHKeyPath() (string, error) {
+	if vm.SSHKey == "" {
+		return "", nil
+	}
+	return sshkey.ResolvePath(vm.SSHKey)
+}
+
+// sshAuthorizedKey returns the public SSH key provisioned in the virtual
+// machine, the key pair is generated when needed
+func (vm *VirtualMachine) sshAuthorizedKey() (string, error) {
+	return sshkey.LoadOrGenerate(vm.SSHKey)
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/crc-org/vfkit/pkg/cloudinit"
+	"github.com/crc-org/vfkit/pkg/sshkey"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSHKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	keyPath := filepath.Join(tmpDir, "id_ed25519")
+	require.NoError(t, sshkey.Generate(keyPath))
+	key, err := sshkey.AuthorizedKey(keyPath)
+	require.NoError(t, err)
+
+	vm := newLinuxVM(t)
+	require.Error(t, vm.AddSSHKeyFromCmdLine(filepath.Join(tmpDir, "missing")))
+	require.NoError(t, vm.AddSSHKeyFromCmdLine(keyPath))
+	path, err := vm.SSHKeyPath()
+	require.NoError(t, err)
+	assert.Equal(t, keyPath, path)
+	args, err := vm.ToCmdLine()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--ssh-key", keyPath}, args[len(args)-2:])
+
+	// the key is added to the cloud-init meta-data
+	userData := filepath.Join(tmpDir, "user-data")
+	require.NoError(t, os.WriteFile(userData, []byte("#cloud-config\n"), 0600))
+	require.NoError(t, vm.AddCloudInitFromCmdLine([]string{userData}, false))
+	files, err := vm.CloudInitConfigFiles()
+	require.NoError(t, err)
+	assert.Regexp(t, "^instance-id: iid-vfkit-[0-9a-f]{16}\nlocal-hostname: vfkit\npublic-keys:\n  - \""+regexp.QuoteMeta(key)+"\"\n$", string(files[cloudinit.MetaData]))
+
+	vm.CloudInit.MetaData = "instance-id: fedora\npublic-keys:\n  - ssh-rsa AAAA\n"
+	_, err = vm.CloudInitConfigFiles()
+	require.EqualError(t, err, "failed to add the SSH key to cloud-init: meta-data already has public-keys")
+
+	// and to the ignition configuration
+	ignitionPath := filepath.Join(tmpDir, "config.ign")
+	require.NoError(t, os.WriteFile(ignitionPath, []byte(`{"ignition":{"version":"3.4.0"}}`), 0600))
+	require.NoError(t, vm.AddIgnitionFileFromCmdLine(ignitionPath))
+	config, err := vm.IgnitionConfig()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ignition":{"version":"3.4.0"},"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["`+key+`"]}]}}`, string(config))
+
+	vm.SSHKey = ""
+	config, err = vm.IgnitionConfig()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ignition":{"version":"3.4.0"}}`, string(config))
+}
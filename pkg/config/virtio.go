@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"math"
 	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
+
+	"go.podman.io/common/pkg/strongunits"
 )
 
 // The VirtioDevice interface is an interface which is implemented by all virtio devices.
@@ -64,6 +68,9 @@ type VirtioVsock struct {
 type VirtioBlk struct {
 	DiskStorageConfig
 	DeviceIdentifier string `json:"deviceIdentifier,omitempty"`
+	// Ephemeral disks use a copy-on-write clone of the disk image, which is
+	// discarded when vfkit exits
+	Ephemeral bool `json:"ephemeral,omitempty"`
 }
 
 type DirectorySharingConfig struct {
@@ -103,8 +110,147 @@ type VirtioNet struct {
 	// see https://github.com/Code-Hex/vz/blob/7f648b6fb9205d6f11792263d79876e3042c33ec/network.go#L113-L155
 	Socket *os.File `json:"socket,omitempty"`
 
-	UnixSocketPath string `json:"unixSocketPath,omitempty"`
-	VfkitMagic     bool   `json:"vfkitMagic,omitempty"`
+	// Type is the type of the UnixSocketPath socket, it defaults to
+	// VirtioNetUnixgram. With VirtioNetUsermode, the device is not
+	// connected to a socket.
+	Type           VirtioNetType `json:"type,omitempty"`
+	UnixSocketPath string        `json:"unixSocketPath,omitempty"`
+	VfkitMagic     bool          `json:"vfkitMagic,omitempty"`
+	// Capture writes the frames of the device to a capture file, it's only
+	// supported with socket-based devices
+	Capture *PacketCapture `json:"capture,omitempty"`
+	// RuntimeCapture relays the frames of unixgram and fd devices without
+	// Capture, so that their capture can be started with the REST API.
+	// The frames of the other devices are always relayed.
+	RuntimeCapture bool `json:"runtimeCapture,omitempty"`
+	// Forwards are the host ports forwarded to the guest, they are only
+	// supported with VirtioNetUsermode
+	Forwards []PortForward `json:"forwards,omitempty"`
+
+	// Guest network configuration, used when generating the cloud-init
+	// network-config. Addresses are in CIDR notation, the interface uses
+	// DHCP when Addresses is empty.
+	Addresses   []string       `json:"addresses,omitempty"`
+	Gateway     string         `json:"gateway,omitempty"`
+	Routes      []NetworkRoute `json:"routes,omitempty"`
+	Nameservers []string       `json:"nameservers,omitempty"`
+}
+
+// PacketCapture configures the capture of the frames of a virtio-net device
+type PacketCapture struct {
+	// Path is the capture file, it's in the pcapng format when its extension
+	// is .pcapng, and in the pcap format otherwise
+	Path string `json:"path"`
+	// MaxSize is the size after which the capture file is rotated, the
+	// file is never rotated when it's 0
+	MaxSize strongunits.B `json:"maxSizeBytes,omitempty"`
+	// MaxFiles is the number of capture files kept when rotating, all of
+	// them are kept when it's 0
+	MaxFiles uint `json:"maxFiles,omitempty"`
+}
+
+// VirtioNetType is the type of the socket a virtio-net device is connected to
+type VirtioNetType string
+
+const (
+	// VirtioNetUnixgram is a SOCK_DGRAM unix socket, each datagram is an
+	// ethernet frame
+	VirtioNetUnixgram VirtioNetType = "unixgram"
+	// VirtioNetUnixstream is a SOCK_STREAM unix socket, each ethernet frame
+	// is prefixed by its length as a 4-byte big-endian integer. This is the
+	// protocol of QEMU's `-netdev stream` and of passt.
+	VirtioNetUnixstream VirtioNetType = "unixstream"
+	// VirtioNetUsermode connects the device to a userspace network stack
+	// embedded in vfkit, which provides DHCP, DNS and NAT to the guest
+	VirtioNetUsermode VirtioNetType = "usermode"
+)
+
+// PortForward forwards a host port to a guest port
+type PortForward struct {
+	// Protocol is "tcp" or "udp"
+	Protocol string `json:"protocol"`
+	// HostAddress is the host address on which the forward listens, it
+	// defaults to 127.0.0.1
+	HostAddress string `json:"hostAddress,omitempty"`
+	HostPort    uint16 `json:"hostPort"`
+	GuestPort   uint16 `json:"guestPort"`
+}
+
+// defaultForwardHostAddress is the address on which the forwards listen when
+// their host address is not set
+const defaultForwardHostAddress = "127.0.0.1"
+
+// ParsePortForward parses a port forward in the PROTOCOL:[HOSTADDRESS:]HOSTPORT:GUESTPORT
+// format, for example tcp:8080:80 or udp:0.0.0.0:5353:53
+func ParsePortForward(str string) (PortForward, error) {
+	invalid := fmt.Errorf("invalid port forward: %s (expected PROTOCOL:[HOSTADDRESS:]HOSTPORT:GUESTPORT)", str)
+	protocol, rest, found := strings.Cut(str, ":")
+	if !found {
+		return PortForward{}, invalid
+	}
+	idx := strings.LastIndex(rest, ":")
+	if idx == -1 {
+		return PortForward{}, invalid
+	}
+	hostAddress, hostPort := "", rest[:idx]
+	if strings.Contains(hostPort, ":") {
+		var err error
+		hostAddress, hostPort, err = net.SplitHostPort(hostPort)
+		if err != nil {
+			return PortForward{}, invalid
+		}
+	}
+	forward := PortForward{Protocol: protocol, HostAddress: hostAddress}
+	for _, port := range []struct {
+		str   string
+		value *uint16
+	}{{hostPort, &forward.HostPort}, {rest[idx+1:], &forward.GuestPort}} {
+		value, err := strconv.ParseUint(port.str, 10, 16)
+		if err != nil {
+			return PortForward{}, invalid
+		}
+		*port.value = uint16(value) // #nosec G115 -- ParseUint checked it fits in 16 bits
+	}
+	return forward, forward.validate()
+}
+
+// HostAddressPort returns the host address and port on which the forward
+// listens
+func (forward *PortForward) HostAddressPort() string {
+	hostAddress := forward.HostAddress
+	if hostAddress == "" {
+		hostAddress = defaultForwardHostAddress
+	}
+	return net.JoinHostPort(hostAddress, strconv.FormatUint(uint64(forward.HostPort), 10))
+}
+
+func (forward *PortForward) String() string {
+	if forward.HostAddress == "" {
+		return fmt.Sprintf("%s:%d:%d", forward.Protocol, forward.HostPort, forward.GuestPort)
+	}
+	return fmt.Sprintf("%s:%s:%d", forward.Protocol, forward.HostAddressPort(), forward.GuestPort)
+}
+
+func (forward *PortForward) validate() error {
+	if forward.Protocol != "tcp" && forward.Protocol != "udp" {
+		return fmt.Errorf("unsupported protocol for port forward: %s (supported protocols are 'tcp' and 'udp')", forward.Protocol)
+	}
+	if forward.HostAddress != "" {
+		if _, err := netip.ParseAddr(forward.HostAddress); err != nil {
+			return fmt.Errorf("invalid host address for port forward: %w", err)
+		}
+	}
+	if forward.HostPort == 0 || forward.GuestPort == 0 {
+		return fmt.Errorf("invalid port forward %s: the ports must not be 0", forward.String())
+	}
+	return nil
+}
+
+// NetworkRoute is a static route of the guest network configuration. To is a
+// network in CIDR notation, Via is the address of the gateway.
+type NetworkRoute struct {
+	To  string `json:"to"`
+	Via string `json:"via"`
 }
 
 // VirtioSerial configures the virtual machine serial ports.
@@ -429,6 +575,12 @@ func (dev *VirtioNet) SetSocket(file *os.File) {
 	dev.Nat = false
 }
 
+// SetUsermode connects the device to the userspace network stack of vfkit
+func (dev *VirtioNet) SetUsermode() {
+	dev.Type = VirtioNetUsermode
+	dev.Nat = false
+}
+
 func (dev *VirtioNet) SetUnixSocketPath(path string) {
 	dev.UnixSocketPath = path
 	dev.Nat = false
@@ -445,10 +597,70 @@ func (dev *VirtioNet) validate() error {
 	if dev.Socket != nil && dev.UnixSocketPath != "" {
 		return fmt.Errorf("'fd' and 'unixSocketPath' cannot be set at the same time")
 	}
-	if !dev.Nat && dev.Socket == nil && dev.UnixSocketPath == "" {
+	if !dev.Nat && dev.Socket == nil && dev.UnixSocketPath == "" && dev.Type != VirtioNetUsermode {
 		return fmt.Errorf("one of 'nat' or 'fd' or 'unixSocketPath' must be set")
 	}
+	if dev.Capture != nil {
+		if dev.Capture.Path == "" {
+			return fmt.Errorf("'pcapMaxSize' and 'pcapMaxFiles' options require 'pcap' to be specified")
+		}
+		if dev.Nat {
+			return fmt.Errorf("'pcap' is not supported with 'nat', it requires a socket-based virtio-net device")
+		}
+	}
+	if dev.RuntimeCapture && dev.Nat {
+		return fmt.Errorf("'capture' is not supported with 'nat', it requires a socket-based virtio-net device")
+	}
+	switch dev.Type {
+	case "", VirtioNetUnixgram:
+	case VirtioNetUnixstream:
+		if dev.UnixSocketPath == "" {
+			return fmt.Errorf("'%s' type requires 'path' to be specified", dev.Type)
+		}
+	case VirtioNetUsermode:
+		if dev.Nat || dev.Socket != nil || dev.UnixSocketPath != "" {
+			return fmt.Errorf("'%s' type cannot be used with 'nat', 'fd' or 'path'", dev.Type)
+		}
+	default:
+		return fmt.Errorf("unsupported virtio-net type: %s", dev.Type)
+	}
+	if len(dev.Forwards) > 0 && dev.Type != VirtioNetUsermode {
+		return fmt.Errorf("'forward' option requires the '%s' type", VirtioNetUsermode)
+	}
+	for _, forward := range dev.Forwards {
+		if err := forward.validate(); err != nil {
+			return err
+		}
+	}
+
+	return dev.validateGuestConfig()
+}
 
+// validateGuestConfig checks the guest network configuration
+func (dev *VirtioNet) validateGuestConfig() error {
+	for _, address := range dev.Addresses {
+		if _, err := netip.ParsePrefix(address); err != nil {
+			return fmt.Errorf("invalid virtio-net address %q, it must be in CIDR notation: %w", address, err)
+		}
+	}
+	if dev.Gateway != "" {
+		if _, err := netip.ParseAddr(dev.Gateway); err != nil {
+			return fmt.Errorf("invalid virtio-net gateway: %w", err)
+		}
+	}
+	for _, route := range dev.Routes {
+		if _, err := netip.ParsePrefix(route.To); err != nil {
+			return fmt.Errorf("invalid virtio-net route destination %q, it must be in CIDR notation: %w", route.To, err)
+		}
+		if _, err := netip.ParseAddr(route.Via); err != nil {
+			return fmt.Errorf("invalid virtio-net route gateway: %w", err)
+		}
+	}
+	for _, nameserver := range dev.Nameservers {
+		if _, err := netip.ParseAddr(nameserver); err != nil {
+			return fmt.Errorf("invalid virtio-net DNS server: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -462,6 +674,10 @@ func (dev *VirtioNet) ToCmdLine() ([]string, error) {
 	switch {
 	case dev.Nat:
 		builder.WriteString(",nat")
+	case dev.Type == VirtioNetUnixstream:
+		fmt.Fprintf(&builder, ",type=%s,path=%s", dev.Type, dev.UnixSocketPath)
+	case dev.Type == VirtioNetUsermode:
+		fmt.Fprintf(&builder, ",type=%s", dev.Type)
 	case dev.UnixSocketPath != "":
 		if dev.VfkitMagic {
 			// Use the old commandline syntax for backwards compatibility
@@ -484,11 +700,46 @@ func (dev *VirtioNet) ToCmdLine() ([]string, error) {
 		fmt.Fprintf(&builder, ",mac=%s", dev.MacAddress)
 	}
 
+	for _, address := range dev.Addresses {
+		fmt.Fprintf(&builder, ",address=%s", address)
+	}
+	if dev.Gateway != "" {
+		fmt.Fprintf(&builder, ",gateway=%s", dev.Gateway)
+	}
+	for _, route := range dev.Routes {
+		fmt.Fprintf(&builder, ",route=%s@%s", route.To, route.Via)
+	}
+	for _, nameserver := range dev.Nameservers {
+		fmt.Fprintf(&builder, ",dns=%s", nameserver)
+	}
+	if dev.Capture != nil {
+		fmt.Fprintf(&builder, ",pcap=%s", dev.Capture.Path)
+		if dev.Capture.MaxSize != 0 {
+			fmt.Fprintf(&builder, ",pcapMaxSize=%d", roundToMiB(dev.Capture.MaxSize))
+		}
+		if dev.Capture.MaxFiles != 0 {
+			fmt.Fprintf(&builder, ",pcapMaxFiles=%d", dev.Capture.MaxFiles)
+		}
+	}
+	if dev.RuntimeCapture {
+		builder.WriteString(",capture")
+	}
+	for _, forward := range dev.Forwards {
+		fmt.Fprintf(&builder, ",forward=%s", forward.String())
+	}
+
 	return []string{"--device", builder.String()}, nil
 }
 
+func (dev *VirtioNet) packetCapture() *PacketCapture {
+	if dev.Capture == nil {
+		dev.Capture = &PacketCapture{}
+	}
+	return dev.Capture
+}
+
 func (dev *VirtioNet) FromOptions(options []option) error {
-	var hasType bool
+	var hasType, hasVfkitMagic bool
 	var typeOnlyOptions []string // Options that require type to be specified
 
 	if slices.ContainsFunc(options, func(opt option) bool {
@@ -522,8 +773,12 @@ func (dev *VirtioNet) FromOptions(options []option) error {
 		case "unixSocketPath":
 			dev.UnixSocketPath = option.value
 		case "type":
-			if option.value != "unixgram" {
-				return fmt.Errorf("unsupported virtio-net type: %s (only 'unixgram' is supported)", option.value)
+			switch VirtioNetType(option.value) {
+			case VirtioNetUnixgram:
+			case VirtioNetUnixstream, VirtioNetUsermode:
+				dev.Type = VirtioNetType(option.value)
+			default:
+				return fmt.Errorf("unsupported virtio-net type: %s (supported types are 'unixgram', 'unixstream' and 'usermode')", option.value)
 			}
 			hasType = true
 		case "path":
@@ -534,18 +789,63 @@ func (dev *VirtioNet) FromOptions(options []option) error {
 				return fmt.Errorf("invalid value for vfkitMagic: %s (expected on/off)", option.value)
 			}
 			dev.VfkitMagic = option.value == "on"
+			hasVfkitMagic = true
 		case "offloading":
 			if option.value != "off" {
 				return fmt.Errorf("invalid value for offloading: %s (only 'off' is supported)", option.value)
 			}
 			typeOnlyOptions = append(typeOnlyOptions, option.key)
+		case "address":
+			dev.Addresses = append(dev.Addresses, option.value)
+		case "gateway":
+			dev.Gateway = option.value
+		case "route":
+			to, via, found := strings.Cut(option.value, "@")
+			if !found {
+				return fmt.Errorf("invalid virtio-net route: %s (expected DESTINATION@GATEWAY)", option.value)
+			}
+			dev.Routes = append(dev.Routes, NetworkRoute{To: to, Via: via})
+		case "dns":
+			dev.Nameservers = append(dev.Nameservers, option.value)
+		case "pcap":
+			dev.packetCapture().Path = option.value
+		case "pcapMaxSize":
+			maxSize, err := strconv.ParseUint(option.value, 10, 64)
+			if err != nil || maxSize == 0 {
+				return fmt.Errorf("invalid value for pcapMaxSize: %s (expected a size in MiB)", option.value)
+			}
+			dev.packetCapture().MaxSize = strongunits.MiB(maxSize).ToBytes()
+		case "pcapMaxFiles":
+			maxFiles, err := strconv.ParseUint(option.value, 10, 32)
+			if err != nil || maxFiles == 0 {
+				return fmt.Errorf("invalid value for pcapMaxFiles: %s (expected a number of files)", option.value)
+			}
+			dev.packetCapture().MaxFiles = uint(maxFiles)
+		case "capture":
+			if option.value != "" {
+				return fmt.Errorf("unexpected value for virtio-net 'capture' option: %s", option.value)
+			}
+			dev.RuntimeCapture = true
+		case "forward":
+			forward, err := ParsePortForward(option.value)
+			if err != nil {
+				return err
+			}
+			dev.Forwards = append(dev.Forwards, forward)
 		default:
 			return fmt.Errorf("unknown option for virtio-net devices: %s", option.key)
 		}
 	}
 
 	// Validate type+path dependency and type-only options
-	if hasType && dev.UnixSocketPath == "" {
+	if dev.Type == VirtioNetUsermode {
+		if dev.UnixSocketPath != "" {
+			return fmt.Errorf("'path' option is not supported with the '%s' type", dev.Type)
+		}
+		if hasVfkitMagic {
+			return fmt.Errorf("'vfkitMagic' option is only supported with the 'unixgram' type")
+		}
+	} else if hasType && dev.UnixSocketPath == "" {
 		return fmt.Errorf("'type' option requires 'path' to be specified")
 	}
 
@@ -553,6 +853,14 @@ func (dev *VirtioNet) FromOptions(options []option) error {
 		return fmt.Errorf("'%s' option requires 'type' to be specified", typeOnlyOptions[0])
 	}
 
+	if dev.Type == VirtioNetUnixstream {
+		// the magic packet is a datagram, stream sockets don't need it
+		if hasVfkitMagic {
+			return fmt.Errorf("'vfkitMagic' option is only supported with the 'unixgram' type")
+		}
+		dev.VfkitMagic = false
+	}
+
 	return dev.validate()
 }
 
@@ -622,6 +930,11 @@ func (dev *VirtioBlk) FromOptions(options []option) error {
 		switch option.key {
 		case "deviceId":
 			dev.DeviceIdentifier = option.value
+		case "ephemeral":
+			if option.value != "" {
+				return fmt.Errorf("unexpected value for virtio-blk 'ephemeral' option: %s", option.value)
+			}
+			dev.Ephemeral = true
 		default:
 			unhandledOpts = append(unhandledOpts, option)
 		}
@@ -644,10 +957,16 @@ func (dev *VirtioBlk) ToCmdLine() ([]string, error) {
 	if dev.DeviceIdentifier != "" {
 		cmdLine[1] = fmt.Sprintf("%s,deviceId=%s", cmdLine[1], dev.DeviceIdentifier)
 	}
+	if dev.Ephemeral {
+		cmdLine[1] += ",ephemeral"
+	}
 	return cmdLine, nil
 }
 
 func (dev *VirtioBlk) validate() error {
+	if dev.Ephemeral && dev.Type == DiskBackendBlockDevice {
+		return fmt.Errorf("'ephemeral' can only be used with disk images")
+	}
 	imgPath := dev.ImagePath
 	file, err := os.Open(imgPath)
 	if err != nil {
@@ -659,8 +978,8 @@ func (dev *VirtioBlk) validate() error {
 	if err != nil {
 		return fmt.Errorf("failed to read the header of file %s: %v", imgPath, err)
 	}
-	if bytes.Equal(header, []byte(qcow2Header)) {
-		return fmt.Errorf("vfkit does not support qcow2 image format")
+	if bytes.Equal(header, []byte(qcow2Header)) && dev.Type != DiskBackendNBD {
+		return fmt.Errorf("qcow2 images can only be used with 'type=nbd', or converted to a raw image with 'vfkit disk convert %s %s.raw'", imgPath, strings.TrimSuffix(imgPath, filepath.Ext(imgPath)))
 	}
 	return nil
 }
@@ -920,13 +1239,71 @@ const (
 	/// Real block devices, like /dev/disk1s1
 	DiskBackendBlockDevice DiskBackendType = "dev"
 
+	/// Raw or qcow2 disk images served to the guest by vfkit's built-in NBD server
+	DiskBackendNBD DiskBackendType = "nbd"
+
 	/// If the value is empty, it defaults to image
 	DiskBackendDefault DiskBackendType = ""
 )
 
 func (typ DiskBackendType) IsValid() bool {
 	switch typ {
-	case DiskBackendImage, DiskBackendBlockDevice, DiskBackendDefault:
+	case DiskBackendImage, DiskBackendBlockDevice, DiskBackendNBD, DiskBackendDefault:
+		return true
+	default:
+		return false
+	}
+}
+
+// DiskCachingMode configures how the host caches the data of disk images.
+type DiskCachingMode string
+
+const (
+	/// Let the virtualization framework choose the caching mode
+	DiskCachingAutomatic DiskCachingMode = "automatic"
+
+	/// Cache the disk image data in the host page cache
+	DiskCachingCached DiskCachingMode = "cached"
+
+	/// Bypass the host page cache
+	DiskCachingUncached DiskCachingMode = "uncached"
+
+	/// If the value is empty, it defaults to cached
+	DiskCachingDefault DiskCachingMode = ""
+)
+
+func (mode DiskCachingMode) IsValid() bool {
+	switch mode {
+	case DiskCachingAutomatic, DiskCachingCached, DiskCachingUncached, DiskCachingDefault:
+		return true
+	default:
+		return false
+	}
+}
+
+// DiskSynchronizationMode configures how the data written by the guest is
+// synchronized with the permanent storage of the host when the guest flushes
+// its writes.
+type DiskSynchronizationMode string
+
+const (
+	/// Synchronize the data with the permanent storage of the host
+	DiskSynchronizationFull DiskSynchronizationMode = "full"
+
+	/// Only call fsync(2), the data may stay in the cache of the drive
+	DiskSynchronizationFsync DiskSynchronizationMode = "fsync"
+
+	/// Don't synchronize the data, data may be lost if the host crashes
+	DiskSynchronizationNone DiskSynchronizationMode = "none"
+
+	/// If the value is empty, it defaults to fsync for disk images and full
+	/// for block devices and the built-in NBD server
+	DiskSynchronizationDefault DiskSynchronizationMode = ""
+)
+
+func (mode DiskSynchronizationMode) IsValid() bool {
+	switch mode {
+	case DiskSynchronizationFull, DiskSynchronizationFsync, DiskSynchronizationNone, DiskSynchronizationDefault:
 		return true
 	default:
 		return false
@@ -935,8 +1312,13 @@ func (typ DiskBackendType) IsValid() bool {
 
 type DiskStorageConfig struct {
 	StorageConfig
-	ImagePath string          `json:"imagePath,omitempty"`
-	Type      DiskBackendType `json:"type,omitempty"`
+	ImagePath           string                  `json:"imagePath,omitempty"`
+	Type                DiskBackendType         `json:"type,omitempty"`
+	CachingMode         DiskCachingMode         `json:"cachingMode,omitempty"`
+	SynchronizationMode DiskSynchronizationMode `json:"synchronizationMode,omitempty"`
+	// NoLock disables the advisory lock preventing other vfkit instances
+	// from using the disk image at the same time
+	NoLock bool `json:"noLock,omitempty"`
 }
 
 type NetworkBlockStorageConfig struct {
@@ -958,6 +1340,18 @@ func (config *DiskStorageConfig) ToCmdLine() ([]string, error) {
 	if config.ReadOnly {
 		value += ",readonly"
 	}
+
+	if config.CachingMode != DiskCachingDefault {
+		value += fmt.Sprintf(",cache=%s", config.CachingMode)
+	}
+
+	if config.SynchronizationMode != DiskSynchronizationDefault {
+		value += fmt.Sprintf(",sync=%s", config.SynchronizationMode)
+	}
+
+	if config.NoLock {
+		value += ",lock=off"
+	}
 	return []string{"--device", value}, nil
 }
 
@@ -977,10 +1371,55 @@ func (config *DiskStorageConfig) FromOptions(options []option) error {
 				return fmt.Errorf("unexpected value for virtio-blk 'readonly' option: %s", option.value)
 			}
 			config.ReadOnly = true
+		case "cache":
+			mode := DiskCachingMode(option.value)
+			if option.value == "" || !mode.IsValid() {
+				return fmt.Errorf("unexpected value for disk 'cache' option: %s, must be 'automatic', 'cached' or 'uncached'", option.value)
+			}
+			config.CachingMode = mode
+		case "sync":
+			mode := DiskSynchronizationMode(option.value)
+			if option.value == "" || !mode.IsValid() {
+				return fmt.Errorf("unexpected value for disk 'sync' option: %s, must be 'full', 'fsync' or 'none'", option.value)
+			}
+			config.SynchronizationMode = mode
+		case "lock":
+			switch option.value {
+			case "on":
+				config.NoLock = false
+			case "off":
+				config.NoLock = true
+			default:
+				return fmt.Errorf("unexpected value for %s 'lock' option: %s", config.DevName, option.value)
+			}
 		default:
 			return fmt.Errorf("unknown option for %s devices: %s", config.DevName, option.key)
 		}
 	}
+	return config.validate()
+}
+
+// validate checks that the caching and synchronization modes are supported
+// by the disk backend
+func (config *DiskStorageConfig) validate() error {
+	if !config.CachingMode.IsValid() {
+		return fmt.Errorf("invalid disk caching mode: %s", config.CachingMode)
+	}
+	if !config.SynchronizationMode.IsValid() {
+		return fmt.Errorf("invalid disk synchronization mode: %s", config.SynchronizationMode)
+	}
+	switch config.Type {
+	case DiskBackendImage, DiskBackendDefault:
+		return nil
+	}
+	// block devices and network block devices have no caching mode, and
+	// only support full or no synchronization
+	if config.CachingMode != DiskCachingDefault {
+		return fmt.Errorf("'cache' can only be used with disk images")
+	}
+	if config.SynchronizationMode == DiskSynchronizationFsync {
+		return fmt.Errorf("'sync=fsync' can only be used with disk images")
+	}
 	return nil
 }
 
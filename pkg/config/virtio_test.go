@@ -127,6 +127,49 @@ func TestVirtioDevices(t *testing.T) {
 			expectedCmdLine:  []string{"--device", fmt.Sprintf("virtio-blk,path=%s,type=dev", testImagePath)},
 			alternateCmdLine: []string{"--device", fmt.Sprintf("virtio-blk,type=dev,path=%s", testImagePath)},
 		},
+		"NewVirtioBlkWithNBDType": {
+			newDev: func() (VirtioDevice, error) {
+				dev, err := getTestVirtioBlkDevice(testImagePath)
+				if err != nil {
+					return nil, err
+				}
+				dev.Type = DiskBackendNBD
+				return dev, nil
+			},
+			expectedDev: &VirtioBlk{
+				DiskStorageConfig: DiskStorageConfig{
+					StorageConfig: StorageConfig{
+						DevName: "virtio-blk",
+					},
+					ImagePath: testImagePath,
+					Type:      DiskBackendNBD,
+				},
+				DeviceIdentifier: "",
+			},
+			expectedCmdLine:  []string{"--device", fmt.Sprintf("virtio-blk,path=%s,type=nbd", testImagePath)},
+			alternateCmdLine: []string{"--device", fmt.Sprintf("virtio-blk,type=nbd,path=%s", testImagePath)},
+		},
+		"NewVirtioBlkEphemeral": {
+			newDev: func() (VirtioDevice, error) {
+				dev, err := getTestVirtioBlkDevice(testImagePath)
+				if err != nil {
+					return nil, err
+				}
+				dev.Ephemeral = true
+				return dev, nil
+			},
+			expectedDev: &VirtioBlk{
+				DiskStorageConfig: DiskStorageConfig{
+					StorageConfig: StorageConfig{
+						DevName: "virtio-blk",
+					},
+					ImagePath: testImagePath,
+				},
+				Ephemeral: true,
+			},
+			expectedCmdLine:  []string{"--device", fmt.Sprintf("virtio-blk,path=%s,ephemeral", testImagePath)},
+			alternateCmdLine: []string{"--device", fmt.Sprintf("virtio-blk,ephemeral,path=%s", testImagePath)},
+		},
 		"NewVirtioBlkWithDefaultType": {
 			newDev: func() (VirtioDevice, error) {
 				dev, err := getTestVirtioBlkDevice(testImagePath)
@@ -181,6 +224,72 @@ func TestVirtioDevices(t *testing.T) {
 			expectedCmdLine:  []string{"--device", "nvme,path=/foo/bar,type=image"},
 			alternateCmdLine: []string{"--device", "nvme,type=image,path=/foo/bar"},
 		},
+		"NewNVMeCacheSync": {
+			newDev: func() (VirtioDevice, error) {
+				dev, err := NVMExpressControllerNew("/foo/bar")
+				if err != nil {
+					return nil, err
+				}
+				dev.CachingMode = DiskCachingUncached
+				dev.SynchronizationMode = DiskSynchronizationNone
+				return dev, nil
+			},
+			expectedDev: &NVMExpressController{
+				DiskStorageConfig: DiskStorageConfig{
+					StorageConfig: StorageConfig{
+						DevName: "nvme",
+					},
+					ImagePath:           "/foo/bar",
+					CachingMode:         DiskCachingUncached,
+					SynchronizationMode: DiskSynchronizationNone,
+				},
+			},
+			expectedCmdLine:  []string{"--device", "nvme,path=/foo/bar,cache=uncached,sync=none"},
+			alternateCmdLine: []string{"--device", "nvme,sync=none,cache=uncached,path=/foo/bar"},
+		},
+		"NewNVMeNoLock": {
+			newDev: func() (VirtioDevice, error) {
+				dev, err := NVMExpressControllerNew("/foo/bar")
+				if err != nil {
+					return nil, err
+				}
+				dev.NoLock = true
+				return dev, nil
+			},
+			expectedDev: &NVMExpressController{
+				DiskStorageConfig: DiskStorageConfig{
+					StorageConfig: StorageConfig{
+						DevName: "nvme",
+					},
+					ImagePath: "/foo/bar",
+					NoLock:    true,
+				},
+			},
+			expectedCmdLine:  []string{"--device", "nvme,path=/foo/bar,lock=off"},
+			alternateCmdLine: []string{"--device", "nvme,lock=off,path=/foo/bar"},
+		},
+		"NewVirtioNetStaticConfig": {
+			newDev: func() (VirtioDevice, error) {
+				dev, err := VirtioNetNew("00:11:22:33:44:55")
+				if err != nil {
+					return nil, err
+				}
+				dev.Addresses = []string{"192.168.100.10/24", "fd00::10/64"}
+				dev.Gateway = "192.168.100.1"
+				dev.Routes = []NetworkRoute{{To: "10.0.0.0/8", Via: "192.168.100.254"}}
+				dev.Nameservers = []string{"1.1.1.1"}
+				return dev, nil
+			},
+			expectedDev: &VirtioNet{
+				Nat:         true,
+				MacAddress:  []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+				Addresses:   []string{"192.168.100.10/24", "fd00::10/64"},
+				Gateway:     "192.168.100.1",
+				Routes:      []NetworkRoute{{To: "10.0.0.0/8", Via: "192.168.100.254"}},
+				Nameservers: []string{"1.1.1.1"},
+			},
+			expectedCmdLine: []string{"--device", "virtio-net,nat,mac=00:11:22:33:44:55,address=192.168.100.10/24,address=fd00::10/64,gateway=192.168.100.1,route=10.0.0.0/8@192.168.100.254,dns=1.1.1.1"},
+		},
 		"NewVirtioFs": {
 			newDev: func() (VirtioDevice, error) { return VirtioFsNew("/foo/bar", "") },
 			expectedDev: &VirtioFs{
@@ -444,7 +553,131 @@ func TestVirtioDevices(t *testing.T) {
 			newDev: func() (VirtioDevice, error) {
 				return deviceFromCmdLine("virtio-net,type=foo")
 			},
-			errorMsg: "unsupported virtio-net type: foo (only 'unixgram' is supported)",
+			errorMsg: "unsupported virtio-net type: foo (supported types are 'unixgram', 'unixstream' and 'usermode')",
+		},
+		"VirtioNetUnixstream": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,type=unixstream,path=/tmp/passt.sock,mac=00:11:22:33:44:55")
+			},
+			expectedDev: &VirtioNet{
+				Type:           VirtioNetUnixstream,
+				UnixSocketPath: "/tmp/passt.sock",
+				MacAddress:     []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+			},
+			expectedCmdLine: []string{"--device", "virtio-net,type=unixstream,path=/tmp/passt.sock,mac=00:11:22:33:44:55"},
+		},
+		"VirtioNetPcap": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,type=unixstream,path=/tmp/passt.sock,pcap=/tmp/vm.pcapng,pcapMaxSize=10,pcapMaxFiles=3")
+			},
+			expectedDev: &VirtioNet{
+				Type:           VirtioNetUnixstream,
+				UnixSocketPath: "/tmp/passt.sock",
+				Capture: &PacketCapture{
+					Path:     "/tmp/vm.pcapng",
+					MaxSize:  10 * 1024 * 1024,
+					MaxFiles: 3,
+				},
+			},
+			expectedCmdLine: []string{"--device", "virtio-net,type=unixstream,path=/tmp/passt.sock,pcap=/tmp/vm.pcapng,pcapMaxSize=10,pcapMaxFiles=3"},
+		},
+		"VirtioNetRuntimeCapture": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,unixSocketPath=/tmp/socket.sock,vfkitMagic=off,capture")
+			},
+			expectedDev: &VirtioNet{
+				UnixSocketPath: "/tmp/socket.sock",
+				RuntimeCapture: true,
+			},
+			expectedCmdLine: []string{"--device", "virtio-net,type=unixgram,path=/tmp/socket.sock,vfkitMagic=off,capture"},
+		},
+		"VirtioNetRuntimeCaptureNat": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,nat,capture")
+			},
+			errorMsg: "'capture' is not supported with 'nat', it requires a socket-based virtio-net device",
+		},
+		"VirtioNetPcapNat": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,nat,pcap=/tmp/vm.pcap")
+			},
+			errorMsg: "'pcap' is not supported with 'nat', it requires a socket-based virtio-net device",
+		},
+		"VirtioNetPcapMaxSizeWithoutPcap": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,unixSocketPath=/tmp/test.sock,pcapMaxSize=10")
+			},
+			errorMsg: "'pcapMaxSize' and 'pcapMaxFiles' options require 'pcap' to be specified",
+		},
+		"VirtioNetPcapMaxFilesInvalid": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,unixSocketPath=/tmp/test.sock,pcap=/tmp/vm.pcap,pcapMaxFiles=0")
+			},
+			errorMsg: "invalid value for pcapMaxFiles: 0 (expected a number of files)",
+		},
+		"VirtioNetUnixstreamWithoutPath": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,type=unixstream")
+			},
+			errorMsg: "'type' option requires 'path' to be specified",
+		},
+		"VirtioNetUnixstreamVfkitMagic": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,type=unixstream,path=/tmp/passt.sock,vfkitMagic=on")
+			},
+			errorMsg: "'vfkitMagic' option is only supported with the 'unixgram' type",
+		},
+		"VirtioNetUsermode": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,type=usermode,mac=00:11:22:33:44:55,forward=tcp:8080:80,forward=udp:0.0.0.0:5353:53,forward=tcp:[::1]:2222:22,pcap=/tmp/vm.pcap")
+			},
+			expectedDev: &VirtioNet{
+				Type:       VirtioNetUsermode,
+				MacAddress: []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+				Capture:    &PacketCapture{Path: "/tmp/vm.pcap"},
+				Forwards: []PortForward{
+					{Protocol: "tcp", HostPort: 8080, GuestPort: 80},
+					{Protocol: "udp", HostAddress: "0.0.0.0", HostPort: 5353, GuestPort: 53},
+					{Protocol: "tcp", HostAddress: "::1", HostPort: 2222, GuestPort: 22},
+				},
+			},
+			expectedCmdLine: []string{"--device", "virtio-net,type=usermode,mac=00:11:22:33:44:55,pcap=/tmp/vm.pcap,forward=tcp:8080:80,forward=udp:0.0.0.0:5353:53,forward=tcp:[::1]:2222:22"},
+		},
+		"VirtioNetUsermodeWithPath": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,type=usermode,path=/tmp/test.sock")
+			},
+			errorMsg: "'path' option is not supported with the 'usermode' type",
+		},
+		"VirtioNetUsermodeNat": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,type=usermode,nat")
+			},
+			errorMsg: "'usermode' type cannot be used with 'nat', 'fd' or 'path'",
+		},
+		"VirtioNetForwardWithoutUsermode": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,nat,forward=tcp:8080:80")
+			},
+			errorMsg: "'forward' option requires the 'usermode' type",
+		},
+		"VirtioNetForwardInvalid": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,type=usermode,forward=tcp:8080")
+			},
+			errorMsg: "invalid port forward: tcp:8080 (expected PROTOCOL:[HOSTADDRESS:]HOSTPORT:GUESTPORT)",
+		},
+		"VirtioNetForwardInvalidProtocol": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,type=usermode,forward=sctp:8080:80")
+			},
+			errorMsg: "unsupported protocol for port forward: sctp (supported protocols are 'tcp' and 'udp')",
+		},
+		"VirtioNetForwardPortZero": {
+			newDev: func() (VirtioDevice, error) {
+				return deviceFromCmdLine("virtio-net,type=usermode,forward=tcp:8080:0")
+			},
+			errorMsg: "invalid port forward tcp:8080:0: the ports must not be 0",
 		},
 		"VirtioNetTypeWithoutPath": {
 			newDev: func() (VirtioDevice, error) {
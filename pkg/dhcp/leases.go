@@ -0,0 +1,121 @@
+// Package dhcp finds the IP addresses the macOS DHCP server gave to virtual
+// machines using NAT networking.
+package dhcp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LeasesFile is where the macOS DHCP server stores its leases
+const LeasesFile = "/var/db/dhcpd_leases"
+
+// Lease is a DHCP lease given to a virtual machine
+type Lease struct {
+	Name       string
+	IPAddress  string
+	MACAddress net.HardwareAddr
+}
+
+// ParseLeases parses the leases in the dhcpd_leases format:
+//
+//	{
+//		name=fedora
+//		ip_address=192.168.64.3
+//		hw_address=1,5a:94:ef:e4:c:dd
+//		identifier=1,5a:94:ef:e4:c:dd
+//		lease=0x66ec9f1b
+//	}
+func ParseLeases(r io.Reader) ([]Lease, error) {
+	leases := []Lease{}
+	var lease *Lease
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "{":
+			lease = &Lease{}
+		case line == "}":
+			if lease != nil && lease.IPAddress != "" && lease.MACAddress != nil {
+				leases = append(leases, *lease)
+			}
+			lease = nil
+		case lease != nil:
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			switch key {
+			case "name":
+				lease.Name = value
+			case "ip_address":
+				lease.IPAddress = value
+			case "hw_address":
+				// the hardware type is 1 for ethernet
+				hwType, address, ok := strings.Cut(value, ",")
+				if !ok || hwType != "1" {
+					continue
+				}
+				mac, err := parseMAC(address)
+				if err != nil {
+					// the lease is skipped, it can't match a virtual machine
+					log.Debugf("skipping DHCP lease: %v", err)
+					continue
+				}
+				lease.MACAddress = mac
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// parseMAC parses MAC addresses, the DHCP server strips the leading zeros of
+// their bytes
+func parseMAC(address string) (net.HardwareAddr, error) {
+	parts := strings.Split(address, ":")
+	for i, part := range parts {
+		if len(part) == 1 {
+			parts[i] = "0" + part
+		}
+	}
+	mac, err := net.ParseMAC(strings.Join(parts, ":"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DHCP lease hardware address: %s", address)
+	}
+	return mac, nil
+}
+
+// IPAddressFromLeases returns the IP address leased to the MAC address mac
+// in leases. The most recent lease comes first in the leases file.
+func IPAddressFromLeases(leases []Lease, mac net.HardwareAddr) (string, error) {
+	for _, lease := range leases {
+		if lease.MACAddress.String() == mac.String() {
+			return lease.IPAddress, nil
+		}
+	}
+	return "", fmt.Errorf("no DHCP lease for MAC address %s", mac)
+}
+
+// IPAddress returns the IP address the macOS DHCP server leased to the MAC
+// address mac.
+func IPAddress(mac net.HardwareAddr) (string, error) {
+	file, err := os.Open(LeasesFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	leases, err := ParseLeases(file)
+	if err != nil {
+		return "", err
+	}
+	return IPAddressFromLeases(leases, mac)
+}
@@ -0,0 +1,61 @@
+package dhcp
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const leasesFile = `{
+	name=fedora
+	ip_address=192.168.64.4
+	hw_address=1,5a:94:ef:e4:c:dd
+	identifier=1,5a:94:ef:e4:c:dd
+	lease=0x66ec9f1b
+}
+{
+	name=ubuntu
+	ip_address=192.168.64.3
+	hw_address=1,56:46:4b:49:54:1
+	identifier=1,56:46:4b:49:54:1
+	lease=0x66ec9e02
+}
+{
+	name=fedora
+	ip_address=192.168.64.2
+	hw_address=1,5a:94:ef:e4:c:dd
+	identifier=1,5a:94:ef:e4:c:dd
+	lease=0x66ec9a11
+}
+`
+
+func TestParseLeases(t *testing.T) {
+	leases, err := ParseLeases(strings.NewReader(leasesFile))
+	require.NoError(t, err)
+	require.Len(t, leases, 3)
+	assert.Equal(t, Lease{
+		Name:       "ubuntu",
+		IPAddress:  "192.168.64.3",
+		MACAddress: net.HardwareAddr{0x56, 0x46, 0x4b, 0x49, 0x54, 0x01},
+	}, leases[1])
+
+	mac, err := net.ParseMAC("5a:94:ef:e4:0c:dd")
+	require.NoError(t, err)
+	ip, err := IPAddressFromLeases(leases, mac)
+	require.NoError(t, err)
+	assert.Equal(t, "192.168.64.4", ip)
+
+	mac, err = net.ParseMAC("5a:94:ef:e4:0c:ee")
+	require.NoError(t, err)
+	_, err = IPAddressFromLeases(leases, mac)
+	require.EqualError(t, err, "no DHCP lease for MAC address 5a:94:ef:e4:0c:ee")
+
+	// leases with an invalid hardware address are skipped
+	leases, err = ParseLeases(strings.NewReader("{\n\tip_address=192.168.64.5\n\thw_address=1,5a:94:ef\n}\n" + leasesFile))
+	require.NoError(t, err)
+	require.Len(t, leases, 3)
+	assert.Equal(t, "192.168.64.4", leases[0].IPAddress)
+}
@@ -0,0 +1,72 @@
+package diskimage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Clone creates a copy-on-write clone of the disk image at srcPath at
+// dstPath, which must not exist. Raw images are cloned with clonefile(2) or
+// the FICLONE ioctl when the filesystem supports it, and copied sparsely
+// otherwise. qcow2 images are cloned by creating a qcow2 overlay which uses
+// srcPath as its backing file, srcPath must then not be modified while the
+// clone is in use.
+func Clone(srcPath, dstPath string) error {
+	format, err := DetectFile(srcPath)
+	if err != nil {
+		return err
+	}
+	if format == QCOW2 {
+		absPath, err := filepath.Abs(srcPath)
+		if err != nil {
+			return err
+		}
+		return CreateQcow2(dstPath, 0, absPath)
+	}
+	return cloneRaw(srcPath, dstPath)
+}
+
+// cloneRaw clones the file at srcPath to dstPath, which must not exist, with
+// clonefile(2) or FICLONE when possible, or with a sparse copy otherwise
+func cloneRaw(srcPath, dstPath string) error {
+	err := cloneFile(srcPath, dstPath)
+	if err == nil {
+		return nil
+	}
+	if _, statErr := os.Lstat(dstPath); statErr == nil {
+		// dstPath already existed, or the clone failed half-way
+		return fmt.Errorf("failed to clone %s: %w", srcPath, err)
+	}
+	return copyFile(srcPath, dstPath)
+}
+
+// copyFile copies the file at srcPath to dstPath, skipping the ranges which
+// only contain zeros so that dstPath is sparse
+func copyFile(srcPath, dstPath string) (retErr error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(dstPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			_ = dst.Close()
+			_ = os.Remove(dstPath)
+		}
+	}()
+
+	if err := copySparse(dst, &rawImage{File: src, size: stat.Size()}); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", srcPath, err)
+	}
+	return dst.Close()
+}
@@ -0,0 +1,9 @@
+package diskimage
+
+import "golang.org/x/sys/unix"
+
+// cloneFile clones srcPath to dstPath with clonefile(2), which is supported
+// by APFS
+func cloneFile(srcPath, dstPath string) error {
+	return unix.Clonefile(srcPath, dstPath, unix.CLONE_NOFOLLOW)
+}
@@ -0,0 +1,31 @@
+package diskimage
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile clones srcPath to dstPath with the FICLONE ioctl, which is
+// supported by btrfs, xfs and a few other filesystems
+func cloneFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(dstPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(dstPath)
+		return err
+	}
+	return dst.Close()
+}
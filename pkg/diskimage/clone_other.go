@@ -0,0 +1,9 @@
+//go:build !darwin && !linux
+
+package diskimage
+
+import "errors"
+
+func cloneFile(_, _ string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,129 @@
+package diskimage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// convertChunkSize is the size of the reads done when converting images,
+	// it is a multiple of all the qcow2 cluster sizes up to 1MiB
+	convertChunkSize = 1024 * 1024
+	// sparseBlockSize is the granularity used to detect ranges of zeros
+	// which are not written to the destination image
+	sparseBlockSize = 4096
+)
+
+// zeroChecker is implemented by images which can tell that a range of the disk
+// only contains zeros without reading it
+type zeroChecker interface {
+	isZero(offset, length int64) (bool, error)
+}
+
+// Convert converts the qcow2 or raw disk image at srcPath to a sparse raw
+// disk image at dstPath. dstPath must not exist. The ranges of the disk which
+// only contain zeros are not allocated in the raw image. It fails if the
+// source image is written by a running vfkit process, and the destination
+// image is locked until it's fully written.
+func Convert(srcPath, dstPath string) (retErr error) {
+	srcLock, err := Lock(srcPath, true)
+	if err != nil {
+		return err
+	}
+	defer srcLock.Unlock()
+	src, err := Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			_ = dst.Close()
+			_ = os.Remove(dstPath)
+		}
+	}()
+	dstLock, err := Lock(dstPath, false)
+	if err != nil {
+		return err
+	}
+	defer dstLock.Unlock()
+
+	if err := copySparse(dst, src); err != nil {
+		return fmt.Errorf("failed to convert %s: %w", srcPath, err)
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	return dst.Close()
+}
+
+// copySparse copies the content of the virtual disk of src to dst, skipping
+// the ranges which only contain zeros
+func copySparse(dst *os.File, src Image) error {
+	size := src.Size()
+	chunkSize := int64(convertChunkSize)
+	if qcow2, ok := src.(*Qcow2); ok {
+		chunkSize = max(chunkSize, qcow2.clusterSize)
+	}
+	buf := make([]byte, chunkSize)
+
+	for offset := int64(0); offset < size; offset += chunkSize {
+		chunk := buf[:min(chunkSize, size-offset)]
+		if checker, ok := src.(zeroChecker); ok {
+			zero, err := checker.isZero(offset, int64(len(chunk)))
+			if err != nil {
+				return err
+			}
+			if zero {
+				continue
+			}
+		}
+		n, err := src.ReadAt(chunk, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if n != len(chunk) {
+			return fmt.Errorf("short read at offset %d", offset)
+		}
+		if err := writeSparse(dst, chunk, offset); err != nil {
+			return err
+		}
+	}
+	return dst.Truncate(size)
+}
+
+// writeSparse writes data to dst at offset, skipping the blocks of data which
+// only contain zeros
+func writeSparse(dst io.WriterAt, data []byte, offset int64) error {
+	zeros := make([]byte, sparseBlockSize)
+	start := -1
+	flush := func(end int) error {
+		if start == -1 {
+			return nil
+		}
+		_, err := dst.WriteAt(data[start:end], offset+int64(start))
+		start = -1
+		return err
+	}
+	for pos := 0; pos < len(data); pos += sparseBlockSize {
+		block := data[pos:min(len(data), pos+sparseBlockSize)]
+		if !bytes.Equal(block, zeros[:len(block)]) {
+			if start == -1 {
+				start = pos
+			}
+			continue
+		}
+		if err := flush(pos); err != nil {
+			return err
+		}
+	}
+	return flush(len(data))
+}
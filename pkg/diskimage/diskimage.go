@@ -0,0 +1,138 @@
+// Package diskimage creates, inspects, resizes and converts the disk images
+// used by virtual machines, without depending on external tools such as
+// qemu-img.
+//
+// The virtualization framework can only use raw disk images. The other
+// formats are detected so that helpful errors can be reported, and qcow2
+// images, which are commonly used by cloud images, can be converted to sparse
+// raw images.
+package diskimage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// Format is the format of a disk image.
+type Format string
+
+const (
+	Raw   Format = "raw"
+	QCOW2 Format = "qcow2"
+	VMDK  Format = "vmdk"
+	VHDX  Format = "vhdx"
+	ISO   Format = "iso"
+)
+
+var (
+	vmdkSparseMagic     = []byte("KDMV")
+	vmdkDescriptorMagic = []byte("# Disk DescriptorFile")
+	vhdxMagic           = []byte("vhdxfile")
+	isoMagic            = []byte("CD001")
+)
+
+const (
+	// the ISO9660 volume descriptors start at sector 16
+	isoMagicOffset = 16*2048 + 1
+)
+
+// Info describes a disk image.
+type Info struct {
+	Format Format `json:"format"`
+	// VirtualSize is the size of the disk seen by the virtual machine
+	VirtualSize uint64 `json:"virtualSize"`
+	// AllocatedSize is the disk space used by the image on the host, which
+	// is smaller than the virtual size for sparse and qcow2 images
+	AllocatedSize uint64 `json:"allocatedSize"`
+	// ClusterSize is only set for qcow2 images
+	ClusterSize uint64 `json:"clusterSize,omitempty"`
+	// BackingFile is only set for qcow2 images with a backing file
+	BackingFile string `json:"backingFile,omitempty"`
+}
+
+func hasMagic(r io.ReaderAt, offset int64, magic []byte) bool {
+	buf := make([]byte, len(magic))
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return false
+	}
+	return bytes.Equal(buf, magic)
+}
+
+// Detect returns the format of the disk image read from r. Images which are
+// not in one of the known formats are raw images.
+func Detect(r io.ReaderAt) Format {
+	switch {
+	case hasMagic(r, 0, qcow2Magic):
+		return QCOW2
+	case hasMagic(r, 0, vmdkSparseMagic), hasMagic(r, 0, vmdkDescriptorMagic):
+		return VMDK
+	case hasMagic(r, 0, vhdxMagic):
+		return VHDX
+	case hasMagic(r, isoMagicOffset, isoMagic):
+		return ISO
+	default:
+		return Raw
+	}
+}
+
+// DetectFile returns the format of the disk image at path.
+func DetectFile(path string) (Format, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return Detect(file), nil
+}
+
+// Inspect returns information about the disk image at path.
+func Inspect(path string) (*Info, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	info := Info{
+		Format:        Detect(file),
+		VirtualSize:   uint64(stat.Size()),
+		AllocatedSize: allocatedSize(stat),
+	}
+	switch info.Format {
+	case QCOW2:
+		header, err := readQcow2Header(file)
+		if err != nil {
+			return nil, fmt.Errorf("invalid qcow2 image %s: %w", path, err)
+		}
+		info.VirtualSize = header.size
+		info.ClusterSize = header.clusterSize()
+		info.BackingFile = header.backingFile
+	case VMDK:
+		info.VirtualSize, err = vmdkVirtualSize(file)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vmdk image %s: %w", path, err)
+		}
+	case VHDX:
+		info.VirtualSize, err = vhdxVirtualSize(file)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vhdx image %s: %w", path, err)
+		}
+	}
+	return &info, nil
+}
+
+// allocatedSize returns the disk space used by a file, holes in sparse files
+// are not counted
+func allocatedSize(stat os.FileInfo) uint64 {
+	if sysStat, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return uint64(sysStat.Blocks) * 512
+	}
+	return uint64(stat.Size())
+}
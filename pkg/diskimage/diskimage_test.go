@@ -0,0 +1,302 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeVHDX(t *testing.T, path string, virtualSize uint64) {
+	const metadataOffset = 1024 * 1024
+	data := make([]byte, metadataOffset+64*1024)
+	copy(data, vhdxMagic)
+
+	le := binary.LittleEndian
+	regionTable := data[vhdxRegionTableOffset:]
+	copy(regionTable, vhdxRegionTableMagic)
+	le.PutUint32(regionTable[8:], 2)
+	// BAT region, then metadata region
+	copy(regionTable[16:], guidBytes("2dc27766-f623-4200-9d64-115e9bfd4a08"))
+	copy(regionTable[48:], vhdxMetadataRegion)
+	le.PutUint64(regionTable[48+16:], metadataOffset)
+
+	metadata := data[metadataOffset:]
+	copy(metadata, vhdxMetadataMagic)
+	le.PutUint16(metadata[10:], 2)
+	// file parameters item, then virtual disk size item
+	copy(metadata[32:], guidBytes("caa16737-fa36-4d43-b3b6-33f0aa44e76b"))
+	le.PutUint32(metadata[32+16:], 64*1024-16)
+	copy(metadata[64:], vhdxVirtualDiskSizeID)
+	le.PutUint32(metadata[64+16:], 64*1024-8)
+	le.PutUint64(metadata[64*1024-8:], virtualSize)
+
+	require.NoError(t, os.WriteFile(path, data, 0600))
+}
+
+func TestInspect(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	rawPath := filepath.Join(tmpDir, "disk.raw")
+	require.NoError(t, Create(rawPath, 64*1024*1024))
+
+	qcow2Path := filepath.Join(tmpDir, "disk.qcow2")
+	writeQcow2(t, qcow2Path, testImage(qcow2CompressionZlib))
+
+	vmdkPath := filepath.Join(tmpDir, "disk.vmdk")
+	vmdk := make([]byte, 4096)
+	copy(vmdk, vmdkSparseMagic)
+	binary.LittleEndian.PutUint64(vmdk[12:], 41943040)
+	require.NoError(t, os.WriteFile(vmdkPath, vmdk, 0600))
+
+	vmdkDescriptorPath := filepath.Join(tmpDir, "descriptor.vmdk")
+	descriptor := `# Disk DescriptorFile
+version=1
+createType="monolithicFlat"
+
+# Extent description
+RW 2097152 FLAT "disk-flat.vmdk" 0
+RW 1024 FLAT "disk-flat2.vmdk" 0
+`
+	require.NoError(t, os.WriteFile(vmdkDescriptorPath, []byte(descriptor), 0600))
+
+	vhdxPath := filepath.Join(tmpDir, "disk.vhdx")
+	writeVHDX(t, vhdxPath, 127*1024*1024*1024)
+
+	isoPath := filepath.Join(tmpDir, "disk.iso")
+	iso := make([]byte, 20*2048)
+	copy(iso[isoMagicOffset:], isoMagic)
+	require.NoError(t, os.WriteFile(isoPath, iso, 0600))
+
+	tests := map[string]struct {
+		path        string
+		format      Format
+		virtualSize uint64
+		clusterSize uint64
+	}{
+		"raw":            {rawPath, Raw, 64 * 1024 * 1024, 0},
+		"qcow2":          {qcow2Path, QCOW2, 3 * 1024 * 1024, 4096},
+		"vmdk":           {vmdkPath, VMDK, 20 * 1024 * 1024 * 1024, 0},
+		"vmdkDescriptor": {vmdkDescriptorPath, VMDK, (2097152 + 1024) * 512, 0},
+		"vhdx":           {vhdxPath, VHDX, 127 * 1024 * 1024 * 1024, 0},
+		"iso":            {isoPath, ISO, 20 * 2048, 0},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			format, err := DetectFile(test.path)
+			require.NoError(t, err)
+			assert.Equal(t, test.format, format)
+
+			info, err := Inspect(test.path)
+			require.NoError(t, err)
+			assert.Equal(t, test.format, info.Format)
+			assert.Equal(t, test.virtualSize, info.VirtualSize)
+			assert.Equal(t, test.clusterSize, info.ClusterSize)
+			assert.Empty(t, info.BackingFile)
+		})
+	}
+
+	// the raw image was created sparse
+	info, err := Inspect(rawPath)
+	require.NoError(t, err)
+	assert.Less(t, info.AllocatedSize, info.VirtualSize)
+
+	_, err = Open(vmdkPath)
+	require.ErrorContains(t, err, "vmdk images are not supported")
+}
+
+func TestConvert(t *testing.T) {
+	tmpDir := t.TempDir()
+	qcow2Path := filepath.Join(tmpDir, "disk.qcow2")
+	testImg := testImage(qcow2CompressionZlib)
+	writeQcow2(t, qcow2Path, testImg)
+
+	rawPath := filepath.Join(tmpDir, "disk.raw")
+	require.NoError(t, Convert(qcow2Path, rawPath))
+	converted, err := os.ReadFile(rawPath)
+	require.NoError(t, err)
+	assert.Equal(t, expectedContent(testImg, nil), converted)
+
+	info, err := Inspect(rawPath)
+	require.NoError(t, err)
+	assert.Equal(t, Raw, info.Format)
+	assert.Equal(t, testImg.size, info.VirtualSize)
+	assert.Less(t, info.AllocatedSize, info.VirtualSize)
+
+	// the destination is never overwritten
+	err = Convert(qcow2Path, rawPath)
+	require.ErrorIs(t, err, os.ErrExist)
+	converted, err = os.ReadFile(rawPath)
+	require.NoError(t, err)
+	assert.Equal(t, expectedContent(testImg, nil), converted)
+
+	// raw to raw conversion is a sparse copy
+	copyPath := filepath.Join(tmpDir, "copy.raw")
+	require.NoError(t, Convert(rawPath, copyPath))
+	copied, err := os.ReadFile(copyPath)
+	require.NoError(t, err)
+	assert.Equal(t, converted, copied)
+
+	// no output is left behind on errors
+	truncatedPath := filepath.Join(tmpDir, "truncated.qcow2")
+	data, err := os.ReadFile(qcow2Path)
+	require.NoError(t, err)
+	// drop the refcount table and block, and the last data cluster
+	require.NoError(t, os.WriteFile(truncatedPath, data[:len(data)-3*4096], 0600))
+	failedPath := filepath.Join(tmpDir, "failed.raw")
+	err = Convert(truncatedPath, failedPath)
+	require.ErrorContains(t, err, "failed to convert")
+	assert.NoFileExists(t, failedPath)
+}
+
+func TestCreateResize(t *testing.T) {
+	tmpDir := t.TempDir()
+	diskPath := filepath.Join(tmpDir, "disk.img")
+
+	require.NoError(t, Create(diskPath, 1024*1024))
+	require.ErrorIs(t, Create(diskPath, 1024*1024), os.ErrExist)
+	require.EqualError(t, Create(filepath.Join(tmpDir, "odd.img"), 1000), "disk size must be a multiple of 512 bytes: 1000")
+	require.EqualError(t, Create(filepath.Join(tmpDir, "empty.img"), 0), "disk size must be greater than 0")
+
+	require.NoError(t, Resize(diskPath, 4*1024*1024, false))
+	info, err := Inspect(diskPath)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4*1024*1024), info.VirtualSize)
+
+	err = Resize(diskPath, 2*1024*1024, false)
+	require.ErrorIs(t, err, ErrShrink)
+	require.ErrorContains(t, err, "is 4 MiB, new size is 2 MiB")
+	require.NoError(t, Resize(diskPath, 2*1024*1024, true))
+	info, err = Inspect(diskPath)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2*1024*1024), info.VirtualSize)
+
+	qcow2Path := filepath.Join(tmpDir, "disk.qcow2")
+	writeQcow2(t, qcow2Path, testImage(qcow2CompressionZlib))
+	require.ErrorContains(t, Resize(qcow2Path, 8*1024*1024, false), "only raw disk images can be resized")
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]uint64{
+		"512":    512,
+		"20GiB":  20 * 1024 * 1024 * 1024,
+		"20G":    20 * 1024 * 1024 * 1024,
+		"20 gb":  20 * 1024 * 1024 * 1024,
+		"1.5T":   1536 * 1024 * 1024 * 1024,
+		"100MiB": 100 * 1024 * 1024,
+		"64k":    64 * 1024,
+		"1024B":  1024,
+	}
+	for size, expected := range tests {
+		parsed, err := ParseSize(size)
+		require.NoError(t, err, size)
+		assert.Equal(t, expected, parsed, size)
+	}
+	for _, size := range []string{"", "G", "-1G", "10X", "1.2.3G", "9999999P"} {
+		_, err := ParseSize(size)
+		require.Error(t, err, size)
+	}
+
+	newSize, err := ParseNewSize(10*1024*1024*1024, "+5G")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(15*1024*1024*1024), newSize)
+	newSize, err = ParseNewSize(10*1024*1024*1024, "-1G")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(9*1024*1024*1024), newSize)
+	newSize, err = ParseNewSize(10*1024*1024*1024, "30GiB")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(30*1024*1024*1024), newSize)
+	_, err = ParseNewSize(1024*1024*1024, "-2G")
+	require.EqualError(t, err, "cannot shrink disk image by 2 GiB, its size is 1 GiB")
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "0 bytes", FormatSize(0))
+	assert.Equal(t, "1000 bytes", FormatSize(1000))
+	assert.Equal(t, "1 KiB", FormatSize(1024))
+	assert.Equal(t, "1.5 MiB", FormatSize(1536*1024))
+	assert.Equal(t, "20 GiB", FormatSize(20*1024*1024*1024))
+	assert.Equal(t, "1.33 TiB", FormatSize(1365*1024*1024*1024))
+}
+
+type recordingWriter struct {
+	writes map[int64][]byte
+}
+
+func (w *recordingWriter) WriteAt(p []byte, offset int64) (int, error) {
+	w.writes[offset] = append([]byte{}, p...)
+	return len(p), nil
+}
+
+func TestWriteSparse(t *testing.T) {
+	data := make([]byte, 5*sparseBlockSize+100)
+	copy(data[sparseBlockSize+10:], "data")
+	copy(data[2*sparseBlockSize:], "more data")
+	copy(data[5*sparseBlockSize+99:], "x")
+
+	writer := recordingWriter{writes: map[int64][]byte{}}
+	require.NoError(t, writeSparse(&writer, data, 1000))
+	assert.Equal(t, map[int64][]byte{
+		1000 + sparseBlockSize:   data[sparseBlockSize : 3*sparseBlockSize],
+		1000 + 5*sparseBlockSize: data[5*sparseBlockSize:],
+	}, writer.writes)
+}
+
+func TestClone(t *testing.T) {
+	tmpDir := t.TempDir()
+	rawPath := filepath.Join(tmpDir, "disk.raw")
+	require.NoError(t, Create(rawPath, 4*1024*1024))
+	data := fileContent("raw", 10000)
+	require.NoError(t, writeFileAt(rawPath, data, 1024*1024))
+
+	clonePath := filepath.Join(tmpDir, "clone.raw")
+	require.NoError(t, Clone(rawPath, clonePath))
+	require.ErrorIs(t, Clone(rawPath, clonePath), os.ErrExist)
+	original, err := os.ReadFile(rawPath)
+	require.NoError(t, err)
+	clone, err := os.ReadFile(clonePath)
+	require.NoError(t, err)
+	assert.Equal(t, original, clone)
+	info, err := Inspect(clonePath)
+	require.NoError(t, err)
+	assert.Less(t, info.AllocatedSize, info.VirtualSize)
+
+	// the clone of a qcow2 image is an overlay, writes to the clone don't
+	// modify the source image
+	qcow2Path := filepath.Join(tmpDir, "disk.qcow2")
+	testImg := testImage(qcow2CompressionZlib)
+	writeQcow2(t, qcow2Path, testImg)
+	qcow2Content, err := os.ReadFile(qcow2Path)
+	require.NoError(t, err)
+	cloneQcow2Path := filepath.Join(tmpDir, "clone.qcow2")
+	require.NoError(t, Clone(qcow2Path, cloneQcow2Path))
+	img, err := OpenWritable(cloneQcow2Path)
+	require.NoError(t, err)
+	defer img.Close()
+	_, err = img.WriteAt(data, 0)
+	require.NoError(t, err)
+	expected := expectedContent(testImg, nil)
+	copy(expected, data)
+	content := make([]byte, len(expected))
+	_, err = img.ReadAt(content, 0)
+	require.NoError(t, err)
+	assert.Equal(t, expected, content)
+	unmodified, err := os.ReadFile(qcow2Path)
+	require.NoError(t, err)
+	assert.Equal(t, qcow2Content, unmodified)
+}
+
+func writeFileAt(path string, data []byte, offset int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(data, offset); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
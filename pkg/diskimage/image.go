@@ -0,0 +1,94 @@
+package diskimage
+
+import (
+	"fmt"
+	"os"
+)
+
+// Image is a disk image opened for reading. ReadAt reads the content of the
+// virtual disk, regardless of the format of the image.
+type Image interface {
+	ReadAt(p []byte, offset int64) (int, error)
+	Close() error
+	// Size returns the virtual size of the disk
+	Size() int64
+	Format() Format
+}
+
+// WritableImage is a disk image opened for reading and writing. WriteAt
+// writes to the virtual disk, regardless of the format of the image.
+type WritableImage interface {
+	Image
+	WriteAt(p []byte, offset int64) (int, error)
+	// Sync commits the data written to the image to stable storage
+	Sync() error
+}
+
+// rawImage is a raw disk image, the content of the disk is the content of the
+// file
+type rawImage struct {
+	*os.File
+	size int64
+}
+
+func (img *rawImage) Size() int64 {
+	return img.size
+}
+
+func (img *rawImage) Format() Format {
+	return Raw
+}
+
+// Open opens the raw or qcow2 disk image at path.
+func Open(path string) (Image, error) {
+	return open(path, 0)
+}
+
+func open(path string, depth int) (Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	format := Detect(file)
+	switch format {
+	case Raw, ISO:
+		stat, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		return &rawImage{File: file, size: stat.Size()}, nil
+	case QCOW2:
+		_ = file.Close()
+		return openQcow2(path, depth, false)
+	default:
+		_ = file.Close()
+		return nil, fmt.Errorf("%s images are not supported: %s", format, path)
+	}
+}
+
+// OpenWritable opens the raw or qcow2 disk image at path for reading and
+// writing. The backing files of qcow2 images are opened read-only.
+func OpenWritable(path string) (WritableImage, error) {
+	format, err := DetectFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case Raw:
+		file, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		stat, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		return &rawImage{File: file, size: stat.Size()}, nil
+	case QCOW2:
+		return openQcow2(path, 0, true)
+	default:
+		return nil, fmt.Errorf("%s images cannot be opened for writing: %s", format, path)
+	}
+}
@@ -0,0 +1,161 @@
+package diskimage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrLocked is returned when a disk image or block device is locked by
+// another process.
+var ErrLocked = errors.New("disk image is in use")
+
+// LockedError is the error returned by Lock when the disk image is locked by
+// another process. PID is the process holding the lock when it is a vfkit
+// process which recorded it, 0 otherwise.
+type LockedError struct {
+	Path string
+	PID  int32
+}
+
+func (err *LockedError) Error() string {
+	if err.PID == 0 {
+		return fmt.Sprintf("%s is in use by another process", err.Path)
+	}
+	return fmt.Sprintf("%s is in use by vfkit (pid %d)", err.Path, err.PID)
+}
+
+func (err *LockedError) Unwrap() error {
+	return ErrLocked
+}
+
+// lockHoldersDir is the directory where Lock records the PIDs of the
+// processes holding the locks, as flock(2) doesn't report them. It's a
+// variable so that the tests can change it.
+var lockHoldersDir = filepath.Join(os.TempDir(), "vfkit-locks")
+
+// ImageLock is an advisory lock on a disk image or block device.
+type ImageLock struct {
+	file *os.File
+	// holderPath is the file recording the PID of vfkit as a holder of the
+	// lock, it's empty when it could not be created
+	holderPath string
+}
+
+// Lock takes an advisory lock on the disk image or block device at path, a
+// shared lock when shared is true, an exclusive lock otherwise. Several
+// processes can hold a shared lock at the same time, but only one can hold an
+// exclusive lock. Lock does not block, it returns a *LockedError when the
+// lock is held by another process.
+// Locks are flock(2) locks, they are released when the process exits. The
+// PID of the process is recorded in a file of lockHoldersDir named after the
+// device and inode numbers of the disk image, so that the error of the other
+// processes can report it.
+func Lock(path string, shared bool) (*ImageLock, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	how := unix.LOCK_EX
+	if shared {
+		how = unix.LOCK_SH
+	}
+	err = unix.Flock(int(file.Fd()), how|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		lockedErr := &LockedError{Path: path}
+		if pids, err := lockHolders(file); err == nil && len(pids) != 0 {
+			lockedErr.PID = pids[0]
+		}
+		_ = file.Close()
+		return nil, lockedErr
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	lock := &ImageLock{file: file}
+	if prefix, err := lockHolderPrefix(file); err == nil {
+		holderPath := prefix + strconv.Itoa(os.Getpid())
+		if err := os.MkdirAll(lockHoldersDir, 0700); err == nil && os.WriteFile(holderPath, nil, 0600) == nil {
+			lock.holderPath = holderPath
+		}
+	}
+	return lock, nil
+}
+
+// Unlock releases the lock.
+func (lock *ImageLock) Unlock() error {
+	if lock.holderPath != "" {
+		_ = os.Remove(lock.holderPath)
+	}
+	return lock.file.Close()
+}
+
+// checkPath fails if path doesn't refer to the locked file anymore, when it
+// was renamed or replaced after it was opened.
+func (lock *ImageLock) checkPath(path string) error {
+	lockStat, err := lock.file.Stat()
+	if err != nil {
+		return err
+	}
+	pathStat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(lockStat, pathStat) {
+		return fmt.Errorf("%s was replaced while it was being locked", path)
+	}
+	return nil
+}
+
+// lockHolderPrefix returns the prefix of the paths of the files recording the
+// holders of the locks of file
+func lockHolderPrefix(file *os.File) (string, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("unexpected stat type %T", stat.Sys())
+	}
+	return filepath.Join(lockHoldersDir, fmt.Sprintf("%d-%d.", sys.Dev, sys.Ino)), nil
+}
+
+// lockHolders returns the PIDs of the running processes which recorded that
+// they hold a lock on file. The records of the processes which are not
+// running anymore are removed.
+func lockHolders(file *os.File) ([]int32, error) {
+	prefix, err := lockHolderPrefix(file)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(lockHoldersDir)
+	if err != nil {
+		return nil, err
+	}
+	pids := []int32{}
+	for _, entry := range entries {
+		holderPath := filepath.Join(lockHoldersDir, entry.Name())
+		pidStr, ok := strings.CutPrefix(holderPath, prefix)
+		if !ok {
+			continue
+		}
+		pid, err := strconv.ParseInt(pidStr, 10, 32)
+		if err != nil {
+			continue
+		}
+		if err := unix.Kill(int(pid), 0); errors.Is(err, unix.ESRCH) {
+			_ = os.Remove(holderPath)
+			continue
+		}
+		pids = append(pids, int32(pid))
+	}
+	return pids, nil
+}
@@ -0,0 +1,111 @@
+package diskimage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	lockHoldersDir = t.TempDir()
+	imgPath := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, Create(imgPath, 1024*1024))
+
+	// flock(2) locks are held by open file descriptions, so locks taken in
+	// the same process conflict with each other
+	shared1, err := Lock(imgPath, true)
+	require.NoError(t, err)
+	shared2, err := Lock(imgPath, true)
+	require.NoError(t, err)
+	_, err = Lock(imgPath, false)
+	require.ErrorIs(t, err, ErrLocked)
+	var lockedErr *LockedError
+	require.ErrorAs(t, err, &lockedErr)
+	assert.Equal(t, imgPath, lockedErr.Path)
+	assert.Equal(t, int32(os.Getpid()), lockedErr.PID)
+	assert.EqualError(t, err, fmt.Sprintf("%s is in use by vfkit (pid %d)", imgPath, os.Getpid()))
+
+	require.NoError(t, shared1.Unlock())
+	require.NoError(t, shared2.Unlock())
+	exclusive, err := Lock(imgPath, false)
+	require.NoError(t, err)
+	_, err = Lock(imgPath, true)
+	require.ErrorIs(t, err, ErrLocked)
+	copyPath := filepath.Join(t.TempDir(), "copy.img")
+	require.ErrorIs(t, Convert(imgPath, copyPath), ErrLocked)
+	assert.NoFileExists(t, copyPath)
+
+	// reverting or deleting a snapshot needs an exclusive lock, creating one
+	// a shared lock
+	require.NoError(t, exclusive.Unlock())
+	_, err = CreateSnapshot(imgPath, "snapshot", "", "")
+	require.NoError(t, err)
+	shared, err := Lock(imgPath, true)
+	require.NoError(t, err)
+	defer shared.Unlock()
+	require.ErrorIs(t, RevertSnapshot(imgPath, "snapshot"), ErrLocked)
+	require.ErrorIs(t, DeleteSnapshot(imgPath, "snapshot"), ErrLocked)
+
+	// resizing needs an exclusive lock, converting a shared lock
+	require.ErrorIs(t, Resize(imgPath, 2*1024*1024, false), ErrLocked)
+	require.NoError(t, Convert(imgPath, copyPath))
+
+	_, err = Lock(filepath.Join(t.TempDir(), "missing.img"), false)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	assert.EqualError(t, &LockedError{Path: imgPath, PID: 0}, imgPath+" is in use by another process")
+}
+
+func TestLockCheckPath(t *testing.T) {
+	lockHoldersDir = t.TempDir()
+	tmpDir := t.TempDir()
+	imgPath := filepath.Join(tmpDir, "disk.img")
+	require.NoError(t, Create(imgPath, 1024*1024))
+	lock, err := Lock(imgPath, false)
+	require.NoError(t, err)
+	defer lock.Unlock()
+	require.NoError(t, lock.checkPath(imgPath))
+
+	newPath := filepath.Join(tmpDir, "new.img")
+	require.NoError(t, Create(newPath, 1024*1024))
+	require.NoError(t, os.Rename(newPath, imgPath))
+	require.ErrorContains(t, lock.checkPath(imgPath), "was replaced")
+}
+
+func TestLockHolders(t *testing.T) {
+	lockHoldersDir = t.TempDir()
+	imgPath := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, Create(imgPath, 1024*1024))
+
+	lock, err := Lock(imgPath, false)
+	require.NoError(t, err)
+	holders, err := os.ReadDir(lockHoldersDir)
+	require.NoError(t, err)
+	require.Len(t, holders, 1)
+	assert.True(t, strings.HasSuffix(holders[0].Name(), fmt.Sprintf(".%d", os.Getpid())))
+
+	// the records of the processes which exited are ignored and removed
+	stalePath := filepath.Join(lockHoldersDir, strings.TrimSuffix(holders[0].Name(), strconv.Itoa(os.Getpid()))+"999999999")
+	require.NoError(t, os.WriteFile(stalePath, nil, 0600))
+	file, err := os.Open(imgPath)
+	require.NoError(t, err)
+	defer file.Close()
+	pids, err := lockHolders(file)
+	require.NoError(t, err)
+	assert.Equal(t, []int32{int32(os.Getpid())}, pids)
+	assert.NoFileExists(t, stalePath)
+
+	require.NoError(t, lock.Unlock())
+	holders, err = os.ReadDir(lockHoldersDir)
+	require.NoError(t, err)
+	assert.Empty(t, holders)
+	lock, err = Lock(imgPath, false)
+	require.NoError(t, err)
+	require.NoError(t, lock.Unlock())
+}
@@ -0,0 +1,501 @@
+package diskimage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The qcow2 format is described in
+// https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt
+
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+const (
+	qcow2V2HeaderLength = 72
+	qcow2V3HeaderLength = 104
+
+	qcow2MinClusterBits = 9
+	qcow2MaxClusterBits = 21
+	// qemu refuses L1 tables larger than 32MiB
+	qcow2MaxL1Size = 32 * 1024 * 1024 / 8
+
+	// bits 9-55 of L1 and L2 entries are the offset of the table or
+	// cluster in the image file
+	qcow2OffsetMask = 0x00fffffffffffe00
+	// L2 entries flags
+	qcow2CompressedFlag = uint64(1) << 62
+	qcow2ZeroFlag       = uint64(1)
+
+	qcow2CompressionZlib = 0
+	qcow2CompressionZstd = 1
+
+	// incompatible features
+	qcow2DirtyFeature              = uint64(1) << 0
+	qcow2CorruptFeature            = uint64(1) << 1
+	qcow2ExternalDataFeature       = uint64(1) << 2
+	qcow2CompressionTypeFeature    = uint64(1) << 3
+	qcow2ExtendedL2Feature         = uint64(1) << 4
+	qcow2SupportedIncompatFeatures = qcow2DirtyFeature | qcow2CompressionTypeFeature
+
+	// maximum length of a chain of backing files
+	maxBackingChainLength = 16
+)
+
+type qcow2Header struct {
+	version              uint32
+	backingFileOffset    uint64
+	backingFileSize      uint32
+	clusterBits          uint32
+	size                 uint64
+	cryptMethod          uint32
+	l1Size               uint32
+	l1TableOffset        uint64
+	refcountTableOffset  uint64
+	refcountClusters     uint32
+	nbSnapshots          uint32
+	incompatibleFeatures uint64
+	autoclearFeatures    uint64
+	refcountOrder        uint32
+	compressionType      uint8
+	backingFile          string
+}
+
+func (header *qcow2Header) clusterSize() uint64 {
+	return uint64(1) << header.clusterBits
+}
+
+func readQcow2Header(r io.ReaderAt) (*qcow2Header, error) {
+	buf := make([]byte, qcow2V3HeaderLength+1)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if n < qcow2V2HeaderLength || !bytes.Equal(buf[:len(qcow2Magic)], qcow2Magic) {
+		return nil, fmt.Errorf("not a qcow2 image")
+	}
+
+	be := binary.BigEndian
+	header := qcow2Header{
+		version:             be.Uint32(buf[4:]),
+		backingFileOffset:   be.Uint64(buf[8:]),
+		backingFileSize:     be.Uint32(buf[16:]),
+		clusterBits:         be.Uint32(buf[20:]),
+		size:                be.Uint64(buf[24:]),
+		cryptMethod:         be.Uint32(buf[32:]),
+		l1Size:              be.Uint32(buf[36:]),
+		l1TableOffset:       be.Uint64(buf[40:]),
+		refcountTableOffset: be.Uint64(buf[48:]),
+		refcountClusters:    be.Uint32(buf[56:]),
+		nbSnapshots:         be.Uint32(buf[60:]),
+		// version 2 images always use 16 bits refcounts
+		refcountOrder: 4,
+	}
+	switch header.version {
+	case 2:
+	case 3:
+		if n < qcow2V3HeaderLength {
+			return nil, fmt.Errorf("truncated qcow2 header")
+		}
+		header.incompatibleFeatures = be.Uint64(buf[72:])
+		header.autoclearFeatures = be.Uint64(buf[88:])
+		header.refcountOrder = be.Uint32(buf[96:])
+		headerLength := be.Uint32(buf[100:])
+		if headerLength > qcow2V3HeaderLength && n > qcow2V3HeaderLength {
+			header.compressionType = buf[104]
+		}
+	default:
+		return nil, fmt.Errorf("unsupported qcow2 version: %d", header.version)
+	}
+	if header.clusterBits < qcow2MinClusterBits || header.clusterBits > qcow2MaxClusterBits {
+		return nil, fmt.Errorf("invalid cluster size: 2^%d", header.clusterBits)
+	}
+	if header.size > uint64(1)<<62 {
+		return nil, fmt.Errorf("invalid virtual size: %d", header.size)
+	}
+
+	if header.backingFileOffset != 0 {
+		if header.backingFileSize == 0 || header.backingFileSize > qcow2MaxBackingFileName {
+			return nil, fmt.Errorf("invalid backing file name length: %d", header.backingFileSize)
+		}
+		backingFile := make([]byte, header.backingFileSize)
+		if _, err := r.ReadAt(backingFile, int64(header.backingFileOffset)); err != nil {
+			return nil, fmt.Errorf("failed to read backing file name: %w", err)
+		}
+		header.backingFile = string(backingFile)
+	}
+	return &header, nil
+}
+
+// checkFeatures returns an error if the image uses qcow2 features which are
+// not supported by this implementation
+func (header *qcow2Header) checkFeatures() error {
+	features := header.incompatibleFeatures
+	switch {
+	case header.cryptMethod != 0:
+		return fmt.Errorf("encrypted qcow2 images are not supported")
+	case features&qcow2CorruptFeature != 0:
+		return fmt.Errorf("qcow2 image is marked as corrupt")
+	case features&qcow2ExternalDataFeature != 0:
+		return fmt.Errorf("qcow2 images with an external data file are not supported")
+	case features&qcow2ExtendedL2Feature != 0:
+		return fmt.Errorf("qcow2 images with extended L2 entries are not supported")
+	case features&^qcow2SupportedIncompatFeatures != 0:
+		return fmt.Errorf("unsupported qcow2 incompatible features: %#x", features&^qcow2SupportedIncompatFeatures)
+	case header.compressionType != qcow2CompressionZlib && header.compressionType != qcow2CompressionZstd:
+		return fmt.Errorf("unsupported qcow2 compression type: %d", header.compressionType)
+	case header.l1Size > qcow2MaxL1Size:
+		return fmt.Errorf("qcow2 L1 table is too large: %d entries", header.l1Size)
+	}
+	return nil
+}
+
+type clusterKind int
+
+const (
+	// unallocated clusters are read from the backing file, or as zeros
+	clusterUnallocated clusterKind = iota
+	clusterZero
+	clusterData
+	clusterCompressed
+)
+
+// Qcow2 is a qcow2 image opened for reading, or for reading and writing.
+type Qcow2 struct {
+	file        *os.File
+	header      *qcow2Header
+	clusterSize int64
+	l1          []uint64
+	backing     Image
+	// backingPath is the path of the backing file, relative paths of the
+	// header are resolved from the directory of the image
+	backingPath string
+
+	// writable images only
+	writable       bool
+	refcountTable  []uint64
+	refcountBlocks map[uint64][]uint16
+	// offset of the end of the image file, new clusters are allocated there
+	fileEnd uint64
+
+	// rwMutex serializes writes with other reads and writes
+	rwMutex  sync.RWMutex
+	mutex    sync.Mutex
+	l2Tables map[uint64][]uint64
+	// the last decompressed cluster, compressed clusters are usually read
+	// sequentially in smaller chunks
+	compressedOffset uint64
+	compressedData   []byte
+}
+
+// OpenQcow2 opens the qcow2 image at path. Its backing file, if any, is also
+// opened.
+func OpenQcow2(path string) (*Qcow2, error) {
+	return openQcow2(path, 0, false)
+}
+
+func openQcow2(path string, depth int, writable bool) (*Qcow2, error) {
+	flags := os.O_RDONLY
+	if writable {
+		flags = os.O_RDWR
+	}
+	file, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		return nil, err
+	}
+	img, err := newQcow2(file, path, depth)
+	if err == nil && writable {
+		err = img.initWrites()
+	}
+	if err != nil {
+		if img != nil && img.backing != nil {
+			_ = img.backing.Close()
+		}
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to open qcow2 image %s: %w", path, err)
+	}
+	return img, nil
+}
+
+func newQcow2(file *os.File, path string, depth int) (*Qcow2, error) {
+	header, err := readQcow2Header(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := header.checkFeatures(); err != nil {
+		return nil, err
+	}
+
+	img := Qcow2{
+		file:        file,
+		header:      header,
+		clusterSize: int64(header.clusterSize()),
+		l1:          make([]uint64, header.l1Size),
+		l2Tables:    map[uint64][]uint64{},
+	}
+	l1 := make([]byte, 8*int(header.l1Size))
+	if _, err := file.ReadAt(l1, int64(header.l1TableOffset)); err != nil {
+		return nil, fmt.Errorf("failed to read L1 table: %w", err)
+	}
+	for i := range img.l1 {
+		img.l1[i] = binary.BigEndian.Uint64(l1[i*8:])
+	}
+
+	if header.backingFile != "" {
+		if depth >= maxBackingChainLength {
+			return nil, fmt.Errorf("too many backing files")
+		}
+		backingPath := header.backingFile
+		if !filepath.IsAbs(backingPath) {
+			backingPath = filepath.Join(filepath.Dir(path), backingPath)
+		}
+		img.backing, err = open(backingPath, depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open backing file: %w", err)
+		}
+		img.backingPath = backingPath
+	}
+	return &img, nil
+}
+
+func (img *Qcow2) Format() Format {
+	return QCOW2
+}
+
+// Size returns the virtual size of the image.
+func (img *Qcow2) Size() int64 {
+	return int64(img.header.size)
+}
+
+// BackingFile returns the backing file name stored in the image, it's empty
+// when the image has no backing file.
+func (img *Qcow2) BackingFile() string {
+	return img.header.backingFile
+}
+
+// BackingChain returns the paths of the backing files of the disk image at
+// path, starting with its own backing file. It's empty for raw images and for
+// qcow2 images without backing file.
+func BackingChain(path string) ([]string, error) {
+	img, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	chain := []string{}
+	for qcow2, ok := img.(*Qcow2); ok && qcow2.backing != nil; qcow2, ok = qcow2.backing.(*Qcow2) {
+		chain = append(chain, qcow2.backingPath)
+	}
+	return chain, nil
+}
+
+func (img *Qcow2) Close() error {
+	var backingErr error
+	if img.backing != nil {
+		backingErr = img.backing.Close()
+	}
+	return errors.Join(img.file.Close(), backingErr)
+}
+
+func (img *Qcow2) l2Table(offset uint64) ([]uint64, error) {
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+
+	if table, ok := img.l2Tables[offset]; ok {
+		return table, nil
+	}
+	buf := make([]byte, img.clusterSize)
+	if _, err := img.file.ReadAt(buf, int64(offset)); err != nil {
+		return nil, fmt.Errorf("failed to read L2 table at offset %d: %w", offset, err)
+	}
+	table := make([]uint64, img.clusterSize/8)
+	for i := range table {
+		table[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	img.l2Tables[offset] = table
+	return table, nil
+}
+
+// cluster returns the kind of the cluster containing the guest offset, and
+// its L2 entry
+func (img *Qcow2) cluster(offset int64) (clusterKind, uint64, error) {
+	l2Entries := img.clusterSize / 8
+	clusterIndex := offset / img.clusterSize
+	l1Index := clusterIndex / l2Entries
+	if l1Index >= int64(len(img.l1)) {
+		return clusterUnallocated, 0, nil
+	}
+	l2Offset := img.l1[l1Index] & qcow2OffsetMask
+	if l2Offset == 0 {
+		return clusterUnallocated, 0, nil
+	}
+	table, err := img.l2Table(l2Offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	entry := table[clusterIndex%l2Entries]
+
+	switch {
+	case entry&qcow2CompressedFlag != 0:
+		return clusterCompressed, entry, nil
+	case img.header.version >= 3 && entry&qcow2ZeroFlag != 0:
+		return clusterZero, entry, nil
+	case entry&qcow2OffsetMask == 0:
+		return clusterUnallocated, entry, nil
+	default:
+		return clusterData, entry, nil
+	}
+}
+
+// compressedRange returns the offset and size of the compressed data of the
+// cluster described by the L2 entry
+func (img *Qcow2) compressedRange(entry uint64) (uint64, uint64) {
+	// the number of bits used for the offset depends on the cluster size,
+	// the remaining bits are the number of additional 512 bytes sectors
+	// used by the compressed data
+	offsetBits := 62 - (img.header.clusterBits - 8)
+	hostOffset := entry & (uint64(1)<<offsetBits - 1)
+	sectors := (entry&(qcow2CompressedFlag-1))>>offsetBits + 1
+	return hostOffset, sectors*SectorSize - hostOffset%SectorSize
+}
+
+// readCompressed returns the uncompressed data of the cluster described by
+// the L2 entry
+func (img *Qcow2) readCompressed(entry uint64) ([]byte, error) {
+	hostOffset, compressedSize := img.compressedRange(entry)
+
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+	if img.compressedData != nil && img.compressedOffset == hostOffset {
+		return img.compressedData, nil
+	}
+
+	compressed := make([]byte, compressedSize)
+	n, err := img.file.ReadAt(compressed, int64(hostOffset))
+	// the last compressed cluster can end before the computed size
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	compressed = compressed[:n]
+
+	data := make([]byte, img.clusterSize)
+	switch img.header.compressionType {
+	case qcow2CompressionZstd:
+		decoder, err := zstd.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		if _, err := io.ReadFull(decoder, data); err != nil {
+			return nil, fmt.Errorf("failed to decompress cluster at offset %d: %w", hostOffset, err)
+		}
+	default:
+		decoder := flate.NewReader(bytes.NewReader(compressed))
+		defer decoder.Close()
+		if _, err := io.ReadFull(decoder, data); err != nil {
+			return nil, fmt.Errorf("failed to decompress cluster at offset %d: %w", hostOffset, err)
+		}
+	}
+	img.compressedOffset = hostOffset
+	img.compressedData = data
+	return data, nil
+}
+
+// readBacking reads p from the backing file at offset. The parts of p which
+// are beyond the end of the backing file, or all of p when there is no
+// backing file, are filled with zeros.
+func (img *Qcow2) readBacking(p []byte, offset int64) error {
+	n := 0
+	if img.backing != nil && offset < img.backing.Size() {
+		var err error
+		n, err = img.backing.ReadAt(p, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+	clear(p[n:])
+	return nil
+}
+
+// ReadAt reads len(p) bytes from the virtual disk at offset.
+func (img *Qcow2) ReadAt(p []byte, offset int64) (int, error) {
+	img.rwMutex.RLock()
+	defer img.rwMutex.RUnlock()
+	return img.readAt(p, offset)
+}
+
+func (img *Qcow2) readAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid offset: %d", offset)
+	}
+	if offset >= img.Size() {
+		return 0, io.EOF
+	}
+	var eof error
+	if remaining := img.Size() - offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+		eof = io.EOF
+	}
+
+	read := 0
+	for read < len(p) {
+		pos := offset + int64(read)
+		inCluster := pos % img.clusterSize
+		chunk := p[read:min(len(p), read+int(img.clusterSize-inCluster))]
+
+		kind, entry, err := img.cluster(pos)
+		if err != nil {
+			return read, err
+		}
+		switch kind {
+		case clusterUnallocated:
+			err = img.readBacking(chunk, pos)
+		case clusterZero:
+			clear(chunk)
+		case clusterData:
+			_, err = img.file.ReadAt(chunk, int64(entry&qcow2OffsetMask)+inCluster)
+		case clusterCompressed:
+			var data []byte
+			data, err = img.readCompressed(entry)
+			copy(chunk, data[inCluster:])
+		}
+		if err != nil {
+			return read, err
+		}
+		read += len(chunk)
+	}
+	return read, eof
+}
+
+// isZero returns true if the guest range [offset, offset+length) is known to
+// only contain zeros without reading it: it's only made of zero clusters, or
+// of unallocated clusters which are not backed by a backing file.
+func (img *Qcow2) isZero(offset, length int64) (bool, error) {
+	img.rwMutex.RLock()
+	defer img.rwMutex.RUnlock()
+	end := min(offset+length, img.Size())
+	for pos := offset - offset%img.clusterSize; pos < end; pos += img.clusterSize {
+		kind, _, err := img.cluster(pos)
+		if err != nil {
+			return false, err
+		}
+		switch kind {
+		case clusterZero:
+		case clusterUnallocated:
+			if img.backing != nil && pos < img.backing.Size() {
+				return false, nil
+			}
+		default:
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,109 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// cluster size of the images created by CreateQcow2, the default of
+	// qemu-img
+	qcow2DefaultClusterBits = 16
+	// header extension storing the format of the backing file
+	qcow2BackingFormatExtension = 0xe2792aca
+	qcow2MaxBackingFileName     = 1023
+)
+
+// CreateQcow2 creates an empty qcow2 image of size bytes at path. It fails if
+// path already exists. When backingFile is not empty, the image is a copy on
+// write overlay of the raw or qcow2 image backingFile, its unallocated
+// clusters are read from backingFile, and size can be 0 to use the size of
+// backingFile. A relative backingFile is relative to the directory of path.
+func CreateQcow2(path string, size uint64, backingFile string) error {
+	var backingFormat Format
+	if len(backingFile) > qcow2MaxBackingFileName {
+		return fmt.Errorf("backing file name is too long: %s", backingFile)
+	}
+	if backingFile != "" {
+		backingPath := backingFile
+		if !filepath.IsAbs(backingPath) {
+			backingPath = filepath.Join(filepath.Dir(path), backingPath)
+		}
+		backing, err := Open(backingPath)
+		if err != nil {
+			return fmt.Errorf("invalid backing file: %w", err)
+		}
+		backingFormat = backing.Format()
+		if size == 0 {
+			size = uint64(backing.Size())
+		}
+		_ = backing.Close()
+		if backingFormat == ISO {
+			backingFormat = Raw
+		}
+	}
+	if err := checkSize(size); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(newQcow2Image(size, backingFile, backingFormat)); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// newQcow2Image returns the content of an empty qcow2 image: the header, the
+// L1 table, the refcount table and a refcount block
+func newQcow2Image(size uint64, backingFile string, backingFormat Format) []byte {
+	const clusterSize = uint64(1) << qcow2DefaultClusterBits
+	l2Coverage := clusterSize / 8 * clusterSize
+	l1Size := (size + l2Coverage - 1) / l2Coverage
+	l1Clusters := max(1, (l1Size*8+clusterSize-1)/clusterSize)
+
+	l1Offset := clusterSize
+	refcountTableOffset := l1Offset + l1Clusters*clusterSize
+	refcountBlockOffset := refcountTableOffset + clusterSize
+	clusters := refcountBlockOffset/clusterSize + 1
+	image := make([]byte, clusters*clusterSize)
+
+	be := binary.BigEndian
+	copy(image, qcow2Magic)
+	be.PutUint32(image[4:], 3)
+	be.PutUint32(image[20:], qcow2DefaultClusterBits)
+	be.PutUint64(image[24:], size)
+	be.PutUint32(image[36:], uint32(l1Size))
+	be.PutUint64(image[40:], l1Offset)
+	be.PutUint64(image[48:], refcountTableOffset)
+	be.PutUint32(image[56:], 1)
+	be.PutUint32(image[96:], qcow2WritableRefcountOrder)
+	be.PutUint32(image[100:], qcow2V3HeaderLength)
+
+	// the header extensions follow the header, the backing file name
+	// follows the end of the header extensions
+	offset := uint64(qcow2V3HeaderLength)
+	if backingFile != "" {
+		be.PutUint32(image[offset:], qcow2BackingFormatExtension)
+		be.PutUint32(image[offset+4:], uint32(len(backingFormat)))
+		copy(image[offset+8:], backingFormat)
+		offset += 8 + (uint64(len(backingFormat))+7)/8*8
+		// end of the header extensions
+		offset += 8
+		be.PutUint64(image[8:], offset)
+		be.PutUint32(image[16:], uint32(len(backingFile)))
+		copy(image[offset:], backingFile)
+	}
+
+	be.PutUint64(image[refcountTableOffset:], refcountBlockOffset)
+	for i := range clusters {
+		be.PutUint16(image[refcountBlockOffset+i*2:], 1)
+	}
+	return image
+}
@@ -0,0 +1,537 @@
+package diskimage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCluster struct {
+	data       []byte
+	compressed bool
+	zero       bool
+}
+
+type testQcow2 struct {
+	clusterBits     uint32
+	size            uint64
+	clusters        map[int64]testCluster
+	backingFile     string
+	compressionType uint8
+	incompatible    uint64
+	cryptMethod     uint32
+}
+
+func compress(t *testing.T, compressionType uint8, data []byte) []byte {
+	buf := bytes.Buffer{}
+	if compressionType == qcow2CompressionZstd {
+		encoder, err := zstd.NewWriter(&buf)
+		require.NoError(t, err)
+		_, err = encoder.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, encoder.Close())
+		return buf.Bytes()
+	}
+	writer, err := flate.NewWriter(&buf, flate.BestCompression)
+	require.NoError(t, err)
+	_, err = writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return buf.Bytes()
+}
+
+// writeQcow2 writes a qcow2 v3 image with the clusters described by img. The
+// header is in the first cluster, followed by the L1 table, the L2 tables,
+// the data clusters, the refcount table and a single refcount block.
+func writeQcow2(t *testing.T, path string, img testQcow2) {
+	clusterSize := uint64(1) << img.clusterBits
+	l2Entries := clusterSize / 8
+	l1Size := (img.size + clusterSize*l2Entries - 1) / (clusterSize * l2Entries)
+	require.LessOrEqual(t, l1Size, l2Entries)
+
+	be := binary.BigEndian
+	header := make([]byte, 112)
+	copy(header, qcow2Magic)
+	be.PutUint32(header[4:], 3)
+	be.PutUint32(header[20:], img.clusterBits)
+	be.PutUint64(header[24:], img.size)
+	be.PutUint32(header[32:], img.cryptMethod)
+	be.PutUint32(header[36:], uint32(l1Size))
+	be.PutUint64(header[40:], clusterSize)
+	be.PutUint64(header[72:], img.incompatible)
+	be.PutUint32(header[96:], 4)
+	be.PutUint32(header[100:], 112)
+	header[104] = img.compressionType
+	if img.backingFile != "" {
+		be.PutUint64(header[8:], 512)
+		be.PutUint32(header[16:], uint32(len(img.backingFile)))
+	}
+
+	file := make([]byte, 2*clusterSize)
+	copy(file, header)
+	copy(file[512:], img.backingFile)
+
+	l2Tables := map[uint64]uint64{}
+	appendCluster := func(data []byte) uint64 {
+		offset := uint64(len(file))
+		padded := make([]byte, max(1, (uint64(len(data))+clusterSize-1)/clusterSize)*clusterSize)
+		copy(padded, data)
+		file = append(file, padded...)
+		return offset
+	}
+	for index, cluster := range img.clusters {
+		l1Index := uint64(index) / l2Entries
+		l2Offset, ok := l2Tables[l1Index]
+		if !ok {
+			l2Offset = appendCluster(nil)
+			l2Tables[l1Index] = l2Offset
+			be.PutUint64(file[clusterSize+l1Index*8:], l2Offset|1<<63)
+		}
+		var entry uint64
+		switch {
+		case cluster.zero:
+			entry = qcow2ZeroFlag
+		case cluster.compressed:
+			compressed := compress(t, img.compressionType, cluster.data)
+			// compressed clusters don't need to be aligned
+			offset := appendCluster(append(make([]byte, 100), compressed...)) + 100
+			sectors := (offset%SectorSize + uint64(len(compressed)) + SectorSize - 1) / SectorSize
+			offsetBits := 62 - (img.clusterBits - 8)
+			entry = qcow2CompressedFlag | (sectors-1)<<offsetBits | offset
+		default:
+			entry = appendCluster(cluster.data) | 1<<63
+		}
+		be.PutUint64(file[l2Offset+uint64(index)%l2Entries*8:], entry)
+	}
+
+	// all the clusters of the image have a refcount of 1
+	refcountTable := appendCluster(nil)
+	refcountBlock := appendCluster(nil)
+	clusters := uint64(len(file)) / clusterSize
+	require.LessOrEqual(t, clusters, clusterSize/2)
+	be.PutUint64(file[refcountTable:], refcountBlock)
+	for i := range clusters {
+		be.PutUint16(file[refcountBlock+i*2:], 1)
+	}
+	be.PutUint64(file[48:], refcountTable)
+	be.PutUint32(file[56:], 1)
+	require.NoError(t, os.WriteFile(path, file, 0600))
+}
+
+func fileContent(name string, size int) []byte {
+	line := []byte(name + "\n")
+	return bytes.Repeat(line, size/len(line)+1)[:size]
+}
+
+// expectedContent returns the content of the virtual disk of img, with the
+// unallocated clusters read from backing
+func expectedContent(img testQcow2, backing []byte) []byte {
+	clusterSize := int64(1) << img.clusterBits
+	content := make([]byte, img.size)
+	copy(content, backing)
+	for index, cluster := range img.clusters {
+		dest := content[index*clusterSize : (index+1)*clusterSize]
+		if cluster.zero {
+			clear(dest)
+		} else {
+			copy(dest, cluster.data)
+		}
+	}
+	return content
+}
+
+func testImage(compressionType uint8) testQcow2 {
+	const clusterSize = 4096
+	return testQcow2{
+		clusterBits: 12,
+		// 2 L2 tables are needed
+		size:            3 * 1024 * 1024,
+		compressionType: compressionType,
+		clusters: map[int64]testCluster{
+			0:   {data: fileContent("first", clusterSize)},
+			1:   {data: fileContent("compressed", clusterSize), compressed: true},
+			2:   {zero: true},
+			3:   {data: fileContent("compressed-2", clusterSize), compressed: true},
+			511: {data: fileContent("last of L2", clusterSize)},
+			512: {data: fileContent("first of L2", clusterSize)},
+			700: {data: make([]byte, clusterSize)},
+			767: {data: fileContent("last", clusterSize), compressed: true},
+		},
+	}
+}
+
+func TestQcow2Read(t *testing.T) {
+	for name, compressionType := range map[string]uint8{"zlib": qcow2CompressionZlib, "zstd": qcow2CompressionZstd} {
+		t.Run(name, func(t *testing.T) {
+			imgPath := filepath.Join(t.TempDir(), "disk.qcow2")
+			testImg := testImage(compressionType)
+			if compressionType == qcow2CompressionZstd {
+				testImg.incompatible = qcow2CompressionTypeFeature
+			}
+			writeQcow2(t, imgPath, testImg)
+			expected := expectedContent(testImg, nil)
+
+			img, err := Open(imgPath)
+			require.NoError(t, err)
+			defer img.Close()
+			assert.Equal(t, QCOW2, img.Format())
+			assert.Equal(t, int64(testImg.size), img.Size())
+
+			// reads crossing cluster boundaries
+			buf := make([]byte, 10000)
+			for _, offset := range []int64{0, 1000, 4096*511 - 17, 4096 * 765} {
+				n, err := img.ReadAt(buf, offset)
+				require.NoError(t, err)
+				assert.Equal(t, len(buf), n)
+				assert.Equal(t, expected[offset:offset+int64(len(buf))], buf)
+			}
+			n, err := img.ReadAt(buf, int64(testImg.size)-100)
+			require.ErrorIs(t, err, io.EOF)
+			assert.Equal(t, 100, n)
+			_, err = img.ReadAt(buf, int64(testImg.size))
+			require.ErrorIs(t, err, io.EOF)
+		})
+	}
+}
+
+func TestQcow2Backing(t *testing.T) {
+	tmpDir := t.TempDir()
+	// the backing file is smaller than the overlay
+	backing := fileContent("backing", 1024*1024)
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "backing.raw"), backing, 0600))
+
+	testImg := testQcow2{
+		clusterBits: 16,
+		size:        2 * 1024 * 1024,
+		backingFile: "backing.raw",
+		clusters: map[int64]testCluster{
+			1: {data: fileContent("overlay", 65536)},
+			2: {zero: true},
+			// beyond the end of the backing file
+			20: {data: fileContent("overlay-2", 65536), compressed: true},
+		},
+	}
+	imgPath := filepath.Join(tmpDir, "overlay.qcow2")
+	writeQcow2(t, imgPath, testImg)
+
+	info, err := Inspect(imgPath)
+	require.NoError(t, err)
+	assert.Equal(t, "backing.raw", info.BackingFile)
+
+	rawPath := filepath.Join(tmpDir, "disk.raw")
+	require.NoError(t, Convert(imgPath, rawPath))
+	converted, err := os.ReadFile(rawPath)
+	require.NoError(t, err)
+	assert.Equal(t, expectedContent(testImg, backing), converted)
+
+	chain, err := BackingChain(imgPath)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(tmpDir, "backing.raw")}, chain)
+	chain, err = BackingChain(rawPath)
+	require.NoError(t, err)
+	assert.Empty(t, chain)
+
+	require.NoError(t, os.Remove(filepath.Join(tmpDir, "backing.raw")))
+	_, err = Open(imgPath)
+	require.ErrorContains(t, err, "failed to open backing file")
+}
+
+func TestQcow2UnsupportedFeatures(t *testing.T) {
+	tests := map[string]struct {
+		img           testQcow2
+		expectedError string
+	}{
+		"Encrypted": {
+			img:           testQcow2{clusterBits: 16, size: 1024 * 1024, cryptMethod: 2},
+			expectedError: "encrypted qcow2 images are not supported",
+		},
+		"Corrupt": {
+			img:           testQcow2{clusterBits: 16, size: 1024 * 1024, incompatible: qcow2CorruptFeature},
+			expectedError: "qcow2 image is marked as corrupt",
+		},
+		"ExternalData": {
+			img:           testQcow2{clusterBits: 16, size: 1024 * 1024, incompatible: qcow2ExternalDataFeature},
+			expectedError: "qcow2 images with an external data file are not supported",
+		},
+		"ExtendedL2": {
+			img:           testQcow2{clusterBits: 16, size: 1024 * 1024, incompatible: qcow2ExtendedL2Feature},
+			expectedError: "qcow2 images with extended L2 entries are not supported",
+		},
+		"CompressionType": {
+			img:           testQcow2{clusterBits: 16, size: 1024 * 1024, compressionType: 2},
+			expectedError: "unsupported qcow2 compression type: 2",
+		},
+		"ClusterSize": {
+			img:           testQcow2{clusterBits: 8, size: 1024},
+			expectedError: "invalid cluster size: 2^8",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			imgPath := filepath.Join(t.TempDir(), "disk.qcow2")
+			writeQcow2(t, imgPath, test.img)
+			_, err := Open(imgPath)
+			require.ErrorContains(t, err, test.expectedError)
+		})
+	}
+}
+
+// checkRefcounts verifies that the refcount of every cluster of the qcow2
+// image at path is the number of references to it
+func checkRefcounts(t *testing.T, path string) {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	be := binary.BigEndian
+	clusterBits := be.Uint32(data[20:])
+	clusterSize := uint64(1) << clusterBits
+
+	expected := map[uint64]uint16{}
+	reference := func(offset, length uint64) {
+		for cluster := offset / clusterSize; cluster <= (offset+length-1)/clusterSize; cluster++ {
+			expected[cluster]++
+		}
+	}
+	reference(0, clusterSize)
+	l1Size, l1Offset := uint64(be.Uint32(data[36:])), be.Uint64(data[40:])
+	reference(l1Offset, l1Size*8)
+	for i := range l1Size {
+		l2Offset := be.Uint64(data[l1Offset+i*8:]) & qcow2OffsetMask
+		if l2Offset == 0 {
+			continue
+		}
+		reference(l2Offset, clusterSize)
+		for j := range clusterSize / 8 {
+			entry := be.Uint64(data[l2Offset+j*8:])
+			if entry&qcow2CompressedFlag != 0 {
+				offsetBits := 62 - (clusterBits - 8)
+				offset := entry & (uint64(1)<<offsetBits - 1)
+				sectors := (entry&(qcow2CompressedFlag-1))>>offsetBits + 1
+				reference(offset, sectors*SectorSize-offset%SectorSize)
+			} else if offset := entry & qcow2OffsetMask; offset != 0 {
+				reference(offset, clusterSize)
+			}
+		}
+	}
+	tableOffset, tableClusters := be.Uint64(data[48:]), uint64(be.Uint32(data[56:]))
+	reference(tableOffset, tableClusters*clusterSize)
+
+	blocks := map[uint64]uint64{}
+	for i := range tableClusters * clusterSize / 8 {
+		if blockOffset := be.Uint64(data[tableOffset+i*8:]) & qcow2OffsetMask; blockOffset != 0 {
+			reference(blockOffset, clusterSize)
+			blocks[i] = blockOffset
+		}
+	}
+
+	blockEntries := clusterSize / 2
+	for cluster, count := range expected {
+		blockOffset, ok := blocks[cluster/blockEntries]
+		require.True(t, ok, "cluster %d has no refcount block", cluster)
+		refcount := be.Uint16(data[blockOffset+cluster%blockEntries*2:])
+		assert.Equal(t, count, refcount, "refcount of cluster %d", cluster)
+	}
+	for i, blockOffset := range blocks {
+		for j := range blockEntries {
+			if _, ok := expected[i*blockEntries+j]; !ok {
+				assert.Zero(t, be.Uint16(data[blockOffset+j*2:]), "refcount of unused cluster %d", i*blockEntries+j)
+			}
+		}
+	}
+}
+
+func TestQcow2Write(t *testing.T) {
+	imgPath := filepath.Join(t.TempDir(), "disk.qcow2")
+	testImg := testImage(qcow2CompressionZlib)
+	// the last L2 table is not allocated
+	testImg.size = 5*1024*1024 - 1024
+	writeQcow2(t, imgPath, testImg)
+	checkRefcounts(t, imgPath)
+	expected := expectedContent(testImg, nil)
+
+	img, err := OpenWritable(imgPath)
+	require.NoError(t, err)
+	writes := map[int64][]byte{
+		// data cluster, modified in place
+		100: fileContent("in place", 1000),
+		// compressed and zero clusters, and across them
+		4096 + 10: fileContent("compressed", 2*4096),
+		// unallocated cluster in an allocated L2 table
+		4096 * 10: fileContent("unallocated", 4096),
+		// across L2 tables
+		4096*511 + 4000: fileContent("L2 boundary", 200),
+		// unallocated L2 table, up to the end of the disk
+		int64(testImg.size) - 5000: fileContent("last", 5000),
+	}
+	for offset, data := range writes {
+		n, err := img.WriteAt(data, offset)
+		require.NoError(t, err)
+		assert.Equal(t, len(data), n)
+		copy(expected[offset:], data)
+	}
+	_, err = img.WriteAt(make([]byte, 10), int64(testImg.size)-5)
+	require.ErrorContains(t, err, "write beyond the end of the disk")
+
+	content := make([]byte, testImg.size)
+	_, err = img.ReadAt(content, 0)
+	require.NoError(t, err)
+	assert.Equal(t, expected, content)
+	require.NoError(t, img.Sync())
+	require.NoError(t, img.Close())
+
+	checkRefcounts(t, imgPath)
+	rawPath := filepath.Join(t.TempDir(), "disk.raw")
+	require.NoError(t, Convert(imgPath, rawPath))
+	converted, err := os.ReadFile(rawPath)
+	require.NoError(t, err)
+	assert.Equal(t, expected, converted)
+
+	readOnly, err := OpenQcow2(imgPath)
+	require.NoError(t, err)
+	defer readOnly.Close()
+	_, err = readOnly.WriteAt([]byte{1}, 0)
+	require.ErrorContains(t, err, "qcow2 image is opened read-only")
+}
+
+func TestQcow2WriteBacking(t *testing.T) {
+	tmpDir := t.TempDir()
+	backing := fileContent("backing", 1024*1024)
+	backingPath := filepath.Join(tmpDir, "backing.raw")
+	require.NoError(t, os.WriteFile(backingPath, backing, 0600))
+
+	testImg := testQcow2{
+		clusterBits: 16,
+		size:        2 * 1024 * 1024,
+		backingFile: "backing.raw",
+	}
+	imgPath := filepath.Join(tmpDir, "overlay.qcow2")
+	writeQcow2(t, imgPath, testImg)
+	expected := expectedContent(testImg, backing)
+
+	img, err := OpenWritable(imgPath)
+	require.NoError(t, err)
+	data := fileContent("overlay", 1000)
+	_, err = img.WriteAt(data, 65536+100)
+	require.NoError(t, err)
+	copy(expected[65536+100:], data)
+	require.NoError(t, img.Close())
+	checkRefcounts(t, imgPath)
+
+	// the backing file is not modified, the rest of the cluster is copied
+	// from it
+	content, err := os.ReadFile(backingPath)
+	require.NoError(t, err)
+	assert.Equal(t, backing, content)
+	overlay, err := Open(imgPath)
+	require.NoError(t, err)
+	defer overlay.Close()
+	content = make([]byte, testImg.size)
+	_, err = overlay.ReadAt(content, 0)
+	require.NoError(t, err)
+	assert.Equal(t, expected, content)
+}
+
+func TestQcow2RefcountTableGrowth(t *testing.T) {
+	imgPath := filepath.Join(t.TempDir(), "disk.qcow2")
+	writeQcow2(t, imgPath, testQcow2{clusterBits: 12, size: 1024 * 1024})
+
+	img, err := openQcow2(imgPath, 0, true)
+	require.NoError(t, err)
+	// with 4KiB clusters, the single cluster refcount table covers 4GiB
+	offset := uint64(5 * 1024 * 1024 * 1024)
+	require.NoError(t, img.setRefcount(offset, 1))
+	assert.Greater(t, img.header.refcountClusters, uint32(1))
+	refcount, err := img.refcount(offset)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(1), refcount)
+	require.NoError(t, img.setRefcount(offset, 0))
+	require.NoError(t, img.Close())
+
+	checkRefcounts(t, imgPath)
+	// the image can be reopened with the new refcount table
+	img, err = openQcow2(imgPath, 0, true)
+	require.NoError(t, err)
+	_, err = img.WriteAt(fileContent("data", 4096), 0)
+	require.NoError(t, err)
+	require.NoError(t, img.Close())
+	checkRefcounts(t, imgPath)
+}
+
+func TestQcow2ReadOnlyFeatures(t *testing.T) {
+	imgPath := filepath.Join(t.TempDir(), "disk.qcow2")
+	writeQcow2(t, imgPath, testQcow2{clusterBits: 16, size: 1024 * 1024, incompatible: qcow2DirtyFeature})
+	_, err := OpenWritable(imgPath)
+	require.ErrorContains(t, err, "qcow2 image is dirty")
+
+	// the image can still be read
+	img, err := Open(imgPath)
+	require.NoError(t, err)
+	require.NoError(t, img.Close())
+}
+
+func TestCreateQcow2(t *testing.T) {
+	tmpDir := t.TempDir()
+	imgPath := filepath.Join(tmpDir, "disk.qcow2")
+	require.NoError(t, CreateQcow2(imgPath, 3*1024*1024*1024, ""))
+	require.ErrorIs(t, CreateQcow2(imgPath, 1024*1024, ""), os.ErrExist)
+	checkRefcounts(t, imgPath)
+
+	info, err := Inspect(imgPath)
+	require.NoError(t, err)
+	assert.Equal(t, QCOW2, info.Format)
+	assert.Equal(t, uint64(3*1024*1024*1024), info.VirtualSize)
+	assert.Equal(t, uint64(65536), info.ClusterSize)
+
+	img, err := OpenWritable(imgPath)
+	require.NoError(t, err)
+	data := fileContent("data", 100000)
+	offset := int64(2*1024*1024*1024 - 50000)
+	_, err = img.WriteAt(data, offset)
+	require.NoError(t, err)
+	require.NoError(t, img.Close())
+	checkRefcounts(t, imgPath)
+
+	img, err = OpenWritable(imgPath)
+	require.NoError(t, err)
+	defer img.Close()
+	content := make([]byte, len(data)+2)
+	_, err = img.ReadAt(content, offset-1)
+	require.NoError(t, err)
+	assert.Equal(t, append(append([]byte{0}, data...), 0), content)
+}
+
+func TestCreateQcow2Overlay(t *testing.T) {
+	tmpDir := t.TempDir()
+	backing := fileContent("backing", 1024*1024)
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "backing.raw"), backing, 0600))
+
+	imgPath := filepath.Join(tmpDir, "overlay.qcow2")
+	require.NoError(t, CreateQcow2(imgPath, 0, "backing.raw"))
+	checkRefcounts(t, imgPath)
+	info, err := Inspect(imgPath)
+	require.NoError(t, err)
+	assert.Equal(t, "backing.raw", info.BackingFile)
+	assert.Equal(t, uint64(len(backing)), info.VirtualSize)
+
+	img, err := OpenWritable(imgPath)
+	require.NoError(t, err)
+	defer img.Close()
+	data := fileContent("overlay", 1000)
+	_, err = img.WriteAt(data, 1000)
+	require.NoError(t, err)
+	content := make([]byte, len(backing))
+	_, err = img.ReadAt(content, 0)
+	require.NoError(t, err)
+	copy(backing[1000:], data)
+	assert.Equal(t, backing, content)
+
+	err = CreateQcow2(filepath.Join(tmpDir, "invalid.qcow2"), 0, "missing.raw")
+	require.ErrorContains(t, err, "invalid backing file")
+}
@@ -0,0 +1,370 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Writes to qcow2 images never modify clusters which are shared or
+// compressed, a new cluster is allocated instead (copy on write). New
+// clusters are always allocated at the end of the image file, the clusters
+// which are no longer used get a refcount of 0 but are not reused.
+
+const (
+	// L1 and L2 entries flag set when the refcount of the table or cluster
+	// is exactly 1, it can then be modified in place
+	qcow2CopiedFlag = uint64(1) << 63
+
+	// refcount order of 16 bits refcounts, the default of qemu-img and the
+	// only one supported for writing
+	qcow2WritableRefcountOrder = 4
+
+	qcow2RefcountTableOffsetField = 48
+	qcow2AutoclearFeaturesField   = 88
+)
+
+// checkWritable returns an error if the image can't be written to by this
+// implementation
+func (header *qcow2Header) checkWritable() error {
+	switch {
+	case header.incompatibleFeatures&qcow2DirtyFeature != 0:
+		return fmt.Errorf("qcow2 image is dirty, repair it with 'qemu-img check -r all'")
+	case header.nbSnapshots != 0:
+		return fmt.Errorf("writing to qcow2 images with internal snapshots is not supported")
+	case header.refcountOrder != qcow2WritableRefcountOrder:
+		return fmt.Errorf("writing to qcow2 images with %d bits refcounts is not supported", 1<<header.refcountOrder)
+	case header.refcountClusters == 0:
+		return fmt.Errorf("qcow2 image has no refcount table")
+	}
+	return nil
+}
+
+// initWrites reads the refcount table, and clears the autoclear features as
+// the metadata they describe, such as dirty bitmaps, is not updated on writes
+func (img *Qcow2) initWrites() error {
+	if err := img.header.checkWritable(); err != nil {
+		return err
+	}
+
+	table := make([]byte, uint64(img.header.refcountClusters)*uint64(img.clusterSize))
+	if _, err := img.file.ReadAt(table, int64(img.header.refcountTableOffset)); err != nil {
+		return fmt.Errorf("failed to read refcount table: %w", err)
+	}
+	img.refcountTable = make([]uint64, len(table)/8)
+	for i := range img.refcountTable {
+		img.refcountTable[i] = binary.BigEndian.Uint64(table[i*8:])
+	}
+	img.refcountBlocks = map[uint64][]uint16{}
+
+	stat, err := img.file.Stat()
+	if err != nil {
+		return err
+	}
+	img.fileEnd = img.alignCluster(uint64(stat.Size()))
+
+	if img.header.autoclearFeatures != 0 {
+		if _, err := img.file.WriteAt(make([]byte, 8), qcow2AutoclearFeaturesField); err != nil {
+			return err
+		}
+		img.header.autoclearFeatures = 0
+	}
+	img.writable = true
+	return nil
+}
+
+func (img *Qcow2) alignCluster(offset uint64) uint64 {
+	clusterSize := uint64(img.clusterSize)
+	return (offset + clusterSize - 1) / clusterSize * clusterSize
+}
+
+func (img *Qcow2) writeUint64(value uint64, offset uint64) error {
+	buf := binary.BigEndian.AppendUint64(nil, value)
+	_, err := img.file.WriteAt(buf, int64(offset))
+	return err
+}
+
+// WriteAt writes len(p) bytes to the virtual disk at offset.
+func (img *Qcow2) WriteAt(p []byte, offset int64) (int, error) {
+	if !img.writable {
+		return 0, fmt.Errorf("qcow2 image is opened read-only")
+	}
+	if offset < 0 || offset+int64(len(p)) > img.Size() {
+		return 0, fmt.Errorf("write beyond the end of the disk: offset %d, length %d", offset, len(p))
+	}
+	img.rwMutex.Lock()
+	defer img.rwMutex.Unlock()
+
+	written := 0
+	for written < len(p) {
+		pos := offset + int64(written)
+		inCluster := pos % img.clusterSize
+		chunk := p[written:min(len(p), written+int(img.clusterSize-inCluster))]
+		if err := img.writeCluster(chunk, pos-inCluster, inCluster); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// writeCluster writes data at offset inCluster of the guest cluster starting
+// at clusterOffset
+func (img *Qcow2) writeCluster(data []byte, clusterOffset int64, inCluster int64) error {
+	kind, entry, err := img.cluster(clusterOffset)
+	if err != nil {
+		return err
+	}
+	if kind == clusterData && entry&qcow2CopiedFlag != 0 {
+		_, err := img.file.WriteAt(data, int64(entry&qcow2OffsetMask)+inCluster)
+		return err
+	}
+
+	// the new cluster is made of the current content of the cluster,
+	// overwritten with data
+	cluster := data
+	if int64(len(data)) != img.clusterSize {
+		cluster = make([]byte, img.clusterSize)
+		// the last cluster can extend beyond the end of the disk
+		if _, err := img.readAt(cluster, clusterOffset); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		copy(cluster[inCluster:], data)
+	}
+	hostOffset, err := img.allocateClusters(1)
+	if err != nil {
+		return err
+	}
+	if _, err := img.file.WriteAt(cluster, int64(hostOffset)); err != nil {
+		return err
+	}
+	if err := img.setL2Entry(clusterOffset, hostOffset|qcow2CopiedFlag); err != nil {
+		return err
+	}
+	return img.release(kind, entry)
+}
+
+// setL2Entry sets the L2 entry of the guest cluster at offset, allocating the
+// L2 table if needed
+func (img *Qcow2) setL2Entry(offset int64, entry uint64) error {
+	l2Entries := img.clusterSize / 8
+	clusterIndex := offset / img.clusterSize
+	l1Index := clusterIndex / l2Entries
+	if l1Index >= int64(len(img.l1)) {
+		return fmt.Errorf("offset %d is not covered by the L1 table", offset)
+	}
+
+	l2Offset := img.l1[l1Index] & qcow2OffsetMask
+	switch {
+	case l2Offset == 0:
+		var err error
+		l2Offset, err = img.allocateClusters(1)
+		if err != nil {
+			return err
+		}
+		if _, err := img.file.WriteAt(make([]byte, img.clusterSize), int64(l2Offset)); err != nil {
+			return err
+		}
+		img.mutex.Lock()
+		img.l2Tables[l2Offset] = make([]uint64, l2Entries)
+		img.mutex.Unlock()
+		img.l1[l1Index] = l2Offset | qcow2CopiedFlag
+		if err := img.writeUint64(img.l1[l1Index], img.header.l1TableOffset+uint64(l1Index)*8); err != nil {
+			return err
+		}
+	case img.l1[l1Index]&qcow2CopiedFlag == 0:
+		return fmt.Errorf("writing to shared L2 tables is not supported")
+	}
+
+	table, err := img.l2Table(l2Offset)
+	if err != nil {
+		return err
+	}
+	l2Index := clusterIndex % l2Entries
+	table[l2Index] = entry
+	return img.writeUint64(entry, l2Offset+uint64(l2Index)*8)
+}
+
+// release decrements the refcounts of the host clusters used by the L2 entry
+// which was replaced
+func (img *Qcow2) release(kind clusterKind, entry uint64) error {
+	var offset, size uint64
+	switch kind {
+	case clusterCompressed:
+		offset, size = img.compressedRange(entry)
+	case clusterData, clusterZero:
+		// zero clusters can be preallocated
+		offset, size = entry&qcow2OffsetMask, uint64(img.clusterSize)
+	}
+	if offset == 0 {
+		return nil
+	}
+	for cluster := offset - offset%uint64(img.clusterSize); cluster < offset+size; cluster += uint64(img.clusterSize) {
+		refcount, err := img.refcount(cluster)
+		if err != nil {
+			return err
+		}
+		if refcount == 0 {
+			return fmt.Errorf("cluster at offset %d is used but has a refcount of 0", cluster)
+		}
+		if err := img.setRefcount(cluster, refcount-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocateClusters allocates count contiguous clusters at the end of the image
+// file, with a refcount of 1, and returns the offset of the first one
+func (img *Qcow2) allocateClusters(count uint64) (uint64, error) {
+	offset := img.fileEnd
+	img.fileEnd += count * uint64(img.clusterSize)
+	for i := range count {
+		if err := img.setRefcount(offset+i*uint64(img.clusterSize), 1); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// refcountBlock returns the refcount block at offset in the image file
+func (img *Qcow2) refcountBlock(offset uint64) ([]uint16, error) {
+	if block, ok := img.refcountBlocks[offset]; ok {
+		return block, nil
+	}
+	buf := make([]byte, img.clusterSize)
+	if _, err := img.file.ReadAt(buf, int64(offset)); err != nil {
+		return nil, fmt.Errorf("failed to read refcount block at offset %d: %w", offset, err)
+	}
+	block := make([]uint16, img.clusterSize/2)
+	for i := range block {
+		block[i] = binary.BigEndian.Uint16(buf[i*2:])
+	}
+	img.refcountBlocks[offset] = block
+	return block, nil
+}
+
+// refcountIndexes returns the refcount table index and the refcount block
+// index of the refcount of the host cluster at offset
+func (img *Qcow2) refcountIndexes(offset uint64) (uint64, uint64) {
+	blockEntries := uint64(img.clusterSize / 2)
+	clusterIndex := offset / uint64(img.clusterSize)
+	return clusterIndex / blockEntries, clusterIndex % blockEntries
+}
+
+// refcount returns the refcount of the host cluster at offset
+func (img *Qcow2) refcount(offset uint64) (uint16, error) {
+	tableIndex, blockIndex := img.refcountIndexes(offset)
+	if tableIndex >= uint64(len(img.refcountTable)) {
+		return 0, nil
+	}
+	blockOffset := img.refcountTable[tableIndex] & qcow2OffsetMask
+	if blockOffset == 0 {
+		return 0, nil
+	}
+	block, err := img.refcountBlock(blockOffset)
+	if err != nil {
+		return 0, err
+	}
+	return block[blockIndex], nil
+}
+
+// setRefcount sets the refcount of the host cluster at offset, allocating a
+// refcount block and growing the refcount table if needed
+func (img *Qcow2) setRefcount(offset uint64, refcount uint16) error {
+	tableIndex, blockIndex := img.refcountIndexes(offset)
+	if tableIndex >= uint64(len(img.refcountTable)) {
+		if err := img.growRefcountTable(tableIndex + 1); err != nil {
+			return err
+		}
+	}
+
+	blockOffset := img.refcountTable[tableIndex] & qcow2OffsetMask
+	if blockOffset == 0 {
+		blockOffset = img.fileEnd
+		img.fileEnd += uint64(img.clusterSize)
+		if _, err := img.file.WriteAt(make([]byte, img.clusterSize), int64(blockOffset)); err != nil {
+			return err
+		}
+		img.refcountBlocks[blockOffset] = make([]uint16, img.clusterSize/2)
+		img.refcountTable[tableIndex] = blockOffset
+		if err := img.writeUint64(blockOffset, img.header.refcountTableOffset+tableIndex*8); err != nil {
+			return err
+		}
+		// the new refcount block needs a refcount too, it may be
+		// stored in itself
+		if err := img.setRefcount(blockOffset, 1); err != nil {
+			return err
+		}
+	}
+
+	block, err := img.refcountBlock(blockOffset)
+	if err != nil {
+		return err
+	}
+	block[blockIndex] = refcount
+	buf := binary.BigEndian.AppendUint16(nil, refcount)
+	_, err = img.file.WriteAt(buf, int64(blockOffset+blockIndex*2))
+	return err
+}
+
+// growRefcountTable replaces the refcount table with a new one of at least
+// minEntries entries, allocated at the end of the image file
+func (img *Qcow2) growRefcountTable(minEntries uint64) error {
+	clusterSize := uint64(img.clusterSize)
+	tableEntries := clusterSize / 8
+	// bytes of the image file covered by a refcount table entry
+	entryCoverage := clusterSize / 2 * clusterSize
+
+	entries := max(2*uint64(len(img.refcountTable)), minEntries)
+	for {
+		entries = (entries + tableEntries - 1) / tableEntries * tableEntries
+		// leave room for the new table and the refcount blocks
+		// describing it
+		if entries*entryCoverage >= 2*(img.fileEnd+entries*8) {
+			break
+		}
+		entries *= 2
+	}
+
+	table := make([]uint64, entries)
+	copy(table, img.refcountTable)
+	buf := make([]byte, entries*8)
+	for i, entry := range table {
+		binary.BigEndian.PutUint64(buf[i*8:], entry)
+	}
+	tableOffset := img.fileEnd
+	tableClusters := entries / tableEntries
+	img.fileEnd += tableClusters * clusterSize
+	if _, err := img.file.WriteAt(buf, int64(tableOffset)); err != nil {
+		return err
+	}
+
+	header := binary.BigEndian.AppendUint64(nil, tableOffset)
+	header = binary.BigEndian.AppendUint32(header, uint32(tableClusters))
+	if _, err := img.file.WriteAt(header, qcow2RefcountTableOffsetField); err != nil {
+		return err
+	}
+	oldOffset, oldClusters := img.header.refcountTableOffset, uint64(img.header.refcountClusters)
+	img.header.refcountTableOffset = tableOffset
+	img.header.refcountClusters = uint32(tableClusters)
+	img.refcountTable = table
+
+	for i := range tableClusters {
+		if err := img.setRefcount(tableOffset+i*clusterSize, 1); err != nil {
+			return err
+		}
+	}
+	for i := range oldClusters {
+		if err := img.setRefcount(oldOffset+i*clusterSize, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync commits the data written to the image to stable storage.
+func (img *Qcow2) Sync() error {
+	return img.file.Sync()
+}
@@ -0,0 +1,95 @@
+package diskimage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrShrink is returned by Resize when shrinking a disk image without
+// allowing it, as the data at the end of the disk is lost
+var ErrShrink = errors.New("shrinking a disk image discards the data at its end")
+
+// Create creates a sparse raw disk image of size bytes at path. It fails if
+// path already exists. size must be a multiple of 512 bytes.
+func Create(path string, size uint64) error {
+	if err := checkSize(size); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(int64(size)); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// Resize changes the size of the raw disk image at path to size bytes. The
+// added space is sparse. ErrShrink is returned if the new size is smaller
+// than the current size and allowShrink is false. It fails if the image is
+// used by a running vfkit process.
+func Resize(path string, size uint64, allowShrink bool) error {
+	if err := checkSize(size); err != nil {
+		return err
+	}
+	lock, err := Lock(path, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	format, err := DetectFile(path)
+	if err != nil {
+		return err
+	}
+	if format != Raw {
+		return fmt.Errorf("only raw disk images can be resized, %s is a %s image", path, format)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	if size < uint64(stat.Size()) && !allowShrink {
+		_ = file.Close()
+		return fmt.Errorf("%w: %s is %s, new size is %s", ErrShrink, path, FormatSize(uint64(stat.Size())), FormatSize(size))
+	}
+	if err := file.Truncate(int64(size)); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ParseNewSize parses the new size of a disk image whose current size is
+// currentSize. newSize is either an absolute size such as "20GiB", or a size
+// relative to currentSize such as "+5GiB" or "-1GiB".
+func ParseNewSize(currentSize uint64, newSize string) (uint64, error) {
+	sign := ""
+	if strings.HasPrefix(newSize, "+") || strings.HasPrefix(newSize, "-") {
+		sign, newSize = newSize[:1], newSize[1:]
+	}
+	size, err := ParseSize(newSize)
+	if err != nil {
+		return 0, err
+	}
+	switch sign {
+	case "+":
+		return currentSize + size, nil
+	case "-":
+		if size > currentSize {
+			return 0, fmt.Errorf("cannot shrink disk image by %s, its size is %s", FormatSize(size), FormatSize(currentSize))
+		}
+		return currentSize - size, nil
+	default:
+		return size, nil
+	}
+}
@@ -0,0 +1,84 @@
+package diskimage
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// SectorSize is the granularity of disk image sizes
+const SectorSize = 512
+
+var sizeSuffixes = []struct {
+	suffixes   []string
+	multiplier float64
+}{
+	{[]string{"", "b"}, 1},
+	{[]string{"k", "kib", "kb"}, 1 << 10},
+	{[]string{"m", "mib", "mb"}, 1 << 20},
+	{[]string{"g", "gib", "gb"}, 1 << 30},
+	{[]string{"t", "tib", "tb"}, 1 << 40},
+	{[]string{"p", "pib", "pb"}, 1 << 50},
+}
+
+// ParseSize parses a disk size such as "20GiB", "512M" or "1.5T". As with
+// qemu-img, all suffixes are binary multiples, "20G", "20GB" and "20GiB" are
+// all 20*1024*1024*1024 bytes. Sizes without suffix are in bytes.
+func ParseSize(size string) (uint64, error) {
+	trimmed := strings.TrimSpace(size)
+	i := strings.IndexFunc(trimmed, func(c rune) bool {
+		return (c < '0' || c > '9') && c != '.'
+	})
+	if i == -1 {
+		i = len(trimmed)
+	}
+	number, suffix := trimmed[:i], strings.ToLower(strings.TrimSpace(trimmed[i:]))
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	for _, unit := range sizeSuffixes {
+		for _, s := range unit.suffixes {
+			if suffix != s {
+				continue
+			}
+			bytes := math.Round(value * unit.multiplier)
+			if bytes >= math.MaxInt64 {
+				return 0, fmt.Errorf("size is too large: %s", size)
+			}
+			return uint64(bytes), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid size suffix: %s", size)
+}
+
+// FormatSize returns a human readable representation of size, such as
+// "20 GiB" or "1.5 MiB".
+func FormatSize(size uint64) string {
+	units := []string{"bytes", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[unit])
+	}
+	formatted := strings.TrimRight(strconv.FormatFloat(value, 'f', 2, 64), "0")
+	return strings.TrimSuffix(formatted, ".") + " " + units[unit]
+}
+
+func checkSize(size uint64) error {
+	if size == 0 {
+		return fmt.Errorf("disk size must be greater than 0")
+	}
+	if size%SectorSize != 0 {
+		return fmt.Errorf("disk size must be a multiple of %d bytes: %d", SectorSize, size)
+	}
+	if size > math.MaxInt64 {
+		return fmt.Errorf("disk size is too large: %d", size)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package diskimage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// Snapshots of a raw disk image are clones of the image stored in a
+// directory next to it, <image>.snapshots, with a snapshots.json manifest
+// describing them.
+
+const snapshotManifestName = "snapshots.json"
+
+var snapshotNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ErrSnapshotNotFound is returned when a snapshot does not exist.
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// Snapshot is a point-in-time clone of a raw disk image.
+type Snapshot struct {
+	Name string `json:"name"`
+	// File is the name of the clone in the snapshot directory
+	File    string    `json:"file"`
+	Created time.Time `json:"created"`
+	// VMConfigHash identifies the configuration of the virtual machine
+	// using the disk image when the snapshot was created
+	VMConfigHash string `json:"vmConfigHash,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+type snapshotManifest struct {
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+// SnapshotDir returns the directory storing the snapshots of the disk image
+// at imagePath.
+func SnapshotDir(imagePath string) string {
+	return imagePath + ".snapshots"
+}
+
+// lockSnapshotImage locks the disk image at imagePath while a snapshot is
+// created from it (shared lock), or while it is reverted or one of its
+// snapshots is deleted (exclusive lock). It fails if the image is not a raw
+// image, or if it is used by a running vfkit process.
+func lockSnapshotImage(imagePath string, shared bool) (*ImageLock, error) {
+	format, err := DetectFile(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	if format != Raw {
+		return nil, fmt.Errorf("snapshots are only supported for raw disk images, %s is a %s image", imagePath, format)
+	}
+	lock, err := Lock(imagePath, shared)
+	if err != nil {
+		return nil, err
+	}
+	// a revert may have renamed a new image over imagePath between the open
+	// and the flock, the lock would then protect the replaced image
+	if err := lock.checkPath(imagePath); err != nil {
+		_ = lock.Unlock()
+		return nil, err
+	}
+	return lock, nil
+}
+
+func readSnapshotManifest(imagePath string) (*snapshotManifest, error) {
+	data, err := os.ReadFile(filepath.Join(SnapshotDir(imagePath), snapshotManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return &snapshotManifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest snapshotManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid snapshot manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// write atomically replaces the snapshot manifest of the disk image
+func (manifest *snapshotManifest) write(imagePath string) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestPath := filepath.Join(SnapshotDir(imagePath), snapshotManifestName)
+	tmpPath := manifestPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, manifestPath)
+}
+
+func (manifest *snapshotManifest) find(name string) int {
+	return slices.IndexFunc(manifest.Snapshots, func(snapshot Snapshot) bool {
+		return snapshot.Name == name
+	})
+}
+
+// CreateSnapshot creates the snapshot name of the raw disk image at
+// imagePath. It fails if the image is used by a running vfkit process.
+func CreateSnapshot(imagePath, name, description, vmConfigHash string) (*Snapshot, error) {
+	if !snapshotNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid snapshot name: %q", name)
+	}
+	lock, err := lockSnapshotImage(imagePath, true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	if err := os.MkdirAll(SnapshotDir(imagePath), 0755); err != nil {
+		return nil, err
+	}
+	manifest, err := readSnapshotManifest(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.find(name) != -1 {
+		return nil, fmt.Errorf("snapshot %s of %s already exists", name, imagePath)
+	}
+
+	snapshot := Snapshot{
+		Name:         name,
+		File:         name + ".raw",
+		Created:      time.Now().UTC().Truncate(time.Second),
+		VMConfigHash: vmConfigHash,
+		Description:  description,
+	}
+	snapshotPath := filepath.Join(SnapshotDir(imagePath), snapshot.File)
+	if err := cloneRaw(imagePath, snapshotPath); err != nil {
+		return nil, err
+	}
+	manifest.Snapshots = append(manifest.Snapshots, snapshot)
+	if err := manifest.write(imagePath); err != nil {
+		_ = os.Remove(snapshotPath)
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// ListSnapshots returns the snapshots of the disk image at imagePath, from
+// the oldest to the newest.
+func ListSnapshots(imagePath string) ([]Snapshot, error) {
+	if _, err := os.Stat(imagePath); err != nil {
+		return nil, err
+	}
+	manifest, err := readSnapshotManifest(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Snapshots, nil
+}
+
+// RevertSnapshot replaces the content of the raw disk image at imagePath with
+// the content of its snapshot name. The snapshot is kept. It fails if the
+// image is used by a running vfkit process.
+func RevertSnapshot(imagePath, name string) error {
+	lock, err := lockSnapshotImage(imagePath, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	manifest, err := readSnapshotManifest(imagePath)
+	if err != nil {
+		return err
+	}
+	index := manifest.find(name)
+	if index == -1 {
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+
+	stat, err := lock.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// the clone is renamed over the image so that the image is never
+	// partially reverted. It is locked before the rename, as the lock of the
+	// image doesn't protect the clone once it replaced the image.
+	snapshotPath := filepath.Join(SnapshotDir(imagePath), manifest.Snapshots[index].File)
+	tmpPath := filepath.Join(filepath.Dir(imagePath), fmt.Sprintf(".%s.revert-%d", filepath.Base(imagePath), os.Getpid()))
+	if err := cloneRaw(snapshotPath, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, stat.Mode().Perm()); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	cloneLock, err := Lock(tmpPath, false)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	defer cloneLock.Unlock()
+	if err := os.Rename(tmpPath, imagePath); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// DeleteSnapshot deletes the snapshot name of the raw disk image at
+// imagePath. It fails if the image is used by a running vfkit process.
+func DeleteSnapshot(imagePath, name string) error {
+	lock, err := lockSnapshotImage(imagePath, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	manifest, err := readSnapshotManifest(imagePath)
+	if err != nil {
+		return err
+	}
+	index := manifest.find(name)
+	if index == -1 {
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+	snapshot := manifest.Snapshots[index]
+	manifest.Snapshots = slices.Delete(manifest.Snapshots, index, index+1)
+	if err := manifest.write(imagePath); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(SnapshotDir(imagePath), snapshot.File)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(manifest.Snapshots) == 0 {
+		_ = os.Remove(filepath.Join(SnapshotDir(imagePath), snapshotManifestName))
+		_ = os.Remove(SnapshotDir(imagePath))
+	}
+	return nil
+}
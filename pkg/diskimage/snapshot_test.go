@@ -0,0 +1,73 @@
+package diskimage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshots(t *testing.T) {
+	tmpDir := t.TempDir()
+	imgPath := filepath.Join(tmpDir, "disk.raw")
+	require.NoError(t, Create(imgPath, 1024*1024))
+	data := fileContent("before", 10000)
+	require.NoError(t, writeFileAt(imgPath, data, 0))
+
+	snapshots, err := ListSnapshots(imgPath)
+	require.NoError(t, err)
+	assert.Empty(t, snapshots)
+
+	snapshot, err := CreateSnapshot(imgPath, "clean", "fresh install", "sha256:1234")
+	require.NoError(t, err)
+	assert.Equal(t, "clean", snapshot.Name)
+	assert.Equal(t, "fresh install", snapshot.Description)
+	assert.Equal(t, "sha256:1234", snapshot.VMConfigHash)
+	assert.False(t, snapshot.Created.IsZero())
+	_, err = CreateSnapshot(imgPath, "clean", "", "")
+	require.ErrorContains(t, err, "already exists")
+	_, err = CreateSnapshot(imgPath, "../escape", "", "")
+	require.ErrorContains(t, err, "invalid snapshot name")
+
+	original, err := os.ReadFile(imgPath)
+	require.NoError(t, err)
+	require.NoError(t, writeFileAt(imgPath, fileContent("after", 10000), 0))
+	_, err = CreateSnapshot(imgPath, "modified", "", "")
+	require.NoError(t, err)
+
+	snapshots, err = ListSnapshots(imgPath)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, *snapshot, snapshots[0])
+	assert.Equal(t, "modified", snapshots[1].Name)
+
+	require.NoError(t, RevertSnapshot(imgPath, "clean"))
+	content, err := os.ReadFile(imgPath)
+	require.NoError(t, err)
+	assert.Equal(t, original, content)
+	require.ErrorIs(t, RevertSnapshot(imgPath, "missing"), ErrSnapshotNotFound)
+
+	// the reverted image keeps the mode of the image
+	require.NoError(t, os.Chmod(imgPath, 0600))
+	require.NoError(t, RevertSnapshot(imgPath, "modified"))
+	stat, err := os.Stat(imgPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	require.NoError(t, DeleteSnapshot(imgPath, "clean"))
+	require.ErrorIs(t, DeleteSnapshot(imgPath, "clean"), ErrSnapshotNotFound)
+	snapshots, err = ListSnapshots(imgPath)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	assert.NoFileExists(t, filepath.Join(SnapshotDir(imgPath), "clean.raw"))
+	require.NoError(t, DeleteSnapshot(imgPath, "modified"))
+	assert.NoDirExists(t, SnapshotDir(imgPath))
+
+	// snapshots of qcow2 images are not supported
+	qcow2Path := filepath.Join(tmpDir, "disk.qcow2")
+	require.NoError(t, CreateQcow2(qcow2Path, 1024*1024, ""))
+	_, err = CreateSnapshot(qcow2Path, "clean", "", "")
+	require.ErrorContains(t, err, "only supported for raw disk images")
+}
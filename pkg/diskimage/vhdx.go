@@ -0,0 +1,100 @@
+package diskimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The VHDX format is described in
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-vhdx/
+const (
+	vhdxRegionTableOffset = 192 * 1024
+	vhdxRegionEntrySize   = 32
+	vhdxMetadataEntrySize = 32
+	vhdxMaxEntries        = 2047
+)
+
+var (
+	vhdxRegionTableMagic  = []byte("regi")
+	vhdxMetadataMagic     = []byte("metadata")
+	vhdxMetadataRegion    = guidBytes("8b7ca206-4790-4b9a-b8fe-575f050f886e")
+	vhdxVirtualDiskSizeID = guidBytes("2fa54224-cd1b-4876-b211-5dbed83bf4b8")
+)
+
+// guidBytes returns the on-disk representation of guid, the first 3 fields of
+// GUIDs are stored in little endian order
+func guidBytes(guid string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(guid, "-", ""))
+	if err != nil || len(b) != 16 {
+		panic("invalid GUID: " + guid)
+	}
+	for _, field := range [][2]int{{0, 4}, {4, 6}, {6, 8}} {
+		for i, j := field[0], field[1]-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+	}
+	return b
+}
+
+// vhdxVirtualSize reads the virtual size of a VHDX image from its metadata
+// region
+func vhdxVirtualSize(r io.ReaderAt) (uint64, error) {
+	if !hasMagic(r, vhdxRegionTableOffset, vhdxRegionTableMagic) {
+		return 0, fmt.Errorf("region table not found")
+	}
+	header := make([]byte, 16)
+	if _, err := r.ReadAt(header, vhdxRegionTableOffset); err != nil {
+		return 0, err
+	}
+	entryCount := binary.LittleEndian.Uint32(header[8:])
+	if entryCount > vhdxMaxEntries {
+		return 0, fmt.Errorf("invalid region table entry count: %d", entryCount)
+	}
+
+	var metadataOffset int64 = -1
+	entry := make([]byte, vhdxRegionEntrySize)
+	for i := int64(0); i < int64(entryCount); i++ {
+		if _, err := r.ReadAt(entry, vhdxRegionTableOffset+int64(len(header))+i*vhdxRegionEntrySize); err != nil {
+			return 0, err
+		}
+		if bytes.Equal(entry[:16], vhdxMetadataRegion) {
+			metadataOffset = int64(binary.LittleEndian.Uint64(entry[16:]))
+			break
+		}
+	}
+	if metadataOffset == -1 {
+		return 0, fmt.Errorf("metadata region not found")
+	}
+
+	if !hasMagic(r, metadataOffset, vhdxMetadataMagic) {
+		return 0, fmt.Errorf("metadata table not found")
+	}
+	header = make([]byte, 32)
+	if _, err := r.ReadAt(header, metadataOffset); err != nil {
+		return 0, err
+	}
+	entryCount = uint32(binary.LittleEndian.Uint16(header[10:]))
+	if entryCount > vhdxMaxEntries {
+		return 0, fmt.Errorf("invalid metadata table entry count: %d", entryCount)
+	}
+	entry = make([]byte, vhdxMetadataEntrySize)
+	for i := int64(0); i < int64(entryCount); i++ {
+		if _, err := r.ReadAt(entry, metadataOffset+int64(len(header))+i*vhdxMetadataEntrySize); err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(entry[:16], vhdxVirtualDiskSizeID) {
+			continue
+		}
+		itemOffset := int64(binary.LittleEndian.Uint32(entry[16:]))
+		size := make([]byte, 8)
+		if _, err := r.ReadAt(size, metadataOffset+itemOffset); err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint64(size), nil
+	}
+	return 0, fmt.Errorf("virtual disk size not found in metadata")
+}
@@ -0,0 +1,59 @@
+package diskimage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxVMDKDescriptorSize limits how much of a text descriptor is read, these
+// files are usually a few hundred bytes
+const maxVMDKDescriptorSize = 1024 * 1024
+
+// vmdkVirtualSize returns the virtual size of a sparse VMDK image, or of a
+// VMDK descriptor file
+func vmdkVirtualSize(r io.ReaderAt) (uint64, error) {
+	if hasMagic(r, 0, vmdkSparseMagic) {
+		// the capacity of the disk, in sectors, follows the magic,
+		// version and flags fields of the sparse extent header
+		capacity := make([]byte, 8)
+		if _, err := r.ReadAt(capacity, 12); err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint64(capacity) * SectorSize, nil
+	}
+	return vmdkDescriptorSize(io.NewSectionReader(r, 0, maxVMDKDescriptorSize))
+}
+
+// vmdkDescriptorSize sums the size of the extents listed in a descriptor
+// file, such as:
+//
+//	RW 41943040 FLAT "disk-flat.vmdk" 0
+func vmdkDescriptorSize(r io.Reader) (uint64, error) {
+	var sectors uint64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		switch fields[0] {
+		case "RW", "RDONLY", "NOACCESS":
+			extentSectors, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid extent size: %s", fields[1])
+			}
+			sectors += extentSectors
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if sectors == 0 {
+		return 0, fmt.Errorf("no extent found in descriptor")
+	}
+	return sectors * SectorSize, nil
+}
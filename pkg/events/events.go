@@ -0,0 +1,85 @@
+// Package events records what happens to a virtual machine while vfkit runs
+// it, such as the guest fetching its ignition configuration. The events are
+// logged, and reported through the REST API.
+package events
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Kind identifies the type of an event.
+type Kind string
+
+const (
+	// KindIgnitionFetch is used when the guest fetches its ignition
+	// configuration, its details are an ignition.Fetch.
+	KindIgnitionFetch Kind = "IgnitionFetch"
+	// KindIgnitionServerStopped is used when the ignition server stops
+	// after the guest fetched its configuration.
+	KindIgnitionServerStopped Kind = "IgnitionServerStopped"
+	// KindHostSleep is used when the host is about to sleep, its details
+	// are a hostsleep.Transition.
+	KindHostSleep Kind = "HostSleep"
+	// KindHostWake is used when the host wakes up, its details are a
+	// hostsleep.Transition.
+	KindHostWake Kind = "HostWake"
+	// KindStateRestored is used when the virtual machine was restored from
+	// a state file, its details are the path of the file.
+	KindStateRestored Kind = "StateRestored"
+)
+
+// defaultMaxEvents is the number of events kept by a Log
+const defaultMaxEvents = 1000
+
+// Event is something which happened to the virtual machine.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Kind    Kind      `json:"kind"`
+	Message string    `json:"message"`
+	Details any       `json:"details,omitempty"`
+}
+
+// Log keeps the most recent events, it's safe for concurrent use.
+type Log struct {
+	mu        sync.Mutex
+	events    []Event
+	maxEvents int
+}
+
+// NewLog creates an empty event log.
+func NewLog() *Log {
+	return &Log{maxEvents: defaultMaxEvents}
+}
+
+// Record adds an event of kind kind to the log, and logs its message.
+// details are optional additional information about the event.
+func (l *Log) Record(kind Kind, details any, format string, args ...any) {
+	event := Event{
+		Time:    time.Now(),
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+		Details: details,
+	}
+	logrus.Infof("%s", event.Message)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+	if len(l.events) > l.maxEvents {
+		l.events = l.events[len(l.events)-l.maxEvents:]
+	}
+}
+
+// Events returns a copy of the events of the log, from the oldest to the most
+// recent.
+func (l *Log) Events() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := make([]Event, len(l.events))
+	copy(events, l.events)
+	return events
+}
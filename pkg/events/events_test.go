@@ -0,0 +1,51 @@
+package events
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	log := NewLog()
+	assert.Empty(t, log.Events())
+
+	log.Record(KindIgnitionFetch, map[string]int{"status": 200}, "ignition configuration fetched by the guest (%d bytes)", 42)
+	events := log.Events()
+	require.Len(t, events, 1)
+	assert.Equal(t, KindIgnitionFetch, events[0].Kind)
+	assert.Equal(t, "ignition configuration fetched by the guest (42 bytes)", events[0].Message)
+	assert.Equal(t, map[string]int{"status": 200}, events[0].Details)
+	assert.False(t, events[0].Time.IsZero())
+
+	// the returned events are a copy
+	events[0].Message = "modified"
+	assert.Equal(t, "ignition configuration fetched by the guest (42 bytes)", log.Events()[0].Message)
+}
+
+func TestLogMaxEvents(t *testing.T) {
+	log := NewLog()
+	log.maxEvents = 10
+
+	var wg sync.WaitGroup
+	for i := 0; i < 25; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Record(KindIgnitionFetch, nil, "event")
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, log.Events(), 10)
+
+	for i := 0; i < 10; i++ {
+		log.Record(KindIgnitionFetch, nil, "event %d", i)
+	}
+	events := log.Events()
+	for i, event := range events {
+		assert.Equal(t, fmt.Sprintf("event %d", i), event.Message)
+	}
+}
@@ -0,0 +1,211 @@
+// Package exitstatus records why a vfkit virtual machine stopped running.
+// This information is used to select vfkit's exit code, it can be written to
+// a JSON status file when vfkit exits, and it is reported through the REST
+// API.
+//
+// This package does not use Code-Hex/vz directly so that applications
+// starting vfkit can use it to parse the status file.
+package exitstatus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reason describes why the virtual machine stopped.
+type Reason string
+
+const (
+	// ReasonNone is used while the virtual machine is still running.
+	ReasonNone Reason = ""
+	// ReasonGuestShutdown is used when the guest powered off the virtual machine.
+	ReasonGuestShutdown Reason = "GuestShutdown"
+	// ReasonStopRequested is used when the virtual machine was stopped
+	// through the `Stop` or `HardStop` REST API state changes.
+	ReasonStopRequested Reason = "StopRequested"
+	// ReasonStateSaved is used when the virtual machine was stopped after
+	// saving its state through the `/vm/snapshot` REST API.
+	ReasonStateSaved Reason = "StateSaved"
+	// ReasonSignal is used when vfkit received SIGINT or SIGTERM.
+	ReasonSignal Reason = "Signal"
+	// ReasonHypervisorError is used when the virtualization framework
+	// reported an error (VirtualMachineStateError).
+	ReasonHypervisorError Reason = "HypervisorError"
+	// ReasonStartTimeout is used when the virtual machine did not reach
+	// the running state in time.
+	ReasonStartTimeout Reason = "StartTimeout"
+	// ReasonError is used for all other errors, such as an invalid
+	// configuration or a failure to start the virtual machine.
+	ReasonError Reason = "Error"
+)
+
+// vfkit exit codes. Exit code 2 is not used as this is the exit code of go
+// programs when they panic.
+const (
+	ExitCodeSuccess         = 0
+	ExitCodeError           = 1
+	ExitCodeHypervisorError = 3
+	ExitCodeStartTimeout    = 4
+	ExitCodeSignal          = 5
+)
+
+// ExitCode returns the exit code vfkit uses when it stops for reason.
+func (reason Reason) ExitCode() int {
+	switch reason {
+	case ReasonNone, ReasonGuestShutdown, ReasonStopRequested, ReasonStateSaved:
+		return ExitCodeSuccess
+	case ReasonSignal:
+		return ExitCodeSignal
+	case ReasonHypervisorError:
+		return ExitCodeHypervisorError
+	case ReasonStartTimeout:
+		return ExitCodeStartTimeout
+	default:
+		return ExitCodeError
+	}
+}
+
+// Error is an error annotated with the reason why the virtual machine stopped.
+type Error struct {
+	Reason Reason
+	Err    error
+}
+
+// NewError wraps err in an [Error] using reason as the stop reason.
+func NewError(reason Reason, err error) error {
+	return &Error{Reason: reason, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ReasonFromError returns the stop reason associated with err. It returns
+// [ReasonNone] when err is nil, and [ReasonError] if err does not wrap an
+// [Error].
+func ReasonFromError(err error) Reason {
+	if err == nil {
+		return ReasonNone
+	}
+	var statusErr *Error
+	if errors.As(err, &statusErr) {
+		return statusErr.Reason
+	}
+	return ReasonError
+}
+
+// Status is the content of the status file written by vfkit when it exits.
+type Status struct {
+	Reason    Reason     `json:"reason"`
+	ExitCode  int        `json:"exitCode"`
+	StartTime time.Time  `json:"startTime"`
+	StopTime  *time.Time `json:"stopTime,omitempty"`
+	LastState string     `json:"lastState,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// Tracker keeps track of the virtual machine state and of the reason why it
+// stopped. It can be used concurrently from multiple goroutines.
+type Tracker struct {
+	mutex  sync.Mutex
+	status Status
+}
+
+// NewTracker creates a new Tracker, using the current time as the start time.
+func NewTracker() *Tracker {
+	return &Tracker{
+		status: Status{
+			StartTime: time.Now(),
+		},
+	}
+}
+
+// SetState records state as the last known state of the virtual machine.
+func (t *Tracker) SetState(state string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.status.LastState = state
+}
+
+// SetReason records why the virtual machine is stopping. Only the first
+// reason is kept, for example when vfkit receives SIGTERM, the guest shutdown
+// which follows is not recorded. It returns true when reason was recorded.
+//
+// The reason must be recorded before the virtual machine is asked to stop,
+// as vfkit can exit as soon as it stops.
+func (t *Tracker) SetReason(reason Reason) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.status.Reason == ReasonNone {
+		t.status.Reason = reason
+		return true
+	}
+	return false
+}
+
+// UnsetReason forgets the reason recorded by SetReason when the virtual
+// machine failed to stop, so that the reason of a later stop can be recorded.
+// It has no effect when the recorded reason is not reason.
+func (t *Tracker) UnsetReason(reason Reason) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.status.Reason == reason {
+		t.status.Reason = ReasonNone
+	}
+}
+
+// Reason returns the reason why the virtual machine is stopping, or
+// [ReasonNone] if it's still running.
+func (t *Tracker) Reason() Reason {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.status.Reason
+}
+
+// Finish records that vfkit is exiting with err as its final error. When no
+// stop reason was previously recorded, it's guessed from err. It returns the
+// final status, which includes the exit code vfkit should use.
+func (t *Tracker) Finish(err error) Status {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	errReason := ReasonFromError(err)
+	switch {
+	case errReason == ReasonHypervisorError:
+		// a hypervisor error takes precedence over the reason which led
+		// to stopping the VM
+		t.status.Reason = errReason
+	case t.status.Reason == ReasonNone && errReason != ReasonNone:
+		t.status.Reason = errReason
+	case t.status.Reason == ReasonNone:
+		t.status.Reason = ReasonGuestShutdown
+	}
+	if err != nil {
+		t.status.Error = err.Error()
+	}
+	stopTime := time.Now()
+	t.status.StopTime = &stopTime
+	t.status.ExitCode = t.status.Reason.ExitCode()
+
+	return t.status
+}
+
+// WriteFile writes status as JSON to the file at path.
+func (status Status) WriteFile(path string) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write status file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package exitstatus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReasonFromError(t *testing.T) {
+	assert.Equal(t, ReasonNone, ReasonFromError(nil))
+	assert.Equal(t, ReasonError, ReasonFromError(errors.New("failure")))
+
+	err := NewError(ReasonStartTimeout, errors.New("timeout waiting for VM state"))
+	assert.Equal(t, ReasonStartTimeout, ReasonFromError(err))
+	assert.Equal(t, ReasonStartTimeout, ReasonFromError(fmt.Errorf("wrapped: %w", err)))
+	assert.EqualError(t, err, "timeout waiting for VM state")
+}
+
+func TestTrackerFinish(t *testing.T) {
+	tests := []struct {
+		name         string
+		reason       Reason
+		err          error
+		wantReason   Reason
+		wantExitCode int
+	}{
+		{
+			name:         "guest shutdown",
+			wantReason:   ReasonGuestShutdown,
+			wantExitCode: ExitCodeSuccess,
+		},
+		{
+			name:         "stop requested",
+			reason:       ReasonStopRequested,
+			wantReason:   ReasonStopRequested,
+			wantExitCode: ExitCodeSuccess,
+		},
+		{
+			name:         "state saved",
+			reason:       ReasonStateSaved,
+			wantReason:   ReasonStateSaved,
+			wantExitCode: ExitCodeSuccess,
+		},
+		{
+			name:         "signal",
+			reason:       ReasonSignal,
+			wantReason:   ReasonSignal,
+			wantExitCode: ExitCodeSignal,
+		},
+		{
+			name:         "signal then generic error",
+			reason:       ReasonSignal,
+			err:          errors.New("failure"),
+			wantReason:   ReasonSignal,
+			wantExitCode: ExitCodeSignal,
+		},
+		{
+			name:         "signal then hypervisor error",
+			reason:       ReasonSignal,
+			err:          NewError(ReasonHypervisorError, errors.New("hypervisor virtualization error")),
+			wantReason:   ReasonHypervisorError,
+			wantExitCode: ExitCodeHypervisorError,
+		},
+		{
+			name:         "start timeout",
+			err:          NewError(ReasonStartTimeout, errors.New("timeout waiting for VM state")),
+			wantReason:   ReasonStartTimeout,
+			wantExitCode: ExitCodeStartTimeout,
+		},
+		{
+			name:         "configuration error",
+			err:          errors.New("unknown device type: foo"),
+			wantReason:   ReasonError,
+			wantExitCode: ExitCodeError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewTracker()
+			if tt.reason != ReasonNone {
+				tracker.SetReason(tt.reason)
+			}
+			status := tracker.Finish(tt.err)
+			assert.Equal(t, tt.wantReason, status.Reason)
+			assert.Equal(t, tt.wantExitCode, status.ExitCode)
+			require.NotNil(t, status.StopTime)
+			assert.False(t, status.StopTime.Before(status.StartTime))
+			if tt.err != nil {
+				assert.Equal(t, tt.err.Error(), status.Error)
+			} else {
+				assert.Empty(t, status.Error)
+			}
+		})
+	}
+}
+
+func TestTrackerFirstReasonWins(t *testing.T) {
+	tracker := NewTracker()
+	assert.Equal(t, ReasonNone, tracker.Reason())
+	assert.True(t, tracker.SetReason(ReasonSignal))
+	assert.False(t, tracker.SetReason(ReasonStopRequested))
+	assert.Equal(t, ReasonSignal, tracker.Reason())
+}
+
+func TestTrackerUnsetReason(t *testing.T) {
+	tracker := NewTracker()
+	assert.True(t, tracker.SetReason(ReasonStopRequested))
+	// only the recorded reason is forgotten
+	tracker.UnsetReason(ReasonStateSaved)
+	assert.Equal(t, ReasonStopRequested, tracker.Reason())
+	tracker.UnsetReason(ReasonStopRequested)
+	assert.Equal(t, ReasonNone, tracker.Reason())
+
+	// the guest shutdown which follows the failed stop is recorded
+	assert.Equal(t, ReasonGuestShutdown, tracker.Finish(nil).Reason)
+}
+
+func TestStatusWriteFile(t *testing.T) {
+	tracker := NewTracker()
+	tracker.SetState("VirtualMachineStateStopped")
+	status := tracker.Finish(nil)
+
+	statusPath := filepath.Join(t.TempDir(), "status.json")
+	require.NoError(t, status.WriteFile(statusPath))
+
+	data, err := os.ReadFile(statusPath)
+	require.NoError(t, err)
+	var readStatus Status
+	require.NoError(t, json.Unmarshal(data, &readStatus))
+	assert.Equal(t, ReasonGuestShutdown, readStatus.Reason)
+	assert.Equal(t, ExitCodeSuccess, readStatus.ExitCode)
+	assert.Equal(t, "VirtualMachineStateStopped", readStatus.LastState)
+	assert.True(t, status.StartTime.Equal(readStatus.StartTime))
+	require.NotNil(t, readStatus.StopTime)
+	assert.True(t, status.StopTime.Equal(*readStatus.StopTime))
+}
@@ -0,0 +1,118 @@
+// Package hostsleep applies the policy of vfkit when the host sleeps: the
+// virtual machine can be paused before the host sleeps, and resumed when it
+// wakes up. It's independent of the sleep notifications of macOS, so that the
+// policy can be tested with synthetic sleep and wake events.
+package hostsleep
+
+import (
+	"sync"
+)
+
+// Event is a power event of the host
+type Event string
+
+const (
+	// Sleep is sent before the host sleeps
+	Sleep Event = "sleep"
+	// Wake is sent when the host wakes up
+	Wake Event = "wake"
+)
+
+// Action is what the handler did with the virtual machine for an event
+type Action string
+
+const (
+	// ActionNone is used when the virtual machine was left as is
+	ActionNone Action = "none"
+	// ActionPaused is used when the virtual machine was paused before sleep
+	ActionPaused Action = "paused"
+	// ActionResumed is used when the virtual machine was resumed on wake
+	ActionResumed Action = "resumed"
+)
+
+// Machine is the virtual machine handled on sleep and wake
+type Machine interface {
+	CanPause() bool
+	Pause() error
+	Resume() error
+}
+
+// Transition describes how an event was handled
+type Transition struct {
+	Event  Event  `json:"event"`
+	Action Action `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Handler pauses the virtual machine before the host sleeps, and resumes it
+// when it wakes up. It only resumes a virtual machine it paused itself, a
+// virtual machine paused through the REST API stays paused.
+type Handler struct {
+	// OnTransition is called after each event
+	OnTransition func(Transition)
+	// OnWake is called after the virtual machine was resumed on wake, or
+	// on wake when it was not paused, for example to synchronize the guest
+	// clock.
+	OnWake func()
+
+	machine      Machine
+	pauseOnSleep bool
+
+	mu             sync.Mutex
+	pausedForSleep bool
+}
+
+// NewHandler creates a handler for machine. The virtual machine is only paused
+// when pauseOnSleep is true, otherwise the handler only reports the events.
+func NewHandler(machine Machine, pauseOnSleep bool) *Handler {
+	return &Handler{
+		machine:      machine,
+		pauseOnSleep: pauseOnSleep,
+	}
+}
+
+// Handle applies the policy for event, and returns how it was handled.
+func (h *Handler) Handle(event Event) Transition {
+	h.mu.Lock()
+	transition := Transition{Event: event, Action: ActionNone}
+	switch event {
+	case Sleep:
+		// the machine may already be paused for a previous sleep event, or
+		// through the REST API
+		if h.pauseOnSleep && !h.pausedForSleep && h.machine.CanPause() {
+			if err := h.machine.Pause(); err != nil {
+				transition.Error = err.Error()
+			} else {
+				h.pausedForSleep = true
+				transition.Action = ActionPaused
+			}
+		}
+	case Wake:
+		if h.pausedForSleep {
+			if err := h.machine.Resume(); err != nil {
+				transition.Error = err.Error()
+			} else {
+				transition.Action = ActionResumed
+			}
+			// when resuming fails, the machine is left to the user
+			h.pausedForSleep = false
+		}
+	}
+	h.mu.Unlock()
+
+	if h.OnTransition != nil {
+		h.OnTransition(transition)
+	}
+	if event == Wake && h.OnWake != nil {
+		h.OnWake()
+	}
+	return transition
+}
+
+// PausedForSleep returns true when the virtual machine is paused while the
+// host sleeps.
+func (h *Handler) PausedForSleep() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.pausedForSleep
+}
@@ -0,0 +1,116 @@
+package hostsleep
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMachine records the calls to Pause and Resume
+type fakeMachine struct {
+	paused    bool
+	calls     []string
+	pauseErr  error
+	resumeErr error
+}
+
+func (m *fakeMachine) CanPause() bool {
+	return !m.paused
+}
+
+func (m *fakeMachine) Pause() error {
+	m.calls = append(m.calls, "pause")
+	if m.pauseErr != nil {
+		return m.pauseErr
+	}
+	m.paused = true
+	return nil
+}
+
+func (m *fakeMachine) Resume() error {
+	m.calls = append(m.calls, "resume")
+	if m.resumeErr != nil {
+		return m.resumeErr
+	}
+	m.paused = false
+	return nil
+}
+
+func newTestHandler(machine Machine, pauseOnSleep bool) (*Handler, *[]Transition, *int) {
+	handler := NewHandler(machine, pauseOnSleep)
+	transitions := []Transition{}
+	wakes := 0
+	handler.OnTransition = func(transition Transition) {
+		transitions = append(transitions, transition)
+	}
+	handler.OnWake = func() {
+		wakes++
+	}
+	return handler, &transitions, &wakes
+}
+
+func TestPauseOnSleep(t *testing.T) {
+	machine := &fakeMachine{}
+	handler, transitions, wakes := newTestHandler(machine, true)
+
+	assert.Equal(t, Transition{Event: Sleep, Action: ActionPaused}, handler.Handle(Sleep))
+	assert.True(t, machine.paused)
+	assert.True(t, handler.PausedForSleep())
+	// duplicate sleep events are ignored
+	assert.Equal(t, Transition{Event: Sleep, Action: ActionNone}, handler.Handle(Sleep))
+
+	assert.Equal(t, Transition{Event: Wake, Action: ActionResumed}, handler.Handle(Wake))
+	assert.False(t, machine.paused)
+	assert.False(t, handler.PausedForSleep())
+	assert.Equal(t, 1, *wakes)
+	// wake events without sleep don't resume the machine
+	assert.Equal(t, Transition{Event: Wake, Action: ActionNone}, handler.Handle(Wake))
+
+	assert.Equal(t, []string{"pause", "resume"}, machine.calls)
+	assert.Len(t, *transitions, 4)
+	assert.Equal(t, 2, *wakes)
+}
+
+func TestPausedByUser(t *testing.T) {
+	// the machine was paused through the REST API, it stays paused
+	machine := &fakeMachine{paused: true}
+	handler, _, wakes := newTestHandler(machine, true)
+
+	assert.Equal(t, Transition{Event: Sleep, Action: ActionNone}, handler.Handle(Sleep))
+	assert.Equal(t, Transition{Event: Wake, Action: ActionNone}, handler.Handle(Wake))
+	assert.True(t, machine.paused)
+	assert.Empty(t, machine.calls)
+	assert.Equal(t, 1, *wakes)
+}
+
+func TestNoPauseOnSleep(t *testing.T) {
+	machine := &fakeMachine{}
+	handler, transitions, wakes := newTestHandler(machine, false)
+
+	handler.Handle(Sleep)
+	handler.Handle(Wake)
+	assert.Empty(t, machine.calls)
+	assert.Equal(t, []Transition{{Event: Sleep, Action: ActionNone}, {Event: Wake, Action: ActionNone}}, *transitions)
+	assert.Equal(t, 1, *wakes)
+}
+
+func TestPauseErrors(t *testing.T) {
+	machine := &fakeMachine{pauseErr: errors.New("pause failed")}
+	handler, _, _ := newTestHandler(machine, true)
+
+	assert.Equal(t, Transition{Event: Sleep, Action: ActionNone, Error: "pause failed"}, handler.Handle(Sleep))
+	require.False(t, handler.PausedForSleep())
+	assert.Equal(t, Transition{Event: Wake, Action: ActionNone}, handler.Handle(Wake))
+
+	machine = &fakeMachine{resumeErr: errors.New("resume failed")}
+	handler, _, wakes := newTestHandler(machine, true)
+	handler.Handle(Sleep)
+	assert.Equal(t, Transition{Event: Wake, Action: ActionNone, Error: "resume failed"}, handler.Handle(Wake))
+	assert.False(t, handler.PausedForSleep())
+	assert.Equal(t, 1, *wakes)
+	// the next sleep doesn't try to pause the paused machine
+	assert.Equal(t, Transition{Event: Sleep, Action: ActionNone}, handler.Handle(Sleep))
+	assert.Equal(t, []string{"pause", "resume"}, machine.calls)
+}
@@ -0,0 +1,93 @@
+// Package ignition modifies the ignition configurations vfkit provides to
+// virtual machines.
+package ignition
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// DefaultUser is the user of Fedora CoreOS and RHCOS, the main distributions
+// using ignition
+const DefaultUser = "core"
+
+// decodeConfig decodes the ignition configuration config into v. Its numbers
+// are decoded as json.Number values, so that encoding the configuration again
+// doesn't change them.
+func decodeConfig(config []byte, v any) error {
+	// json.Unmarshal reports the syntax errors, including the data after
+	// the top-level value which the decoder doesn't read
+	if err := json.Unmarshal(config, &json.RawMessage{}); err != nil {
+		return fmt.Errorf("invalid ignition configuration: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(config))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid ignition configuration: %w", err)
+	}
+	return nil
+}
+
+// AddSSHAuthorizedKeys adds keys to the SSH authorized keys of user in the
+// ignition configuration config. The user is added to the configuration if it
+// doesn't have it yet. Unknown fields of the configuration are preserved.
+func AddSSHAuthorizedKeys(config []byte, user string, keys ...string) ([]byte, error) {
+	var ign map[string]any
+	if err := decodeConfig(config, &ign); err != nil {
+		return nil, err
+	}
+	if ign == nil {
+		return nil, fmt.Errorf("invalid ignition configuration: not a JSON object")
+	}
+
+	passwd, err := object(ign, "passwd")
+	if err != nil {
+		return nil, err
+	}
+	users, ok := passwd["users"].([]any)
+	if !ok && passwd["users"] != nil {
+		return nil, fmt.Errorf("invalid ignition configuration: 'passwd.users' is not a list")
+	}
+	var ignUser map[string]any
+	for _, u := range users {
+		if u, ok := u.(map[string]any); ok && u["name"] == user {
+			ignUser = u
+			break
+		}
+	}
+	if ignUser == nil {
+		ignUser = map[string]any{"name": user}
+		users = append(users, ignUser)
+		passwd["users"] = users
+	}
+
+	authorizedKeys, ok := ignUser["sshAuthorizedKeys"].([]any)
+	if !ok && ignUser["sshAuthorizedKeys"] != nil {
+		return nil, fmt.Errorf("invalid ignition configuration: 'sshAuthorizedKeys' of user %s is not a list", user)
+	}
+	for _, key := range keys {
+		if !slices.Contains(authorizedKeys, any(key)) {
+			authorizedKeys = append(authorizedKeys, key)
+		}
+	}
+	ignUser["sshAuthorizedKeys"] = authorizedKeys
+
+	return json.Marshal(ign)
+}
+
+// object returns the JSON object named key in parent, it's created if needed
+func object(parent map[string]any, key string) (map[string]any, error) {
+	value, ok := parent[key]
+	if !ok || value == nil {
+		obj := map[string]any{}
+		parent[key] = obj
+		return obj, nil
+	}
+	obj, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid ignition configuration: '%s' is not an object", key)
+	}
+	return obj, nil
+}
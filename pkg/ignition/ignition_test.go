@@ -0,0 +1,190 @@
+package ignition
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var addSSHAuthorizedKeysTests = map[string]struct {
+	config       string
+	expected     string
+	errorMessage string
+}{
+	"NoUsers": {
+		config:   `{"ignition":{"version":"3.4.0"}}`,
+		expected: `{"ignition":{"version":"3.4.0"},"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["ssh-ed25519 AAAA vfkit"]}]}}`,
+	},
+	"OtherUser": {
+		config:   `{"ignition":{"version":"3.4.0"},"passwd":{"users":[{"name":"admin","groups":["wheel"]}]}}`,
+		expected: `{"ignition":{"version":"3.4.0"},"passwd":{"users":[{"groups":["wheel"],"name":"admin"},{"name":"core","sshAuthorizedKeys":["ssh-ed25519 AAAA vfkit"]}]}}`,
+	},
+	"ExistingKeys": {
+		config:   `{"ignition":{"version":"3.4.0"},"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["ssh-rsa BBBB user"]}]}}`,
+		expected: `{"ignition":{"version":"3.4.0"},"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["ssh-rsa BBBB user","ssh-ed25519 AAAA vfkit"]}]}}`,
+	},
+	"AlreadyAuthorized": {
+		config:   `{"ignition":{"version":"3.4.0"},"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["ssh-ed25519 AAAA vfkit"]}]}}`,
+		expected: `{"ignition":{"version":"3.4.0"},"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["ssh-ed25519 AAAA vfkit"]}]}}`,
+	},
+	"InvalidJSON": {
+		config:       `{"ignition":`,
+		errorMessage: "invalid ignition configuration: unexpected end of JSON input",
+	},
+	"InvalidPasswd": {
+		config:       `{"passwd":[]}`,
+		errorMessage: "invalid ignition configuration: 'passwd' is not an object",
+	},
+	"InvalidUsers": {
+		config:       `{"passwd":{"users":{}}}`,
+		errorMessage: "invalid ignition configuration: 'passwd.users' is not a list",
+	},
+}
+
+func TestAddSSHAuthorizedKeys(t *testing.T) {
+	for name, test := range addSSHAuthorizedKeysTests {
+		t.Run(name, func(t *testing.T) {
+			config, err := AddSSHAuthorizedKeys([]byte(test.config), DefaultUser, "ssh-ed25519 AAAA vfkit")
+			if test.errorMessage != "" {
+				require.EqualError(t, err, test.errorMessage)
+				return
+			}
+			require.NoError(t, err)
+			assert.JSONEq(t, test.expected, string(config))
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	users := []byte(`{"ignition":{"version":"3.2.0"},"passwd":{"users":[{"name":"core"}]}}`)
+	files := []byte(`{"ignition":{"version":"3.4.0"},"storage":{"files":[{"path":"/etc/hostname","contents":{"source":"data:,vfkit"}}]}}`)
+	usersURL := "data:;base64," + base64.StdEncoding.EncodeToString(users)
+	filesURL := "data:;base64," + base64.StdEncoding.EncodeToString(files)
+
+	config, err := Merge([]byte(`{"ignition":{"version":"3.4.0","config":{"merge":[{"source":"https://example.com/config.ign"}]}}}`), users, files)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ignition":{"version":"3.4.0","config":{"merge":[{"source":"https://example.com/config.ign"},{"source":"`+usersURL+`"},{"source":"`+filesURL+`"}]}}}`, string(config))
+
+	// without a base configuration, the most recent spec version is used
+	config, err = Merge(nil, users, files)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ignition":{"version":"3.4.0","config":{"merge":[{"source":"`+usersURL+`"},{"source":"`+filesURL+`"}]}}}`, string(config))
+
+	config, err = Merge([]byte(`{"ignition":{"version":"3.4.0"}}`))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ignition":{"version":"3.4.0"}}`, string(config))
+
+	_, err = Merge(nil, users, []byte(`{"passwd":{}}`))
+	require.EqualError(t, err, "invalid ignition fragment 1: missing 'ignition.version'")
+	_, err = Merge(nil, []byte(`{"ignition":{"version":"three"}}`))
+	require.EqualError(t, err, "invalid ignition fragment 0: invalid 'ignition.version': three")
+	_, err = Merge([]byte(`{"ignition":{"config":{"merge":{}}}}`), users)
+	require.EqualError(t, err, "invalid ignition configuration: 'ignition.config.merge' is not a list")
+}
+
+var validateTests = map[string]struct {
+	config       string
+	errorMessage string
+}{
+	"Minimal": {
+		config: `{"ignition":{"version":"3.4.0"}}`,
+	},
+	"Complete": {
+		config: `{
+			"ignition": {"version": "3.5.0", "config": {"merge": [{"source": "data:,"}]}},
+			"passwd": {"users": [{"name": "core", "sshAuthorizedKeys": ["ssh-ed25519 AAAA"], "groups": ["wheel"]}]},
+			"storage": {
+				"files": [{"path": "/etc/hostname", "overwrite": true, "contents": {"source": "data:,vfkit"}}],
+				"directories": [{"path": "/var/lib/vfkit"}],
+				"links": [{"path": "/etc/localtime", "target": "/usr/share/zoneinfo/UTC"}]
+			},
+			"systemd": {"units": [{"name": "vfkit.service", "enabled": true, "dropins": [{"name": "10-vfkit.conf", "contents": "[Unit]"}]}]},
+			"kernelArguments": {"shouldExist": ["console=hvc0"]}
+		}`,
+	},
+	"InvalidJSON": {
+		config:       `{"ignition":`,
+		errorMessage: "invalid ignition configuration: unexpected end of JSON input",
+	},
+	"NotAnObject": {
+		config:       `[]`,
+		errorMessage: "invalid ignition configuration: not a JSON object",
+	},
+	"MissingVersion": {
+		config:       `{"passwd":{}}`,
+		errorMessage: "invalid ignition configuration: missing 'ignition.version'",
+	},
+	"UnsupportedVersion": {
+		config:       `{"ignition":{"version":"2.3.0"}}`,
+		errorMessage: "invalid ignition configuration: unsupported 'ignition.version': 2.3.0 (supported versions: 3.0.0 to 3.5.0)",
+	},
+	"InvalidUsers": {
+		config:       `{"ignition":{"version":"3.4.0"},"passwd":{"users":[{"sshAuthorizedKeys":"ssh-ed25519 AAAA"}]}}`,
+		errorMessage: "invalid ignition configuration: missing 'passwd.users[0].name'\n'passwd.users[0].sshAuthorizedKeys' is not a list",
+	},
+	"RelativePath": {
+		config:       `{"ignition":{"version":"3.4.0"},"storage":{"files":[{"path":"etc/hostname","contents":"vfkit"}]}}`,
+		errorMessage: "invalid ignition configuration: 'storage.files[0].path' is not an absolute path: etc/hostname\n'storage.files[0].contents' is not an object",
+	},
+	"InvalidUnits": {
+		config:       `{"ignition":{"version":"3.4.0"},"systemd":{"units":[{"name":"vfkit.service","enabled":"yes"},"vfkit.socket"]}}`,
+		errorMessage: "invalid ignition configuration: 'systemd.units[0].enabled' is not a boolean\n'systemd.units[1]' is not an object",
+	},
+}
+
+func TestValidate(t *testing.T) {
+	for name, test := range validateTests {
+		t.Run(name, func(t *testing.T) {
+			err := Validate([]byte(test.config))
+			if test.errorMessage != "" {
+				require.EqualError(t, err, test.errorMessage)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	vars := Variables{
+		Name:         "fedora",
+		MACAddresses: []string{"5a:94:ef:e4:0c:ee"},
+		VsockPorts:   []uint32{1024, 2222},
+		SSHKey:       `ssh-ed25519 AAAA "vfkit"`,
+	}
+	config, err := Render([]byte(`{
+		"ignition": {"version": "3.4.0"},
+		"passwd": {"users": [{"name": "core", "sshAuthorizedKeys": ["{{ .SSHKey }}"]}]},
+		"storage": {"files": [{"path": "/etc/hostname", "contents": {"source": "data:,{{ .Name }}"}}]},
+		"systemd": {"units": [{"name": "vfkit.service", "contents": "[Service]\nEnvironment=MAC={{ index .MACAddresses 0 }}\n{{ range .VsockPorts }}Environment=PORT{{ . }}=1\n{{ end }}"}]}
+	}`), vars)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"ignition": {"version": "3.4.0"},
+		"passwd": {"users": [{"name": "core", "sshAuthorizedKeys": ["ssh-ed25519 AAAA \"vfkit\""]}]},
+		"storage": {"files": [{"path": "/etc/hostname", "contents": {"source": "data:,fedora"}}]},
+		"systemd": {"units": [{"name": "vfkit.service", "contents": "[Service]\nEnvironment=MAC=5a:94:ef:e4:0c:ee\nEnvironment=PORT1024=1\nEnvironment=PORT2222=1\n"}]}
+	}`, string(config))
+
+	// the numbers are kept as is, and the configurations without templates
+	// are not modified
+	config, err = Render([]byte(`{"storage":{"files":[{"path":"/etc/{{ .Name }}","mode":420,"contents":{"size":9007199254740993}}]}}`), vars)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"storage":{"files":[{"path":"/etc/fedora","mode":420,"contents":{"size":9007199254740993}}]}}`, string(config))
+	assert.Contains(t, string(config), "9007199254740993")
+	unchanged := []byte("{\n  \"ignition\": {\"version\": \"3.4.0\"},\n  \"storage\": {\"files\": [{\"path\": \"/etc/motd\", \"mode\": 4.2e2}]}\n}\n")
+	config, err = Render(unchanged, vars)
+	require.NoError(t, err)
+	assert.Equal(t, unchanged, config)
+	_, err = Render([]byte(`{"ignition":{"version":"3.4.0"}} {}`), vars)
+	require.EqualError(t, err, "invalid ignition configuration: invalid character '{' after top-level value")
+
+	_, err = Render([]byte(`{"storage":{"files":[{"path":"/etc/{{ .Hostname }}"}]}}`), vars)
+	require.ErrorContains(t, err, "failed to render ignition template in 'storage.files[0].path': ")
+	_, err = Render([]byte(`{"storage":{"files":[{"path":"/etc/{{ .Name"}]}}`), vars)
+	require.ErrorContains(t, err, "invalid ignition template in 'storage.files[0].path': ")
+	_, err = Render([]byte(`{"ignition":{"version":"3.4.0"},"passwd":{"users":[{"name":"{{ index .MACAddresses 1 }}"}]}}`), vars)
+	require.ErrorContains(t, err, "failed to render ignition template in 'passwd.users[0].name': ")
+}
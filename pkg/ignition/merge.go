@@ -0,0 +1,81 @@
+package ignition
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/mod/semver"
+)
+
+// Merge returns an ignition configuration merging fragments into config,
+// using the ignition.config.merge mechanism of the ignition specification:
+// the fragments are added to it as data URLs, and ignition merges them in the
+// guest. When config is nil, the merged configuration only has fragments, and
+// it uses the most recent spec version of the fragments.
+func Merge(config []byte, fragments ...[]byte) ([]byte, error) {
+	if len(fragments) == 0 {
+		return config, nil
+	}
+	var latestVersion string
+	for i, fragment := range fragments {
+		version, err := specVersion(fragment)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignition fragment %d: %w", i, err)
+		}
+		if latestVersion == "" || semver.Compare("v"+version, "v"+latestVersion) > 0 {
+			latestVersion = version
+		}
+	}
+	if config == nil {
+		config = fmt.Appendf(nil, `{"ignition":{"version":%q}}`, latestVersion)
+	}
+
+	var ign map[string]any
+	if err := decodeConfig(config, &ign); err != nil {
+		return nil, err
+	}
+	if ign == nil {
+		return nil, fmt.Errorf("invalid ignition configuration: not a JSON object")
+	}
+	ignitionSection, err := object(ign, "ignition")
+	if err != nil {
+		return nil, err
+	}
+	configSection, err := object(ignitionSection, "config")
+	if err != nil {
+		return nil, err
+	}
+	merge, ok := configSection["merge"].([]any)
+	if !ok && configSection["merge"] != nil {
+		return nil, fmt.Errorf("invalid ignition configuration: 'ignition.config.merge' is not a list")
+	}
+	for _, fragment := range fragments {
+		merge = append(merge, map[string]any{
+			"source": "data:;base64," + base64.StdEncoding.EncodeToString(fragment),
+		})
+	}
+	configSection["merge"] = merge
+
+	return json.Marshal(ign)
+}
+
+// specVersion returns the ignition spec version of config
+func specVersion(config []byte) (string, error) {
+	var ign struct {
+		Ignition struct {
+			Version string `json:"version"`
+		} `json:"ignition"`
+	}
+	if err := json.Unmarshal(config, &ign); err != nil {
+		return "", err
+	}
+	version := ign.Ignition.Version
+	if version == "" {
+		return "", fmt.Errorf("missing 'ignition.version'")
+	}
+	if !semver.IsValid("v" + version) {
+		return "", fmt.Errorf("invalid 'ignition.version': %s", version)
+	}
+	return version, nil
+}
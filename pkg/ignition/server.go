@@ -0,0 +1,175 @@
+package ignition
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Source of the ignition configuration fetches
+const (
+	// SourceGuest is used for fetches from the guest, over vsock
+	SourceGuest = "guest"
+	// SourceHost is used for fetches from the host, over the unix socket
+	// of config.Ignition.SocketPath
+	SourceHost = "host"
+)
+
+// Fetch is an attempt to fetch the ignition configuration
+type Fetch struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Status int       `json:"status"`
+	Bytes  int64     `json:"bytes"`
+}
+
+// Server serves an ignition configuration over HTTP. The configuration is
+// immutable, it can be fetched concurrently, and the fetch attempts are
+// recorded.
+type Server struct {
+	// ShutdownAfterFetch stops the server once the guest fetched the whole
+	// configuration.
+	ShutdownAfterFetch bool
+	// OnFetch is called after each fetch attempt.
+	OnFetch func(Fetch)
+
+	config []byte
+
+	mu           sync.Mutex
+	fetches      []Fetch
+	servers      []*http.Server
+	shutdown     bool
+	shutdownOnce sync.Once
+}
+
+// NewServer creates a server for the ignition configuration config.
+func NewServer(config []byte) *Server {
+	return &Server{config: config}
+}
+
+// Serve serves the configuration to the guest on listener. It returns nil
+// when the server is stopped after a fetch.
+func (s *Server) Serve(listener net.Listener) error {
+	return s.serve(listener, SourceGuest)
+}
+
+// ServeHost serves the configuration to host processes on listener, their
+// fetches never stop the server. It returns nil when the server is stopped
+// after a guest fetch.
+func (s *Server) ServeHost(listener net.Listener) error {
+	return s.serve(listener, SourceHost)
+}
+
+func (s *Server) serve(listener net.Listener, source string) error {
+	srv := &http.Server{
+		Handler:           s.handler(source),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return listener.Close()
+	}
+	s.servers = append(s.servers, srv)
+	s.mu.Unlock()
+
+	err := srv.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) handler(source string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		// each request gets its own reader, ServeContent seeks it
+		http.ServeContent(recorder, req, "", time.Time{}, bytes.NewReader(s.config))
+
+		fetch := Fetch{
+			Time:   time.Now(),
+			Source: source,
+			Status: recorder.status,
+			Bytes:  recorder.bytes,
+		}
+		s.mu.Lock()
+		s.fetches = append(s.fetches, fetch)
+		s.mu.Unlock()
+		if s.OnFetch != nil {
+			s.OnFetch(fetch)
+		}
+
+		if s.ShutdownAfterFetch && source == SourceGuest && s.isComplete(fetch) {
+			// the current request must complete before the server is
+			// shut down
+			s.shutdownOnce.Do(func() {
+				go func() { _ = s.Shutdown(context.Background()) }()
+			})
+		}
+	})
+}
+
+func (s *Server) isComplete(fetch Fetch) bool {
+	return fetch.Status == http.StatusOK && fetch.Bytes == int64(len(s.config))
+}
+
+// Fetches returns the fetch attempts, from the oldest to the most recent.
+func (s *Server) Fetches() []Fetch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fetches := make([]Fetch, len(s.fetches))
+	copy(fetches, s.fetches)
+	return fetches
+}
+
+// Fetched returns true when the guest fetched the whole configuration.
+func (s *Server) Fetched() bool {
+	for _, fetch := range s.Fetches() {
+		if fetch.Source == SourceGuest && s.isComplete(fetch) {
+			return true
+		}
+	}
+	return false
+}
+
+// Shutdown gracefully stops the server on all its listeners.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	servers := s.servers
+	s.mu.Unlock()
+
+	var errs []error
+	for _, srv := range servers {
+		errs = append(errs, srv.Shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// responseRecorder records the status and size of responses
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += int64(n)
+	return n, err
+}
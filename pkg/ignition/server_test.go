@@ -0,0 +1,140 @@
+package ignition
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listenUnix(t *testing.T) (net.Listener, *http.Client) {
+	socketPath := filepath.Join(t.TempDir(), "ignition.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	return listener, client
+}
+
+func fetch(client *http.Client, header http.Header) (int, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://ignition/", nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+func TestServer(t *testing.T) {
+	config := []byte(`{"ignition":{"version":"3.4.0"}}`)
+	server := NewServer(config)
+	var onFetchCalls int
+	var onFetchMu sync.Mutex
+	server.OnFetch = func(Fetch) {
+		onFetchMu.Lock()
+		defer onFetchMu.Unlock()
+		onFetchCalls++
+	}
+	listener, client := listenUnix(t)
+	errCh := make(chan error, 1)
+	go func() { errCh <- server.Serve(listener) }()
+	t.Cleanup(func() {
+		require.NoError(t, server.Shutdown(context.Background()))
+		require.NoError(t, <-errCh)
+	})
+
+	// concurrent fetches all get the whole configuration
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, body, err := fetch(client, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, status)
+			assert.Equal(t, config, body)
+		}()
+	}
+	wg.Wait()
+
+	status, body, err := fetch(client, http.Header{"Range": []string{"bytes=0-9"}})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, status)
+	assert.Equal(t, config[:10], body)
+
+	fetches := server.Fetches()
+	require.Len(t, fetches, 21)
+	for _, f := range fetches[:20] {
+		assert.Equal(t, SourceGuest, f.Source)
+		assert.Equal(t, http.StatusOK, f.Status)
+		assert.Equal(t, int64(len(config)), f.Bytes)
+	}
+	assert.Equal(t, http.StatusPartialContent, fetches[20].Status)
+	assert.Equal(t, int64(10), fetches[20].Bytes)
+	assert.True(t, server.Fetched())
+	onFetchMu.Lock()
+	assert.Equal(t, 21, onFetchCalls)
+	onFetchMu.Unlock()
+}
+
+func TestServerShutdownAfterFetch(t *testing.T) {
+	config := []byte(`{"ignition":{"version":"3.4.0"}}`)
+	server := NewServer(config)
+	server.ShutdownAfterFetch = true
+
+	guestListener, guestClient := listenUnix(t)
+	hostListener, hostClient := listenUnix(t)
+	guestErrCh := make(chan error, 1)
+	hostErrCh := make(chan error, 1)
+	go func() { guestErrCh <- server.Serve(guestListener) }()
+	go func() { hostErrCh <- server.ServeHost(hostListener) }()
+
+	// partial and host fetches don't stop the server
+	status, _, err := fetch(guestClient, http.Header{"Range": []string{"bytes=0-9"}})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, status)
+	status, body, err := fetch(hostClient, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, config, body)
+	assert.False(t, server.Fetched())
+
+	status, body, err = fetch(guestClient, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, config, body)
+	assert.True(t, server.Fetched())
+
+	for _, errCh := range []chan error{guestErrCh, hostErrCh} {
+		select {
+		case err := <-errCh:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the server was not stopped after the fetch")
+		}
+	}
+	fetches := server.Fetches()
+	require.Len(t, fetches, 3)
+	assert.Equal(t, SourceHost, fetches[1].Source)
+}
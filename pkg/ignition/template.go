@@ -0,0 +1,96 @@
+package ignition
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Variables are the values available to the templates of ignition
+// configurations
+type Variables struct {
+	// Name is the name of the virtual machine
+	Name string
+	// MACAddresses are the MAC addresses of the virtio-net devices
+	MACAddresses []string
+	// VsockPorts are the ports of the virtio-vsock devices
+	VsockPorts []uint32
+	// SSHKey is the SSH public key of the host provisioned in the virtual
+	// machine
+	SSHKey string
+}
+
+// Render expands the templates in the strings of the ignition configuration
+// config, such as `"hostname-{{ .Name }}"` or `"{{ index .MACAddresses 0 }}"`.
+// The templates use the text/template syntax, and the vars values. As only
+// strings are expanded, the rendered configuration is always valid JSON.
+// The configuration is returned unchanged when it has no templates.
+func Render(config []byte, vars Variables) ([]byte, error) {
+	var ign any
+	if err := decodeConfig(config, &ign); err != nil {
+		return nil, err
+	}
+	r := renderer{vars: vars}
+	rendered, err := r.render(ign, "")
+	if err != nil {
+		return nil, err
+	}
+	if !r.expanded {
+		return config, nil
+	}
+	return json.Marshal(rendered)
+}
+
+// renderer expands the templates of a configuration
+type renderer struct {
+	vars Variables
+	// expanded is set when a template was expanded
+	expanded bool
+}
+
+// render expands the templates of value, name is the path of value in the
+// configuration
+func (r *renderer) render(value any, name string) (any, error) {
+	switch value := value.(type) {
+	case string:
+		return r.renderString(value, name)
+	case map[string]any:
+		for key, child := range value {
+			childName := key
+			if name != "" {
+				childName = name + "." + key
+			}
+			rendered, err := r.render(child, childName)
+			if err != nil {
+				return nil, err
+			}
+			value[key] = rendered
+		}
+	case []any:
+		for i, child := range value {
+			rendered, err := r.render(child, fmt.Sprintf("%s[%d]", name, i))
+			if err != nil {
+				return nil, err
+			}
+			value[i] = rendered
+		}
+	}
+	return value, nil
+}
+
+func (r *renderer) renderString(value string, name string) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	r.expanded = true
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid ignition template in '%s': %w", name, err)
+	}
+	var builder strings.Builder
+	if err := tmpl.Execute(&builder, r.vars); err != nil {
+		return "", fmt.Errorf("failed to render ignition template in '%s': %w", name, err)
+	}
+	return builder.String(), nil
+}
@@ -0,0 +1,181 @@
+package ignition
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+)
+
+// SupportedVersions are the ignition spec versions accepted by Validate
+var SupportedVersions = []string{"3.0.0", "3.1.0", "3.2.0", "3.3.0", "3.4.0", "3.5.0"}
+
+// Validate checks that config is an ignition configuration the guest can use:
+// its spec version must be supported, and the sections it uses must have the
+// structure of the ignition specification. This catches malformed
+// configurations on the host, instead of when the guest fails to boot.
+// Validate doesn't check everything ignition checks, such as the values of
+// the fields, or the unknown fields.
+func Validate(config []byte) error {
+	var ign any
+	if err := decodeConfig(config, &ign); err != nil {
+		return err
+	}
+	v := &validator{}
+	v.validate(ign)
+	if len(v.errs) != 0 {
+		return fmt.Errorf("invalid ignition configuration: %w", errors.Join(v.errs...))
+	}
+	return nil
+}
+
+type validator struct {
+	errs []error
+}
+
+func (v *validator) errorf(format string, args ...any) {
+	v.errs = append(v.errs, fmt.Errorf(format, args...))
+}
+
+// object returns value as a JSON object, nil values are empty objects
+func (v *validator) object(value any, name string) map[string]any {
+	if value == nil {
+		return nil
+	}
+	obj, ok := value.(map[string]any)
+	if !ok {
+		v.errorf("'%s' is not an object", name)
+	}
+	return obj
+}
+
+// list returns value as a JSON list, nil values are empty lists
+func (v *validator) list(value any, name string) []any {
+	if value == nil {
+		return nil
+	}
+	list, ok := value.([]any)
+	if !ok {
+		v.errorf("'%s' is not a list", name)
+	}
+	return list
+}
+
+// objects calls check with the objects of the list obj[key] and their name,
+// prefix is the name of obj followed by a dot
+func (v *validator) objects(obj map[string]any, key string, prefix string, check func(name string, item map[string]any)) {
+	for i, value := range v.list(obj[key], prefix+key) {
+		name := fmt.Sprintf("%s%s[%d]", prefix, key, i)
+		if item := v.object(value, name); item != nil {
+			check(name, item)
+		}
+	}
+}
+
+// str returns obj[key] as a string, name is the name of obj[key]
+func (v *validator) str(obj map[string]any, key string, name string, required bool) string {
+	value, ok := obj[key]
+	if !ok || value == nil {
+		if required {
+			v.errorf("missing '%s'", name)
+		}
+		return ""
+	}
+	str, ok := value.(string)
+	if !ok {
+		v.errorf("'%s' is not a string", name)
+	}
+	return str
+}
+
+func (v *validator) boolean(obj map[string]any, key string, name string) {
+	if value, ok := obj[key]; ok && value != nil {
+		if _, ok := value.(bool); !ok {
+			v.errorf("'%s' is not a boolean", name)
+		}
+	}
+}
+
+func (v *validator) strings(obj map[string]any, key string, name string) {
+	for i, value := range v.list(obj[key], name) {
+		if _, ok := value.(string); !ok {
+			v.errorf("'%s[%d]' is not a string", name, i)
+		}
+	}
+}
+
+func (v *validator) validate(value any) {
+	ign, ok := value.(map[string]any)
+	if !ok {
+		v.errorf("not a JSON object")
+		return
+	}
+
+	ignitionSection := v.object(ign["ignition"], "ignition")
+	version := v.str(ignitionSection, "version", "ignition.version", true)
+	if version != "" && !slices.Contains(SupportedVersions, version) {
+		v.errorf("unsupported 'ignition.version': %s (supported versions: %s to %s)", version, SupportedVersions[0], SupportedVersions[len(SupportedVersions)-1])
+	}
+	configSection := v.object(ignitionSection["config"], "ignition.config")
+	v.objects(configSection, "merge", "ignition.config.", func(name string, merge map[string]any) {
+		v.str(merge, "source", name+".source", false)
+	})
+	if replace := v.object(configSection["replace"], "ignition.config.replace"); replace != nil {
+		v.str(replace, "source", "ignition.config.replace.source", false)
+	}
+
+	passwd := v.object(ign["passwd"], "passwd")
+	v.objects(passwd, "users", "passwd.", func(name string, user map[string]any) {
+		v.str(user, "name", name+".name", true)
+		v.strings(user, "sshAuthorizedKeys", name+".sshAuthorizedKeys")
+		v.strings(user, "groups", name+".groups")
+	})
+	v.objects(passwd, "groups", "passwd.", func(name string, group map[string]any) {
+		v.str(group, "name", name+".name", true)
+	})
+
+	storage := v.object(ign["storage"], "storage")
+	for _, key := range []string{"files", "directories", "links"} {
+		v.objects(storage, key, "storage.", func(name string, node map[string]any) {
+			nodePath := v.str(node, "path", name+".path", true)
+			if nodePath != "" && !path.IsAbs(nodePath) {
+				v.errorf("'%s.path' is not an absolute path: %s", name, nodePath)
+			}
+			v.boolean(node, "overwrite", name+".overwrite")
+			if key == "files" {
+				if contents := v.object(node["contents"], name+".contents"); contents != nil {
+					v.str(contents, "source", name+".contents.source", false)
+				}
+				v.objects(node, "append", name+".", func(appendName string, appendContents map[string]any) {
+					v.str(appendContents, "source", appendName+".source", false)
+				})
+			}
+			if key == "links" {
+				v.str(node, "target", name+".target", false)
+			}
+		})
+	}
+	v.objects(storage, "disks", "storage.", func(name string, disk map[string]any) {
+		v.str(disk, "device", name+".device", true)
+	})
+	v.objects(storage, "filesystems", "storage.", func(name string, filesystem map[string]any) {
+		v.str(filesystem, "device", name+".device", true)
+		v.str(filesystem, "format", name+".format", false)
+	})
+
+	systemd := v.object(ign["systemd"], "systemd")
+	v.objects(systemd, "units", "systemd.", func(name string, unit map[string]any) {
+		v.str(unit, "name", name+".name", true)
+		v.str(unit, "contents", name+".contents", false)
+		v.boolean(unit, "enabled", name+".enabled")
+		v.boolean(unit, "mask", name+".mask")
+		v.objects(unit, "dropins", name+".", func(dropinName string, dropin map[string]any) {
+			v.str(dropin, "name", dropinName+".name", true)
+			v.str(dropin, "contents", dropinName+".contents", false)
+		})
+	})
+
+	kernelArguments := v.object(ign["kernelArguments"], "kernelArguments")
+	v.strings(kernelArguments, "shouldExist", "kernelArguments.shouldExist")
+	v.strings(kernelArguments, "shouldNotExist", "kernelArguments.shouldNotExist")
+}
@@ -0,0 +1,292 @@
+// Package kernel detects compressed Linux kernels and decompresses them.
+//
+// The virtualization framework can only boot uncompressed arm64 kernels
+// (`Image` files), while most distributions ship compressed kernels
+// (`vmlinuz`), either as a plain gzip/xz/zstd/lz4 stream, or wrapped in an EFI
+// zboot executable. This package can convert these kernels to a format
+// usable by the virtualization framework.
+package kernel
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/xi2/xz"
+)
+
+// Compression is the compression format used by a kernel file.
+type Compression string
+
+const (
+	CompressionNone    Compression = "none"
+	CompressionGzip    Compression = "gzip"
+	CompressionXz      Compression = "xz"
+	CompressionZstd    Compression = "zstd"
+	CompressionLz4     Compression = "lz4"
+	CompressionZboot   Compression = "zboot"
+	CompressionUnknown Compression = "unknown"
+)
+
+// headerSize is the number of bytes needed by Detect to identify a kernel
+const headerSize = 64
+
+var (
+	// patterns and offsets are coming from https://github.com/file/file/blob/master/magic/Magdir/linux
+	arm64Magic       = []byte{0x41, 0x52, 0x4d, 0x64} // "ARMd" at offset 0x38
+	gzipMagic        = []byte{0x1f, 0x8b}
+	xzMagic          = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic        = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4LegacyMagic   = []byte{0x02, 0x21, 0x4c, 0x18}
+	lz4FrameMagic    = []byte{0x04, 0x22, 0x4d, 0x18}
+	peMagic          = []byte{'M', 'Z'}
+	zbootImageMagic  = []byte{'z', 'i', 'm', 'g'}
+	arm64MagicOffset = 0x38
+)
+
+// from https://github.com/h2non/filetype/blob/cfcd7d097bc4990dc8fc86187307651ae79bf9d9/matchers/document.go#L159-L174
+func compareBytes(slice, subSlice []byte, startOffset int) bool {
+	sl := len(subSlice)
+
+	if startOffset+sl > len(slice) {
+		return false
+	}
+
+	s := slice[startOffset : startOffset+sl]
+	return bytes.Equal(s, subSlice)
+}
+
+// IsUncompressedArm64 returns true if header is the beginning of an
+// uncompressed arm64 kernel.
+func IsUncompressedArm64(header []byte) bool {
+	return compareBytes(header, arm64Magic, arm64MagicOffset)
+}
+
+// Detect returns the compression format of the kernel starting with header.
+// header should be at least 64 bytes long.
+func Detect(header []byte) Compression {
+	switch {
+	case IsUncompressedArm64(header):
+		return CompressionNone
+	case compareBytes(header, peMagic, 0) && compareBytes(header, zbootImageMagic, 4):
+		return CompressionZboot
+	case compareBytes(header, gzipMagic, 0):
+		return CompressionGzip
+	case compareBytes(header, xzMagic, 0):
+		return CompressionXz
+	case compareBytes(header, zstdMagic, 0):
+		return CompressionZstd
+	case compareBytes(header, lz4LegacyMagic, 0), compareBytes(header, lz4FrameMagic, 0):
+		return CompressionLz4
+	default:
+		return CompressionUnknown
+	}
+}
+
+// zboot images are EFI executables with a custom header describing the
+// location of the compressed payload:
+// https://github.com/torvalds/linux/blob/master/drivers/firmware/efi/libstub/zboot-header.S
+type zbootHeader struct {
+	MZMagic         [4]byte
+	ImageType       [4]byte
+	PayloadOffset   uint32
+	PayloadSize     uint32
+	_               [8]byte
+	CompressionType [32]byte
+}
+
+func zbootPayload(r io.ReaderAt) (*io.SectionReader, error) {
+	var header zbootHeader
+	if err := binary.Read(io.NewSectionReader(r, 0, int64(binary.Size(header))), binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("failed to read EFI zboot header: %w", err)
+	}
+	return io.NewSectionReader(r, int64(header.PayloadOffset), int64(header.PayloadSize)), nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	if r.close == nil {
+		return nil
+	}
+	return r.close()
+}
+
+// NewReader returns a reader for the uncompressed content of the kernel
+// provided by r.
+func NewReader(r io.ReaderAt, size int64) (io.ReadCloser, error) {
+	header := make([]byte, headerSize)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	header = header[:n]
+
+	compression := Detect(header)
+	switch compression {
+	case CompressionNone:
+		return readCloser{Reader: io.NewSectionReader(r, 0, size)}, nil
+	case CompressionZboot:
+		payload, err := zbootPayload(r)
+		if err != nil {
+			return nil, err
+		}
+		n, err := payload.ReadAt(header, 0)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		compression = Detect(header[:n])
+		if compression == CompressionNone || compression == CompressionZboot || compression == CompressionUnknown {
+			return nil, fmt.Errorf("unsupported compression format for EFI zboot payload")
+		}
+		return newDecompressor(payload, compression)
+	case CompressionUnknown:
+		return nil, fmt.Errorf("unknown kernel format")
+	default:
+		return newDecompressor(io.NewSectionReader(r, 0, size), compression)
+	}
+}
+
+func newDecompressor(r io.Reader, compression Compression) (io.ReadCloser, error) {
+	r = bufio.NewReader(r)
+	switch compression {
+	case CompressionGzip:
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		// compressed kernels can be followed by padding
+		gzipReader.Multistream(false)
+		return gzipReader, nil
+	case CompressionXz:
+		xzReader, err := xz.NewReader(r, 0)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{Reader: xzReader}, nil
+	case CompressionZstd:
+		zstdReader, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReader.IOReadCloser(), nil
+	case CompressionLz4:
+		return readCloser{Reader: lz4.NewReader(r)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression format: %s", compression)
+	}
+}
+
+// DefaultCacheDir returns the directory used by vfkit to store decompressed kernels.
+func DefaultCacheDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "vfkit", "kernels"), nil
+}
+
+func fileDigest(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Uncompressed returns the path to an uncompressed version of the arm64
+// kernel at kernelPath. If this kernel is already uncompressed, kernelPath
+// is returned. Otherwise, the kernel is decompressed to cacheDir. The name
+// of the decompressed file is derived from the sha256 digest of the compressed
+// kernel so that it can be reused the next time the same kernel is used.
+func Uncompressed(kernelPath string, cacheDir string) (string, error) {
+	file, err := os.Open(kernelPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, headerSize)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	compression := Detect(header[:n])
+	switch compression {
+	case CompressionNone:
+		return kernelPath, nil
+	case CompressionUnknown:
+		return "", fmt.Errorf("%s is neither an uncompressed arm64 kernel nor a supported compressed kernel", kernelPath)
+	}
+
+	digest, err := fileDigest(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute digest of %s: %w", kernelPath, err)
+	}
+	uncompressedPath := filepath.Join(cacheDir, fmt.Sprintf("vmlinux-%s", digest))
+	if _, err := os.Stat(uncompressedPath); err == nil {
+		return uncompressedPath, nil
+	}
+
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return "", fmt.Errorf("unable to create directory %s: %w", cacheDir, err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if err := decompressTo(file, stat.Size(), uncompressedPath); err != nil {
+		return "", fmt.Errorf("failed to decompress %s kernel %s: %w", compression, kernelPath, err)
+	}
+
+	return uncompressedPath, nil
+}
+
+func decompressTo(file io.ReaderAt, size int64, destPath string) error {
+	reader, err := NewReader(file, size)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(destPath), filepath.Base(destPath)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+	}()
+	if _, err := io.Copy(tmpFile, reader); err != nil {
+		return err
+	}
+
+	header := make([]byte, headerSize)
+	n, err := tmpFile.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if !IsUncompressedArm64(header[:n]) {
+		return fmt.Errorf("decompressed file is not an arm64 kernel")
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	// the rename is atomic, concurrent vfkit instances using the same
+	// kernel will not see a partially written file
+	return os.Rename(tmpFile.Name(), destPath)
+}
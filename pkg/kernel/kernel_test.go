@@ -0,0 +1,113 @@
+package kernel
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var compressedKernelTests = map[string]Compression{
+	"Image":       CompressionNone,
+	"Image.gz":    CompressionGzip,
+	"Image.xz":    CompressionXz,
+	"Image.zst":   CompressionZstd,
+	"Image.lz4":   CompressionLz4,
+	"vmlinuz.efi": CompressionZboot,
+}
+
+// truncated versions of kernels shipped by distributions, only their header
+// is usable
+var distroKernelTests = map[string]Compression{
+	"vmlinuz-truncated-6.4.11-200.fc38.x86_64":       CompressionUnknown,
+	"vmlinuz-truncated-6.4.11-200.fc38.aarch64":      CompressionZboot,
+	"vmlinux-truncated-0.1.0.puipui.aarch64":         CompressionNone,
+	"vmlinux-truncated-0.1.0.puipui.x86_64":          CompressionUnknown,
+	"vmlinux-truncated-5.14.0-70.72.1.el9_0.aarch64": CompressionNone,
+	"vmlinuz-truncated-5.14.0-70.72.1.el9_0.aarch64": CompressionGzip,
+}
+
+func readHeader(t *testing.T, filename string) []byte {
+	file, err := os.Open(filename)
+	require.NoError(t, err)
+	defer file.Close()
+	header := make([]byte, headerSize)
+	_, err = io.ReadFull(file, header)
+	require.NoError(t, err)
+	return header
+}
+
+func TestDetect(t *testing.T) {
+	for filename, compression := range distroKernelTests {
+		t.Run(filename, func(t *testing.T) {
+			header := readHeader(t, filepath.Join("testdata", filename))
+			assert.Equal(t, compression, Detect(header))
+			assert.Equal(t, compression == CompressionNone, IsUncompressedArm64(header))
+		})
+	}
+	for filename, compression := range compressedKernelTests {
+		t.Run(filename, func(t *testing.T) {
+			header := readHeader(t, filepath.Join("testdata", filename))
+			assert.Equal(t, compression, Detect(header))
+		})
+	}
+	assert.Equal(t, CompressionUnknown, Detect([]byte("not a kernel")))
+	assert.Equal(t, CompressionUnknown, Detect(nil))
+}
+
+func TestUncompressed(t *testing.T) {
+	expected, err := os.ReadFile(filepath.Join("testdata", "Image"))
+	require.NoError(t, err)
+
+	cacheDir := t.TempDir()
+	for filename := range compressedKernelTests {
+		t.Run(filename, func(t *testing.T) {
+			kernelPath := filepath.Join("testdata", filename)
+			uncompressedPath, err := Uncompressed(kernelPath, cacheDir)
+			require.NoError(t, err)
+			if filename == "Image" {
+				assert.Equal(t, kernelPath, uncompressedPath)
+				return
+			}
+			assert.Equal(t, cacheDir, filepath.Dir(uncompressedPath))
+			uncompressed, err := os.ReadFile(uncompressedPath)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(expected, uncompressed))
+
+			// the second call must reuse the cached file
+			info, err := os.Stat(uncompressedPath)
+			require.NoError(t, err)
+			cachedPath, err := Uncompressed(kernelPath, cacheDir)
+			require.NoError(t, err)
+			assert.Equal(t, uncompressedPath, cachedPath)
+			cachedInfo, err := os.Stat(cachedPath)
+			require.NoError(t, err)
+			assert.Equal(t, info.ModTime(), cachedInfo.ModTime())
+		})
+	}
+}
+
+func TestUncompressedErrors(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	unknownPath := filepath.Join(tmpDir, "unknown")
+	require.NoError(t, os.WriteFile(unknownPath, bytes.Repeat([]byte{0xaa}, 128), 0600))
+	_, err := Uncompressed(unknownPath, tmpDir)
+	require.ErrorContains(t, err, "neither an uncompressed arm64 kernel nor a supported compressed kernel")
+
+	// a gzip kernel truncated in the middle of the compressed stream
+	compressed, err := os.ReadFile(filepath.Join("testdata", "Image.gz"))
+	require.NoError(t, err)
+	truncatedPath := filepath.Join(tmpDir, "truncated.gz")
+	require.NoError(t, os.WriteFile(truncatedPath, compressed[:len(compressed)/2], 0600))
+	_, err = Uncompressed(truncatedPath, tmpDir)
+	require.ErrorContains(t, err, "failed to decompress gzip kernel")
+
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "temporary files were not removed")
+}
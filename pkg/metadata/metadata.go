@@ -0,0 +1,139 @@
+// Package metadata implements an instance metadata service, which serves
+// information about the virtual machine to the guest over HTTP.
+//
+// The metadata is served in the layout of the EC2 instance metadata service,
+// under /latest, and of the OpenStack metadata service, under
+// /openstack/latest. Directories list their entries, one per line, with a
+// trailing '/' for subdirectories.
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Metadata is the information served to the guest
+type Metadata struct {
+	InstanceID    string
+	Hostname      string
+	PublicKeys    []string
+	UserData      []byte
+	VendorData    []byte
+	NetworkConfig []byte
+	// Tags are custom key/values, served under
+	// /latest/meta-data/tags/instance/
+	Tags map[string]string
+}
+
+// openstackMetadata is the subset of the OpenStack meta_data.json file used by
+// cloud-init
+type openstackMetadata struct {
+	UUID       string            `json:"uuid"`
+	Name       string            `json:"name"`
+	Hostname   string            `json:"hostname"`
+	PublicKeys map[string]string `json:"public_keys,omitempty"`
+	Meta       map[string]string `json:"meta,omitempty"`
+}
+
+// files returns the files of the metadata tree, indexed by their path
+func (md *Metadata) files() (map[string][]byte, error) {
+	files := map[string][]byte{
+		"latest/meta-data/instance-id":    []byte(md.InstanceID),
+		"latest/meta-data/hostname":       []byte(md.Hostname),
+		"latest/meta-data/local-hostname": []byte(md.Hostname),
+	}
+	osMetadata := openstackMetadata{
+		UUID:     md.InstanceID,
+		Name:     md.Hostname,
+		Hostname: md.Hostname,
+	}
+	for i, key := range md.PublicKeys {
+		files[fmt.Sprintf("latest/meta-data/public-keys/%d/openssh-key", i)] = []byte(key)
+		if osMetadata.PublicKeys == nil {
+			osMetadata.PublicKeys = map[string]string{}
+		}
+		osMetadata.PublicKeys[fmt.Sprintf("vfkit-%d", i)] = key
+	}
+	for key, value := range md.Tags {
+		if key == "" || strings.Contains(key, "/") {
+			return nil, fmt.Errorf("invalid metadata tag name: %q", key)
+		}
+		files["latest/meta-data/tags/instance/"+key] = []byte(value)
+	}
+	osMetadata.Meta = md.Tags
+	if md.UserData != nil {
+		files["latest/user-data"] = md.UserData
+		files["openstack/latest/user_data"] = md.UserData
+	}
+	if md.VendorData != nil {
+		files["latest/vendor-data"] = md.VendorData
+	}
+	if md.NetworkConfig != nil {
+		files["latest/network-config"] = md.NetworkConfig
+	}
+	osMetadataJSON, err := json.Marshal(osMetadata)
+	if err != nil {
+		return nil, err
+	}
+	files["openstack/latest/meta_data.json"] = osMetadataJSON
+	return files, nil
+}
+
+// listDir returns the entries of the directory dir of the tree of files
+func listDir(files map[string][]byte, dir string) []string {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	entries := []string{}
+	for path := range files {
+		rest, ok := strings.CutPrefix(path, prefix)
+		if !ok {
+			continue
+		}
+		entry := rest
+		if name, _, isDir := strings.Cut(rest, "/"); isDir {
+			entry = name + "/"
+		}
+		if !slices.Contains(entries, entry) {
+			entries = append(entries, entry)
+		}
+	}
+	slices.Sort(entries)
+	return entries
+}
+
+// Handler returns an HTTP handler serving md
+func Handler(md *Metadata) (http.Handler, error) {
+	files, err := md.files()
+	if err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		path := strings.Trim(req.URL.Path, "/")
+		if content, ok := files[path]; ok && !strings.HasSuffix(req.URL.Path, "/") {
+			if strings.HasSuffix(path, ".json") {
+				w.Header().Set("Content-Type", "application/json")
+			} else {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			}
+			_, _ = w.Write(content)
+			return
+		}
+		entries := listDir(files, path)
+		if len(entries) == 0 {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(strings.Join(entries, "\n")))
+	}), nil
+}
@@ -0,0 +1,66 @@
+package metadata
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, handler http.Handler, path string) (int, string) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	body, err := io.ReadAll(rec.Result().Body)
+	require.NoError(t, err)
+	return rec.Code, string(body)
+}
+
+func TestHandler(t *testing.T) {
+	handler, err := Handler(&Metadata{
+		InstanceID: "iid-vfkit-0123456789abcdef",
+		Hostname:   "fedora",
+		PublicKeys: []string{"ssh-ed25519 AAAA vfkit"},
+		UserData:   []byte("#cloud-config\n"),
+		Tags:       map[string]string{"role": "web", "env": "dev"},
+	})
+	require.NoError(t, err)
+
+	tests := map[string]string{
+		"/":                                           "latest/\nopenstack/",
+		"/latest":                                     "meta-data/\nuser-data",
+		"/latest/meta-data/":                          "hostname\ninstance-id\nlocal-hostname\npublic-keys/\ntags/",
+		"/latest/meta-data/instance-id":               "iid-vfkit-0123456789abcdef",
+		"/latest/meta-data/local-hostname":            "fedora",
+		"/latest/meta-data/public-keys/":              "0/",
+		"/latest/meta-data/public-keys/0/":            "openssh-key",
+		"/latest/meta-data/public-keys/0/openssh-key": "ssh-ed25519 AAAA vfkit",
+		"/latest/meta-data/tags/instance":             "env\nrole",
+		"/latest/meta-data/tags/instance/role":        "web",
+		"/latest/user-data":                           "#cloud-config\n",
+		"/openstack/latest/user_data":                 "#cloud-config\n",
+	}
+	for path, expected := range tests {
+		code, body := get(t, handler, path)
+		assert.Equal(t, http.StatusOK, code, path)
+		assert.Equal(t, expected, body, path)
+	}
+
+	code, body := get(t, handler, "/openstack/latest/meta_data.json")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"uuid":"iid-vfkit-0123456789abcdef","name":"fedora","hostname":"fedora","public_keys":{"vfkit-0":"ssh-ed25519 AAAA vfkit"},"meta":{"env":"dev","role":"web"}}`, body)
+
+	code, _ = get(t, handler, "/latest/network-config")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get(t, handler, "/latest/user-data/")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/latest/meta-data/hostname", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	_, err = Handler(&Metadata{Tags: map[string]string{"a/b": "c"}})
+	require.EqualError(t, err, `invalid metadata tag name: "a/b"`)
+}
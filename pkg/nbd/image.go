@@ -0,0 +1,34 @@
+package nbd
+
+import (
+	"fmt"
+
+	"github.com/crc-org/vfkit/pkg/diskimage"
+)
+
+// readOnlyImage is a disk image exported read-only
+type readOnlyImage struct {
+	diskimage.Image
+}
+
+func (img readOnlyImage) WriteAt(_ []byte, _ int64) (int, error) {
+	return 0, fmt.Errorf("disk image is read-only")
+}
+
+func (img readOnlyImage) Sync() error {
+	return nil
+}
+
+// OpenImage opens the raw or qcow2 disk image at path so that it can be used
+// as the Device of an export. The image is opened read-only when readOnly is
+// true.
+func OpenImage(path string, readOnly bool) (diskimage.WritableImage, error) {
+	if !readOnly {
+		return diskimage.OpenWritable(path)
+	}
+	img, err := diskimage.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return readOnlyImage{Image: img}, nil
+}
@@ -0,0 +1,77 @@
+// Package nbd implements a Network Block Device server exporting disk images.
+//
+// The protocol is described in
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+// Only the fixed newstyle handshake and simple replies are implemented, which
+// is enough for the NBD client of the virtualization framework.
+package nbd
+
+const (
+	nbdMagic       = 0x4e42444d41474943 // "NBDMAGIC"
+	optionMagic    = 0x49484156454f5054 // "IHAVEOPT"
+	optReplyMagic  = 0x0003e889045565a9
+	requestMagic   = 0x25609513
+	simpleRepMagic = 0x67446698
+
+	// handshake flags
+	flagFixedNewstyle = 1 << 0
+	flagNoZeroes      = 1 << 1
+
+	// client flags
+	clientFlagFixedNewstyle = 1 << 0
+	clientFlagNoZeroes      = 1 << 1
+
+	// options
+	optExportName = 1
+	optAbort      = 2
+	optList       = 3
+	optInfo       = 6
+	optGo         = 7
+
+	// option replies
+	repAck        = 1
+	repServer     = 2
+	repInfo       = 3
+	repErrUnsup   = 1<<31 + 1
+	repErrInvalid = 1<<31 + 3
+	repErrUnknown = 1<<31 + 6
+
+	// information types of repInfo replies
+	infoExport    = 0
+	infoBlockSize = 3
+
+	// transmission flags
+	transmissionHasFlags        = 1 << 0
+	transmissionReadOnly        = 1 << 1
+	transmissionSendFlush       = 1 << 2
+	transmissionSendFUA         = 1 << 3
+	transmissionSendTrim        = 1 << 5
+	transmissionSendWriteZeroes = 1 << 6
+
+	// commands
+	cmdRead        = 0
+	cmdWrite       = 1
+	cmdDisc        = 2
+	cmdFlush       = 3
+	cmdTrim        = 4
+	cmdWriteZeroes = 6
+
+	// command flags
+	cmdFlagFUA = 1 << 0
+
+	// errors
+	errPerm     = 1
+	errIO       = 5
+	errInval    = 22
+	errNoSpc    = 28
+	errOverflow = 75
+	errNotSup   = 95
+
+	// maximum length of the data of options
+	maxOptionLen = 64 * 1024
+	// maximum length of read and write requests
+	maxRequestLen = 32 * 1024 * 1024
+	// block sizes advertised to clients
+	minBlockSize       = 1
+	preferredBlockSize = 4096
+)
@@ -0,0 +1,477 @@
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Device is the storage exported by the server.
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+	// Size returns the size of the device in bytes
+	Size() int64
+	// Sync commits the data written to the device to stable storage
+	Sync() error
+}
+
+// Export is a device exported by the server under a name.
+type Export struct {
+	Name     string
+	Device   Device
+	ReadOnly bool
+}
+
+// Server serves exports to NBD clients. A Device can be shared by several
+// exports or connections, it must then be safe for concurrent use.
+type Server struct {
+	exports map[string]*Export
+
+	mutex     sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer creates a new server serving exports.
+func NewServer(exports ...Export) *Server {
+	server := Server{
+		exports:   map[string]*Export{},
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+	for _, export := range exports {
+		server.exports[export.Name] = &export
+	}
+	return &server
+}
+
+// Serve accepts connections on listener and serves them until the listener
+// is closed or Close is called.
+func (server *Server) Serve(listener net.Listener) error {
+	server.mutex.Lock()
+	if server.closed {
+		server.mutex.Unlock()
+		return net.ErrClosed
+	}
+	server.listeners[listener] = struct{}{}
+	server.mutex.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			server.mutex.Lock()
+			delete(server.listeners, listener)
+			closed := server.closed
+			server.mutex.Unlock()
+			if closed {
+				return net.ErrClosed
+			}
+			return err
+		}
+		if !server.track(conn) {
+			_ = conn.Close()
+			return net.ErrClosed
+		}
+		go func() {
+			defer server.untrack(conn)
+			if err := server.serveConn(conn); err != nil {
+				log.Warnf("NBD connection error: %v", err)
+			}
+		}()
+	}
+}
+
+func (server *Server) track(conn net.Conn) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.closed {
+		return false
+	}
+	server.conns[conn] = struct{}{}
+	server.wg.Add(1)
+	return true
+}
+
+func (server *Server) untrack(conn net.Conn) {
+	_ = conn.Close()
+	server.mutex.Lock()
+	delete(server.conns, conn)
+	server.mutex.Unlock()
+	server.wg.Done()
+}
+
+// Close closes the listeners and the client connections, and waits for the
+// requests in progress to complete. The devices are not closed.
+func (server *Server) Close() error {
+	server.mutex.Lock()
+	server.closed = true
+	var errs []error
+	for listener := range server.listeners {
+		errs = append(errs, listener.Close())
+	}
+	for conn := range server.conns {
+		errs = append(errs, conn.Close())
+	}
+	server.mutex.Unlock()
+
+	server.wg.Wait()
+	return errors.Join(errs...)
+}
+
+// conn is a client connection
+type conn struct {
+	server *Server
+	reader *bufio.Reader
+	writer *bufio.Writer
+	export *Export
+	// the client doesn't want the 124 zero bytes after NBD_OPT_EXPORT_NAME
+	noZeroes bool
+}
+
+func (server *Server) serveConn(netConn net.Conn) error {
+	c := conn{
+		server: server,
+		reader: bufio.NewReader(netConn),
+		writer: bufio.NewWriter(netConn),
+	}
+	if err := c.handshake(); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	if c.export == nil {
+		// the client aborted the handshake
+		return nil
+	}
+	err := c.transmission()
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (c *conn) write(values ...any) error {
+	for _, value := range values {
+		var err error
+		if data, ok := value.([]byte); ok {
+			_, err = c.writer.Write(data)
+		} else {
+			err = binary.Write(c.writer, binary.BigEndian, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) read(values ...any) error {
+	for _, value := range values {
+		var err error
+		if data, ok := value.([]byte); ok {
+			_, err = io.ReadFull(c.reader, data)
+		} else {
+			err = binary.Read(c.reader, binary.BigEndian, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func transmissionFlags(export *Export) uint16 {
+	flags := uint16(transmissionHasFlags | transmissionSendFlush | transmissionSendFUA)
+	if export.ReadOnly {
+		flags |= transmissionReadOnly
+	} else {
+		flags |= transmissionSendTrim | transmissionSendWriteZeroes
+	}
+	return flags
+}
+
+// handshake negotiates the export with the client, c.export is nil if the
+// client aborted the negotiation
+func (c *conn) handshake() error {
+	if err := c.write(uint64(nbdMagic), uint64(optionMagic), uint16(flagFixedNewstyle|flagNoZeroes)); err != nil {
+		return err
+	}
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+	var clientFlags uint32
+	if err := c.read(&clientFlags); err != nil {
+		return err
+	}
+	if clientFlags&clientFlagFixedNewstyle == 0 {
+		return fmt.Errorf("client does not support the fixed newstyle negotiation")
+	}
+	c.noZeroes = clientFlags&clientFlagNoZeroes != 0
+
+	for {
+		var magic uint64
+		var option, length uint32
+		if err := c.read(&magic, &option, &length); err != nil {
+			return err
+		}
+		if magic != optionMagic {
+			return fmt.Errorf("invalid option magic: %#x", magic)
+		}
+		if length > maxOptionLen {
+			return fmt.Errorf("option %d is too large: %d bytes", option, length)
+		}
+		data := make([]byte, length)
+		if err := c.read(data); err != nil {
+			return err
+		}
+
+		done, err := c.handleOption(option, data)
+		if err != nil {
+			return err
+		}
+		if err := c.writer.Flush(); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+func (c *conn) reply(option uint32, replyType uint32, data []byte) error {
+	return c.write(uint64(optReplyMagic), option, replyType, uint32(len(data)), data)
+}
+
+// handleOption handles a negotiation option, it returns true when the
+// negotiation is over
+func (c *conn) handleOption(option uint32, data []byte) (bool, error) {
+	switch option {
+	case optExportName:
+		export, ok := c.server.exports[string(data)]
+		if !ok {
+			// the only way to refuse an export with this option is
+			// to close the connection
+			return false, fmt.Errorf("unknown export: %q", string(data))
+		}
+		c.export = export
+		if err := c.write(uint64(export.Device.Size()), transmissionFlags(export)); err != nil {
+			return false, err
+		}
+		if !c.noZeroes {
+			return true, c.write(make([]byte, 124))
+		}
+		return true, nil
+	case optAbort:
+		return true, c.reply(option, repAck, nil)
+	case optList:
+		if len(data) != 0 {
+			return false, c.reply(option, repErrInvalid, nil)
+		}
+		for name := range c.server.exports {
+			reply := binary.BigEndian.AppendUint32(nil, uint32(len(name)))
+			if err := c.reply(option, repServer, append(reply, name...)); err != nil {
+				return false, err
+			}
+		}
+		return false, c.reply(option, repAck, nil)
+	case optInfo, optGo:
+		return c.handleInfo(option, data)
+	default:
+		return false, c.reply(option, repErrUnsup, nil)
+	}
+}
+
+// handleInfo handles the NBD_OPT_INFO and NBD_OPT_GO options
+func (c *conn) handleInfo(option uint32, data []byte) (bool, error) {
+	if len(data) < 4 {
+		return false, c.reply(option, repErrInvalid, nil)
+	}
+	nameLen := binary.BigEndian.Uint32(data)
+	if uint64(len(data)) < 4+uint64(nameLen)+2 {
+		return false, c.reply(option, repErrInvalid, nil)
+	}
+	name := string(data[4 : 4+nameLen])
+	export, ok := c.server.exports[name]
+	if !ok {
+		return false, c.reply(option, repErrUnknown, []byte(fmt.Sprintf("unknown export: %q", name)))
+	}
+
+	be := binary.BigEndian
+	info := be.AppendUint16(nil, infoExport)
+	info = be.AppendUint64(info, uint64(export.Device.Size()))
+	info = be.AppendUint16(info, transmissionFlags(export))
+	if err := c.reply(option, repInfo, info); err != nil {
+		return false, err
+	}
+	// the block sizes are always sent, clients which didn't request them
+	// ignore them
+	blockSize := be.AppendUint16(nil, infoBlockSize)
+	blockSize = be.AppendUint32(blockSize, minBlockSize)
+	blockSize = be.AppendUint32(blockSize, preferredBlockSize)
+	blockSize = be.AppendUint32(blockSize, maxRequestLen)
+	if err := c.reply(option, repInfo, blockSize); err != nil {
+		return false, err
+	}
+	if err := c.reply(option, repAck, nil); err != nil {
+		return false, err
+	}
+	if option == optInfo {
+		return false, nil
+	}
+	c.export = export
+	return true, nil
+}
+
+type request struct {
+	flags   uint16
+	command uint16
+	cookie  uint64
+	offset  uint64
+	length  uint32
+}
+
+// transmission handles the requests of the client until it disconnects
+func (c *conn) transmission() error {
+	buf := []byte{}
+	for {
+		var magic uint32
+		var req request
+		if err := c.read(&magic, &req.flags, &req.command, &req.cookie, &req.offset, &req.length); err != nil {
+			return err
+		}
+		if magic != requestMagic {
+			return fmt.Errorf("invalid request magic: %#x", magic)
+		}
+
+		if req.command == cmdWrite {
+			if req.length > maxRequestLen {
+				// the data of the request can't be skipped safely
+				return fmt.Errorf("write request is too large: %d bytes", req.length)
+			}
+			buf = grow(buf, req.length)
+			if err := c.read(buf); err != nil {
+				return err
+			}
+		}
+		if req.command == cmdDisc {
+			return c.export.Device.Sync()
+		}
+
+		errno, data := c.handleRequest(&req, buf)
+		if err := c.write(uint32(simpleRepMagic), errno, req.cookie); err != nil {
+			return err
+		}
+		if errno == 0 && data != nil {
+			if err := c.write(data); err != nil {
+				return err
+			}
+		}
+		if err := c.writer.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func grow(buf []byte, length uint32) []byte {
+	if uint32(cap(buf)) < length {
+		return make([]byte, length)
+	}
+	return buf[:length]
+}
+
+// handleRequest executes a request and returns the NBD error code and the
+// data of the reply. buf contains the data of write requests.
+func (c *conn) handleRequest(req *request, buf []byte) (uint32, []byte) {
+	device := c.export.Device
+	switch req.command {
+	case cmdRead, cmdWrite, cmdTrim, cmdWriteZeroes:
+		if req.offset > uint64(device.Size()) || uint64(req.length) > uint64(device.Size())-req.offset {
+			if req.command == cmdRead {
+				return errInval, nil
+			}
+			return errNoSpc, nil
+		}
+	}
+
+	var err error
+	switch req.command {
+	case cmdRead:
+		if req.length > maxRequestLen {
+			return errOverflow, nil
+		}
+		buf = grow(buf, req.length)
+		_, err = device.ReadAt(buf, int64(req.offset))
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		if err == nil {
+			return 0, buf
+		}
+	case cmdWrite:
+		if c.export.ReadOnly {
+			return errPerm, nil
+		}
+		_, err = device.WriteAt(buf, int64(req.offset))
+	case cmdWriteZeroes:
+		if c.export.ReadOnly {
+			return errPerm, nil
+		}
+		err = c.writeZeroes(req.offset, req.length)
+	case cmdTrim:
+		if c.export.ReadOnly {
+			return errPerm, nil
+		}
+		// trimming is advisory, the data is kept
+		return 0, nil
+	case cmdFlush:
+		err = device.Sync()
+	default:
+		return errInval, nil
+	}
+	if err == nil && req.flags&cmdFlagFUA != 0 && req.command != cmdFlush {
+		err = device.Sync()
+	}
+	if err != nil {
+		log.Warnf("NBD request %d on export %q failed: %v", req.command, c.export.Name, err)
+		return errnoOf(err), nil
+	}
+	return 0, nil
+}
+
+func (c *conn) writeZeroes(offset uint64, length uint32) error {
+	zeros := make([]byte, min(length, preferredBlockSize*256))
+	for length > 0 {
+		chunk := zeros[:min(length, uint32(len(zeros)))]
+		if _, err := c.export.Device.WriteAt(chunk, int64(offset)); err != nil {
+			return err
+		}
+		offset += uint64(len(chunk))
+		length -= uint32(len(chunk))
+	}
+	return nil
+}
+
+// errnoOf returns the NBD error code corresponding to err
+func errnoOf(err error) uint32 {
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		return errNoSpc
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EROFS):
+		return errPerm
+	case errors.Is(err, syscall.ENOTSUP):
+		return errNotSup
+	default:
+		return errIO
+	}
+}
@@ -0,0 +1,291 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/crc-org/vfkit/pkg/diskimage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient is a minimal NBD client
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	cookie uint64
+}
+
+func (c *testClient) write(values ...any) {
+	for _, value := range values {
+		require.NoError(c.t, binary.Write(c.conn, binary.BigEndian, value))
+	}
+}
+
+func (c *testClient) read(values ...any) {
+	for _, value := range values {
+		require.NoError(c.t, binary.Read(c.conn, binary.BigEndian, value))
+	}
+}
+
+func dial(t *testing.T, socketPath string, clientFlags uint32) *testClient {
+	conn, err := net.Dial("unix", socketPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	c := &testClient{t: t, conn: conn}
+
+	var magic, option uint64
+	var flags uint16
+	c.read(&magic, &option, &flags)
+	require.Equal(t, uint64(nbdMagic), magic)
+	require.Equal(t, uint64(optionMagic), option)
+	require.Equal(t, uint16(flagFixedNewstyle|flagNoZeroes), flags)
+	c.write(clientFlags)
+	return c
+}
+
+func (c *testClient) option(option uint32, data []byte) {
+	c.write(uint64(optionMagic), option, uint32(len(data)), data)
+}
+
+// reply reads an option reply
+func (c *testClient) reply(option uint32) (uint32, []byte) {
+	var magic uint64
+	var replyOption, replyType, length uint32
+	c.read(&magic, &replyOption, &replyType, &length)
+	require.Equal(c.t, uint64(optReplyMagic), magic)
+	require.Equal(c.t, option, replyOption)
+	data := make([]byte, length)
+	c.read(data)
+	return replyType, data
+}
+
+func infoRequest(name string) []byte {
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(name)))
+	data = append(data, name...)
+	return binary.BigEndian.AppendUint16(data, 0)
+}
+
+// optGo negotiates the export name with NBD_OPT_GO, and returns the size and
+// transmission flags of the export
+func (c *testClient) optGo(name string) (uint64, uint16) {
+	c.option(optGo, infoRequest(name))
+	var size uint64
+	var flags uint16
+	for {
+		replyType, data := c.reply(optGo)
+		if replyType == repAck {
+			return size, flags
+		}
+		require.Equal(c.t, uint32(repInfo), replyType)
+		if binary.BigEndian.Uint16(data) == infoExport {
+			size = binary.BigEndian.Uint64(data[2:])
+			flags = binary.BigEndian.Uint16(data[10:])
+		}
+	}
+}
+
+// request sends a transmission request and returns the error code and the
+// data of the reply
+func (c *testClient) request(command uint16, flags uint16, offset uint64, length uint32, data []byte) (uint32, []byte) {
+	c.cookie++
+	c.write(uint32(requestMagic), flags, command, c.cookie, offset, length, data)
+	var magic, errno uint32
+	var cookie uint64
+	c.read(&magic, &errno, &cookie)
+	require.Equal(c.t, uint32(simpleRepMagic), magic)
+	require.Equal(c.t, c.cookie, cookie)
+	if command != cmdRead || errno != 0 {
+		return errno, nil
+	}
+	reply := make([]byte, length)
+	c.read(reply)
+	return errno, reply
+}
+
+func serve(t *testing.T, exports ...Export) (*Server, string) {
+	socketPath := filepath.Join(t.TempDir(), "nbd.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	server := NewServer(exports...)
+	done := make(chan error)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		require.NoError(t, server.Close())
+		require.ErrorIs(t, <-done, net.ErrClosed)
+	})
+	return server, socketPath
+}
+
+func createImage(t *testing.T, size uint64) string {
+	imgPath := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, diskimage.Create(imgPath, size))
+	return imgPath
+}
+
+func TestServerReadWrite(t *testing.T) {
+	imgPath := createImage(t, 1024*1024)
+	img, err := OpenImage(imgPath, false)
+	require.NoError(t, err)
+	defer img.Close()
+	_, socketPath := serve(t, Export{Name: "disk", Device: img})
+
+	c := dial(t, socketPath, clientFlagFixedNewstyle|clientFlagNoZeroes)
+	size, flags := c.optGo("disk")
+	assert.Equal(t, uint64(1024*1024), size)
+	assert.Equal(t, uint16(transmissionHasFlags|transmissionSendFlush|transmissionSendFUA|transmissionSendTrim|transmissionSendWriteZeroes), flags)
+
+	data := bytes.Repeat([]byte("vfkit nbd\n"), 1000)
+	errno, _ := c.request(cmdWrite, 0, 5000, uint32(len(data)), data)
+	require.Zero(t, errno)
+	errno, reply := c.request(cmdRead, 0, 5000, uint32(len(data)), nil)
+	require.Zero(t, errno)
+	assert.Equal(t, data, reply)
+
+	errno, _ = c.request(cmdWriteZeroes, cmdFlagFUA, 6000, 1000, nil)
+	require.Zero(t, errno)
+	copy(data[1000:2000], make([]byte, 1000))
+	errno, _ = c.request(cmdTrim, 0, 0, 4096, nil)
+	require.Zero(t, errno)
+	errno, _ = c.request(cmdFlush, 0, 0, 0, nil)
+	require.Zero(t, errno)
+
+	// requests beyond the end of the disk
+	errno, _ = c.request(cmdRead, 0, size-10, 20, nil)
+	assert.Equal(t, uint32(errInval), errno)
+	errno, _ = c.request(cmdWrite, 0, size-10, 20, make([]byte, 20))
+	assert.Equal(t, uint32(errNoSpc), errno)
+	errno, _ = c.request(5, 0, 0, 0, nil)
+	assert.Equal(t, uint32(errInval), errno)
+
+	c.write(uint32(requestMagic), uint16(0), uint16(cmdDisc), uint64(0), uint64(0), uint32(0))
+	_, err = c.conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	content, err := os.ReadFile(imgPath)
+	require.NoError(t, err)
+	assert.Equal(t, data, content[5000:5000+len(data)])
+}
+
+func TestServerReadOnly(t *testing.T) {
+	imgPath := createImage(t, 1024*1024)
+	img, err := OpenImage(imgPath, true)
+	require.NoError(t, err)
+	defer img.Close()
+	_, socketPath := serve(t, Export{Name: "disk", Device: img, ReadOnly: true})
+
+	c := dial(t, socketPath, clientFlagFixedNewstyle|clientFlagNoZeroes)
+	_, flags := c.optGo("disk")
+	assert.NotZero(t, flags&transmissionReadOnly)
+	for _, command := range []uint16{cmdWrite, cmdWriteZeroes, cmdTrim} {
+		var data []byte
+		if command == cmdWrite {
+			data = make([]byte, 512)
+		}
+		errno, _ := c.request(command, 0, 0, 512, data)
+		assert.Equal(t, uint32(errPerm), errno)
+	}
+	errno, reply := c.request(cmdRead, 0, 0, 512, nil)
+	require.Zero(t, errno)
+	assert.Equal(t, make([]byte, 512), reply)
+}
+
+func TestServerNegotiation(t *testing.T) {
+	img, err := OpenImage(createImage(t, 1024*1024), false)
+	require.NoError(t, err)
+	defer img.Close()
+	_, socketPath := serve(t, Export{Name: "disk", Device: img}, Export{Name: "disk-ro", Device: img, ReadOnly: true})
+
+	c := dial(t, socketPath, clientFlagFixedNewstyle)
+	c.option(optList, nil)
+	names := []string{}
+	for {
+		replyType, data := c.reply(optList)
+		if replyType == repAck {
+			break
+		}
+		require.Equal(t, uint32(repServer), replyType)
+		names = append(names, string(data[4:]))
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"disk", "disk-ro"}, names)
+
+	c.option(optInfo, infoRequest("missing"))
+	replyType, _ := c.reply(optInfo)
+	assert.Equal(t, uint32(repErrUnknown), replyType)
+	c.option(optInfo, []byte{0})
+	replyType, _ = c.reply(optInfo)
+	assert.Equal(t, uint32(repErrInvalid), replyType)
+	// NBD_OPT_STRUCTURED_REPLY
+	c.option(8, nil)
+	replyType, _ = c.reply(8)
+	assert.Equal(t, uint32(repErrUnsup), replyType)
+
+	// NBD_OPT_EXPORT_NAME, without the NO_ZEROES flag
+	c.option(optExportName, []byte("disk-ro"))
+	var size uint64
+	var flags uint16
+	c.read(&size, &flags)
+	assert.Equal(t, uint64(1024*1024), size)
+	assert.NotZero(t, flags&transmissionReadOnly)
+	zeroes := make([]byte, 124)
+	c.read(zeroes)
+	errno, _ := c.request(cmdRead, 0, 0, 10, nil)
+	assert.Zero(t, errno)
+
+	// unknown exports close the connection
+	c = dial(t, socketPath, clientFlagFixedNewstyle)
+	c.option(optExportName, []byte("missing"))
+	_, err = c.conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	c = dial(t, socketPath, clientFlagFixedNewstyle)
+	c.option(optAbort, nil)
+	replyType, _ = c.reply(optAbort)
+	assert.Equal(t, uint32(repAck), replyType)
+}
+
+func TestServerQcow2Overlay(t *testing.T) {
+	tmpDir := t.TempDir()
+	backing := bytes.Repeat([]byte("backing\n"), 128*1024)
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "backing.raw"), backing, 0600))
+	original := bytes.Clone(backing)
+	imgPath := filepath.Join(tmpDir, "overlay.qcow2")
+	require.NoError(t, diskimage.CreateQcow2(imgPath, 0, "backing.raw"))
+
+	img, err := OpenImage(imgPath, false)
+	require.NoError(t, err)
+	_, socketPath := serve(t, Export{Name: "disk", Device: img})
+	c := dial(t, socketPath, clientFlagFixedNewstyle|clientFlagNoZeroes)
+	size, _ := c.optGo("disk")
+	assert.Equal(t, uint64(len(backing)), size)
+
+	data := bytes.Repeat([]byte("overlay\n"), 100)
+	errno, _ := c.request(cmdWrite, cmdFlagFUA, 70000, uint32(len(data)), data)
+	require.Zero(t, errno)
+	copy(backing[70000:], data)
+	errno, reply := c.request(cmdRead, 0, 0, uint32(len(backing)), nil)
+	require.Zero(t, errno)
+	assert.Equal(t, backing, reply)
+	require.NoError(t, img.Close())
+
+	// the backing file is not modified
+	content, err := os.ReadFile(filepath.Join(tmpDir, "backing.raw"))
+	require.NoError(t, err)
+	assert.Equal(t, original, content)
+	overlay, err := diskimage.Open(imgPath)
+	require.NoError(t, err)
+	defer overlay.Close()
+	content = make([]byte, len(backing))
+	_, err = overlay.ReadAt(content, 0)
+	require.NoError(t, err)
+	assert.Equal(t, backing, content)
+}
@@ -0,0 +1,183 @@
+// Package netrelay copies ethernet frames between two connections which
+// don't use the same framing. The virtualization framework exchanges frames
+// over a datagram socket, one frame per datagram, while user-mode network
+// stacks such as passt or QEMU's `-netdev stream` use stream sockets where
+// each frame is prefixed by its length.
+package netrelay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxFrameSize is the size of the largest frame which can be relayed
+const MaxFrameSize = 65536
+
+// headerSize is the size of the length prefix of the frames of stream
+// connections
+const headerSize = 4
+
+// Conn reads and writes ethernet frames
+type Conn interface {
+	// ReadFrame reads the next frame into buf and returns its size
+	ReadFrame(buf []byte) (int, error)
+	// WriteFrame writes frame
+	WriteFrame(frame []byte) error
+	Close() error
+}
+
+type datagramConn struct {
+	conn net.Conn
+}
+
+// NewDatagramConn returns a Conn where each datagram of conn is a frame
+func NewDatagramConn(conn net.Conn) Conn {
+	return &datagramConn{conn: conn}
+}
+
+func (c *datagramConn) ReadFrame(buf []byte) (int, error) {
+	return c.conn.Read(buf)
+}
+
+// WriteFrame drops the frame when it can't be written, for example when the
+// socket buffer is full or the peer is restarting, like a network link would.
+// Only writing to a closed connection fails.
+func (c *datagramConn) WriteFrame(frame []byte) error {
+	_, err := c.conn.Write(frame)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Debugf("dropped a frame of %d bytes: %v", len(frame), err)
+		return nil
+	}
+	return err
+}
+
+func (c *datagramConn) Close() error {
+	return c.conn.Close()
+}
+
+type streamConn struct {
+	conn   net.Conn
+	header [headerSize]byte
+	// writeBuf holds the header and the frame, so that they are sent with a
+	// single write
+	writeBuf []byte
+}
+
+// NewStreamConn returns a Conn where each frame of conn is prefixed by its
+// length as a 4-byte big-endian integer
+func NewStreamConn(conn net.Conn) Conn {
+	return &streamConn{
+		conn:     conn,
+		writeBuf: make([]byte, headerSize+MaxFrameSize),
+	}
+}
+
+func (c *streamConn) ReadFrame(buf []byte) (int, error) {
+	if _, err := io.ReadFull(c.conn, c.header[:]); err != nil {
+		return 0, err
+	}
+	size := binary.BigEndian.Uint32(c.header[:])
+	if size > uint32(len(buf)) {
+		return 0, fmt.Errorf("frame too large: %d bytes", size)
+	}
+	if _, err := io.ReadFull(c.conn, buf[:size]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return int(size), nil
+}
+
+func (c *streamConn) WriteFrame(frame []byte) error {
+	if len(frame) > MaxFrameSize {
+		return fmt.Errorf("frame too large: %d bytes", len(frame))
+	}
+	binary.BigEndian.PutUint32(c.writeBuf, uint32(len(frame))) // #nosec G115 -- checked against MaxFrameSize
+	n := copy(c.writeBuf[headerSize:], frame)
+	_, err := c.conn.Write(c.writeBuf[:headerSize+n])
+	return err
+}
+
+func (c *streamConn) Close() error {
+	return c.conn.Close()
+}
+
+type tapConn struct {
+	Conn
+	tap func(frame []byte)
+}
+
+// Tap returns a Conn which calls tap with each frame read from conn or
+// written to conn, for example to capture them. tap must not keep frame.
+func Tap(conn Conn, tap func(frame []byte)) Conn {
+	return &tapConn{Conn: conn, tap: tap}
+}
+
+func (c *tapConn) ReadFrame(buf []byte) (int, error) {
+	n, err := c.Conn.ReadFrame(buf)
+	if err == nil {
+		c.tap(buf[:n])
+	}
+	return n, err
+}
+
+func (c *tapConn) WriteFrame(frame []byte) error {
+	c.tap(frame)
+	return c.Conn.WriteFrame(frame)
+}
+
+// copyFrames copies the frames read from src to dst until reading or writing
+// fails
+func copyFrames(dst, src Conn) error {
+	buf := make([]byte, MaxFrameSize)
+	for {
+		n, err := src.ReadFrame(buf)
+		if err != nil {
+			return err
+		}
+		if err := dst.WriteFrame(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// Relay copies the frames between a and b in both directions. When one
+// direction stops, both connections are closed, and Relay returns the error
+// which stopped it. It returns nil when one of the connections was closed by
+// its peer.
+func Relay(a, b Conn) error {
+	var (
+		once     sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	stop := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			a.Close()
+			b.Close()
+		})
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stop(copyFrames(b, a))
+	}()
+	go func() {
+		defer wg.Done()
+		stop(copyFrames(a, b))
+	}()
+	wg.Wait()
+
+	if errors.Is(firstErr, io.EOF) || errors.Is(firstErr, net.ErrClosed) {
+		return nil
+	}
+	return firstErr
+}
@@ -0,0 +1,223 @@
+package netrelay
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// datagramPair returns the two ends of a SOCK_DGRAM socketpair, as used
+// with the virtualization framework
+func datagramPair(t *testing.T) (net.Conn, net.Conn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	require.NoError(t, err)
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "socketpair")
+		conns[i], err = net.FileConn(file)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+	}
+	return conns[0], conns[1]
+}
+
+func TestStreamConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewStreamConn(server)
+
+	go func() {
+		_ = conn.WriteFrame([]byte("frame"))
+	}()
+	data := make([]byte, headerSize+5)
+	_, err := io.ReadFull(client, data)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 5, 'f', 'r', 'a', 'm', 'e'}, data)
+
+	go func() {
+		_, _ = client.Write([]byte{0, 0, 0, 3, 'a', 'b', 'c'})
+	}()
+	buf := make([]byte, MaxFrameSize)
+	n, err := conn.ReadFrame(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(buf[:n]))
+
+	// the length is checked before reading the frame
+	go func() {
+		header := make([]byte, headerSize)
+		binary.BigEndian.PutUint32(header, MaxFrameSize+1)
+		_, _ = client.Write(header)
+	}()
+	_, err = conn.ReadFrame(buf)
+	require.ErrorContains(t, err, "frame too large: 65537 bytes")
+
+	require.ErrorContains(t, conn.WriteFrame(make([]byte, MaxFrameSize+1)), "frame too large")
+}
+
+func TestStreamConnTruncated(t *testing.T) {
+	client, server := net.Pipe()
+	conn := NewStreamConn(server)
+	go func() {
+		_, _ = client.Write([]byte{0, 0, 0, 10, 'a'})
+		client.Close()
+	}()
+	_, err := conn.ReadFrame(make([]byte, MaxFrameSize))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestRelay(t *testing.T) {
+	vmSide, relaySide := datagramPair(t)
+	defer vmSide.Close()
+	streamPeer, streamSide := net.Pipe()
+	defer streamPeer.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Relay(NewDatagramConn(relaySide), NewStreamConn(streamSide))
+	}()
+
+	// virtual machine to stream
+	_, err := vmSide.Write([]byte("from the guest"))
+	require.NoError(t, err)
+	peer := NewStreamConn(streamPeer)
+	buf := make([]byte, MaxFrameSize)
+	n, err := peer.ReadFrame(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "from the guest", string(buf[:n]))
+
+	// stream to virtual machine, each frame is a datagram
+	require.NoError(t, peer.WriteFrame([]byte("first")))
+	require.NoError(t, peer.WriteFrame([]byte("second")))
+	for _, expected := range []string{"first", "second"} {
+		n, err := vmSide.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(buf[:n]))
+	}
+
+	// the relay stops when the stream is closed
+	require.NoError(t, streamPeer.Close())
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not stop")
+	}
+}
+
+func TestRelayError(t *testing.T) {
+	_, relaySide := datagramPair(t)
+	streamPeer, streamSide := net.Pipe()
+	defer streamPeer.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Relay(NewDatagramConn(relaySide), NewStreamConn(streamSide))
+	}()
+	header := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(header, MaxFrameSize+1)
+	_, err := streamPeer.Write(header)
+	require.NoError(t, err)
+
+	select {
+	case err := <-done:
+		require.ErrorContains(t, err, "frame too large")
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not stop")
+	}
+}
+
+// failingConn is a net.Conn whose writes fail with err until err is nil
+type failingConn struct {
+	net.Conn
+	mu  sync.Mutex
+	err error
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	err := c.err
+	c.err = nil
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func TestRelayWriteError(t *testing.T) {
+	vmSide, relaySide := datagramPair(t)
+	defer vmSide.Close()
+	peerSide, peer := datagramPair(t)
+	defer peer.Close()
+
+	// the first frame sent to the peer can't be written
+	failing := &failingConn{Conn: peerSide, err: syscall.ENOBUFS}
+	done := make(chan error, 1)
+	go func() {
+		done <- Relay(NewDatagramConn(relaySide), NewDatagramConn(failing))
+	}()
+
+	_, err := vmSide.Write([]byte("dropped"))
+	require.NoError(t, err)
+	_, err = vmSide.Write([]byte("relayed"))
+	require.NoError(t, err)
+	buf := make([]byte, MaxFrameSize)
+	require.NoError(t, peer.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err := peer.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "relayed", string(buf[:n]))
+
+	// the relay still stops when a connection is closed
+	require.NoError(t, vmSide.Close())
+	require.NoError(t, peer.Close())
+	require.NoError(t, relaySide.Close())
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not stop")
+	}
+}
+
+func TestTap(t *testing.T) {
+	vmSide, relaySide := datagramPair(t)
+	defer vmSide.Close()
+	peerSide, peer := datagramPair(t)
+	defer peer.Close()
+
+	var mu sync.Mutex
+	tapped := []string{}
+	tap := func(frame []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		tapped = append(tapped, string(frame))
+	}
+	go func() {
+		_ = Relay(Tap(NewDatagramConn(relaySide), tap), NewDatagramConn(peerSide))
+	}()
+
+	buf := make([]byte, MaxFrameSize)
+	_, err := vmSide.Write([]byte("outgoing"))
+	require.NoError(t, err)
+	n, err := peer.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "outgoing", string(buf[:n]))
+
+	_, err = peer.Write([]byte("incoming"))
+	require.NoError(t, err)
+	n, err = vmSide.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "incoming", string(buf[:n]))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"outgoing", "incoming"}, tapped)
+}
@@ -0,0 +1,214 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Options configures the rotation of capture files
+type Options struct {
+	// MaxSize is the size of a capture file after which it's rotated, 0
+	// disables the rotation
+	MaxSize int64
+	// MaxFiles is the number of capture files kept when rotating, including
+	// the current one, 0 keeps all of them
+	MaxFiles uint
+}
+
+// File is a capture file which is rotated when it's larger than
+// Options.MaxSize. The rotated files have a numeric suffix, path.1 being the
+// most recent.
+type File struct {
+	path    string
+	format  Format
+	options Options
+
+	file    *os.File
+	writer  *Writer
+	written *countingWriter
+}
+
+// Create creates the capture file path, its format depends on its extension
+// (see FormatFromPath).
+func Create(path string, options Options) (*File, error) {
+	f := &File{
+		path:    path,
+		format:  FormatFromPath(path),
+		options: options,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	written := &countingWriter{w: file}
+	writer, err := NewWriter(written, f.format)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.writer = writer
+	f.written = written
+	return nil
+}
+
+// countingWriter counts the bytes written to the capture file
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// rotatedPath returns the path of the nth rotated file
+func (f *File) rotatedPath(n uint) string {
+	return fmt.Sprintf("%s.%d", f.path, n)
+}
+
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	// path.1 is the most recent rotated file, and path.(MaxFiles-1) the
+	// oldest one which is kept
+	var last uint
+	if f.options.MaxFiles > 0 {
+		last = f.options.MaxFiles - 1
+		if last == 0 {
+			// only the current file is kept
+			return f.open()
+		}
+		if err := os.Remove(f.rotatedPath(last)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	} else {
+		for last = 1; ; last++ {
+			if _, err := os.Stat(f.rotatedPath(last)); errors.Is(err, os.ErrNotExist) {
+				break
+			}
+		}
+	}
+	for n := last; n > 1; n-- {
+		if err := os.Rename(f.rotatedPath(n-1), f.rotatedPath(n)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, f.rotatedPath(1)); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// WritePacket writes frame captured at t, the file is rotated first if frame
+// would make it larger than Options.MaxSize.
+func (f *File) WritePacket(t time.Time, frame []byte) error {
+	if f.options.MaxSize > 0 && f.written.n+int64(len(frame)) > f.options.MaxSize {
+		if err := f.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate capture file %s: %w", f.path, err)
+		}
+	}
+	_, err := f.writer.WritePacket(t, frame)
+	return err
+}
+
+// Close closes the capture file
+func (f *File) Close() error {
+	return f.file.Close()
+}
+
+// CaptureStatus describes a Capture
+type CaptureStatus struct {
+	Enabled bool   `json:"enabled"`
+	Path    string `json:"path,omitempty"`
+	Packets uint64 `json:"packets"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Capture writes frames to a capture file while it's enabled. It can be
+// started and stopped while frames are written from other goroutines.
+type Capture struct {
+	mu      sync.Mutex
+	file    *File
+	path    string
+	packets uint64
+	err     string
+}
+
+// Start writes the next frames to the capture file path, the previous
+// content of path is removed.
+func (c *Capture) Start(path string, options Options) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file != nil {
+		return fmt.Errorf("packet capture to %s is already running", c.path)
+	}
+	file, err := Create(path, options)
+	if err != nil {
+		return err
+	}
+	c.file = file
+	c.path = path
+	c.packets = 0
+	c.err = ""
+	return nil
+}
+
+// Stop stops writing frames and closes the capture file. It does nothing
+// when the capture is not running.
+func (c *Capture) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stop()
+}
+
+func (c *Capture) stop() error {
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// WritePacket writes frame when the capture is running. The capture stops
+// when writing fails, the error is reported by Status.
+func (c *Capture) WritePacket(frame []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return
+	}
+	if err := c.file.WritePacket(time.Now(), frame); err != nil {
+		c.err = err.Error()
+		_ = c.stop()
+		return
+	}
+	c.packets++
+}
+
+// Status returns the status of the capture
+func (c *Capture) Status() CaptureStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CaptureStatus{
+		Enabled: c.file != nil,
+		Path:    c.path,
+		Packets: c.packets,
+		Error:   c.err,
+	}
+}
@@ -0,0 +1,154 @@
+// Package pcap writes ethernet frames to capture files which can be read by
+// tcpdump or wireshark, in the pcap or pcapng format.
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// Format is the format of a capture file
+type Format string
+
+const (
+	// FormatPcap is the classic libpcap format
+	FormatPcap Format = "pcap"
+	// FormatPcapng is the pcap next generation format
+	FormatPcapng Format = "pcapng"
+)
+
+// FormatFromPath returns FormatPcapng for files with a .pcapng extension,
+// and FormatPcap otherwise
+func FormatFromPath(path string) Format {
+	if filepath.Ext(path) == ".pcapng" {
+		return FormatPcapng
+	}
+	return FormatPcap
+}
+
+// SnapLen is the maximum size of the captured frames, larger frames are
+// truncated
+const SnapLen = 65536
+
+const (
+	linkTypeEthernet = 1
+
+	// the pcap magic number for timestamps in nanoseconds
+	pcapMagicNanoseconds = 0xa1b23c4d
+
+	pcapngSectionHeaderBlock        = 0x0a0d0d0a
+	pcapngInterfaceDescriptionBlock = 0x00000001
+	pcapngEnhancedPacketBlock       = 0x00000006
+	pcapngByteOrderMagic            = 0x1a2b3c4d
+	pcapngOptionEnd                 = 0
+	pcapngOptionTimestampResolution = 9
+)
+
+// Writer writes frames to w, after the header of the capture file
+type Writer struct {
+	w      io.Writer
+	format Format
+	// buf is reused to write each packet with a single call to w.Write
+	buf []byte
+}
+
+// NewWriter writes the header of a capture file in format to w, and returns
+// a Writer for its packets.
+func NewWriter(w io.Writer, format Format) (*Writer, error) {
+	writer := &Writer{w: w, format: format}
+	var header []byte
+	switch format {
+	case FormatPcap:
+		header = pcapHeader()
+	case FormatPcapng:
+		header = pcapngHeader()
+	default:
+		return nil, fmt.Errorf("unsupported capture format: %s", format)
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func pcapHeader() []byte {
+	header := make([]byte, 0, 24)
+	header = binary.LittleEndian.AppendUint32(header, pcapMagicNanoseconds)
+	header = binary.LittleEndian.AppendUint16(header, 2) // major version
+	header = binary.LittleEndian.AppendUint16(header, 4) // minor version
+	header = binary.LittleEndian.AppendUint32(header, 0) // timezone offset
+	header = binary.LittleEndian.AppendUint32(header, 0) // timestamp accuracy
+	header = binary.LittleEndian.AppendUint32(header, SnapLen)
+	header = binary.LittleEndian.AppendUint32(header, linkTypeEthernet)
+	return header
+}
+
+// pcapngBlock returns a pcapng block with its type, total length and body,
+// the body is padded to 32 bits
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	padding := (4 - len(body)%4) % 4
+	length := uint32(12 + len(body) + padding) // #nosec G115 -- the body is smaller than SnapLen plus a few headers
+	block := make([]byte, 0, length)
+	block = binary.LittleEndian.AppendUint32(block, blockType)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = append(block, make([]byte, padding)...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	return block
+}
+
+func pcapngHeader() []byte {
+	section := make([]byte, 0, 16)
+	section = binary.LittleEndian.AppendUint32(section, pcapngByteOrderMagic)
+	section = binary.LittleEndian.AppendUint16(section, 1) // major version
+	section = binary.LittleEndian.AppendUint16(section, 0) // minor version
+	// the section length is not specified
+	section = binary.LittleEndian.AppendUint64(section, 0xffffffffffffffff)
+
+	iface := make([]byte, 0, 20)
+	iface = binary.LittleEndian.AppendUint16(iface, linkTypeEthernet)
+	iface = binary.LittleEndian.AppendUint16(iface, 0) // reserved
+	iface = binary.LittleEndian.AppendUint32(iface, SnapLen)
+	// timestamps are in nanoseconds, the default is microseconds
+	iface = binary.LittleEndian.AppendUint16(iface, pcapngOptionTimestampResolution)
+	iface = binary.LittleEndian.AppendUint16(iface, 1)
+	iface = append(iface, 9, 0, 0, 0)
+	iface = binary.LittleEndian.AppendUint16(iface, pcapngOptionEnd)
+	iface = binary.LittleEndian.AppendUint16(iface, 0)
+
+	return append(pcapngBlock(pcapngSectionHeaderBlock, section), pcapngBlock(pcapngInterfaceDescriptionBlock, iface)...)
+}
+
+// WritePacket writes frame, captured at t. It returns the number of bytes
+// written to the capture file.
+func (w *Writer) WritePacket(t time.Time, frame []byte) (int, error) {
+	origLen := uint32(len(frame)) // #nosec G115 -- frames are smaller than 4GiB
+	if len(frame) > SnapLen {
+		frame = frame[:SnapLen]
+	}
+	capLen := uint32(len(frame)) // #nosec G115 -- at most SnapLen
+	nsec := uint64(t.UnixNano()) // #nosec G115 -- captures are after 1970
+
+	w.buf = w.buf[:0]
+	switch w.format {
+	case FormatPcap:
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(t.Unix()))       // #nosec G115 -- until 2106
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(t.Nanosecond())) // #nosec G115 -- less than 1e9
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, capLen)
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, origLen)
+		w.buf = append(w.buf, frame...)
+	case FormatPcapng:
+		body := make([]byte, 0, 20+len(frame))
+		body = binary.LittleEndian.AppendUint32(body, 0) // interface ID
+		body = binary.LittleEndian.AppendUint32(body, uint32(nsec>>32))
+		body = binary.LittleEndian.AppendUint32(body, uint32(nsec&0xffffffff))
+		body = binary.LittleEndian.AppendUint32(body, capLen)
+		body = binary.LittleEndian.AppendUint32(body, origLen)
+		body = append(body, frame...)
+		w.buf = append(w.buf, pcapngBlock(pcapngEnhancedPacketBlock, body)...)
+	}
+	return w.w.Write(w.buf)
+}
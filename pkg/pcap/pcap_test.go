@@ -0,0 +1,162 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var captureTime = time.Unix(1700000000, 123456789)
+
+func TestFormatFromPath(t *testing.T) {
+	assert.Equal(t, FormatPcap, FormatFromPath("/tmp/vm.pcap"))
+	assert.Equal(t, FormatPcapng, FormatFromPath("/tmp/vm.pcapng"))
+	assert.Equal(t, FormatPcap, FormatFromPath("/tmp/vm"))
+}
+
+func TestPcapWriter(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf, FormatPcap)
+	require.NoError(t, err)
+	header := buf.Bytes()
+	require.Len(t, header, 24)
+	assert.Equal(t, uint32(pcapMagicNanoseconds), binary.LittleEndian.Uint32(header[0:]))
+	assert.Equal(t, uint32(SnapLen), binary.LittleEndian.Uint32(header[16:]))
+	assert.Equal(t, uint32(linkTypeEthernet), binary.LittleEndian.Uint32(header[20:]))
+
+	buf.Reset()
+	n, err := writer.WritePacket(captureTime, []byte("frame"))
+	require.NoError(t, err)
+	record := buf.Bytes()
+	require.Len(t, record, n)
+	assert.Equal(t, uint32(1700000000), binary.LittleEndian.Uint32(record[0:]))
+	assert.Equal(t, uint32(123456789), binary.LittleEndian.Uint32(record[4:]))
+	assert.Equal(t, uint32(5), binary.LittleEndian.Uint32(record[8:]))
+	assert.Equal(t, uint32(5), binary.LittleEndian.Uint32(record[12:]))
+	assert.Equal(t, []byte("frame"), record[16:])
+
+	// large frames are truncated
+	buf.Reset()
+	_, err = writer.WritePacket(captureTime, make([]byte, SnapLen+10))
+	require.NoError(t, err)
+	record = buf.Bytes()
+	assert.Equal(t, uint32(SnapLen), binary.LittleEndian.Uint32(record[8:]))
+	assert.Equal(t, uint32(SnapLen+10), binary.LittleEndian.Uint32(record[12:]))
+	assert.Len(t, record, 16+SnapLen)
+}
+
+type pcapngTestBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+// parsePcapng splits data in blocks, and checks their lengths
+func parsePcapng(t *testing.T, data []byte) []pcapngTestBlock {
+	blocks := []pcapngTestBlock{}
+	for len(data) > 0 {
+		require.GreaterOrEqual(t, len(data), 12)
+		length := binary.LittleEndian.Uint32(data[4:])
+		require.Zero(t, length%4)
+		require.LessOrEqual(t, int(length), len(data))
+		require.Equal(t, length, binary.LittleEndian.Uint32(data[length-4:]))
+		blocks = append(blocks, pcapngTestBlock{
+			blockType: binary.LittleEndian.Uint32(data),
+			body:      data[8 : length-4],
+		})
+		data = data[length:]
+	}
+	return blocks
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf, FormatPcapng)
+	require.NoError(t, err)
+	_, err = writer.WritePacket(captureTime, []byte("frame"))
+	require.NoError(t, err)
+
+	blocks := parsePcapng(t, buf.Bytes())
+	require.Len(t, blocks, 3)
+	assert.Equal(t, uint32(pcapngSectionHeaderBlock), blocks[0].blockType)
+	assert.Equal(t, uint32(pcapngByteOrderMagic), binary.LittleEndian.Uint32(blocks[0].body))
+	assert.Equal(t, uint32(pcapngInterfaceDescriptionBlock), blocks[1].blockType)
+	assert.Equal(t, uint16(linkTypeEthernet), binary.LittleEndian.Uint16(blocks[1].body))
+
+	packet := blocks[2]
+	assert.Equal(t, uint32(pcapngEnhancedPacketBlock), packet.blockType)
+	timestamp := uint64(binary.LittleEndian.Uint32(packet.body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(packet.body[8:]))
+	assert.Equal(t, uint64(captureTime.UnixNano()), timestamp)
+	assert.Equal(t, uint32(5), binary.LittleEndian.Uint32(packet.body[12:]))
+	// the frame is padded to 32 bits
+	assert.Equal(t, []byte{'f', 'r', 'a', 'm', 'e', 0, 0, 0}, packet.body[20:])
+}
+
+func TestFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.pcap")
+	// the header and 2 packets of 100 bytes fit in a file
+	file, err := Create(path, Options{MaxSize: 24 + 2*(16+100), MaxFiles: 3})
+	require.NoError(t, err)
+	for range 7 {
+		require.NoError(t, file.WritePacket(captureTime, make([]byte, 100)))
+	}
+	require.NoError(t, file.Close())
+
+	for _, name := range []string{"vm.pcap", "vm.pcap.1", "vm.pcap.2"} {
+		info, err := os.Stat(filepath.Join(filepath.Dir(path), name))
+		require.NoError(t, err)
+		if name == "vm.pcap" {
+			assert.Equal(t, int64(24+16+100), info.Size())
+		} else {
+			assert.Equal(t, int64(24+2*(16+100)), info.Size())
+		}
+	}
+	assert.NoFileExists(t, path+".3")
+}
+
+func TestFileRotationUnlimited(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.pcapng")
+	file, err := Create(path, Options{MaxSize: 200})
+	require.NoError(t, err)
+	for range 4 {
+		require.NoError(t, file.WritePacket(captureTime, make([]byte, 100)))
+	}
+	require.NoError(t, file.Close())
+	for _, p := range []string{path, path + ".1", path + ".2", path + ".3"} {
+		data, err := os.ReadFile(p)
+		require.NoError(t, err)
+		// each file is a valid pcapng file with a single packet
+		assert.Len(t, parsePcapng(t, data), 3)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.pcap")
+	capture := &Capture{}
+
+	// frames are ignored while the capture is stopped
+	capture.WritePacket([]byte("ignored"))
+	assert.Equal(t, CaptureStatus{}, capture.Status())
+
+	require.NoError(t, capture.Start(path, Options{}))
+	require.ErrorContains(t, capture.Start(path, Options{}), "already running")
+	capture.WritePacket([]byte("frame"))
+	assert.Equal(t, CaptureStatus{Enabled: true, Path: path, Packets: 1}, capture.Status())
+
+	require.NoError(t, capture.Stop())
+	require.NoError(t, capture.Stop())
+	capture.WritePacket([]byte("ignored"))
+	assert.Equal(t, CaptureStatus{Path: path, Packets: 1}, capture.Status())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(24+16+5), info.Size())
+
+	require.Error(t, capture.Start(filepath.Join(path, "notadir", "vm.pcap"), Options{}))
+	assert.False(t, capture.Status().Enabled)
+}
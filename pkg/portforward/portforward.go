@@ -0,0 +1,259 @@
+// Package portforward forwards host TCP and UDP ports to the guest. The
+// forwards can be added and removed while the virtual machine runs, and
+// count the connections they forward.
+package portforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultHostAddress is the host address of the forwards which don't set one
+const defaultHostAddress = "127.0.0.1"
+
+// ErrNotFound is returned when removing a forward which does not exist
+var ErrNotFound = errors.New("port forward not found")
+
+// Spec describes a forward from a host port to a guest port or to a guest
+// vsock port
+type Spec struct {
+	// Protocol is "tcp" or "udp"
+	Protocol string `json:"protocol"`
+	// HostAddress is the host address on which the forward listens, it
+	// defaults to 127.0.0.1
+	HostAddress string `json:"hostAddress,omitempty"`
+	// HostPort is the host port on which the forward listens, a free port
+	// is used when it's 0
+	HostPort uint16 `json:"hostPort"`
+	// GuestAddress is the guest address to which the connections are
+	// forwarded. On usermode networks, it defaults to the address of the
+	// guest.
+	GuestAddress string `json:"guestAddress,omitempty"`
+	// GuestPort is the guest port to which the connections are forwarded
+	GuestPort uint16 `json:"guestPort,omitempty"`
+	// VsockPort is the guest vsock port to which the connections are
+	// forwarded, instead of GuestAddress and GuestPort
+	VsockPort uint32 `json:"vsockPort,omitempty"`
+}
+
+// Validate checks that spec describes a valid forward
+func (spec *Spec) Validate() error {
+	switch spec.Protocol {
+	case "tcp", "udp":
+	default:
+		return fmt.Errorf("unsupported protocol for port forward: %s (supported protocols are 'tcp' and 'udp')", spec.Protocol)
+	}
+	if spec.HostAddress != "" {
+		if _, err := netip.ParseAddr(spec.HostAddress); err != nil {
+			return fmt.Errorf("invalid host address for port forward: %w", err)
+		}
+	}
+	if spec.VsockPort != 0 {
+		if spec.GuestAddress != "" || spec.GuestPort != 0 {
+			return fmt.Errorf("invalid port forward %s: a vsock port can't be used with a guest address or port", spec)
+		}
+		if spec.Protocol != "tcp" {
+			return fmt.Errorf("invalid port forward %s: vsock ports can only be used with the 'tcp' protocol", spec)
+		}
+		return nil
+	}
+	if spec.GuestPort == 0 {
+		return fmt.Errorf("invalid port forward %s: the guest port or the vsock port must be set", spec)
+	}
+	if spec.GuestAddress != "" {
+		if _, err := netip.ParseAddr(spec.GuestAddress); err != nil {
+			return fmt.Errorf("invalid guest address for port forward: %w", err)
+		}
+	}
+	return nil
+}
+
+// HostAddressPort returns the host address and port of the forward, in the
+// form expected by net.Listen
+func (spec *Spec) HostAddressPort() string {
+	host := spec.HostAddress
+	if host == "" {
+		host = defaultHostAddress
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(spec.HostPort), 10))
+}
+
+// GuestAddressPort returns the guest address and port of the forward, the
+// address is the unspecified address when GuestAddress is not set
+func (spec *Spec) GuestAddressPort() (netip.AddrPort, error) {
+	addr := netip.IPv4Unspecified()
+	if spec.GuestAddress != "" {
+		var err error
+		addr, err = netip.ParseAddr(spec.GuestAddress)
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+	}
+	return netip.AddrPortFrom(addr, spec.GuestPort), nil
+}
+
+func (spec *Spec) String() string {
+	target := fmt.Sprintf("vsock:%d", spec.VsockPort)
+	if spec.VsockPort == 0 {
+		guestAddress := spec.GuestAddress
+		if guestAddress == "" {
+			guestAddress = "guest"
+		}
+		target = net.JoinHostPort(guestAddress, strconv.FormatUint(uint64(spec.GuestPort), 10))
+	}
+	return fmt.Sprintf("%s/%s -> %s", spec.HostAddressPort(), spec.Protocol, target)
+}
+
+// Status is the status of a forward
+type Status struct {
+	// ID identifies the forward in the Manager
+	ID string `json:"id"`
+	Spec
+	// ActiveConnections is the number of connections being forwarded, for
+	// UDP forwards it's the number of host clients which sent datagrams
+	// recently
+	ActiveConnections int64 `json:"activeConnections"`
+	// TotalConnections is the number of connections received on the host
+	// port
+	TotalConnections uint64 `json:"totalConnections"`
+	// FailedConnections is the number of connections which could not be
+	// forwarded because the connection to the guest failed
+	FailedConnections uint64 `json:"failedConnections"`
+}
+
+// DialFunc connects to the guest end of a forward. For UDP forwards, each
+// Write of the returned connection sends a datagram, and each Read returns
+// one.
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+// forward is a forward managed by a Manager
+type forward struct {
+	id       string
+	spec     Spec
+	dial     DialFunc
+	listener io.Closer
+
+	active atomic.Int64
+	total  atomic.Uint64
+	failed atomic.Uint64
+}
+
+func (f *forward) status() Status {
+	return Status{
+		ID:                f.id,
+		Spec:              f.spec,
+		ActiveConnections: f.active.Load(),
+		TotalConnections:  f.total.Load(),
+		FailedConnections: f.failed.Load(),
+	}
+}
+
+// Manager manages the forwards of a virtual machine
+type Manager struct {
+	mu       sync.Mutex
+	forwards map[string]*forward
+	nextID   uint64
+	closed   bool
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		forwards: map[string]*forward{},
+	}
+}
+
+// Add starts listening on the host port of spec, and forwards the
+// connections it receives to the connections returned by dial
+func (m *Manager) Add(spec Spec, dial DialFunc) (Status, error) {
+	if err := spec.Validate(); err != nil {
+		return Status{}, err
+	}
+	if spec.HostAddress == "" {
+		spec.HostAddress = defaultHostAddress
+	}
+	f := &forward{
+		spec: spec,
+		dial: dial,
+	}
+	var err error
+	switch spec.Protocol {
+	case "tcp":
+		f.listener, err = f.listenTCP()
+	case "udp":
+		f.listener, err = f.listenUDP()
+	}
+	if err != nil {
+		return Status{}, fmt.Errorf("failed to forward %s: %w", &spec, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		f.listener.Close()
+		return Status{}, net.ErrClosed
+	}
+	m.nextID++
+	f.id = strconv.FormatUint(m.nextID, 10)
+	m.forwards[f.id] = f
+	return f.status(), nil
+}
+
+// Remove stops the forward with the given id, and closes the connections it
+// forwards
+func (m *Manager) Remove(id string) error {
+	m.mu.Lock()
+	f, ok := m.forwards[id]
+	delete(m.forwards, id)
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return f.listener.Close()
+}
+
+// List returns the status of the forwards, in the order in which they were
+// added
+func (m *Manager) List() []Status {
+	m.mu.Lock()
+	forwards := make([]*forward, 0, len(m.forwards))
+	for _, f := range m.forwards {
+		forwards = append(forwards, f)
+	}
+	m.mu.Unlock()
+
+	statuses := make([]Status, 0, len(forwards))
+	for _, f := range forwards {
+		statuses = append(statuses, f.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		a, _ := strconv.ParseUint(statuses[i].ID, 10, 64)
+		b, _ := strconv.ParseUint(statuses[j].ID, 10, 64)
+		return a < b
+	})
+	return statuses
+}
+
+// Close removes all the forwards, no forwards can be added afterwards
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	forwards := m.forwards
+	m.forwards = map[string]*forward{}
+	m.closed = true
+	m.mu.Unlock()
+
+	var errs []error
+	for _, f := range forwards {
+		if err := f.listener.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,263 @@
+package portforward
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpecValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  Spec
+		error string
+	}{
+		{
+			name: "GuestPort",
+			spec: Spec{Protocol: "tcp", HostPort: 8080, GuestPort: 80},
+		},
+		{
+			name: "GuestAddress",
+			spec: Spec{Protocol: "udp", HostAddress: "::1", HostPort: 5353, GuestAddress: "192.168.64.2", GuestPort: 53},
+		},
+		{
+			name: "VsockPort",
+			spec: Spec{Protocol: "tcp", HostPort: 2222, VsockPort: 1024},
+		},
+		{
+			name:  "InvalidProtocol",
+			spec:  Spec{Protocol: "sctp", HostPort: 8080, GuestPort: 80},
+			error: "unsupported protocol for port forward: sctp",
+		},
+		{
+			name:  "InvalidHostAddress",
+			spec:  Spec{Protocol: "tcp", HostAddress: "localhost", HostPort: 8080, GuestPort: 80},
+			error: "invalid host address for port forward",
+		},
+		{
+			name:  "InvalidGuestAddress",
+			spec:  Spec{Protocol: "tcp", HostPort: 8080, GuestAddress: "guest", GuestPort: 80},
+			error: "invalid guest address for port forward",
+		},
+		{
+			name:  "NoTarget",
+			spec:  Spec{Protocol: "tcp", HostPort: 8080},
+			error: "the guest port or the vsock port must be set",
+		},
+		{
+			name:  "VsockAndGuestPort",
+			spec:  Spec{Protocol: "tcp", HostPort: 8080, GuestPort: 80, VsockPort: 1024},
+			error: "a vsock port can't be used with a guest address or port",
+		},
+		{
+			name:  "VsockUDP",
+			spec:  Spec{Protocol: "udp", HostPort: 8080, VsockPort: 1024},
+			error: "vsock ports can only be used with the 'tcp' protocol",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.spec.Validate()
+			if test.error == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, test.error)
+			}
+		})
+	}
+}
+
+func TestSpecString(t *testing.T) {
+	spec := Spec{Protocol: "tcp", HostPort: 8080, GuestPort: 80}
+	assert.Equal(t, "127.0.0.1:8080/tcp -> guest:80", spec.String())
+	spec = Spec{Protocol: "udp", HostAddress: "::1", HostPort: 5353, GuestAddress: "192.168.64.2", GuestPort: 53}
+	assert.Equal(t, "[::1]:5353/udp -> 192.168.64.2:53", spec.String())
+	spec = Spec{Protocol: "tcp", HostPort: 2222, VsockPort: 1024}
+	assert.Equal(t, "127.0.0.1:2222/tcp -> vsock:1024", spec.String())
+}
+
+// tcpEchoServer starts a loopback server which stands for the guest, it
+// echoes the data it receives
+func tcpEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func dialer(network, addr string) DialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+func hostAddr(status Status) string {
+	return net.JoinHostPort(status.HostAddress, strconv.Itoa(int(status.HostPort)))
+}
+
+func TestTCPForward(t *testing.T) {
+	manager := NewManager()
+	defer manager.Close()
+	status, err := manager.Add(Spec{Protocol: "tcp", GuestPort: 80}, dialer("tcp", tcpEchoServer(t)))
+	require.NoError(t, err)
+	assert.Equal(t, "1", status.ID)
+	assert.Equal(t, "127.0.0.1", status.HostAddress)
+	assert.NotZero(t, status.HostPort)
+
+	client, err := net.Dial("tcp", hostAddr(status))
+	require.NoError(t, err)
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, client.(*net.TCPConn).CloseWrite())
+	data, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	client.Close()
+
+	require.Eventually(t, func() bool {
+		return manager.List()[0].ActiveConnections == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	status = manager.List()[0]
+	assert.Equal(t, uint64(1), status.TotalConnections)
+	assert.Equal(t, uint64(0), status.FailedConnections)
+}
+
+func TestTCPForwardDialError(t *testing.T) {
+	manager := NewManager()
+	defer manager.Close()
+	status, err := manager.Add(Spec{Protocol: "tcp", VsockPort: 1024}, func(context.Context) (net.Conn, error) {
+		return nil, errors.New("no vsock device")
+	})
+	require.NoError(t, err)
+
+	client, err := net.Dial("tcp", hostAddr(status))
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = client.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	require.Eventually(t, func() bool {
+		return manager.List()[0].ActiveConnections == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	status = manager.List()[0]
+	assert.Equal(t, uint64(1), status.TotalConnections)
+	assert.Equal(t, uint64(1), status.FailedConnections)
+}
+
+// udpEchoServer starts a loopback server which stands for the guest, it
+// sends back the datagrams it receives
+func udpEchoServer(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDPAddrPort(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestUDPForward(t *testing.T) {
+	manager := NewManager()
+	defer manager.Close()
+	status, err := manager.Add(Spec{Protocol: "udp", GuestPort: 53}, dialer("udp", udpEchoServer(t)))
+	require.NoError(t, err)
+
+	buf := make([]byte, 100)
+	for _, payload := range []string{"first client", "second client"} {
+		client, err := net.Dial("udp", hostAddr(status))
+		require.NoError(t, err)
+		defer client.Close()
+		_, err = client.Write([]byte(payload))
+		require.NoError(t, err)
+		require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, err := client.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, payload, string(buf[:n]))
+	}
+
+	status = manager.List()[0]
+	assert.Equal(t, int64(2), status.ActiveConnections)
+	assert.Equal(t, uint64(2), status.TotalConnections)
+}
+
+func TestRemove(t *testing.T) {
+	manager := NewManager()
+	defer manager.Close()
+	echo := tcpEchoServer(t)
+	first, err := manager.Add(Spec{Protocol: "tcp", GuestPort: 80}, dialer("tcp", echo))
+	require.NoError(t, err)
+	second, err := manager.Add(Spec{Protocol: "tcp", GuestPort: 443}, dialer("tcp", echo))
+	require.NoError(t, err)
+
+	statuses := manager.List()
+	require.Len(t, statuses, 2)
+	assert.Equal(t, first.ID, statuses[0].ID)
+	assert.Equal(t, uint16(443), statuses[1].GuestPort)
+
+	client, err := net.Dial("tcp", hostAddr(first))
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(client, make([]byte, len("hello")))
+	require.NoError(t, err)
+
+	// the forwarded connections are closed with the forward
+	require.NoError(t, manager.Remove(first.ID))
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = client.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	_, err = net.Dial("tcp", hostAddr(first))
+	require.Error(t, err)
+
+	require.ErrorIs(t, manager.Remove(first.ID), ErrNotFound)
+	statuses = manager.List()
+	require.Len(t, statuses, 1)
+	assert.Equal(t, second.ID, statuses[0].ID)
+}
+
+func TestAddErrors(t *testing.T) {
+	manager := NewManager()
+	_, err := manager.Add(Spec{Protocol: "tcp"}, dialer("tcp", "127.0.0.1:80"))
+	require.ErrorContains(t, err, "the guest port or the vsock port must be set")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	_, err = manager.Add(Spec{Protocol: "tcp", HostPort: port, GuestPort: 80}, dialer("tcp", "127.0.0.1:80"))
+	require.ErrorContains(t, err, "failed to forward 127.0.0.1:"+strconv.Itoa(int(port))+"/tcp -> guest:80")
+	assert.Empty(t, manager.List())
+
+	require.NoError(t, manager.Close())
+	_, err = manager.Add(Spec{Protocol: "tcp", GuestPort: 80}, dialer("tcp", "127.0.0.1:80"))
+	require.ErrorIs(t, err, net.ErrClosed)
+}
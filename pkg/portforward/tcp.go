@@ -0,0 +1,97 @@
+package portforward
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/inetaf/tcpproxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// tcpForward is the tcpproxy target of a TCP forward, it keeps track of the
+// connections it forwards so that they can be closed with the forward
+type tcpForward struct {
+	forward *forward
+	proxy   *tcpproxy.Proxy
+	dialer  *tcpproxy.DialProxy
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func (f *forward) listenTCP() (io.Closer, error) {
+	listener, err := net.Listen("tcp", f.spec.HostAddressPort())
+	if err != nil {
+		return nil, err
+	}
+	// the host port is allocated by the kernel when it's 0
+	f.spec.HostPort = uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	t := &tcpForward{
+		forward: f,
+		proxy: &tcpproxy.Proxy{
+			ListenFunc: func(_, _ string) (net.Listener, error) {
+				return listener, nil
+			},
+		},
+		dialer: &tcpproxy.DialProxy{
+			Addr: f.spec.String(),
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return f.dial(ctx)
+			},
+			OnDialError: func(src net.Conn, err error) {
+				f.failed.Add(1)
+				log.Debugf("failed to forward connection from %s for %s: %v", src.RemoteAddr(), &f.spec, err)
+				src.Close()
+			},
+		},
+		conns: map[net.Conn]struct{}{},
+	}
+	t.proxy.AddRoute(f.spec.HostAddressPort(), t)
+	if err := t.proxy.Start(); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// HandleConn forwards a connection received on the host port
+func (t *tcpForward) HandleConn(src net.Conn) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		src.Close()
+		return
+	}
+	t.conns[src] = struct{}{}
+	t.mu.Unlock()
+
+	t.forward.total.Add(1)
+	t.forward.active.Add(1)
+	defer t.forward.active.Add(-1)
+	t.dialer.HandleConn(src)
+
+	t.mu.Lock()
+	delete(t.conns, src)
+	t.mu.Unlock()
+}
+
+func (t *tcpForward) Close() error {
+	err := t.proxy.Close()
+
+	t.mu.Lock()
+	t.closed = true
+	conns := t.conns
+	t.conns = map[net.Conn]struct{}{}
+	t.mu.Unlock()
+
+	// closing the host connections ends the copies, which then close the
+	// guest connections
+	for conn := range conns {
+		conn.Close()
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+package portforward
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// udpIdleTimeout is the time after which a host client which didn't
+	// send or receive datagrams is forgotten, and its guest connection
+	// closed
+	udpIdleTimeout = 60 * time.Second
+	udpDialTimeout = 10 * time.Second
+)
+
+// udpForward forwards the datagrams received on a host socket. Each host
+// client gets its own guest connection, so that the guest replies can be
+// sent back to it.
+type udpForward struct {
+	forward   *forward
+	conn      *net.UDPConn
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	sessions map[netip.AddrPort]*udpSession
+	closed   bool
+}
+
+type udpSession struct {
+	conn net.Conn
+	// lastActive is the time of the last datagram, in unix nanoseconds
+	lastActive atomic.Int64
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (f *forward) listenUDP() (io.Closer, error) {
+	addr, err := net.ResolveUDPAddr("udp", f.spec.HostAddressPort())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// the host port is allocated by the kernel when it's 0
+	f.spec.HostPort = uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	u := &udpForward{
+		forward:  f,
+		conn:     conn,
+		done:     make(chan struct{}),
+		sessions: map[netip.AddrPort]*udpSession{},
+	}
+	go u.serve()
+	go u.expire()
+	return u, nil
+}
+
+func (u *udpForward) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, client, err := u.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		session := u.session(client)
+		if session == nil {
+			continue
+		}
+		session.touch()
+		if _, err := session.conn.Write(buf[:n]); err != nil {
+			log.Debugf("failed to forward datagram from %s for %s: %v", client, &u.forward.spec, err)
+		}
+	}
+}
+
+// session returns the session of client, the guest connection of a new
+// client is dialed
+func (u *udpForward) session(client netip.AddrPort) *udpSession {
+	u.mu.Lock()
+	session, ok := u.sessions[client]
+	u.mu.Unlock()
+	if ok {
+		return session
+	}
+
+	f := u.forward
+	f.total.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), udpDialTimeout)
+	defer cancel()
+	conn, err := f.dial(ctx)
+	if err != nil {
+		f.failed.Add(1)
+		log.Debugf("failed to forward datagrams from %s for %s: %v", client, &f.spec, err)
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		conn.Close()
+		return nil
+	}
+	session = &udpSession{conn: conn}
+	session.touch()
+	u.sessions[client] = session
+	f.active.Add(1)
+	go u.reply(client, session)
+	return session
+}
+
+// reply sends the guest datagrams of session back to client, until the
+// guest connection is closed
+func (u *udpForward) reply(client netip.AddrPort, session *udpSession) {
+	buf := make([]byte, 65536)
+	for {
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			break
+		}
+		session.touch()
+		if _, err := u.conn.WriteToUDPAddrPort(buf[:n], client); err != nil {
+			log.Debugf("failed to send datagram to %s for %s: %v", client, &u.forward.spec, err)
+		}
+	}
+
+	u.mu.Lock()
+	if u.sessions[client] == session {
+		delete(u.sessions, client)
+	}
+	u.mu.Unlock()
+	u.forward.active.Add(-1)
+	session.conn.Close()
+}
+
+// expire closes the guest connections of the idle clients
+func (u *udpForward) expire() {
+	ticker := time.NewTicker(udpIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.done:
+			return
+		case now := <-ticker.C:
+			u.mu.Lock()
+			for _, session := range u.sessions {
+				if now.Sub(time.Unix(0, session.lastActive.Load())) > udpIdleTimeout {
+					// reply removes the session once its read fails
+					session.conn.Close()
+				}
+			}
+			u.mu.Unlock()
+		}
+	}
+}
+
+func (u *udpForward) Close() error {
+	var err error
+	u.closeOnce.Do(func() {
+		close(u.done)
+		err = u.conn.Close()
+
+		u.mu.Lock()
+		u.closed = true
+		for _, session := range u.sessions {
+			session.conn.Close()
+		}
+		u.mu.Unlock()
+	})
+	return err
+}
@@ -0,0 +1,57 @@
+package process
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+// Instance is a running vfkit process
+type Instance struct {
+	PID  int32
+	Args []string
+
+	proc *process.Process
+}
+
+// Instances returns the running vfkit processes, except the current one.
+// Processes which can't be inspected are ignored.
+func Instances() ([]Instance, error) {
+	procs, err := process.Processes()
+	if err != nil {
+		return nil, err
+	}
+
+	instances := []Instance{}
+	for _, proc := range procs {
+		if proc.Pid == int32(os.Getpid()) {
+			continue
+		}
+		// processes of other users can't always be inspected, and
+		// processes can exit at any time
+		name, err := proc.Name()
+		if err != nil || name != "vfkit" {
+			continue
+		}
+		args, err := proc.CmdlineSlice()
+		if err != nil {
+			continue
+		}
+		instances = append(instances, Instance{PID: proc.Pid, Args: args, proc: proc})
+	}
+	return instances, nil
+}
+
+// AbsPath returns the absolute path of path, relative paths of the command
+// line of the instance are relative to its working directory
+func (instance *Instance) AbsPath(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
+	cwd, err := instance.proc.Cwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cwd, path), nil
+}
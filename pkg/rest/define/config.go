@@ -14,3 +14,23 @@ const (
 	Stop     StateChange = "Stop"
 	HardStop StateChange = "HardStop"
 )
+
+// Snapshot is used to request saving the state of the virtual machine
+type Snapshot struct {
+	// Path is the absolute path of the state file
+	Path string `json:"path" binding:"required"`
+}
+
+// NetworkCapture is used to start or stop the packet capture of a virtio-net
+// device
+type NetworkCapture struct {
+	Enabled bool `json:"enabled"`
+	// Path is the absolute path of the capture file, it defaults to the
+	// 'pcap' option of the device
+	Path string `json:"path,omitempty"`
+	// MaxSizeBytes and MaxFiles configure the rotation of the capture
+	// files, they default to the 'pcapMaxSize' and 'pcapMaxFiles' options
+	// of the device
+	MaxSizeBytes int64 `json:"maxSizeBytes,omitempty"`
+	MaxFiles     uint  `json:"maxFiles,omitempty"`
+}
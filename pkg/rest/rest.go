@@ -81,7 +81,7 @@ func (v *VFKitService) Start() {
 }
 
 // NewServer creates a new restful service
-func NewServer(inspector VirtualMachineInspector, stateHandler VirtualMachineStateHandler, endpoint string) (*VFKitService, error) {
+func NewServer(vm VirtualMachineHandler, endpoint string) (*VFKitService, error) {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
 	ep, err := NewEndpoint(endpoint)
@@ -98,12 +98,29 @@ func NewServer(inspector VirtualMachineInspector, stateHandler VirtualMachineSta
 	}
 
 	// Handlers for the restful service.  This is where endpoints are defined.
-	r.GET("/vm/state", stateHandler.GetVMState)
-	r.POST("/vm/state", stateHandler.SetVMState)
-	r.GET("/vm/inspect", inspector.Inspect)
+	r.GET("/vm/state", vm.GetVMState)
+	r.POST("/vm/state", vm.SetVMState)
+	r.GET("/vm/inspect", vm.Inspect)
+	r.GET("/vm/events", vm.GetVMEvents)
+	r.POST("/vm/snapshot", vm.SaveVMState)
+	r.POST("/vm/network/:id/capture", vm.SetNetworkCapture)
+	r.GET("/vm/forwards", vm.GetPortForwards)
+	r.POST("/vm/forwards", vm.CreatePortForward)
+	r.DELETE("/vm/forwards/:id", vm.DeletePortForward)
 	return &s, nil
 }
 
+// VirtualMachineHandler handles the requests of all the endpoints of the
+// restful service
+type VirtualMachineHandler interface {
+	VirtualMachineInspector
+	VirtualMachineStateHandler
+	VirtualMachineEventsHandler
+	VirtualMachineSnapshotHandler
+	VirtualMachineNetworkHandler
+	VirtualMachinePortForwardsHandler
+}
+
 type VirtualMachineInspector interface {
 	Inspect(c *gin.Context)
 }
@@ -113,6 +130,24 @@ type VirtualMachineStateHandler interface {
 	SetVMState(c *gin.Context)
 }
 
+type VirtualMachineEventsHandler interface {
+	GetVMEvents(c *gin.Context)
+}
+
+type VirtualMachineSnapshotHandler interface {
+	SaveVMState(c *gin.Context)
+}
+
+type VirtualMachineNetworkHandler interface {
+	SetNetworkCapture(c *gin.Context)
+}
+
+type VirtualMachinePortForwardsHandler interface {
+	GetPortForwards(c *gin.Context)
+	CreatePortForward(c *gin.Context)
+	DeletePortForward(c *gin.Context)
+}
+
 // parseRestfulURI validates the input URI and returns an URL object
 func parseRestfulURI(inputURI string) (*url.URL, error) {
 	restURI, err := url.ParseRequestURI(inputURI)
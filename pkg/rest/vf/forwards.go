@@ -0,0 +1,57 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/crc-org/vfkit/pkg/portforward"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// GetPortForwards returns the port forwards of the virtual machine and
+// their connection counters
+func (vm *VzVirtualMachine) GetPortForwards(c *gin.Context) {
+	c.JSON(http.StatusOK, vm.PortForwards().List())
+}
+
+// CreatePortForward starts forwarding a host port to a guest port or to a guest
+// vsock port
+func (vm *VzVirtualMachine) CreatePortForward(c *gin.Context) {
+	var spec portforward.Spec
+
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := spec.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	logrus.Debugf("adding port forward %s", &spec)
+	status, err := vm.VirtualMachine.AddPortForward(spec)
+	if err != nil {
+		logrus.Errorf("failed to add port forward: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// DeletePortForward stops the port forward with the id of the request, and
+// closes the connections it forwards
+func (vm *VzVirtualMachine) DeletePortForward(c *gin.Context) {
+	id := c.Param("id")
+	logrus.Debugf("removing port forward %s", id)
+	if err := vm.PortForwards().Remove(id); err != nil {
+		if errors.Is(err, portforward.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		logrus.Errorf("failed to remove port forward %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusOK)
+}
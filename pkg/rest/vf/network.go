@@ -0,0 +1,76 @@
+package rest
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/crc-org/vfkit/pkg/pcap"
+	"github.com/crc-org/vfkit/pkg/rest/define"
+	"github.com/crc-org/vfkit/pkg/vf"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// SetNetworkCapture starts or stops the packet capture of a virtio-net
+// device, the id of the device is its index in the virtio-net devices of the
+// configuration
+func (vm *VzVirtualMachine) SetNetworkCapture(c *gin.Context) {
+	var (
+		s define.NetworkCapture
+	)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid virtio-net device: " + c.Param("id")})
+		return
+	}
+	if err := c.ShouldBindJSON(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	capture, err := vm.NetworkCapture(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !s.Enabled {
+		logrus.Debugf("stopping packet capture of virtio-net device %d", id)
+		if err := capture.Stop(); err != nil {
+			logrus.Errorf("failed to stop packet capture: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, capture.Status())
+		return
+	}
+
+	// the capture settings default to the ones of the configuration
+	path := s.Path
+	options := pcap.Options{}
+	if devCapture := vm.Config().VirtioNetDevices()[id].Capture; devCapture != nil {
+		if path == "" {
+			path = devCapture.Path
+		}
+		options = vf.CaptureOptions(devCapture)
+	}
+	if s.MaxSizeBytes != 0 {
+		options.MaxSize = s.MaxSizeBytes
+	}
+	if s.MaxFiles != 0 {
+		options.MaxFiles = s.MaxFiles
+	}
+	if path == "" || !filepath.IsAbs(path) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the path of the capture file must be absolute"})
+		return
+	}
+
+	logrus.Debugf("starting packet capture of virtio-net device %d to %s", id, path)
+	if err := capture.Start(path, options); err != nil {
+		logrus.Errorf("failed to start packet capture: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, capture.Status())
+}
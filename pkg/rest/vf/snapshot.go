@@ -0,0 +1,48 @@
+package rest
+
+import (
+	"net/http"
+	"path/filepath"
+
+	"github.com/crc-org/vfkit/pkg/exitstatus"
+	"github.com/crc-org/vfkit/pkg/rest/define"
+	"github.com/crc-org/vfkit/pkg/snapshot"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+var _ snapshot.Machine = &VzVirtualMachine{}
+
+// SaveVMState saves the state of the virtual machine to the file of the
+// request, and stops it. The virtual machine can be restored with
+// --restore-from.
+func (vm *VzVirtualMachine) SaveVMState(c *gin.Context) {
+	var s define.Snapshot
+
+	if err := c.ShouldBindJSON(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !filepath.IsAbs(s.Path) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the path of the state file must be absolute"})
+		return
+	}
+
+	logrus.Debugf("saving virtual machine state to %s", s.Path)
+	// the reason is recorded before the virtual machine stops, as vfkit
+	// exits as soon as it's stopped
+	recorded := false
+	beforeStop := func() { recorded = vm.status.SetReason(exitstatus.ReasonStateSaved) }
+	if err := snapshot.Save(vm, s.Path, beforeStop); err != nil {
+		if recorded {
+			vm.status.UnsetReason(exitstatus.ReasonStateSaved)
+		}
+		logrus.Errorf("failed to save virtual machine state: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"path":         s.Path,
+		"metadataPath": snapshot.MetadataPath(s.Path),
+	})
+}
@@ -3,7 +3,9 @@ package rest
 import (
 	"fmt"
 
+	"github.com/crc-org/vfkit/pkg/exitstatus"
 	"github.com/crc-org/vfkit/pkg/rest/define"
+	"github.com/crc-org/vfkit/pkg/timesync"
 	"github.com/sirupsen/logrus"
 )
 
@@ -12,6 +14,13 @@ func (vm *VzVirtualMachine) ChangeState(newState define.StateChange) error {
 	var (
 		response error
 	)
+	// the reason is recorded before the stop is issued, as vfkit exits as
+	// soon as the virtual machine is stopped. It's forgotten when the stop
+	// fails.
+	stopRecorded := false
+	if newState == define.Stop || newState == define.HardStop {
+		stopRecorded = vm.status.SetReason(exitstatus.ReasonStopRequested)
+	}
 	switch newState {
 	case define.Pause:
 		logrus.Debug("pausing virtual machine")
@@ -28,5 +37,12 @@ func (vm *VzVirtualMachine) ChangeState(newState define.StateChange) error {
 	default:
 		return fmt.Errorf("invalid new VMState: %s", newState)
 	}
+	if response != nil && stopRecorded {
+		vm.status.UnsetReason(exitstatus.ReasonStopRequested)
+	}
+	if response == nil && newState == define.Resume && vm.timeSyncer != nil {
+		// the guest clock is late after the pause
+		vm.timeSyncer.Trigger(timesync.ReasonResume)
+	}
 	return response
 }
@@ -1,9 +1,14 @@
 package rest
 
 import (
+	"encoding/json"
 	"net/http"
 
+	"github.com/crc-org/vfkit/pkg/events"
+	"github.com/crc-org/vfkit/pkg/exitstatus"
+	"github.com/crc-org/vfkit/pkg/ignition"
 	"github.com/crc-org/vfkit/pkg/rest/define"
+	"github.com/crc-org/vfkit/pkg/timesync"
 	"github.com/crc-org/vfkit/pkg/vf"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -11,29 +16,71 @@ import (
 
 type VzVirtualMachine struct {
 	*vf.VirtualMachine
+	status         *exitstatus.Tracker
+	events         *events.Log
+	ignitionServer *ignition.Server
+	timeSyncer     *timesync.Syncer
 }
 
-func NewVzVirtualMachine(vm *vf.VirtualMachine) *VzVirtualMachine {
-	return &VzVirtualMachine{vm}
+// NewVzVirtualMachine creates the REST API handlers for vm. ignitionServer is
+// nil when the virtual machine has no ignition configuration, and timeSyncer
+// when it doesn't use time synchronization.
+func NewVzVirtualMachine(vm *vf.VirtualMachine, status *exitstatus.Tracker, eventLog *events.Log, ignitionServer *ignition.Server, timeSyncer *timesync.Syncer) *VzVirtualMachine {
+	return &VzVirtualMachine{vm, status, eventLog, ignitionServer, timeSyncer}
 }
 
 // Inspect returns information about the virtual machine like hw resources
-// and devices
+// and devices, and the fetches of its ignition configuration
 func (vm *VzVirtualMachine) Inspect(c *gin.Context) {
-	c.JSON(http.StatusOK, vm.Config())
+	if vm.ignitionServer == nil {
+		c.JSON(http.StatusOK, vm.Config())
+		return
+	}
+	inspect, err := vm.inspectWithIgnitionFetches()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, inspect)
+}
+
+func (vm *VzVirtualMachine) inspectWithIgnitionFetches() (map[string]any, error) {
+	data, err := json.Marshal(vm.Config())
+	if err != nil {
+		return nil, err
+	}
+	var inspect map[string]any
+	if err := json.Unmarshal(data, &inspect); err != nil {
+		return nil, err
+	}
+	if ignitionConfig, ok := inspect["ignition"].(map[string]any); ok {
+		ignitionConfig["fetches"] = vm.ignitionServer.Fetches()
+	}
+	return inspect, nil
+}
+
+// GetVMEvents returns the events of the virtual machine, from the oldest to
+// the most recent
+func (vm *VzVirtualMachine) GetVMEvents(c *gin.Context) {
+	c.JSON(http.StatusOK, vm.events.Events())
 }
 
 // GetVMState retrieves the current vm state
 func (vm *VzVirtualMachine) GetVMState(c *gin.Context) {
 	current := vm.State()
-	c.JSON(http.StatusOK, gin.H{
+	state := gin.H{
 		"state":       current.String(),
 		"canStart":    vm.CanStart(),
 		"canPause":    vm.CanPause(),
 		"canResume":   vm.CanResume(),
 		"canStop":     vm.CanRequestStop(),
 		"canHardStop": vm.CanStop(),
-	})
+		"stopReason":  vm.status.Reason(),
+	}
+	if vm.timeSyncer != nil {
+		state["timeSync"] = vm.timeSyncer.Status()
+	}
+	c.JSON(http.StatusOK, state)
 }
 
 // SetVMState requests a state change on a virtual machine.  At this time only
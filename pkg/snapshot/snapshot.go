@@ -0,0 +1,247 @@
+// Package snapshot saves the state of a virtual machine to a file, and
+// restores it later. The hardware configuration of the virtual machine is
+// stored in a metadata file alongside the state file, a state file can only
+// be restored by a virtual machine with the same hardware configuration.
+// The metadata also stores the values vfkit generated for the virtual
+// machine, such as its MAC addresses, the restored virtual machine must reuse
+// them.
+//
+// The virtual machine is abstracted by the [Machine] interface, so that the
+// sequence of state changes can be tested without the virtualization
+// framework.
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/crc-org/vfkit/pkg/config"
+)
+
+// metadataVersion is the version of the metadata file format
+const metadataVersion = 1
+
+// Machine is the virtual machine whose state is saved and restored
+type Machine interface {
+	CanPause() bool
+	CanResume() bool
+	Pause() error
+	Resume() error
+	Stop() error
+	// Hardware returns the hardware configuration of the virtual machine,
+	// computed before vfkit generated the values the configuration doesn't
+	// set
+	Hardware() Hardware
+	// Generated returns the values vfkit generated for the virtual machine
+	Generated() Generated
+	// SaveState saves the state of the paused virtual machine to path
+	SaveState(path string) error
+	// RestoreState restores the state saved in path, the virtual machine
+	// must be stopped and it's paused after the restore
+	RestoreState(path string) error
+}
+
+// Metadata is stored alongside the state file
+type Metadata struct {
+	Version  int       `json:"version"`
+	SavedAt  time.Time `json:"savedAt"`
+	Hardware Hardware  `json:"hardware"`
+	// Generated are the values the restored virtual machine must reuse
+	Generated Generated `json:"generated"`
+}
+
+// Hardware is the JSON representation of the parts of the virtual machine
+// configuration which must not change between the save and the restore
+type Hardware map[string]json.RawMessage
+
+// Generated are the values vfkit generated when it created the virtual
+// machine, the guest state depends on them
+type Generated struct {
+	// MachineIdentifier is the data representation of the generic machine
+	// identifier, it's empty with the macOS bootloader, whose identifier is
+	// stored in a file
+	MachineIdentifier []byte `json:"machineIdentifier,omitempty"`
+	// MACAddresses are the MAC addresses of the virtio-net devices, in the
+	// order of the devices
+	MACAddresses []string `json:"macAddresses,omitempty"`
+}
+
+// MetadataPath returns the path of the metadata file of the state file path
+func MetadataPath(path string) string {
+	return path + ".json"
+}
+
+// hardwareKeys lists the hardware configuration in the order the keys are
+// compared
+var hardwareKeys = []string{"vcpus", "memoryBytes", "bootloader", "devices", "nested", "cloudInit"}
+
+// NewHardware returns the hardware configuration of vmConfig. It must be
+// called with the configuration as parsed: vfkit changes the devices when it
+// creates the virtual machine, for example to set the MAC addresses.
+func NewHardware(vmConfig *config.VirtualMachine) (Hardware, error) {
+	values := map[string]any{
+		"vcpus":       vmConfig.Vcpus,
+		"memoryBytes": vmConfig.Memory,
+		"bootloader":  vmConfig.Bootloader,
+		"devices":     vmConfig.Devices,
+		"nested":      vmConfig.Nested,
+		// the cloud-init configuration is attached as a disk
+		"cloudInit": vmConfig.CloudInit != nil,
+	}
+	hw := Hardware{}
+	for key, value := range values {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal '%s' configuration: %w", key, err)
+		}
+		hw[key] = data
+	}
+	return hw, nil
+}
+
+// NewGenerated returns the values vfkit generated for vmConfig, once the
+// virtual machine was created. machineIdentifier is the data representation
+// of its generic machine identifier.
+func NewGenerated(vmConfig *config.VirtualMachine, machineIdentifier []byte) Generated {
+	generated := Generated{MachineIdentifier: machineIdentifier}
+	for _, dev := range vmConfig.VirtioNetDevices() {
+		generated.MACAddresses = append(generated.MACAddresses, dev.MacAddress.String())
+	}
+	return generated
+}
+
+// Apply sets the saved MAC addresses of the virtio-net devices of vmConfig
+// which don't have one, so that vfkit doesn't generate new ones
+func (generated Generated) Apply(vmConfig *config.VirtualMachine) error {
+	for i, dev := range vmConfig.VirtioNetDevices() {
+		if len(dev.MacAddress) != 0 || i >= len(generated.MACAddresses) {
+			continue
+		}
+		mac, err := net.ParseMAC(generated.MACAddresses[i])
+		if err != nil {
+			return fmt.Errorf("invalid saved MAC address of virtio-net device %d: %w", i, err)
+		}
+		dev.MacAddress = mac
+	}
+	return nil
+}
+
+func equalJSON(a, b json.RawMessage) bool {
+	var compactA, compactB bytes.Buffer
+	if json.Compact(&compactA, a) != nil || json.Compact(&compactB, b) != nil {
+		return false
+	}
+	return bytes.Equal(compactA.Bytes(), compactB.Bytes())
+}
+
+// Save pauses the virtual machine if it's running, saves its state to path
+// and stops it. The metadata of the state file is written to
+// [MetadataPath]. When saving fails, the virtual machine is resumed if Save
+// paused it. beforeStop is called when the state is saved, just before the
+// virtual machine is stopped, for example to record why it stops.
+func Save(machine Machine, path string, beforeStop func()) error {
+	paused := false
+	switch {
+	case machine.CanPause():
+		if err := machine.Pause(); err != nil {
+			return fmt.Errorf("failed to pause the virtual machine: %w", err)
+		}
+		paused = true
+	case machine.CanResume():
+		// already paused
+	default:
+		return errors.New("the virtual machine must be running or paused to save its state")
+	}
+
+	if err := save(machine, path); err != nil {
+		if paused {
+			if resumeErr := machine.Resume(); resumeErr != nil {
+				err = errors.Join(err, fmt.Errorf("failed to resume the virtual machine: %w", resumeErr))
+			}
+		}
+		return err
+	}
+
+	if beforeStop != nil {
+		beforeStop()
+	}
+	if err := machine.Stop(); err != nil {
+		return fmt.Errorf("failed to stop the virtual machine: %w", err)
+	}
+	return nil
+}
+
+func save(machine Machine, path string) error {
+	if err := machine.SaveState(path); err != nil {
+		return fmt.Errorf("failed to save the virtual machine state to %s: %w", path, err)
+	}
+	metadata := Metadata{
+		Version:   metadataVersion,
+		SavedAt:   time.Now(),
+		Hardware:  machine.Hardware(),
+		Generated: machine.Generated(),
+	}
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(MetadataPath(path), data, 0600); err != nil {
+		// a state file without metadata can't be restored
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// ReadMetadata reads the metadata of the state file path
+func ReadMetadata(path string) (*Metadata, error) {
+	data, err := os.ReadFile(MetadataPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the metadata of the saved state: %w", err)
+	}
+	var metadata Metadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata in %s: %w", MetadataPath(path), err)
+	}
+	if metadata.Version != metadataVersion {
+		return nil, fmt.Errorf("unsupported metadata version in %s: %d", MetadataPath(path), metadata.Version)
+	}
+	return &metadata, nil
+}
+
+// CheckCompatibility returns an error when the state file path was saved by
+// a virtual machine whose hardware configuration differs from hw.
+func CheckCompatibility(hw Hardware, path string) error {
+	metadata, err := ReadMetadata(path)
+	if err != nil {
+		return err
+	}
+	for _, key := range hardwareKeys {
+		if !equalJSON(hw[key], metadata.Hardware[key]) {
+			return fmt.Errorf("the saved state is not compatible with the virtual machine configuration: '%s' changed since %s", key, metadata.SavedAt.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// Restore restores the state saved in path and resumes the virtual machine.
+// The state is only restored when the hardware configuration of the virtual
+// machine didn't change since it was saved. The virtual machine must have
+// been created with the [Generated] values of the metadata.
+func Restore(machine Machine, path string) error {
+	if err := CheckCompatibility(machine.Hardware(), path); err != nil {
+		return err
+	}
+	if err := machine.RestoreState(path); err != nil {
+		return fmt.Errorf("failed to restore the virtual machine state from %s: %w", path, err)
+	}
+	if err := machine.Resume(); err != nil {
+		return fmt.Errorf("failed to resume the restored virtual machine: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package snapshot
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/crc-org/vfkit/pkg/exitstatus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMachine records the state changes of the virtual machine, the saved
+// state is an empty file
+type fakeMachine struct {
+	state      string
+	hardware   Hardware
+	generated  Generated
+	calls      []string
+	saveErr    error
+	restoreErr error
+	stopErr    error
+	// onStop is called when the virtual machine is stopped
+	onStop func()
+}
+
+func (m *fakeMachine) CanPause() bool {
+	return m.state == "running"
+}
+
+func (m *fakeMachine) CanResume() bool {
+	return m.state == "paused"
+}
+
+func (m *fakeMachine) Pause() error {
+	m.calls = append(m.calls, "pause")
+	m.state = "paused"
+	return nil
+}
+
+func (m *fakeMachine) Resume() error {
+	m.calls = append(m.calls, "resume")
+	m.state = "running"
+	return nil
+}
+
+func (m *fakeMachine) Stop() error {
+	m.calls = append(m.calls, "stop")
+	if m.onStop != nil {
+		m.onStop()
+	}
+	if m.stopErr != nil {
+		return m.stopErr
+	}
+	m.state = "stopped"
+	return nil
+}
+
+func (m *fakeMachine) Hardware() Hardware {
+	return m.hardware
+}
+
+func (m *fakeMachine) Generated() Generated {
+	return m.generated
+}
+
+func (m *fakeMachine) SaveState(path string) error {
+	m.calls = append(m.calls, "save")
+	if m.state != "paused" {
+		return errors.New("the virtual machine is not paused")
+	}
+	if m.saveErr != nil {
+		return m.saveErr
+	}
+	return os.WriteFile(path, []byte{}, 0600)
+}
+
+func (m *fakeMachine) RestoreState(path string) error {
+	m.calls = append(m.calls, "restore")
+	if m.state != "stopped" {
+		return errors.New("the virtual machine is not stopped")
+	}
+	if m.restoreErr != nil {
+		return m.restoreErr
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	m.state = "paused"
+	return nil
+}
+
+func newTestConfig(t *testing.T) *config.VirtualMachine {
+	vmConfig := config.NewVirtualMachine(2, 1024, config.NewEFIBootloader("efi-variable-store", false))
+	dev, err := config.VirtioRngNew()
+	require.NoError(t, err)
+	require.NoError(t, vmConfig.AddDevice(dev))
+	return vmConfig
+}
+
+// newTestMachine returns a machine in state whose hardware configuration is
+// vmConfig
+func newTestMachine(t *testing.T, state string, vmConfig *config.VirtualMachine) *fakeMachine {
+	hw, err := NewHardware(vmConfig)
+	require.NoError(t, err)
+	return &fakeMachine{state: state, hardware: hw}
+}
+
+func TestSaveRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.state")
+	vmConfig := newTestConfig(t)
+
+	machine := newTestMachine(t, "running", vmConfig)
+	require.NoError(t, Save(machine, path, nil))
+	assert.Equal(t, []string{"pause", "save", "stop"}, machine.calls)
+	assert.Equal(t, "stopped", machine.state)
+	metadata, err := ReadMetadata(path)
+	require.NoError(t, err)
+	assert.Equal(t, metadataVersion, metadata.Version)
+	assert.JSONEq(t, "2", string(metadata.Hardware["vcpus"]))
+
+	// the restore happens in a new vfkit process, with the same configuration
+	machine = newTestMachine(t, "stopped", newTestConfig(t))
+	require.NoError(t, Restore(machine, path))
+	assert.Equal(t, []string{"restore", "resume"}, machine.calls)
+	assert.Equal(t, "running", machine.state)
+}
+
+func TestSavePaused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.state")
+	machine := newTestMachine(t, "paused", newTestConfig(t))
+	require.NoError(t, Save(machine, path, nil))
+	assert.Equal(t, []string{"save", "stop"}, machine.calls)
+}
+
+func TestSaveStopReason(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.state")
+	tracker := exitstatus.NewTracker()
+	machine := newTestMachine(t, "running", newTestConfig(t))
+	// vfkit can exit as soon as the virtual machine stops
+	var reasonAtStop exitstatus.Reason
+	machine.onStop = func() { reasonAtStop = tracker.Reason() }
+	require.NoError(t, Save(machine, path, func() { tracker.SetReason(exitstatus.ReasonStateSaved) }))
+	assert.Equal(t, exitstatus.ReasonStateSaved, reasonAtStop)
+	assert.Equal(t, exitstatus.ReasonStateSaved, tracker.Finish(nil).Reason)
+}
+
+func TestSaveErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.state")
+
+	machine := newTestMachine(t, "stopped", newTestConfig(t))
+	require.ErrorContains(t, Save(machine, path, nil), "must be running or paused")
+	assert.Empty(t, machine.calls)
+
+	// the virtual machine is resumed when the save fails
+	machine = newTestMachine(t, "running", newTestConfig(t))
+	machine.saveErr = errors.New("save failed")
+	require.ErrorContains(t, Save(machine, path, nil), "save failed")
+	assert.Equal(t, []string{"pause", "save", "resume"}, machine.calls)
+	assert.NoFileExists(t, MetadataPath(path))
+
+	// the user paused the virtual machine, it stays paused
+	machine = newTestMachine(t, "paused", newTestConfig(t))
+	machine.saveErr = errors.New("save failed")
+	require.Error(t, Save(machine, path, nil))
+	assert.Equal(t, []string{"save"}, machine.calls)
+
+	machine = newTestMachine(t, "running", newTestConfig(t))
+	machine.stopErr = errors.New("stop failed")
+	require.ErrorContains(t, Save(machine, path, nil), "stop failed")
+	assert.Equal(t, []string{"pause", "save", "stop"}, machine.calls)
+}
+
+func TestRestoreIncompatible(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.state")
+	require.NoError(t, Save(newTestMachine(t, "running", newTestConfig(t)), path, nil))
+
+	vmConfig := newTestConfig(t)
+	vmConfig.Memory *= 2
+	machine := newTestMachine(t, "stopped", vmConfig)
+	require.ErrorContains(t, Restore(machine, path), "'memoryBytes' changed")
+	assert.Empty(t, machine.calls)
+
+	vmConfig = newTestConfig(t)
+	dev, err := config.VirtioRngNew()
+	require.NoError(t, err)
+	require.NoError(t, vmConfig.AddDevice(dev))
+	require.ErrorContains(t, Restore(newTestMachine(t, "stopped", vmConfig), path), "'devices' changed")
+
+	// settings which don't change the hardware can be modified
+	vmConfig = newTestConfig(t)
+	vmConfig.Name = "renamed"
+	vmConfig.OnHostSleep = config.HostSleepPause
+	require.NoError(t, Restore(newTestMachine(t, "stopped", vmConfig), path))
+}
+
+func TestRestoreErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.state")
+
+	machine := newTestMachine(t, "stopped", newTestConfig(t))
+	require.ErrorContains(t, Restore(machine, path), "failed to read the metadata")
+	assert.Empty(t, machine.calls)
+
+	require.NoError(t, Save(newTestMachine(t, "running", newTestConfig(t)), path, nil))
+	machine = newTestMachine(t, "stopped", newTestConfig(t))
+	machine.restoreErr = errors.New("restore failed")
+	require.ErrorContains(t, Restore(machine, path), "restore failed")
+	assert.Equal(t, []string{"restore"}, machine.calls)
+
+	require.NoError(t, os.WriteFile(MetadataPath(path), []byte(`{"version":2}`), 0600))
+	require.ErrorContains(t, Restore(machine, path), "unsupported metadata version")
+}
+
+// parseTestConfig returns the configuration of a virtual machine with
+// virtio-net devices, parsed like the command line
+func parseTestConfig(t *testing.T, socketPath string) *config.VirtualMachine {
+	vmConfig := config.NewVirtualMachine(2, 1024, config.NewEFIBootloader("efi-variable-store", false))
+	require.NoError(t, vmConfig.AddDevicesFromCmdLine([]string{
+		"virtio-net,nat",
+		"virtio-net,unixSocketPath=" + socketPath + ",mac=52:54:00:70:2b:71",
+		"virtio-rng",
+	}))
+	return vmConfig
+}
+
+func TestSaveRestoreVirtioNet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.state")
+	socketPath := filepath.Join(t.TempDir(), "net.sock")
+
+	// vfkit computes the hardware configuration before it creates the
+	// virtual machine, which generates the missing MAC addresses and
+	// replaces the unix socket paths with sockets
+	vmConfig := parseTestConfig(t, socketPath)
+	machine := newTestMachine(t, "running", vmConfig)
+	netDevs := vmConfig.VirtioNetDevices()
+	netDevs[0].MacAddress = net.HardwareAddr{0x5a, 0x94, 0xef, 0xe4, 0x0c, 0xee}
+	netDevs[1].UnixSocketPath = ""
+	machine.generated = NewGenerated(vmConfig, []byte("machine identifier"))
+	require.NoError(t, Save(machine, path, nil))
+	metadata, err := ReadMetadata(path)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("machine identifier"), metadata.Generated.MachineIdentifier)
+	assert.Equal(t, []string{"5a:94:ef:e4:0c:ee", "52:54:00:70:2b:71"}, metadata.Generated.MACAddresses)
+
+	// the same command line is used to restore the state, the generated MAC
+	// addresses are reused
+	vmConfig = parseTestConfig(t, socketPath)
+	machine = newTestMachine(t, "stopped", vmConfig)
+	require.NoError(t, metadata.Generated.Apply(vmConfig))
+	netDevs = vmConfig.VirtioNetDevices()
+	assert.Equal(t, "5a:94:ef:e4:0c:ee", netDevs[0].MacAddress.String())
+	assert.Equal(t, "52:54:00:70:2b:71", netDevs[1].MacAddress.String())
+	require.NoError(t, Restore(machine, path))
+	assert.Equal(t, []string{"restore", "resume"}, machine.calls)
+
+	// explicit MAC addresses are part of the hardware configuration
+	vmConfig = parseTestConfig(t, socketPath)
+	vmConfig.VirtioNetDevices()[1].MacAddress = net.HardwareAddr{0x52, 0x54, 0x00, 0x70, 0x2b, 0x72}
+	require.ErrorContains(t, Restore(newTestMachine(t, "stopped", vmConfig), path), "'devices' changed")
+}
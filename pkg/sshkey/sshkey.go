@@ -0,0 +1,115 @@
+// Package sshkey manages the SSH keys vfkit provisions in virtual machines.
+package sshkey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Auto is the --ssh-key value asking vfkit to use its own key pair, which is
+// generated the first time it's needed
+const Auto = "auto"
+
+// DefaultPath returns the path of the private key of the key pair generated
+// by vfkit, the public key is stored next to it with a .pub extension
+func DefaultPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "vfkit", "ssh", "id_ed25519"), nil
+}
+
+// ResolvePath returns the path of the private key for the --ssh-key value key,
+// which is either Auto or the path of a private key
+func ResolvePath(key string) (string, error) {
+	if key == Auto {
+		return DefaultPath()
+	}
+	return key, nil
+}
+
+// Generate creates a new ed25519 key pair, the private key is written to path
+// and the public key to path.pub
+func Generate(path string) error {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	block, err := ssh.MarshalPrivateKey(privateKey, "vfkit")
+	if err != nil {
+		return err
+	}
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// O_EXCL so that an existing key is never overwritten
+	privateKeyFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(privateKeyFile, block); err != nil {
+		_ = privateKeyFile.Close()
+		return err
+	}
+	if err := privateKeyFile.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(sshPublicKey), 0644) //#nosec G306 -- public keys are not secret
+}
+
+// AuthorizedKey returns the public key of the private key at path, in the
+// authorized_keys format. The public key is read from path.pub when it exists,
+// the private key is used otherwise.
+func AuthorizedKey(path string) (string, error) {
+	if data, err := os.ReadFile(path + ".pub"); err == nil {
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return "", fmt.Errorf("invalid public key %s.pub: %w", path, err)
+		}
+		return authorizedKey(publicKey), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key %s: %w", path, err)
+	}
+	return authorizedKey(signer.PublicKey()), nil
+}
+
+// LoadOrGenerate returns the public key of the key pair for the --ssh-key
+// value key, in the authorized_keys format. With Auto, the key pair is
+// generated if it doesn't exist yet.
+func LoadOrGenerate(key string) (string, error) {
+	path, err := ResolvePath(key)
+	if err != nil {
+		return "", err
+	}
+	if key == Auto {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			if err := Generate(path); err != nil {
+				return "", fmt.Errorf("failed to generate SSH key: %w", err)
+			}
+		}
+	}
+	return AuthorizedKey(path)
+}
+
+func authorizedKey(publicKey ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+}
@@ -0,0 +1,61 @@
+package sshkey
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh", "id_ed25519")
+	require.NoError(t, Generate(path))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	signer, err := ssh.ParsePrivateKey(data)
+	require.NoError(t, err)
+
+	key, err := AuthorizedKey(path)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, "ssh-ed25519 "))
+	assert.Equal(t, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), key)
+
+	// the public key is derived from the private key when path.pub is missing
+	require.NoError(t, os.Remove(path+".pub"))
+	fromPrivateKey, err := AuthorizedKey(path)
+	require.NoError(t, err)
+	assert.Equal(t, key, fromPrivateKey)
+
+	// existing keys are never overwritten
+	require.ErrorIs(t, Generate(path), os.ErrExist)
+}
+
+func TestLoadOrGenerate(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(t.TempDir(), "config"))
+
+	path, err := ResolvePath(Auto)
+	require.NoError(t, err)
+	_, err = os.Stat(path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	key, err := LoadOrGenerate(Auto)
+	require.NoError(t, err)
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+	reused, err := LoadOrGenerate(Auto)
+	require.NoError(t, err)
+	assert.Equal(t, key, reused)
+
+	// keys given by path are never generated
+	_, err = LoadOrGenerate(filepath.Join(t.TempDir(), "id_rsa"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
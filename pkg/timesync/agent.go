@@ -0,0 +1,108 @@
+package timesync
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// commandTimeout is the time the guest agent has to answer a command
+const commandTimeout = 10 * time.Second
+
+// Agent sends commands to a qemu-guest-agent over a connection
+type Agent struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewAgent creates an agent using conn to communicate with qemu-guest-agent.
+func NewAgent(conn net.Conn) *Agent {
+	return &Agent{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// CommandError is returned when the guest agent fails to run a command, the
+// connection to the agent can still be used.
+type CommandError struct {
+	Command string
+	Class   string
+	Desc    string
+}
+
+func (err *CommandError) Error() string {
+	return fmt.Sprintf("qemu-guest-agent %s error: %s: %s", err.Command, err.Class, err.Desc)
+}
+
+type agentResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+}
+
+// execute runs the qemu-guest-agent command, and returns its return value
+func (a *Agent) execute(command string, arguments any) (json.RawMessage, error) {
+	request := map[string]any{"execute": command}
+	if arguments != nil {
+		request["arguments"] = arguments
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	// not all connections support deadlines, a failure to set them is not fatal
+	_ = a.conn.SetDeadline(time.Now().Add(commandTimeout))
+
+	if _, err := a.conn.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+	line, err := a.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var response agentResponse
+	if err := json.Unmarshal(line, &response); err != nil {
+		return nil, fmt.Errorf("unexpected response from qemu-guest-agent: %s", line)
+	}
+	if response.Error != nil {
+		return nil, &CommandError{Command: command, Class: response.Error.Class, Desc: response.Error.Desc}
+	}
+	if response.Return == nil {
+		return nil, fmt.Errorf("unexpected response from qemu-guest-agent: %s", line)
+	}
+	return response.Return, nil
+}
+
+// SetTime sets the guest clock to t
+func (a *Agent) SetTime(t time.Time) error {
+	_, err := a.execute("guest-set-time", map[string]any{"time": t.UnixNano()})
+	return err
+}
+
+// Drift returns the difference between the guest clock and the host clock,
+// it's negative when the guest clock is late.
+func (a *Agent) Drift() (time.Duration, error) {
+	before := time.Now()
+	ret, err := a.execute("guest-get-time", nil)
+	if err != nil {
+		return 0, err
+	}
+	after := time.Now()
+	var guestTime int64
+	if err := json.Unmarshal(ret, &guestTime); err != nil {
+		return 0, fmt.Errorf("unexpected guest-get-time response from qemu-guest-agent: %s", ret)
+	}
+	// the guest time is compared to the middle of the request
+	hostTime := before.Add(after.Sub(before) / 2)
+	return time.Unix(0, guestTime).Sub(hostTime), nil
+}
+
+// Close closes the connection to the guest agent
+func (a *Agent) Close() error {
+	return a.conn.Close()
+}
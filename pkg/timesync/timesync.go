@@ -0,0 +1,255 @@
+// Package timesync keeps the guest clock synchronized with the host clock,
+// using qemu-guest-agent. The guest clock stops when the host sleeps or when
+// the virtual machine is paused, and it's late when the virtual machine
+// resumes.
+package timesync
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reason is why the guest clock is synchronized
+type Reason string
+
+const (
+	// ReasonBoot is used for the synchronization once the guest agent
+	// answers after boot
+	ReasonBoot Reason = "boot"
+	// ReasonWakeup is used when the host wakes up from sleep
+	ReasonWakeup Reason = "wakeup"
+	// ReasonResume is used when the virtual machine is resumed
+	ReasonResume Reason = "resume"
+	// ReasonInterval is used for the periodic synchronizations
+	ReasonInterval Reason = "interval"
+	// ReasonRestore is used when the virtual machine is restored from a
+	// saved state
+	ReasonRestore Reason = "restore"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// Policy describes when the guest clock is synchronized. It's always
+// synchronized when the host wakes up from sleep, and when the virtual machine
+// is restored from a saved state.
+type Policy struct {
+	// Interval is the period of the synchronizations, 0 disables them
+	Interval time.Duration
+	// OnBoot synchronizes the clock once the guest agent answers after boot
+	OnBoot bool
+	// OnResume synchronizes the clock when the virtual machine is resumed
+	OnResume bool
+}
+
+// Status describes the synchronizations of the guest clock
+type Status struct {
+	// Connected is true when vfkit is connected to the guest agent
+	Connected bool `json:"connected"`
+	// LastSync is the time of the last successful synchronization
+	LastSync *time.Time `json:"lastSync,omitempty"`
+	// LastSyncReason is why the last successful synchronization happened
+	LastSyncReason Reason `json:"lastSyncReason,omitempty"`
+	// LastError is the error of the last synchronization, when it failed
+	LastError string `json:"lastError,omitempty"`
+	// Drift is the difference between the guest and the host clocks
+	// measured before the last synchronization, in nanoseconds. It's
+	// negative when the guest clock was late.
+	Drift time.Duration `json:"drift"`
+	// DriftTime is the time the drift was measured
+	DriftTime *time.Time `json:"driftTime,omitempty"`
+}
+
+// Syncer synchronizes the guest clock according to a Policy. The connection
+// to the guest agent is reopened when it fails, and failed synchronizations
+// are retried with an exponential backoff.
+type Syncer struct {
+	dial   func() (net.Conn, error)
+	policy Policy
+
+	triggers   chan Reason
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// agentMu serializes the commands sent to the guest agent
+	agentMu sync.Mutex
+	agent   *Agent
+
+	mu     sync.Mutex
+	status Status
+}
+
+// NewSyncer creates a syncer for policy, dial connects to the guest agent.
+func NewSyncer(dial func() (net.Conn, error), policy Policy) *Syncer {
+	return &Syncer{
+		dial:       dial,
+		policy:     policy,
+		triggers:   make(chan Reason, 1),
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+	}
+}
+
+// Trigger requests a synchronization of the guest clock from Run. It's
+// ignored when the policy doesn't synchronize the clock for reason.
+func (s *Syncer) Trigger(reason Reason) {
+	if !s.enabled(reason) {
+		return
+	}
+	select {
+	case s.triggers <- reason:
+	default:
+		// a synchronization is already pending
+	}
+}
+
+func (s *Syncer) enabled(reason Reason) bool {
+	switch reason {
+	case ReasonBoot:
+		return s.policy.OnBoot
+	case ReasonResume:
+		return s.policy.OnResume
+	case ReasonInterval:
+		return s.policy.Interval > 0
+	default:
+		return true
+	}
+}
+
+// Run synchronizes the guest clock when the policy requires it, until ctx is
+// done.
+func (s *Syncer) Run(ctx context.Context) {
+	defer s.disconnect()
+
+	var tick <-chan time.Time
+	if s.policy.Interval > 0 {
+		ticker := time.NewTicker(s.policy.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// the retry timer only runs after a failed synchronization
+	retry := time.NewTimer(s.maxBackoff)
+	retry.Stop()
+	defer retry.Stop()
+	var pending Reason
+	backoff := s.minBackoff
+	attempt := func(reason Reason) {
+		retry.Stop()
+		if err := s.Sync(reason); err != nil {
+			log.Debugf("error syncing guest time (%s), retrying in %s: %v", reason, backoff, err)
+			pending = reason
+			retry.Reset(backoff)
+			backoff = min(2*backoff, s.maxBackoff)
+			return
+		}
+		pending = ""
+		backoff = s.minBackoff
+	}
+
+	if s.policy.OnBoot {
+		attempt(ReasonBoot)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			attempt(ReasonInterval)
+		case reason := <-s.triggers:
+			attempt(reason)
+		case <-retry.C:
+			attempt(pending)
+		}
+	}
+}
+
+// Sync synchronizes the guest clock now, after measuring its drift.
+func (s *Syncer) Sync(reason Reason) error {
+	s.agentMu.Lock()
+	defer s.agentMu.Unlock()
+
+	err := s.sync(reason)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Connected = s.agent != nil
+	if err != nil {
+		s.status.LastError = err.Error()
+		return err
+	}
+	now := time.Now()
+	s.status.LastSync = &now
+	s.status.LastSyncReason = reason
+	s.status.LastError = ""
+	return nil
+}
+
+func (s *Syncer) sync(reason Reason) error {
+	if s.agent == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.agent = NewAgent(conn)
+	}
+
+	// the drift is only informative, the clock is set even if the agent
+	// can't get the guest time
+	drift, err := s.agent.Drift()
+	var cmdErr *CommandError
+	switch {
+	case err == nil:
+		driftTime := time.Now()
+		s.mu.Lock()
+		s.status.Drift = drift
+		s.status.DriftTime = &driftTime
+		s.mu.Unlock()
+	case errors.As(err, &cmdErr):
+		log.Debugf("error measuring guest time drift: %v", err)
+	default:
+		s.closeAgent()
+		return err
+	}
+
+	if err := s.agent.SetTime(time.Now()); err != nil {
+		s.closeAgent()
+		return err
+	}
+	log.Infof("guest time synchronized (%s)", reason)
+	return nil
+}
+
+// closeAgent closes the connection to the guest agent, it's reopened by the
+// next synchronization. agentMu must be held.
+func (s *Syncer) closeAgent() {
+	if s.agent == nil {
+		return
+	}
+	if err := s.agent.Close(); err != nil {
+		log.Debugf("error closing the guest agent connection: %v", err)
+	}
+	s.agent = nil
+}
+
+func (s *Syncer) disconnect() {
+	s.agentMu.Lock()
+	defer s.agentMu.Unlock()
+	s.closeAgent()
+	s.mu.Lock()
+	s.status.Connected = false
+	s.mu.Unlock()
+}
+
+// Status returns the status of the synchronizations of the guest clock.
+func (s *Syncer) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
@@ -0,0 +1,190 @@
+package timesync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAgent emulates qemu-guest-agent, its clock is late by offset
+type fakeAgent struct {
+	mu          sync.Mutex
+	offset      time.Duration
+	setTimes    []time.Time
+	dials       int
+	failDials   int
+	getTimeErr  bool
+	closeOnNext bool
+}
+
+func (agent *fakeAgent) dial() (net.Conn, error) {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	agent.dials++
+	if agent.failDials > 0 {
+		agent.failDials--
+		return nil, errors.New("connection refused")
+	}
+	host, guest := net.Pipe()
+	go agent.serve(guest)
+	return host, nil
+}
+
+func (agent *fakeAgent) serve(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var request struct {
+			Execute   string `json:"execute"`
+			Arguments struct {
+				Time int64 `json:"time"`
+			} `json:"arguments"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			return
+		}
+		agent.mu.Lock()
+		if agent.closeOnNext {
+			agent.closeOnNext = false
+			agent.mu.Unlock()
+			return
+		}
+		var response string
+		switch request.Execute {
+		case "guest-get-time":
+			if agent.getTimeErr {
+				response = `{"error": {"class": "CommandDisabled", "desc": "The command guest-get-time has been disabled"}}`
+			} else {
+				response = fmt.Sprintf(`{"return": %d}`, time.Now().Add(-agent.offset).UnixNano())
+			}
+		case "guest-set-time":
+			agent.setTimes = append(agent.setTimes, time.Unix(0, request.Arguments.Time))
+			agent.offset = 0
+			response = `{"return": {}}`
+		default:
+			response = `{"error": {"class": "CommandNotFound", "desc": "unknown command"}}`
+		}
+		agent.mu.Unlock()
+		if _, err := conn.Write([]byte(response + "\n")); err != nil {
+			return
+		}
+	}
+}
+
+func (agent *fakeAgent) syncs() int {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	return len(agent.setTimes)
+}
+
+func TestAgent(t *testing.T) {
+	fake := &fakeAgent{offset: 3 * time.Minute}
+	conn, err := fake.dial()
+	require.NoError(t, err)
+	agent := NewAgent(conn)
+	defer agent.Close()
+
+	drift, err := agent.Drift()
+	require.NoError(t, err)
+	assert.InDelta(t, -3*time.Minute, drift, float64(time.Second))
+
+	now := time.Now()
+	require.NoError(t, agent.SetTime(now))
+	assert.Equal(t, []time.Time{time.Unix(0, now.UnixNano())}, fake.setTimes)
+
+	_, err = agent.execute("guest-unknown", nil)
+	var cmdErr *CommandError
+	require.ErrorAs(t, err, &cmdErr)
+	assert.EqualError(t, err, "qemu-guest-agent guest-unknown error: CommandNotFound: unknown command")
+}
+
+func TestSyncerSync(t *testing.T) {
+	fake := &fakeAgent{offset: 2 * time.Minute}
+	syncer := NewSyncer(fake.dial, Policy{})
+
+	require.NoError(t, syncer.Sync(ReasonWakeup))
+	status := syncer.Status()
+	assert.True(t, status.Connected)
+	assert.Equal(t, ReasonWakeup, status.LastSyncReason)
+	assert.NotNil(t, status.LastSync)
+	assert.Empty(t, status.LastError)
+	assert.InDelta(t, -2*time.Minute, status.Drift, float64(time.Second))
+
+	// the connection is reused
+	require.NoError(t, syncer.Sync(ReasonResume))
+	assert.Equal(t, 1, fake.dials)
+	assert.Equal(t, 2, fake.syncs())
+	assert.InDelta(t, 0, syncer.Status().Drift, float64(time.Second))
+
+	// and reopened after an error
+	fake.closeOnNext = true
+	require.Error(t, syncer.Sync(ReasonWakeup))
+	status = syncer.Status()
+	assert.False(t, status.Connected)
+	assert.NotEmpty(t, status.LastError)
+	assert.Equal(t, ReasonResume, status.LastSyncReason)
+	require.NoError(t, syncer.Sync(ReasonWakeup))
+	assert.Equal(t, 2, fake.dials)
+
+	// the clock is set even when the drift can't be measured
+	fake.getTimeErr = true
+	require.NoError(t, syncer.Sync(ReasonInterval))
+	assert.Equal(t, 4, fake.syncs())
+	assert.Equal(t, 2, fake.dials)
+}
+
+func TestSyncerRun(t *testing.T) {
+	// the agent doesn't answer while the guest boots
+	fake := &fakeAgent{failDials: 3}
+	syncer := NewSyncer(fake.dial, Policy{Interval: 50 * time.Millisecond, OnBoot: true})
+	syncer.minBackoff = time.Millisecond
+	syncer.maxBackoff = 4 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		syncer.Run(ctx)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool { return syncer.Status().LastSync != nil }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, ReasonBoot, syncer.Status().LastSyncReason)
+	require.Eventually(t, func() bool { return syncer.Status().LastSyncReason == ReasonInterval }, 5*time.Second, time.Millisecond)
+
+	cancel()
+	<-done
+	assert.False(t, syncer.Status().Connected)
+}
+
+func TestSyncerTrigger(t *testing.T) {
+	fake := &fakeAgent{}
+	syncer := NewSyncer(fake.dial, Policy{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go syncer.Run(ctx)
+
+	// resume synchronizations are disabled
+	syncer.Trigger(ReasonResume)
+	syncer.Trigger(ReasonWakeup)
+	require.Eventually(t, func() bool { return fake.syncs() == 1 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, ReasonWakeup, syncer.Status().LastSyncReason)
+
+	syncer.policy.OnResume = true
+	syncer.Trigger(ReasonResume)
+	require.Eventually(t, func() bool { return fake.syncs() == 2 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, ReasonResume, syncer.Status().LastSyncReason)
+
+	// restores are always synchronized
+	syncer.Trigger(ReasonRestore)
+	require.Eventually(t, func() bool { return fake.syncs() == 3 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, ReasonRestore, syncer.Status().LastSyncReason)
+}
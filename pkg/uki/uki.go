@@ -0,0 +1,140 @@
+// Package uki extracts the kernel, initrd and kernel command line from a
+// Unified Kernel Image.
+//
+// A Unified Kernel Image (UKI) is an EFI PE/COFF executable which embeds the
+// Linux kernel in its `.linux` section, the initrd in its `.initrd` section,
+// and the kernel command line in its `.cmdline` section:
+// https://uapi-group.org/specifications/specs/unified_kernel_image/
+// Once these sections are extracted, the UKI can be booted without EFI
+// firmware, using the virtualization framework Linux bootloader.
+package uki
+
+import (
+	"debug/pe"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	linuxSection   = ".linux"
+	initrdSection  = ".initrd"
+	cmdlineSection = ".cmdline"
+)
+
+// UKI is an opened Unified Kernel Image file.
+type UKI struct {
+	file   *os.File
+	peFile *pe.File
+}
+
+// Open opens the Unified Kernel Image at path and parses its PE/COFF headers.
+func Open(path string) (*UKI, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	peFile, err := pe.NewFile(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("%s is not a valid unified kernel image: %w", path, err)
+	}
+	return &UKI{
+		file:   file,
+		peFile: peFile,
+	}, nil
+}
+
+// Close closes the UKI file.
+func (uki *UKI) Close() error {
+	return uki.file.Close()
+}
+
+// Section returns a reader for the content of the section called name, or
+// nil if the UKI has no such section.
+func (uki *UKI) Section(name string) *io.SectionReader {
+	section := uki.peFile.Section(name)
+	if section == nil {
+		return nil
+	}
+	// the section size in the file is rounded up to the file alignment, the
+	// virtual size is the actual size of the data
+	size := int64(section.Size)
+	if section.VirtualSize != 0 && int64(section.VirtualSize) < size {
+		size = int64(section.VirtualSize)
+	}
+	return io.NewSectionReader(section, 0, size)
+}
+
+// CmdLine returns the kernel command line embedded in the UKI. It returns an
+// empty string if the UKI has no `.cmdline` section.
+func (uki *UKI) CmdLine() (string, error) {
+	section := uki.Section(cmdlineSection)
+	if section == nil {
+		return "", nil
+	}
+	cmdline, err := io.ReadAll(section)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s section: %w", cmdlineSection, err)
+	}
+	return strings.TrimSpace(strings.TrimRight(string(cmdline), "\x00")), nil
+}
+
+func (uki *UKI) extractSection(name string, destPath string) error {
+	section := uki.Section(name)
+	if section == nil {
+		return fmt.Errorf("missing %s section", name)
+	}
+	file, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, section); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to extract %s section: %w", name, err)
+	}
+	return file.Close()
+}
+
+// BootFiles describes the files extracted from a UKI which are needed to
+// boot it with a Linux bootloader.
+type BootFiles struct {
+	KernelPath string
+	// InitrdPath is empty if the UKI does not contain an initrd
+	InitrdPath string
+	CmdLine    string
+}
+
+// Extract extracts the kernel and initrd of the UKI at ukiPath to destDir.
+// extraCmdLine is appended to the kernel command line embedded in the UKI.
+func Extract(ukiPath string, destDir string, extraCmdLine string) (*BootFiles, error) {
+	uki, err := Open(ukiPath)
+	if err != nil {
+		return nil, err
+	}
+	defer uki.Close()
+
+	bootFiles := BootFiles{
+		KernelPath: filepath.Join(destDir, "vmlinuz"),
+	}
+	if err := uki.extractSection(linuxSection, bootFiles.KernelPath); err != nil {
+		return nil, fmt.Errorf("failed to extract kernel from %s: %w", ukiPath, err)
+	}
+
+	if uki.Section(initrdSection) != nil {
+		bootFiles.InitrdPath = filepath.Join(destDir, "initrd")
+		if err := uki.extractSection(initrdSection, bootFiles.InitrdPath); err != nil {
+			return nil, fmt.Errorf("failed to extract initrd from %s: %w", ukiPath, err)
+		}
+	}
+
+	cmdline, err := uki.CmdLine()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kernel command line from %s: %w", ukiPath, err)
+	}
+	bootFiles.CmdLine = strings.TrimSpace(strings.Join([]string{cmdline, extraCmdLine}, " "))
+
+	return &bootFiles, nil
+}
@@ -0,0 +1,122 @@
+package uki
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testSection struct {
+	name string
+	data []byte
+}
+
+const testFileAlignment = 0x200
+
+func alignUp(n int) int {
+	return (n + testFileAlignment - 1) &^ (testFileAlignment - 1)
+}
+
+// writeTestUKI creates a minimal PE/COFF file with the given sections. Section
+// data is padded to the file alignment, as in real UKIs.
+func writeTestUKI(t *testing.T, sections []testSection) string {
+	const peHeaderOffset = 0x40
+
+	var buf bytes.Buffer
+	dosHeader := make([]byte, peHeaderOffset)
+	copy(dosHeader, "MZ")
+	binary.LittleEndian.PutUint32(dosHeader[0x3c:], peHeaderOffset)
+	buf.Write(dosHeader)
+	buf.WriteString("PE\x00\x00")
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, pe.FileHeader{
+		Machine:          pe.IMAGE_FILE_MACHINE_ARM64,
+		NumberOfSections: uint16(len(sections)),
+	}))
+
+	dataOffset := alignUp(buf.Len() + len(sections)*binary.Size(pe.SectionHeader32{}))
+	virtualAddress := 0x1000
+	for _, section := range sections {
+		header := pe.SectionHeader32{
+			VirtualSize:      uint32(len(section.data)),
+			VirtualAddress:   uint32(virtualAddress),
+			SizeOfRawData:    uint32(alignUp(len(section.data))),
+			PointerToRawData: uint32(dataOffset),
+		}
+		copy(header.Name[:], section.name)
+		require.NoError(t, binary.Write(&buf, binary.LittleEndian, header))
+		dataOffset += alignUp(len(section.data))
+		virtualAddress += alignUp(len(section.data))
+	}
+	for _, section := range sections {
+		buf.Write(make([]byte, alignUp(buf.Len())-buf.Len()))
+		buf.Write(section.data)
+	}
+	buf.Write(make([]byte, alignUp(buf.Len())-buf.Len()))
+
+	ukiPath := filepath.Join(t.TempDir(), "uki.efi")
+	require.NoError(t, os.WriteFile(ukiPath, buf.Bytes(), 0600))
+	return ukiPath
+}
+
+func TestExtract(t *testing.T) {
+	kernel := bytes.Repeat([]byte("kernel"), 100)
+	initrd := bytes.Repeat([]byte("initrd"), 200)
+	ukiPath := writeTestUKI(t, []testSection{
+		{name: ".osrel", data: []byte("ID=fedora\n")},
+		{name: ".cmdline", data: []byte("root=LABEL=root console=hvc0\n\x00")},
+		{name: ".linux", data: kernel},
+		{name: ".initrd", data: initrd},
+	})
+
+	destDir := t.TempDir()
+	bootFiles, err := Extract(ukiPath, destDir, "")
+	require.NoError(t, err)
+	assert.Equal(t, "root=LABEL=root console=hvc0", bootFiles.CmdLine)
+
+	require.Equal(t, destDir, filepath.Dir(bootFiles.KernelPath))
+	extractedKernel, err := os.ReadFile(bootFiles.KernelPath)
+	require.NoError(t, err)
+	assert.Equal(t, kernel, extractedKernel)
+
+	require.Equal(t, destDir, filepath.Dir(bootFiles.InitrdPath))
+	extractedInitrd, err := os.ReadFile(bootFiles.InitrdPath)
+	require.NoError(t, err)
+	assert.Equal(t, initrd, extractedInitrd)
+
+	bootFiles, err = Extract(ukiPath, t.TempDir(), "systemd.unit=rescue.target")
+	require.NoError(t, err)
+	assert.Equal(t, "root=LABEL=root console=hvc0 systemd.unit=rescue.target", bootFiles.CmdLine)
+}
+
+func TestExtractNoInitrdNoCmdLine(t *testing.T) {
+	ukiPath := writeTestUKI(t, []testSection{
+		{name: ".linux", data: []byte("kernel")},
+	})
+
+	bootFiles, err := Extract(ukiPath, t.TempDir(), "console=hvc0")
+	require.NoError(t, err)
+	assert.Empty(t, bootFiles.InitrdPath)
+	assert.Equal(t, "console=hvc0", bootFiles.CmdLine)
+}
+
+func TestExtractErrors(t *testing.T) {
+	ukiPath := writeTestUKI(t, []testSection{
+		{name: ".initrd", data: []byte("initrd")},
+	})
+	_, err := Extract(ukiPath, t.TempDir(), "")
+	require.ErrorContains(t, err, "missing .linux section")
+
+	notPEPath := filepath.Join(t.TempDir(), "not-a-uki")
+	require.NoError(t, os.WriteFile(notPEPath, []byte("not a PE file"), 0600))
+	_, err = Extract(notPEPath, t.TempDir(), "")
+	require.ErrorContains(t, err, "is not a valid unified kernel image")
+
+	_, err = Extract(filepath.Join(t.TempDir(), "missing"), t.TempDir(), "")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,54 @@
+package usernet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// guestTarget returns the guest address and port of a connection initiated
+// by the host, the unspecified address stands for the address of the guest
+func (s *Stack) guestTarget(guest netip.AddrPort) (tcpip.FullAddress, error) {
+	addr := guest.Addr()
+	if !addr.IsValid() || addr.IsUnspecified() {
+		addr = s.guestIP
+	}
+	if !s.subnet.Contains(addr) || addr == s.gateway || addr == s.hostAddr || addr == lastAddr(s.subnet) {
+		return tcpip.FullAddress{}, fmt.Errorf("%s is not a guest address of the %s network", addr, s.subnet)
+	}
+	return tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFrom4(addr.As4()), Port: guest.Port()}, nil
+}
+
+// DialTCP connects to a guest port from the gateway. When the address of
+// guest is unspecified, it connects to the address of the guest. The
+// returned connection is established once the guest accepted the connection.
+func (s *Stack) DialTCP(ctx context.Context, guest netip.AddrPort) (net.Conn, error) {
+	if s.ctx.Err() != nil {
+		return nil, net.ErrClosed
+	}
+	target, err := s.guestTarget(guest)
+	if err != nil {
+		return nil, err
+	}
+	return gonet.DialContextTCP(ctx, s.stack, target, ipv4.ProtocolNumber)
+}
+
+// DialUDP returns a connection which exchanges datagrams with a guest port
+// from a gateway port. When the address of guest is unspecified, the
+// datagrams are sent to the address of the guest.
+func (s *Stack) DialUDP(guest netip.AddrPort) (net.Conn, error) {
+	if s.ctx.Err() != nil {
+		return nil, net.ErrClosed
+	}
+	target, err := s.guestTarget(guest)
+	if err != nil {
+		return nil, err
+	}
+	local := tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFrom4(s.gateway.As4())}
+	return gonet.DialUDP(s.stack, &local, &target, ipv4.ProtocolNumber)
+}
@@ -0,0 +1,298 @@
+// Package usernet is a userspace network stack for virtio-net devices. It
+// exchanges ethernet frames with the guest, and provides it with a virtual
+// network behind a gateway which answers DHCP requests, resolves DNS queries
+// with the resolver of the host, and translates the guest TCP and UDP flows
+// to host sockets. The host can connect to guest ports with DialTCP and
+// DialUDP.
+//
+// The stack is the gvisor network stack, with the switch and the services of
+// gvisor-tap-vsock. The guest only gets IPv4 connectivity.
+package usernet
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dhcp"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dns"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/forwarder"
+	"github.com/containers/gvisor-tap-vsock/pkg/tap"
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/crc-org/vfkit/pkg/netrelay"
+	log "github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// DefaultSubnet is the subnet of the virtual network when Config.Subnet is
+// not set
+var DefaultSubnet = netip.MustParsePrefix("192.168.127.0/24")
+
+// gatewayMAC is the MAC address of the gateway
+var gatewayMAC = net.HardwareAddr{0x5a, 0x94, 0xef, 0xe4, 0x0c, 0xdd}
+
+// mtu is the MTU of the virtual network, it's sent to the guest by the DHCP
+// server
+const mtu = 1500
+
+// nicID is the identifier of the interface of the gateway in the stack
+const nicID tcpip.NICID = 1
+
+// Config is the configuration of a Stack
+type Config struct {
+	// Subnet is the subnet of the virtual network. The gateway uses its
+	// first address, the guest its second address, and the host can be
+	// reached at its last usable address, the one before the broadcast
+	// address.
+	Subnet netip.Prefix
+	// GuestMAC is the MAC address of the guest interface, the DHCP server
+	// leases the second address of the subnet to it
+	GuestMAC net.HardwareAddr
+}
+
+// Stack is a userspace network stack, it implements netrelay.Conn so that
+// its frames can be relayed to a virtio-net device
+type Stack struct {
+	subnet   netip.Prefix
+	gateway  netip.Addr
+	hostAddr netip.Addr
+	guestIP  netip.Addr
+
+	stack *stack.Stack
+	// frames is the end of the socketpair connected to the switch, the
+	// frames of the guest are written to it
+	frames     netrelay.Conn
+	switchConn net.Conn
+	ctx        context.Context
+	cancel     context.CancelFunc
+	closeOnce  sync.Once
+}
+
+// New creates a Stack
+func New(config Config) (*Stack, error) {
+	subnet := config.Subnet
+	if !subnet.IsValid() {
+		subnet = DefaultSubnet
+	}
+	subnet = subnet.Masked()
+	if !subnet.Addr().Is4() || subnet.Bits() > 29 {
+		return nil, fmt.Errorf("invalid subnet %s: an IPv4 subnet with at least 8 addresses is required", subnet)
+	}
+	if len(config.GuestMAC) == 0 {
+		return nil, fmt.Errorf("the MAC address of the guest is required")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Stack{
+		subnet:   subnet,
+		gateway:  subnet.Addr().Next(),
+		hostAddr: lastAddr(subnet).Prev(),
+		guestIP:  subnet.Addr().Next().Next(),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	configuration := &types.Configuration{
+		MTU:               mtu,
+		Subnet:            subnet.String(),
+		GatewayIP:         s.gateway.String(),
+		GatewayMacAddress: gatewayMAC.String(),
+		DHCPStaticLeases:  map[string]string{s.guestIP.String(): config.GuestMAC.String()},
+		GatewayVirtualIPs: []string{s.hostAddr.String()},
+	}
+
+	networkSwitch, err := s.createStack(configuration)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	switchConn, stackConn, err := datagramPair()
+	if err != nil {
+		cancel()
+		s.stack.Destroy()
+		return nil, err
+	}
+	if err := s.startServices(configuration); err != nil {
+		cancel()
+		switchConn.Close()
+		stackConn.Close()
+		s.stack.Destroy()
+		return nil, err
+	}
+	s.frames = netrelay.NewDatagramConn(stackConn)
+	s.switchConn = switchConn
+	go func() {
+		if err := networkSwitch.Accept(ctx, switchConn, types.VfkitProtocol); err != nil && ctx.Err() == nil {
+			log.Errorf("usernet: the switch stopped: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+// createStack creates the gvisor stack of the gateway, and connects it to a
+// switch
+func (s *Stack) createStack(configuration *types.Configuration) (*tap.Switch, error) {
+	endpoint, err := tap.NewLinkEndpoint(false, mtu, configuration.GatewayMacAddress, configuration.GatewayIP, configuration.GatewayVirtualIPs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the link endpoint: %w", err)
+	}
+	networkSwitch := tap.NewSwitch(false)
+	endpoint.Connect(networkSwitch)
+	networkSwitch.Connect(endpoint)
+
+	s.stack = stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+	})
+	if err := s.stack.CreateNIC(nicID, endpoint); err != nil {
+		return nil, fmt.Errorf("failed to create the gateway interface: %s", err)
+	}
+	if err := s.stack.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4(s.gateway.As4()).WithPrefix(),
+	}, stack.AddressProperties{}); err != nil {
+		return nil, fmt.Errorf("failed to add the gateway address: %s", err)
+	}
+	// the gateway handles the traffic of all the destinations of the guest
+	s.stack.SetSpoofing(nicID, true)
+	s.stack.SetPromiscuousMode(nicID, true)
+	subnet, err := tcpip.NewSubnet(tcpip.AddrFrom4(s.subnet.Addr().As4()), tcpip.MaskFromBytes(net.CIDRMask(s.subnet.Bits(), 32)))
+	if err != nil {
+		return nil, err
+	}
+	s.stack.SetRouteTable([]tcpip.Route{{Destination: subnet, NIC: nicID}})
+	return networkSwitch, nil
+}
+
+// startServices starts the TCP and UDP forwarders, and the DHCP and DNS
+// servers of the gateway
+func (s *Stack) startServices(configuration *types.Configuration) error {
+	var natLock sync.Mutex
+	nat := map[tcpip.Address]tcpip.Address{
+		tcpip.AddrFrom4(s.hostAddr.As4()): tcpip.AddrFrom4([4]byte{127, 0, 0, 1}),
+	}
+	s.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, forwarder.TCP(s.stack, nat, &natLock, false).HandlePacket)
+	s.stack.SetTransportProtocolHandler(udp.ProtocolNumber, forwarder.UDP(s.stack, nat, &natLock).HandlePacket)
+
+	ipPool := tap.NewIPPool(&net.IPNet{IP: s.subnet.Addr().AsSlice(), Mask: net.CIDRMask(s.subnet.Bits(), 32)})
+	ipPool.Reserve(s.gateway.AsSlice(), configuration.GatewayMacAddress)
+	for ip, mac := range configuration.DHCPStaticLeases {
+		ipPool.Reserve(net.ParseIP(ip), mac)
+	}
+	dhcpServer, err := dhcp.New(configuration, s.stack, ipPool)
+	if err != nil {
+		return fmt.Errorf("failed to start the DHCP server: %w", err)
+	}
+	go s.serve("DHCP", dhcpServer.Serve)
+
+	gatewayDNS := tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFrom4(s.gateway.As4()), Port: 53}
+	udpConn, err := gonet.DialUDP(s.stack, &gatewayDNS, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		return fmt.Errorf("failed to start the DNS server: %w", err)
+	}
+	tcpListener, err := gonet.ListenTCP(s.stack, gatewayDNS, ipv4.ProtocolNumber)
+	if err != nil {
+		udpConn.Close()
+		return fmt.Errorf("failed to start the DNS server: %w", err)
+	}
+	dnsServer, err := dns.New(udpConn, tcpListener, nil)
+	if err != nil {
+		udpConn.Close()
+		tcpListener.Close()
+		return fmt.Errorf("failed to start the DNS server: %w", err)
+	}
+	go s.serve("DNS", dnsServer.Serve)
+	go s.serve("DNS", dnsServer.ServeTCP)
+	return nil
+}
+
+// serve runs the server loop serve, its error is only logged when the stack
+// is not closed
+func (s *Stack) serve(name string, serve func() error) {
+	if err := serve(); err != nil && s.ctx.Err() == nil {
+		log.Errorf("usernet: the %s server stopped: %v", name, err)
+	}
+}
+
+// datagramPair returns the two ends of a unix datagram socketpair
+func datagramPair() (net.Conn, net.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	conns := make([]net.Conn, 0, 2)
+	for _, fd := range fds {
+		file := os.NewFile(uintptr(fd), "usernet socketpair")
+		conn, err := net.FileConn(file)
+		file.Close()
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns[0], conns[1], nil
+}
+
+// lastAddr returns the broadcast address of subnet
+func lastAddr(subnet netip.Prefix) netip.Addr {
+	addr := subnet.Addr().As4()
+	hostBits := uint32(1)<<(32-subnet.Bits()) - 1
+	binary.BigEndian.PutUint32(addr[:], binary.BigEndian.Uint32(addr[:])|hostBits)
+	return netip.AddrFrom4(addr)
+}
+
+// Subnet returns the subnet of the virtual network
+func (s *Stack) Subnet() netip.Prefix {
+	return s.subnet
+}
+
+// Gateway returns the address of the gateway of the virtual network
+func (s *Stack) Gateway() netip.Addr {
+	return s.gateway
+}
+
+// HostAddr returns the address at which the guest can reach the host
+// loopback interface
+func (s *Stack) HostAddr() netip.Addr {
+	return s.hostAddr
+}
+
+// GuestIP returns the address the DHCP server leases to the guest
+func (s *Stack) GuestIP() netip.Addr {
+	return s.guestIP
+}
+
+// ReadFrame reads the next frame sent to the guest
+func (s *Stack) ReadFrame(buf []byte) (int, error) {
+	return s.frames.ReadFrame(buf)
+}
+
+// WriteFrame processes a frame sent by the guest
+func (s *Stack) WriteFrame(frame []byte) error {
+	return s.frames.WriteFrame(frame)
+}
+
+// Close stops the stack, and closes the host sockets of the guest flows and
+// the connections to the guest
+func (s *Stack) Close() error {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.frames.Close()
+		s.switchConn.Close()
+		s.stack.Destroy()
+	})
+	return nil
+}
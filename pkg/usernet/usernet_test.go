@@ -0,0 +1,268 @@
+package usernet
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/link/ethernet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+var (
+	testGuestMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testGateway  = netip.MustParseAddr("192.168.127.1")
+	testHostAddr = netip.MustParseAddr("192.168.127.254")
+	testGuestIP  = netip.MustParseAddr("192.168.127.2")
+)
+
+// testGuest is the network stack of a guest, its frames are exchanged with a
+// Stack
+type testGuest struct {
+	host  *Stack
+	stack *stack.Stack
+}
+
+func newTestGuest(t *testing.T) *testGuest {
+	host, err := New(Config{GuestMAC: testGuestMAC})
+	require.NoError(t, err)
+
+	endpoint := channel.New(256, mtu, tcpip.LinkAddress(testGuestMAC))
+	guest := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	require.Nil(t, guest.CreateNIC(1, ethernet.New(endpoint)))
+	require.Nil(t, guest.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4(testGuestIP.As4()).WithPrefix(),
+	}, stack.AddressProperties{}))
+	guest.SetRouteTable([]tcpip.Route{
+		{Destination: routeSubnet(t, "0.0.0.0/0"), Gateway: tcpip.AddrFrom4(testGateway.As4()), NIC: 1},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		host.Close()
+		guest.Destroy()
+	})
+	go func() {
+		for {
+			pkt := endpoint.ReadContext(ctx)
+			if pkt == nil {
+				return
+			}
+			frame := pkt.ToView().AsSlice()
+			pkt.DecRef()
+			if err := host.WriteFrame(frame); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := host.ReadFrame(buf)
+			if err != nil {
+				return
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(append([]byte{}, buf[:n]...))})
+			endpoint.InjectInbound(0, pkt)
+			pkt.DecRef()
+		}
+	}()
+	return &testGuest{host: host, stack: guest}
+}
+
+func routeSubnet(t *testing.T, cidr string) tcpip.Subnet {
+	prefix := netip.MustParsePrefix(cidr)
+	subnet, err := tcpip.NewSubnet(tcpip.AddrFrom4(prefix.Addr().As4()), tcpip.MaskFromBytes(net.CIDRMask(prefix.Bits(), 32)))
+	require.NoError(t, err)
+	return subnet
+}
+
+func (g *testGuest) addr(addr netip.Addr, port uint16) tcpip.FullAddress {
+	return tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFrom4(addr.As4()), Port: port}
+}
+
+// echo copies the data received on conn back to it
+func echo(conn net.Conn) {
+	defer conn.Close()
+	_, _ = io.Copy(conn, conn)
+}
+
+func assertEcho(t *testing.T, conn net.Conn, data string) {
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err := conn.Write([]byte(data))
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, data, string(buf))
+}
+
+func TestSubnet(t *testing.T) {
+	stack, err := New(Config{Subnet: netip.MustParsePrefix("10.0.2.15/24"), GuestMAC: testGuestMAC})
+	require.NoError(t, err)
+	defer stack.Close()
+	assert.Equal(t, netip.MustParsePrefix("10.0.2.0/24"), stack.Subnet())
+	assert.Equal(t, netip.MustParseAddr("10.0.2.1"), stack.Gateway())
+	assert.Equal(t, netip.MustParseAddr("10.0.2.2"), stack.GuestIP())
+	assert.Equal(t, netip.MustParseAddr("10.0.2.254"), stack.HostAddr())
+
+	_, err = New(Config{Subnet: netip.MustParsePrefix("10.0.2.0/30"), GuestMAC: testGuestMAC})
+	require.ErrorContains(t, err, "invalid subnet")
+	_, err = New(Config{Subnet: netip.MustParsePrefix("fd00::/64"), GuestMAC: testGuestMAC})
+	require.ErrorContains(t, err, "invalid subnet")
+	_, err = New(Config{})
+	require.ErrorContains(t, err, "MAC address of the guest is required")
+}
+
+func TestDHCP(t *testing.T) {
+	g := newTestGuest(t)
+	conn, err := gonet.DialUDP(g.stack, &tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFrom4(testGuestIP.As4()), Port: 68}, &tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFrom4(testGateway.As4()), Port: 67}, ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	discover, err := dhcpv4.NewDiscovery(testGuestMAC)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write(discover.ToBytes())
+	require.NoError(t, err)
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	offer, err := dhcpv4.FromBytes(buf[:n])
+	require.NoError(t, err)
+	assert.Equal(t, dhcpv4.MessageTypeOffer, offer.MessageType())
+	assert.Equal(t, testGuestIP.String(), offer.YourIPAddr.String())
+	assert.Equal(t, []net.IP{testGateway.AsSlice()}, offer.Router())
+	assert.Equal(t, []net.IP{testGateway.AsSlice()}, offer.DNS())
+}
+
+func TestTCPNAT(t *testing.T) {
+	g := newTestGuest(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			echo(conn)
+		}
+	}()
+
+	// the host address of the virtual network is translated to 127.0.0.1
+	port := uint16(listener.Addr().(*net.TCPAddr).Port) // #nosec G115 -- ports fit in 16 bits
+	conn, err := gonet.DialTCP(g.stack, g.addr(testHostAddr, port), ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, "hello from the guest")
+}
+
+func TestUDPNAT(t *testing.T) {
+	g := newTestGuest(t)
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = server.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	port := uint16(server.LocalAddr().(*net.UDPAddr).Port) // #nosec G115 -- ports fit in 16 bits
+	remote := g.addr(testHostAddr, port)
+	conn, err := gonet.DialUDP(g.stack, nil, &remote, ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, "datagram from the guest")
+}
+
+func TestDialTCP(t *testing.T) {
+	g := newTestGuest(t)
+	listener, err := gonet.ListenTCP(g.stack, g.addr(testGuestIP, 22), ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	defer listener.Close()
+	remoteAddrs := make(chan net.Addr, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			remoteAddrs <- conn.RemoteAddr()
+			echo(conn)
+		}
+	}()
+
+	// the unspecified address is the address of the guest
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := g.host.DialTCP(ctx, netip.MustParseAddrPort("0.0.0.0:22"))
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, "hello from the host")
+	// the connections come from the gateway
+	assert.Equal(t, testGateway.String(), (<-remoteAddrs).(*net.TCPAddr).IP.String())
+
+	_, err = g.host.DialTCP(ctx, netip.AddrPortFrom(testGuestIP, 23))
+	require.Error(t, err)
+}
+
+func TestDialUDP(t *testing.T) {
+	g := newTestGuest(t)
+	server, err := gonet.DialUDP(g.stack, &tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFrom4(testGuestIP.As4()), Port: 5353}, nil, ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = server.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conn, err := g.host.DialUDP(netip.AddrPortFrom(testGuestIP, 5353))
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, "datagram from the host")
+}
+
+func TestDialErrors(t *testing.T) {
+	stack, err := New(Config{GuestMAC: testGuestMAC})
+	require.NoError(t, err)
+	for _, addr := range []string{"192.168.127.1:22", "192.168.127.254:22", "192.168.127.255:22", "10.0.0.2:22"} {
+		_, err := stack.DialUDP(netip.MustParseAddrPort(addr))
+		require.ErrorContains(t, err, "is not a guest address", addr)
+		_, err = stack.DialTCP(context.Background(), netip.MustParseAddrPort(addr))
+		require.ErrorContains(t, err, "is not a guest address", addr)
+	}
+
+	require.NoError(t, stack.Close())
+	require.NoError(t, stack.Close())
+	_, err = stack.DialUDP(netip.MustParseAddrPort("0.0.0.0:53"))
+	require.ErrorIs(t, err, net.ErrClosed)
+	_, err = stack.ReadFrame(make([]byte, 1500))
+	require.Error(t, err)
+}
@@ -13,12 +13,20 @@ const cloudInitPrefix = "vfkit-cloudinit"
 
 var cloudInitTempDir = filepath.Join(os.TempDir(), cloudInitPrefix)
 
-func CreateCloudInitISOFile() (*os.File, error) {
-	if err := os.MkdirAll(cloudInitTempDir, 0700); err != nil {
-		return nil, fmt.Errorf("unable to create directory %s: %w", cloudInitTempDir, err)
+// CreateCloudInitISOFile creates the file of a cloud-init ISO image in dir,
+// or in a temporary directory when dir is empty. The name of the file
+// contains the PID of vfkit so that it can be removed by
+// CleanupStaleCloudInitISO or OpenStateDir if vfkit does not remove it when
+// exiting.
+func CreateCloudInitISOFile(dir string) (*os.File, error) {
+	if dir == "" {
+		dir = cloudInitTempDir
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create directory %s: %w", dir, err)
 	}
 	pid := os.Getpid()
-	file, err := os.CreateTemp(cloudInitTempDir, fmt.Sprintf("%s-%d-*.iso", cloudInitPrefix, pid))
+	file, err := os.CreateTemp(dir, fmt.Sprintf("%s-%d-*.iso", cloudInitPrefix, pid))
 	if err != nil {
 		return nil, fmt.Errorf("unable to create cloud-init ISO temporary file: %w", err)
 	}
@@ -26,20 +34,25 @@ func CreateCloudInitISOFile() (*os.File, error) {
 }
 
 func CleanupStaleCloudInitISO() error {
-	entries, err := os.ReadDir(cloudInitTempDir)
+	return cleanupStaleFiles(cloudInitTempDir, cloudInitPrefix+"-%d-", "cloud-init ISO")
+}
+
+// cleanupStaleFiles removes the files and directories of dir named after the
+// PID of a vfkit process which is no longer running. pattern is the
+// fmt.Sscanf format of the beginning of their name, with a single verb for
+// the PID.
+func cleanupStaleFiles(dir string, pattern string, description string) error {
+	entries, err := os.ReadDir(dir)
 	if os.IsNotExist(err) {
 		return nil
 	}
 	if err != nil {
-		return fmt.Errorf("unable to read directory %s: %w", cloudInitTempDir, err)
+		return fmt.Errorf("unable to read directory %s: %w", dir, err)
 	}
 	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
 		filename := entry.Name()
 		var pid int32
-		if _, err := fmt.Sscanf(filename, cloudInitPrefix+"-%d-", &pid); err != nil {
+		if _, err := fmt.Sscanf(filename, pattern, &pid); err != nil {
 			continue
 		}
 		exists, err := process.PidExists(pid)
@@ -49,10 +62,10 @@ func CleanupStaleCloudInitISO() error {
 		if exists {
 			continue
 		}
-		if err := os.Remove(filepath.Join(cloudInitTempDir, filename)); err != nil {
-			return fmt.Errorf("unable to remove file %s: %w", filepath.Join(cloudInitTempDir, filename), err)
+		if err := os.RemoveAll(filepath.Join(dir, filename)); err != nil {
+			return fmt.Errorf("unable to remove file %s: %w", filepath.Join(dir, filename), err)
 		}
-		logrus.Debugf("removed stale cloud-init ISO %s", filepath.Join(cloudInitTempDir, filename))
+		logrus.Debugf("removed stale %s %s", description, filepath.Join(dir, filename))
 	}
 	return nil
 }
@@ -0,0 +1,42 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const ephemeralDiskPrefix = "vfkit-ephemeral"
+
+var ephemeralDiskTempDir = filepath.Join(os.TempDir(), ephemeralDiskPrefix)
+
+// EphemeralDiskPath returns a path which does not exist yet in dir, or in a
+// temporary directory when dir is empty, for the ephemeral clone of the disk
+// image at imagePath. The path contains the PID of vfkit so that
+// CleanupStaleEphemeralDisks or OpenStateDir can remove the clone if vfkit
+// does not remove it when exiting.
+func EphemeralDiskPath(dir string, imagePath string) (string, error) {
+	if dir == "" {
+		dir = ephemeralDiskTempDir
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("unable to create directory %s: %w", dir, err)
+	}
+	pid := os.Getpid()
+	file, err := os.CreateTemp(dir, fmt.Sprintf("%s-%d-*-%s", ephemeralDiskPrefix, pid, filepath.Base(imagePath)))
+	if err != nil {
+		return "", fmt.Errorf("unable to create ephemeral disk temporary file: %w", err)
+	}
+	// the clone can only be created at a path which does not exist
+	_ = file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// CleanupStaleEphemeralDisks removes the ephemeral disk clones left behind by
+// vfkit processes which are no longer running.
+func CleanupStaleEphemeralDisks() error {
+	return cleanupStaleFiles(ephemeralDiskTempDir, ephemeralDiskPrefix+"-%d-", "ephemeral disk")
+}
@@ -0,0 +1,34 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEphemeralDisks(t *testing.T) {
+	ephemeralDiskTempDir = t.TempDir()
+
+	clonePath, err := EphemeralDiskPath("", "/images/disk.img")
+	require.NoError(t, err)
+	assert.NoFileExists(t, clonePath)
+	assert.Equal(t, ephemeralDiskTempDir, filepath.Dir(clonePath))
+	assert.True(t, strings.HasPrefix(filepath.Base(clonePath), fmt.Sprintf("vfkit-ephemeral-%d-", os.Getpid())))
+	assert.True(t, strings.HasSuffix(clonePath, "-disk.img"))
+
+	// the PID of the stale clone is out of the range of valid PIDs
+	stalePath := filepath.Join(ephemeralDiskTempDir, "vfkit-ephemeral-2147483647-1234-disk.img")
+	otherPath := filepath.Join(ephemeralDiskTempDir, "disk.img")
+	for _, path := range []string{clonePath, stalePath, otherPath} {
+		require.NoError(t, os.WriteFile(path, nil, 0600))
+	}
+	require.NoError(t, CleanupStaleEphemeralDisks())
+	assert.FileExists(t, clonePath)
+	assert.NoFileExists(t, stalePath)
+	assert.FileExists(t, otherPath)
+}
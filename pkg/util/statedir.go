@@ -0,0 +1,148 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// names of the files of a state directory
+const (
+	stateDirLockFile   = "vfkit.lock"
+	stateDirPidFile    = "vfkit.pid"
+	stateDirRESTSocket = "rest.sock"
+	stateDirStatusFile = "status.json"
+	stateDirConfigFile = "config.json"
+)
+
+// stateDirStalePatterns are the fmt.Sscanf patterns of the files of a state
+// directory named after the PID of the vfkit process which created them: the
+// cloud-init ISO images, the ephemeral disk clones, the directories of the
+// NBD sockets and of the extracted kernels, and the unixgram sockets of the
+// virtio-net devices
+var stateDirStalePatterns = map[string]string{
+	cloudInitPrefix + "-%d-":     "cloud-init ISO",
+	ephemeralDiskPrefix + "-%d-": "ephemeral disk",
+	nbdSocketDirPrefix + "-%d-":  "NBD socket directory",
+	extractDirPrefix + "-%d-":    "kernel directory",
+	"vfkit-%x-":                  "virtio-net socket",
+}
+
+// StateDir is the directory in which vfkit places the runtime files of a
+// virtual machine. It's locked while vfkit runs, so that it's only used by
+// one vfkit process.
+type StateDir struct {
+	Path string
+	lock *os.File
+}
+
+// OpenStateDir creates the state directory at path if it does not exist, and
+// locks it. The files left behind by the vfkit processes which used it
+// before are removed, except for the configuration and status files.
+func OpenStateDir(path string) (*StateDir, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create state directory %s: %w", path, err)
+	}
+	lock, err := os.OpenFile(filepath.Join(path, stateDirLockFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the lock file of state directory %s: %w", path, err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("state directory %s is used by another vfkit process", path)
+		}
+		return nil, fmt.Errorf("unable to lock state directory %s: %w", path, err)
+	}
+
+	dir := &StateDir{Path: path, lock: lock}
+	if err := dir.cleanup(); err != nil {
+		dir.Close()
+		return nil, err
+	}
+	return dir, nil
+}
+
+// cleanup removes the files left behind by the vfkit processes which used
+// the state directory before. The directory must be locked.
+func (dir *StateDir) cleanup() error {
+	for _, name := range []string{stateDirPidFile, stateDirRESTSocket} {
+		path := filepath.Join(dir.Path, name)
+		if err := os.Remove(path); err == nil {
+			logrus.Debugf("removed stale file %s", path)
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove file %s: %w", path, err)
+		}
+	}
+	for pattern, description := range stateDirStalePatterns {
+		if err := cleanupStaleFiles(dir.Path, pattern, description); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PidFile returns the default path of the pid file of vfkit
+func (dir *StateDir) PidFile() string {
+	return filepath.Join(dir.Path, stateDirPidFile)
+}
+
+// RESTSocket returns the default path of the unix socket of the REST API
+func (dir *StateDir) RESTSocket() string {
+	return filepath.Join(dir.Path, stateDirRESTSocket)
+}
+
+// StatusFile returns the default path of the file describing why vfkit
+// exited
+func (dir *StateDir) StatusFile() string {
+	return filepath.Join(dir.Path, stateDirStatusFile)
+}
+
+// ConfigFile returns the path of the file with the effective configuration
+// of the virtual machine
+func (dir *StateDir) ConfigFile() string {
+	return filepath.Join(dir.Path, stateDirConfigFile)
+}
+
+// Resolve returns path when it's absolute, otherwise its path relative to
+// the state directory
+func (dir *StateDir) Resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir.Path, path)
+}
+
+// WriteConfigFile atomically replaces the configuration file of the state
+// directory with config, the JSON configuration of the virtual machine
+func (dir *StateDir) WriteConfigFile(config []byte) error {
+	file, err := os.CreateTemp(dir.Path, stateDirConfigFile+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(config); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), dir.ConfigFile())
+}
+
+// Close removes the pid file of the state directory and unlocks it
+func (dir *StateDir) Close() error {
+	if err := os.Remove(dir.PidFile()); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("failed to remove %s: %v", dir.PidFile(), err)
+	}
+	return dir.lock.Close()
+}
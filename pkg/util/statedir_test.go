@@ -0,0 +1,81 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm")
+	dir, err := OpenStateDir(path)
+	require.NoError(t, err)
+	assert.DirExists(t, path)
+	assert.Equal(t, filepath.Join(path, "vfkit.pid"), dir.PidFile())
+	assert.Equal(t, filepath.Join(path, "rest.sock"), dir.RESTSocket())
+	assert.Equal(t, filepath.Join(path, "status.json"), dir.StatusFile())
+	assert.Equal(t, "/var/log/console.log", dir.Resolve("/var/log/console.log"))
+	assert.Equal(t, filepath.Join(path, "console.log"), dir.Resolve("console.log"))
+
+	// the state directory can only be used by one vfkit process
+	_, err = OpenStateDir(path)
+	require.ErrorContains(t, err, "is used by another vfkit process")
+
+	require.NoError(t, dir.WriteConfigFile([]byte(`{"vcpus":2}`)))
+	config, err := os.ReadFile(dir.ConfigFile())
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"vcpus":2}`, string(config))
+
+	iso, err := CreateCloudInitISOFile(path)
+	require.NoError(t, err)
+	iso.Close()
+	assert.Equal(t, path, filepath.Dir(iso.Name()))
+	clonePath, err := EphemeralDiskPath(path, "/images/disk.img")
+	require.NoError(t, err)
+	assert.Equal(t, path, filepath.Dir(clonePath))
+	socketDir, err := CreateNbdSocketDir(path)
+	require.NoError(t, err)
+	assert.Equal(t, path, filepath.Dir(socketDir))
+	extractDir, err := CreateExtractDir(path)
+	require.NoError(t, err)
+	assert.Equal(t, path, filepath.Dir(extractDir))
+	require.NoError(t, os.WriteFile(dir.PidFile(), []byte("1234"), 0600))
+	require.NoError(t, dir.Close())
+	assert.NoFileExists(t, dir.PidFile())
+}
+
+func TestStateDirCleanup(t *testing.T) {
+	path := t.TempDir()
+	// the PID of the stale files is out of the range of valid PIDs
+	stale := []string{"vfkit.pid", "rest.sock", "vfkit-cloudinit-2147483647-1234.iso", "vfkit-ephemeral-2147483647-1234-disk.img", "vfkit-7fffffff-1234.sock"}
+	staleDirs := []string{"vfkit-nbd-2147483647-1234", "vfkit-kernel-2147483647-1234"}
+	kept := []string{"config.json", "status.json", "console.log", fmt.Sprintf("vfkit-cloudinit-%d-1234.iso", os.Getpid())}
+	keptDirs := []string{fmt.Sprintf("vfkit-nbd-%d-1234", os.Getpid())}
+	for _, name := range append(stale, kept...) {
+		require.NoError(t, os.WriteFile(filepath.Join(path, name), nil, 0600))
+	}
+	for _, name := range append(staleDirs, keptDirs...) {
+		require.NoError(t, os.Mkdir(filepath.Join(path, name), 0700))
+		require.NoError(t, os.WriteFile(filepath.Join(path, name, "nbd.sock"), nil, 0600))
+	}
+
+	dir, err := OpenStateDir(path)
+	require.NoError(t, err)
+	defer dir.Close()
+	for _, name := range stale {
+		assert.NoFileExists(t, filepath.Join(path, name))
+	}
+	for _, name := range kept {
+		assert.FileExists(t, filepath.Join(path, name))
+	}
+	for _, name := range staleDirs {
+		assert.NoDirExists(t, filepath.Join(path, name))
+	}
+	for _, name := range keptDirs {
+		assert.DirExists(t, filepath.Join(path, name))
+	}
+}
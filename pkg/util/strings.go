@@ -2,9 +2,11 @@ package util
 
 import "strings"
 
+// TrimQuotes removes the double quotes surrounding str. Only one pair of
+// quotes is removed, so that quotes nested in str are preserved.
 func TrimQuotes(str string) string {
-	if strings.HasPrefix(str, `"`) && strings.HasSuffix(str, `"`) {
-		str = strings.Trim(str, `"`)
+	if len(str) >= 2 && strings.HasPrefix(str, `"`) && strings.HasSuffix(str, `"`) {
+		str = str[1 : len(str)-1]
 	}
 
 	return str
@@ -76,6 +76,20 @@ func TestTrimQuotes(t *testing.T) {
 			},
 			want: "foobar\"",
 		},
+		{
+			name: "nested quotes",
+			args: args{
+				str: "\"foo=\"bar baz\"\"",
+			},
+			want: "foo=\"bar baz\"",
+		},
+		{
+			name: "single quote",
+			args: args{
+				str: "\"",
+			},
+			want: "\"",
+		},
 		{
 			name: "no quote",
 			args: args{
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	nbdSocketDirPrefix = "vfkit-nbd"
+	extractDirPrefix   = "vfkit-kernel"
+)
+
+// CreateNbdSocketDir creates the directory of the unix socket of a NBD server
+// in dir, or in the temporary directory when dir is empty. Its name contains
+// the PID of vfkit so that OpenStateDir can remove it if vfkit does not
+// remove it when exiting.
+func CreateNbdSocketDir(dir string) (string, error) {
+	return createTempDir(dir, nbdSocketDirPrefix)
+}
+
+// CreateExtractDir creates the directory of the kernel and initrd extracted
+// from a UKI or a disk image in dir, or in the temporary directory when dir is
+// empty. Its name contains the PID of vfkit so that OpenStateDir can remove
+// it if vfkit does not remove it when exiting.
+func CreateExtractDir(dir string) (string, error) {
+	return createTempDir(dir, extractDirPrefix)
+}
+
+func createTempDir(dir string, prefix string) (string, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", fmt.Errorf("unable to create directory %s: %w", dir, err)
+		}
+	}
+	path, err := os.MkdirTemp(dir, fmt.Sprintf("%s-%d-", prefix, os.Getpid()))
+	if err != nil {
+		return "", fmt.Errorf("unable to create temporary directory: %w", err)
+	}
+	return path, nil
+}
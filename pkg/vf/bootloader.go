@@ -1,66 +1,149 @@
 package vf
 
 import (
-	"bytes"
 	"fmt"
 	"os"
 	"runtime"
 
 	"github.com/Code-Hex/vz/v3"
+	"github.com/crc-org/vfkit/pkg/bootdisk"
 	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/crc-org/vfkit/pkg/kernel"
+	"github.com/crc-org/vfkit/pkg/uki"
+	"github.com/crc-org/vfkit/pkg/util"
+	log "github.com/sirupsen/logrus"
 )
 
-// from https://github.com/h2non/filetype/blob/cfcd7d097bc4990dc8fc86187307651ae79bf9d9/matchers/document.go#L159-L174
-func compareBytes(slice, subSlice []byte, startOffset int) bool {
-	sl := len(subSlice)
-
-	if startOffset+sl > len(slice) {
-		return false
+// uncompressedKernelPath returns the path to an uncompressed version of the
+// kernel at vmlinuzPath. The virtualization framework cannot boot compressed
+// kernels on arm64, so they are transparently decompressed to vfkit's cache
+// directory.
+func uncompressedKernelPath(vmlinuzPath string) (string, error) {
+	if runtime.GOARCH != "arm64" {
+		return vmlinuzPath, nil
 	}
-
-	s := slice[startOffset : startOffset+sl]
-	return bytes.Equal(s, subSlice)
+	cacheDir, err := kernel.DefaultCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get kernel cache directory: %w", err)
+	}
+	uncompressedPath, err := kernel.Uncompressed(vmlinuzPath, cacheDir)
+	if err != nil {
+		return "", err
+	}
+	if uncompressedPath != vmlinuzPath {
+		log.Infof("Using uncompressed kernel %s for %s", uncompressedPath, vmlinuzPath)
+	}
+	return uncompressedPath, nil
 }
 
-// patterns and offsets are coming from https://github.com/file/file/blob/master/magic/Magdir/linux
-func isUncompressedArm64Kernel(buf []byte) bool {
-	pattern := []byte{0x41, 0x52, 0x4d, 0x64}
-	offset := 0x38
-
-	return compareBytes(buf, pattern, offset)
+// newExtractDir creates a directory to store the kernel and initrd extracted
+// from UKIs or disk images, in stateDir when it's set. The virtualization
+// framework reads these files when the VM starts, so the directory is kept
+// until vfkit exits.
+func newExtractDir(stateDir string) (string, error) {
+	extractDir, err := util.CreateExtractDir(stateDir)
+	if err != nil {
+		return "", err
+	}
+	util.RegisterExitHandler(func() {
+		_ = os.RemoveAll(extractDir)
+	})
+	return extractDir, nil
 }
 
-func isKernelUncompressed(filename string) (bool, error) {
-	file, err := os.Open(filename)
+// extractFromDisk replaces a bootloader using a kernel from a disk image with
+// a bootloader using the kernel and initrd extracted from this disk image
+func extractFromDisk(bootloader *config.LinuxBootloader, stateDir string) (*config.LinuxBootloader, error) {
+	extractDir, err := newExtractDir(stateDir)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	opts := bootdisk.Options{
+		Partition: bootloader.Partition,
+		Kernel:    bootloader.VmlinuzPath,
+		Initrd:    bootloader.InitrdPath,
 	}
-	defer file.Close()
+	entry, err := bootdisk.Extract(bootloader.FromDisk, opts, extractDir)
+	if err != nil {
+		return nil, err
+	}
+	cmdline, err := config.ParseKernelCmdLine(entry.CmdLine)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kernel command line in %s: %w", bootloader.FromDisk, err)
+	}
+	extraCmdLine, err := bootloader.CmdLine()
+	if err != nil {
+		return nil, err
+	}
+	cmdline.AppendCmdLine(extraCmdLine)
+	log.Infof("Using kernel %s from %s", entry.Version, bootloader.FromDisk)
 
-	buf := make([]byte, 2048)
-	_, err = file.Read(buf)
+	extracted := config.NewLinuxBootloader(entry.KernelPath, "", entry.InitrdPath)
+	extracted.SetCmdLine(cmdline)
+	extracted.AutoConsole = bootloader.AutoConsole
+	return extracted, nil
+}
+
+// kernelCmdLine returns the kernel command line to use for bootloader. When
+// autoConsole is set, the console for the serial devices of the virtual
+// machine is added to it.
+func kernelCmdLine(bootloader *config.LinuxBootloader, devices []config.VirtioDevice) (string, error) {
+	if !bootloader.AutoConsole {
+		return bootloader.KernelCmdLine, nil
+	}
+	cmdline, err := bootloader.CmdLine()
 	if err != nil {
-		return false, err
+		return "", err
 	}
-	return isUncompressedArm64Kernel(buf), nil
+	cmdline.AddConsole(devices)
+	return cmdline.String(), nil
 }
 
-func toVzLinuxBootloader(bootloader *config.LinuxBootloader) (vz.BootLoader, error) {
-	if runtime.GOARCH == "arm64" {
-		uncompressed, err := isKernelUncompressed(bootloader.VmlinuzPath)
+func toVzLinuxBootloader(bootloader *config.LinuxBootloader, devices []config.VirtioDevice, stateDir string) (vz.BootLoader, error) {
+	if bootloader.FromDisk != "" {
+		var err error
+		bootloader, err = extractFromDisk(bootloader, stateDir)
 		if err != nil {
 			return nil, err
 		}
-		if !uncompressed {
-			return nil, fmt.Errorf("kernel must be uncompressed, %s is a compressed file", bootloader.VmlinuzPath)
-		}
 	}
 
-	return vz.NewLinuxBootLoader(
-		bootloader.VmlinuzPath,
-		vz.WithCommandLine(bootloader.KernelCmdLine),
-		vz.WithInitrd(bootloader.InitrdPath),
-	)
+	vmlinuzPath, err := uncompressedKernelPath(bootloader.VmlinuzPath)
+	if err != nil {
+		return nil, err
+	}
+	cmdline, err := kernelCmdLine(bootloader, devices)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("kernel command line: %s", cmdline)
+
+	opts := []vz.LinuxBootLoaderOption{
+		vz.WithCommandLine(cmdline),
+	}
+	// UKIs and disk images are not required to provide an initrd
+	if bootloader.InitrdPath != "" {
+		opts = append(opts, vz.WithInitrd(bootloader.InitrdPath))
+	}
+
+	return vz.NewLinuxBootLoader(vmlinuzPath, opts...)
+}
+
+func toVzUKIBootloader(bootloader *config.UKIBootloader, devices []config.VirtioDevice, stateDir string) (vz.BootLoader, error) {
+	extractDir, err := newExtractDir(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	bootFiles, err := uki.Extract(bootloader.UKIPath, extractDir, bootloader.ExtraKernelCmdLine)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("extracted UKI %s to %s, kernel command line: %s", bootloader.UKIPath, extractDir, bootFiles.CmdLine)
+
+	linuxBootloader := config.NewLinuxBootloader(bootFiles.KernelPath, bootFiles.CmdLine, bootFiles.InitrdPath)
+	linuxBootloader.AutoConsole = bootloader.AutoConsole
+	return toVzLinuxBootloader(linuxBootloader, devices, stateDir)
 }
 
 func toVzEFIBootloader(bootloader *config.EFIBootloader) (vz.BootLoader, error) {
@@ -81,12 +164,18 @@ func toVzEFIBootloader(bootloader *config.EFIBootloader) (vz.BootLoader, error)
 	)
 }
 
-func toVzBootloader(bootloader config.Bootloader) (vz.BootLoader, error) {
+// toVzBootloader converts bootloader to a vz bootloader. devices are the
+// devices of the virtual machine, they are used by Linux bootloaders with
+// autoConsole. The kernels extracted from UKIs and disk images are stored in
+// stateDir when it's set.
+func toVzBootloader(bootloader config.Bootloader, devices []config.VirtioDevice, stateDir string) (vz.BootLoader, error) {
 	switch b := bootloader.(type) {
 	case *config.LinuxBootloader:
-		return toVzLinuxBootloader(b)
+		return toVzLinuxBootloader(b, devices, stateDir)
 	case *config.EFIBootloader:
 		return toVzEFIBootloader(b)
+	case *config.UKIBootloader:
+		return toVzUKIBootloader(b, devices, stateDir)
 	case *config.MacOSBootloader:
 		return toVzMacOSBootloader(b)
 	default:
@@ -0,0 +1,52 @@
+package vf
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/crc-org/vfkit/pkg/cloudinit"
+	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/crc-org/vfkit/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// createCloudInitISO generates a temporary ISO image with the cloud-init
+// configuration, which is removed when vfkit exits
+func createCloudInitISO(vmConfig *config.VirtualMachine) (string, error) {
+	files, err := vmConfig.CloudInitConfigFiles()
+	if err != nil {
+		return "", err
+	}
+	isoFile, err := util.CreateCloudInitISOFile(vmConfig.StateDir)
+	if err != nil {
+		return "", err
+	}
+	// register handler to remove isoFile when exiting
+	util.RegisterExitHandler(func() {
+		os.Remove(isoFile.Name()) //#nosec G703 -- filename is created in `CreateCloudInitISOFile` from the state directory, constants and random strings
+	})
+	if err := cloudinit.WriteISO(isoFile, files); err != nil {
+		_ = isoFile.Close()
+		return "", err
+	}
+	if err := isoFile.Close(); err != nil {
+		return "", fmt.Errorf("failed to close cloud-init ISO file: %w", err)
+	}
+	return isoFile.Name(), nil
+}
+
+// addCloudInitDevice attaches the cloud-init configuration of the virtual
+// machine as a read-only virtio-blk device
+func (cfg *VirtualMachineConfiguration) addCloudInitDevice() error {
+	isoPath, err := createCloudInitISO(cfg.config)
+	if err != nil {
+		return err
+	}
+	dev, err := config.VirtioBlkNew(isoPath)
+	if err != nil {
+		return err
+	}
+	dev.ReadOnly = true
+	log.Infof("Adding cloud-init configuration (imagePath: %s)", isoPath)
+	return (*VirtioBlk)(dev).AddToVirtualMachineConfig(cfg)
+}
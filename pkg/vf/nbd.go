@@ -0,0 +1,104 @@
+package vf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Code-Hex/vz/v3"
+	"github.com/crc-org/vfkit/pkg/diskimage"
+	"github.com/crc-org/vfkit/pkg/nbd"
+	"github.com/crc-org/vfkit/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	nbdExportName = "disk"
+	nbdTimeout    = 15 * time.Second
+)
+
+// serveNbdImage starts a NBD server exporting the disk image at imagePath on
+// a private unix socket, and returns the nbd+unix:// URI to connect to it.
+// The socket is created in stateDir when it's set and short enough, in a
+// temporary directory otherwise. The server is stopped and the socket is
+// removed when vfkit exits.
+func serveNbdImage(imagePath string, readOnly bool, stateDir string) (string, error) {
+	img, err := nbd.OpenImage(imagePath, readOnly)
+	if err != nil {
+		return "", err
+	}
+	if len(stateDir)+len("/vfkit-nbd-4294967295-4294967295/nbd.sock") >= maxUnixgramPathLen {
+		stateDir = ""
+	}
+	socketDir, err := util.CreateNbdSocketDir(stateDir)
+	if err != nil {
+		_ = img.Close()
+		return "", err
+	}
+	socketPath := filepath.Join(socketDir, "nbd.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		_ = img.Close()
+		_ = os.RemoveAll(socketDir)
+		return "", err
+	}
+
+	server := nbd.NewServer(nbd.Export{Name: nbdExportName, Device: img, ReadOnly: readOnly})
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Errorf("NBD server for %s failed: %v", imagePath, err)
+		}
+	}()
+	util.RegisterExitHandler(func() {
+		if err := server.Close(); err != nil {
+			log.Debugf("failed to stop NBD server for %s: %v", imagePath, err)
+		}
+		if err := img.Sync(); err != nil {
+			log.Errorf("failed to sync %s: %v", imagePath, err)
+		}
+		_ = img.Close()
+		_ = os.RemoveAll(socketDir)
+	})
+
+	uri := url.URL{
+		Scheme:   "nbd+unix",
+		Path:     "/" + nbdExportName,
+		RawQuery: url.Values{"socket": []string{socketPath}}.Encode(),
+	}
+	log.Infof("Serving %s over NBD at %s", imagePath, uri.String())
+	return uri.String(), nil
+}
+
+// nbdImageAttachment returns an attachment to the disk image served by the
+// built-in NBD server
+func (conf *DiskStorageConfig) nbdImageAttachment(stateDir string) (vz.StorageDeviceAttachment, error) {
+	if conf.ImagePath == "" {
+		return nil, fmt.Errorf("missing mandatory 'path' option for %s device", conf.DevName)
+	}
+	syncMode, err := conf.synchronizationModeVZ()
+	if err != nil {
+		return nil, err
+	}
+	// the backing files of qcow2 images are only read, other vfkit
+	// instances can use them as well
+	if !conf.NoLock {
+		chain, err := diskimage.BackingChain(conf.ImagePath)
+		if err != nil {
+			return nil, err
+		}
+		for _, backingPath := range chain {
+			if err := lockDiskImage(backingPath, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+	uri, err := serveNbdImage(conf.ImagePath, conf.ReadOnly, stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serve %s over NBD: %w", conf.ImagePath, err)
+	}
+	return vz.NewNetworkBlockDeviceStorageDeviceAttachment(uri, nbdTimeout, conf.ReadOnly, syncMode)
+}
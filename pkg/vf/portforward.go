@@ -0,0 +1,102 @@
+package vf
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/crc-org/vfkit/pkg/portforward"
+	"github.com/crc-org/vfkit/pkg/usernet"
+	log "github.com/sirupsen/logrus"
+)
+
+// PortForwards returns the manager of the port forwards of the virtual
+// machine
+func (vm *VirtualMachine) PortForwards() *portforward.Manager {
+	return vm.forwards
+}
+
+// AddPortForward starts forwarding the host port of spec to the guest. The
+// connections to a guest address go through the userspace network stack of
+// the 'usermode' device whose subnet contains it, or are made from the host
+// for the other networks. The guest address can only be omitted with a
+// 'usermode' device.
+func (vm *VirtualMachine) AddPortForward(spec portforward.Spec) (portforward.Status, error) {
+	if err := spec.Validate(); err != nil {
+		return portforward.Status{}, err
+	}
+	dial, err := vm.portForwardDialer(spec)
+	if err != nil {
+		return portforward.Status{}, err
+	}
+	status, err := vm.forwards.Add(spec, dial)
+	if err != nil {
+		return portforward.Status{}, err
+	}
+	log.Infof("forwarding %s", &status.Spec)
+	return status, nil
+}
+
+func (vm *VirtualMachine) portForwardDialer(spec portforward.Spec) (portforward.DialFunc, error) {
+	if spec.VsockPort != 0 {
+		if len(vm.Config().VirtioVsockDevices()) != 1 {
+			return nil, fmt.Errorf("forwarding to vsock port %d requires a single virtio-vsock device", spec.VsockPort)
+		}
+		return func(context.Context) (net.Conn, error) {
+			return ConnectVsockSync(vm, spec.VsockPort)
+		}, nil
+	}
+
+	guest, err := spec.GuestAddressPort()
+	if err != nil {
+		return nil, err
+	}
+	for _, stack := range vm.vfConfig.networkStacks {
+		if stack != nil && (guest.Addr().IsUnspecified() || stack.Subnet().Contains(guest.Addr())) {
+			return stackDialer(stack, spec), nil
+		}
+	}
+	if guest.Addr().IsUnspecified() {
+		return nil, fmt.Errorf("the guest address of port forward %s must be set, the virtual machine has no 'usermode' virtio-net device", &spec)
+	}
+	return func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, spec.Protocol, guest.String())
+	}, nil
+}
+
+// stackDialer returns a function connecting to the guest end of spec through
+// a userspace network stack
+func stackDialer(stack *usernet.Stack, spec portforward.Spec) portforward.DialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		guest, err := spec.GuestAddressPort()
+		if err != nil {
+			return nil, err
+		}
+		if spec.Protocol == "udp" {
+			return stack.DialUDP(guest)
+		}
+		return stack.DialTCP(ctx, guest)
+	}
+}
+
+// addConfigPortForwards starts the port forwards of the 'usermode' virtio-net
+// devices of the configuration
+func (vm *VirtualMachine) addConfigPortForwards() error {
+	for i, dev := range vm.Config().VirtioNetDevices() {
+		for _, forward := range dev.Forwards {
+			spec := portforward.Spec{
+				Protocol:    forward.Protocol,
+				HostAddress: forward.HostAddress,
+				HostPort:    forward.HostPort,
+				GuestPort:   forward.GuestPort,
+			}
+			status, err := vm.forwards.Add(spec, stackDialer(vm.vfConfig.networkStacks[i], spec))
+			if err != nil {
+				return err
+			}
+			log.Infof("forwarding %s", &status.Spec)
+		}
+	}
+	return nil
+}
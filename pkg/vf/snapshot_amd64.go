@@ -0,0 +1,13 @@
+package vf
+
+import (
+	"fmt"
+)
+
+func (vm *VirtualMachine) SaveState(_ string) error {
+	return fmt.Errorf("saving the virtual machine state is only supported on ARM devices")
+}
+
+func (vm *VirtualMachine) RestoreState(_ string) error {
+	return fmt.Errorf("restoring the virtual machine state is only supported on ARM devices")
+}
@@ -0,0 +1,35 @@
+package vf
+
+import (
+	"fmt"
+)
+
+func (vm *VirtualMachine) validateSaveRestoreSupport() error {
+	supported, err := vm.vfConfig.ValidateSaveRestoreSupport()
+	if err != nil {
+		return err
+	}
+	if !supported {
+		return fmt.Errorf("the virtual machine configuration does not support saving its state")
+	}
+	return nil
+}
+
+// SaveState saves the state of the paused virtual machine to path. This
+// requires macOS 14 or newer.
+func (vm *VirtualMachine) SaveState(path string) error {
+	if err := vm.validateSaveRestoreSupport(); err != nil {
+		return err
+	}
+	return vm.SaveMachineStateToPath(path)
+}
+
+// RestoreState restores the state saved in path by SaveState. The virtual
+// machine must be stopped, and it's paused after the restore. This requires
+// macOS 14 or newer.
+func (vm *VirtualMachine) RestoreState(path string) error {
+	if err := vm.validateSaveRestoreSupport(); err != nil {
+		return err
+	}
+	return vm.RestoreMachineStateFromURL(path)
+}
@@ -1,6 +1,7 @@
 package vf
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
@@ -8,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/crc-org/vfkit/pkg/diskimage"
 	"github.com/crc-org/vfkit/pkg/util"
 	"golang.org/x/sys/unix"
 
@@ -36,9 +38,9 @@ type vzNetworkBlockDevice struct {
 	config *NetworkBlockDevice
 }
 
-func (dev *NVMExpressController) toVz() (vz.StorageDeviceConfiguration, error) {
+func (dev *NVMExpressController) toVz(stateDir string) (vz.StorageDeviceConfiguration, error) {
 	var storageConfig = DiskStorageConfig(dev.DiskStorageConfig)
-	attachment, err := storageConfig.toVz()
+	attachment, err := storageConfig.toVz(stateDir)
 	if err != nil {
 		return nil, err
 	}
@@ -51,7 +53,7 @@ func (dev *NVMExpressController) toVz() (vz.StorageDeviceConfiguration, error) {
 }
 
 func (dev *NVMExpressController) AddToVirtualMachineConfig(vmConfig *VirtualMachineConfiguration) error {
-	storageDeviceConfig, err := dev.toVz()
+	storageDeviceConfig, err := dev.toVz(vmConfig.config.StateDir)
 	if err != nil {
 		return err
 	}
@@ -61,9 +63,28 @@ func (dev *NVMExpressController) AddToVirtualMachineConfig(vmConfig *VirtualMach
 	return nil
 }
 
-func (dev *VirtioBlk) toVz() (vz.StorageDeviceConfiguration, error) {
+// toVz converts the device to a vz storage device, its ephemeral clone and NBD
+// socket are created in stateDir when it's set
+func (dev *VirtioBlk) toVz(stateDir string) (vz.StorageDeviceConfiguration, error) {
 	var storageConfig = DiskStorageConfig(dev.DiskStorageConfig)
-	attachment, err := storageConfig.toVz()
+	if dev.Ephemeral {
+		if dev.Type == config.DiskBackendBlockDevice {
+			return nil, fmt.Errorf("'ephemeral' can only be used with disk images")
+		}
+		// the disk image is only read, but a qcow2 clone keeps using it
+		// as its backing file
+		if dev.ImagePath != "" && !dev.NoLock {
+			if err := lockDiskImage(dev.ImagePath, true); err != nil {
+				return nil, err
+			}
+		}
+		clonePath, err := cloneEphemeralDisk(dev.ImagePath, stateDir)
+		if err != nil {
+			return nil, err
+		}
+		storageConfig.ImagePath = clonePath
+	}
+	attachment, err := storageConfig.toVz(stateDir)
 	if err != nil {
 		return nil, err
 	}
@@ -82,8 +103,49 @@ func (dev *VirtioBlk) toVz() (vz.StorageDeviceConfiguration, error) {
 	return devConfig, nil
 }
 
+// cloneEphemeralDisk creates a copy-on-write clone of the disk image at
+// imagePath in stateDir, or in a temporary directory when it's empty. The
+// clone is removed when vfkit exits.
+func cloneEphemeralDisk(imagePath string, stateDir string) (string, error) {
+	if imagePath == "" {
+		return "", fmt.Errorf("missing mandatory 'path' option for ephemeral virtio-blk device")
+	}
+	clonePath, err := util.EphemeralDiskPath(stateDir, imagePath)
+	if err != nil {
+		return "", err
+	}
+	if err := diskimage.Clone(imagePath, clonePath); err != nil {
+		return "", fmt.Errorf("failed to create ephemeral clone of %s: %w", imagePath, err)
+	}
+	util.RegisterExitHandler(func() {
+		if err := os.Remove(clonePath); err != nil {
+			log.Warnf("failed to remove ephemeral disk %s: %v", clonePath, err)
+		}
+	})
+	log.Infof("Using ephemeral clone %s of %s", clonePath, imagePath)
+	return clonePath, nil
+}
+
+// lockDiskImage takes an advisory lock on the disk image or block device at
+// imagePath, shared when readOnly is true, exclusive otherwise, to prevent
+// other vfkit instances from writing to it at the same time. The lock is
+// released when vfkit exits.
+func lockDiskImage(imagePath string, readOnly bool) error {
+	lock, err := diskimage.Lock(imagePath, readOnly)
+	if errors.Is(err, diskimage.ErrLocked) {
+		return fmt.Errorf("%w, use the 'lock=off' option to use it anyway", err)
+	}
+	if err != nil {
+		return err
+	}
+	util.RegisterExitHandler(func() {
+		_ = lock.Unlock()
+	})
+	return nil
+}
+
 func (dev *VirtioBlk) AddToVirtualMachineConfig(vmConfig *VirtualMachineConfiguration) error {
-	storageDeviceConfig, err := dev.toVz()
+	storageDeviceConfig, err := dev.toVz(vmConfig.config.StateDir)
 	if err != nil {
 		return err
 	}
@@ -495,14 +557,27 @@ func AddToVirtualMachineConfig(vmConfig *VirtualMachineConfiguration, dev config
 	}
 }
 
-func (conf *DiskStorageConfig) toVz() (vz.StorageDeviceAttachment, error) {
+// toVz converts the disk to a vz attachment, the socket of the NBD server of
+// 'nbd' disks is created in stateDir when it's set
+func (conf *DiskStorageConfig) toVz(stateDir string) (vz.StorageDeviceAttachment, error) {
+	if conf.ImagePath != "" && !conf.NoLock {
+		if err := lockDiskImage(conf.ImagePath, conf.ReadOnly); err != nil {
+			return nil, err
+		}
+	}
 	switch conf.Type {
 	case config.DiskBackendImage, config.DiskBackendDefault:
 		if conf.ImagePath == "" {
 			return nil, fmt.Errorf("missing mandatory 'path' option for %s device", conf.DevName)
 		}
-		syncMode := vz.DiskImageSynchronizationModeFsync
-		caching := vz.DiskImageCachingModeCached
+		caching, err := conf.cachingModeVZ()
+		if err != nil {
+			return nil, err
+		}
+		syncMode, err := conf.imageSynchronizationModeVZ()
+		if err != nil {
+			return nil, err
+		}
 		return vz.NewDiskImageStorageDeviceAttachmentWithCacheAndSync(conf.ImagePath, conf.ReadOnly, caching, syncMode)
 	case config.DiskBackendBlockDevice:
 		var stat unix.Stat_t
@@ -517,6 +592,11 @@ func (conf *DiskStorageConfig) toVz() (vz.StorageDeviceAttachment, error) {
 			return nil, fmt.Errorf("file %s is not a block device", conf.ImagePath)
 		}
 
+		syncMode, err := conf.synchronizationModeVZ()
+		if err != nil {
+			return nil, err
+		}
+
 		var open_flags int
 		if conf.ReadOnly {
 			open_flags = os.O_RDONLY
@@ -529,7 +609,6 @@ func (conf *DiskStorageConfig) toVz() (vz.StorageDeviceAttachment, error) {
 			return nil, fmt.Errorf("error opening file: %v", err)
 		}
 
-		syncMode := vz.DiskSynchronizationModeFull
 		attachment, err := vz.NewDiskBlockDeviceStorageDeviceAttachment(f, conf.ReadOnly, syncMode)
 		if err != nil {
 			_ = f.Close()
@@ -540,14 +619,60 @@ func (conf *DiskStorageConfig) toVz() (vz.StorageDeviceAttachment, error) {
 		})
 
 		return attachment, nil
+	case config.DiskBackendNBD:
+		return conf.nbdImageAttachment(stateDir)
 	default:
 		return nil, fmt.Errorf("unknown disk backend type: %v", conf.Type)
 	}
 }
 
-func (dev *USBMassStorage) toVz() (vz.StorageDeviceConfiguration, error) {
+// cachingModeVZ returns the caching mode of disk image attachments
+func (conf *DiskStorageConfig) cachingModeVZ() (vz.DiskImageCachingMode, error) {
+	switch conf.CachingMode {
+	case config.DiskCachingAutomatic:
+		return vz.DiskImageCachingModeAutomatic, nil
+	case config.DiskCachingCached, config.DiskCachingDefault:
+		return vz.DiskImageCachingModeCached, nil
+	case config.DiskCachingUncached:
+		return vz.DiskImageCachingModeUncached, nil
+	default:
+		return 0, fmt.Errorf("unknown disk caching mode: %s", conf.CachingMode)
+	}
+}
+
+// imageSynchronizationModeVZ returns the synchronization mode of disk image
+// attachments
+func (conf *DiskStorageConfig) imageSynchronizationModeVZ() (vz.DiskImageSynchronizationMode, error) {
+	switch conf.SynchronizationMode {
+	case config.DiskSynchronizationFull:
+		return vz.DiskImageSynchronizationModeFull, nil
+	case config.DiskSynchronizationFsync, config.DiskSynchronizationDefault:
+		return vz.DiskImageSynchronizationModeFsync, nil
+	case config.DiskSynchronizationNone:
+		return vz.DiskImageSynchronizationModeNone, nil
+	default:
+		return 0, fmt.Errorf("unknown disk synchronization mode: %s", conf.SynchronizationMode)
+	}
+}
+
+// synchronizationModeVZ returns the synchronization mode of block device and
+// network block device attachments, which don't support fsync
+func (conf *DiskStorageConfig) synchronizationModeVZ() (vz.DiskSynchronizationMode, error) {
+	switch conf.SynchronizationMode {
+	case config.DiskSynchronizationFull, config.DiskSynchronizationDefault:
+		return vz.DiskSynchronizationModeFull, nil
+	case config.DiskSynchronizationNone:
+		return vz.DiskSynchronizationModeNone, nil
+	case config.DiskSynchronizationFsync:
+		return 0, fmt.Errorf("'sync=fsync' can only be used with disk images")
+	default:
+		return 0, fmt.Errorf("unknown disk synchronization mode: %s", conf.SynchronizationMode)
+	}
+}
+
+func (dev *USBMassStorage) toVz(stateDir string) (vz.StorageDeviceConfiguration, error) {
 	var storageConfig = DiskStorageConfig(dev.DiskStorageConfig)
-	attachment, err := storageConfig.toVz()
+	attachment, err := storageConfig.toVz(stateDir)
 	if err != nil {
 		return nil, err
 	}
@@ -555,7 +680,7 @@ func (dev *USBMassStorage) toVz() (vz.StorageDeviceConfiguration, error) {
 }
 
 func (dev *USBMassStorage) AddToVirtualMachineConfig(vmConfig *VirtualMachineConfiguration) error {
-	storageDeviceConfig, err := dev.toVz()
+	storageDeviceConfig, err := dev.toVz(vmConfig.config.StateDir)
 	if err != nil {
 		return err
 	}
@@ -9,6 +9,9 @@ import (
 	"syscall"
 
 	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/crc-org/vfkit/pkg/netrelay"
+	"github.com/crc-org/vfkit/pkg/pcap"
+	"github.com/crc-org/vfkit/pkg/usernet"
 	"github.com/crc-org/vfkit/pkg/util"
 
 	"github.com/Code-Hex/vz/v3"
@@ -18,6 +21,10 @@ import (
 type VirtioNet struct {
 	*config.VirtioNet
 	localAddr *net.UnixAddr
+	// capture is set when vfkit relays the frames of the device
+	capture *pcap.Capture
+	// stack is the userspace network stack of 'usermode' devices
+	stack *usernet.Stack
 }
 
 func localUnixSocketPath(dir string) (string, error) {
@@ -46,13 +53,20 @@ func localUnixSocketPath(dir string) (string, error) {
 // path for unixgram sockets must be less than 104 bytes on macOS
 const maxUnixgramPathLen = 104
 
-func (dev *VirtioNet) connectUnixPath() error {
+// connectUnixPath connects the device to the unixgram socket at
+// dev.UnixSocketPath, from a socket created in stateDir when it's set and
+// short enough, or next to the remote socket otherwise
+func (dev *VirtioNet) connectUnixPath(stateDir string) error {
 
 	remoteAddr := net.UnixAddr{
 		Name: dev.UnixSocketPath,
 		Net:  "unixgram",
 	}
-	localSocketPath, err := localUnixSocketPath(filepath.Dir(dev.UnixSocketPath))
+	socketDir := filepath.Dir(dev.UnixSocketPath)
+	if stateDir != "" && len(stateDir)+len("/vfkit-ffffffff-ffff.sock") < maxUnixgramPathLen {
+		socketDir = stateDir
+	}
+	localSocketPath, err := localUnixSocketPath(socketDir)
 	if err != nil {
 		return err
 	}
@@ -114,17 +128,131 @@ func (dev *VirtioNet) connectUnixPath() error {
 	return nil
 }
 
-func (dev *VirtioNet) toVz() (*vz.VirtioNetworkDeviceConfiguration, error) {
-	var (
-		mac *vz.MACAddress
-		err error
-	)
+// relayToSocket relays the frames between the virtual machine and the
+// connected datagram socket of the device, so that they can be captured
+func (dev *VirtioNet) relayToSocket() error {
+	peerConn, err := net.FileConn(dev.Socket)
+	if err != nil {
+		return err
+	}
+	if err := dev.Socket.Close(); err != nil {
+		log.Debugf("failed to close fd %d: %v", dev.Socket.Fd(), err)
+	}
+	dev.Socket = nil
+	return dev.relay(netrelay.NewDatagramConn(peerConn), fmt.Sprint(peerConn.RemoteAddr()))
+}
 
-	if len(dev.MacAddress) == 0 {
-		mac, err = vz.NewRandomLocallyAdministeredMACAddress()
-	} else {
-		mac, err = vz.NewMACAddress(dev.MacAddress)
+// relay creates the datagram socketpair used by the virtual machine, and
+// relays its frames to peer. The frames are captured when the Capture option
+// is set, or when a capture is started with the REST API.
+func (dev *VirtioNet) relay(peer netrelay.Conn, peerName string) error {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		peer.Close()
+		return err
 	}
+	for _, fd := range fds {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, 1*1024*1024); err != nil {
+			log.Debugf("failed to set socket send buffer size: %v", err)
+		}
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4*1024*1024); err != nil {
+			log.Debugf("failed to set socket receive buffer size: %v", err)
+		}
+	}
+	vmSocket := os.NewFile(uintptr(fds[0]), "vfkit virtio-net socket")
+	relayFile := os.NewFile(uintptr(fds[1]), "vfkit virtio-net relay socket")
+	// net.FileConn duplicates the file descriptor
+	relayConn, err := net.FileConn(relayFile)
+	relayFile.Close()
+	if err != nil {
+		vmSocket.Close()
+		peer.Close()
+		return err
+	}
+
+	dev.capture = &pcap.Capture{}
+	if dev.Capture != nil {
+		log.Infof("capturing virtio-net frames to %s", dev.Capture.Path)
+		if err := dev.capture.Start(dev.Capture.Path, CaptureOptions(dev.Capture)); err != nil {
+			vmSocket.Close()
+			relayConn.Close()
+			peer.Close()
+			return err
+		}
+		util.RegisterExitHandler(func() { _ = dev.capture.Stop() })
+	}
+
+	go func() {
+		vmConn := netrelay.Tap(netrelay.NewDatagramConn(relayConn), dev.capture.WritePacket)
+		if err := netrelay.Relay(vmConn, peer); err != nil {
+			log.Errorf("virtio-net relay to %s stopped: %v", peerName, err)
+			return
+		}
+		log.Infof("virtio-net relay to %s stopped", peerName)
+	}()
+
+	dev.Socket = vmSocket
+	return nil
+}
+
+// CaptureOptions returns the rotation options of the capture files of
+// capture
+func CaptureOptions(capture *config.PacketCapture) pcap.Options {
+	return pcap.Options{
+		MaxSize:  int64(capture.MaxSize), // #nosec G115 -- sizes are smaller than 8EiB
+		MaxFiles: capture.MaxFiles,
+	}
+}
+
+// connectUnixStream connects to the stream socket at UnixSocketPath, and
+// relays the frames of the virtual machine between a datagram socketpair and
+// this connection
+func (dev *VirtioNet) connectUnixStream() error {
+	streamConn, err := net.Dial("unix", dev.UnixSocketPath)
+	if err != nil {
+		return err
+	}
+	log.Infof("relaying virtio-net frames to stream socket %s", dev.UnixSocketPath)
+	if err := dev.relay(netrelay.NewStreamConn(streamConn), dev.UnixSocketPath); err != nil {
+		return err
+	}
+	dev.UnixSocketPath = ""
+	return nil
+}
+
+// connectUsermode relays the frames of the virtual machine between a datagram
+// socketpair and the userspace network stack of vfkit
+func (dev *VirtioNet) connectUsermode() error {
+	stack, err := usernet.New(usernet.Config{GuestMAC: dev.MacAddress})
+	if err != nil {
+		return err
+	}
+	log.Infof("using the userspace network stack (gateway: %s, guest: %s, host: %s)", stack.Gateway(), stack.GuestIP(), stack.HostAddr())
+	if err := dev.relay(stack, "the userspace network stack"); err != nil {
+		stack.Close()
+		return err
+	}
+	dev.stack = stack
+	return nil
+}
+
+// generateMACAddress sets a random MAC address when the device doesn't have
+// one. The generated cloud-init network-config and the DHCP server of the
+// userspace network stack need the MAC address of the device.
+func (dev *VirtioNet) generateMACAddress() error {
+	if len(dev.MacAddress) != 0 {
+		return nil
+	}
+	mac, err := vz.NewRandomLocallyAdministeredMACAddress()
+	if err != nil {
+		return err
+	}
+	dev.MacAddress = mac.HardwareAddr()
+	return nil
+}
+
+func (dev *VirtioNet) toVz() (*vz.VirtioNetworkDeviceConfiguration, error) {
+	mac, err := vz.NewMACAddress(dev.MacAddress)
 	if err != nil {
 		return nil, err
 	}
@@ -147,13 +275,38 @@ func (dev *VirtioNet) toVz() (*vz.VirtioNetworkDeviceConfiguration, error) {
 }
 
 func (dev *VirtioNet) AddToVirtualMachineConfig(vmConfig *VirtualMachineConfiguration) error {
+	if err := dev.generateMACAddress(); err != nil {
+		return err
+	}
 	log.Infof("Adding virtio-net device (nat: %t macAddress: [%s])", dev.Nat, dev.MacAddress)
 	if dev.Socket != nil {
 		log.Infof("Using fd %d", dev.Socket.Fd())
 	}
 	if dev.UnixSocketPath != "" {
 		log.Infof("Using unix socket %s", dev.UnixSocketPath)
-		if err := dev.connectUnixPath(); err != nil {
+		connect := func() error { return dev.connectUnixPath(vmConfig.config.StateDir) }
+		if dev.Type == config.VirtioNetUnixstream {
+			connect = dev.connectUnixStream
+		}
+		if err := connect(); err != nil {
+			return err
+		}
+	}
+	if dev.Type == config.VirtioNetUsermode {
+		// the userspace network stacks would use the same subnet
+		for _, stack := range vmConfig.networkStacks {
+			if stack != nil {
+				return fmt.Errorf("only one virtio-net device can use the '%s' type", config.VirtioNetUsermode)
+			}
+		}
+		if err := dev.connectUsermode(); err != nil {
+			return err
+		}
+	}
+	if dev.Socket != nil && dev.capture == nil && (dev.Capture != nil || dev.RuntimeCapture) {
+		// the frames of unixgram and fd devices are only relayed when
+		// they are captured, or can be captured with the REST API
+		if err := dev.relayToSocket(); err != nil {
 			return err
 		}
 	}
@@ -166,6 +319,8 @@ func (dev *VirtioNet) AddToVirtualMachineConfig(vmConfig *VirtualMachineConfigur
 	}
 
 	vmConfig.networkDevicesConfiguration = append(vmConfig.networkDevicesConfiguration, netConfig)
+	vmConfig.networkCaptures = append(vmConfig.networkCaptures, dev.capture)
+	vmConfig.networkStacks = append(vmConfig.networkStacks, dev.stack)
 
 	return nil
 }
@@ -184,3 +339,17 @@ func (dev *VirtioNet) Shutdown() {
 		}
 	}
 }
+
+// NetworkCapture returns the packet capture of the virtio-net device at
+// index, in the order of the virtio-net devices of the configuration. Only
+// the devices whose frames are relayed by vfkit can be captured.
+func (vm *VirtualMachine) NetworkCapture(index int) (*pcap.Capture, error) {
+	captures := vm.vfConfig.networkCaptures
+	if index < 0 || index >= len(captures) {
+		return nil, fmt.Errorf("invalid virtio-net device: %d", index)
+	}
+	if captures[index] == nil {
+		return nil, fmt.Errorf("the frames of virtio-net device %d can't be captured, it must use the 'pcap' or 'capture' option, or the 'unixstream' or 'usermode' type", index)
+	}
+	return captures[index], nil
+}
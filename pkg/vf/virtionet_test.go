@@ -27,7 +27,7 @@ func sourceSocketPath(t *testing.T, sourcePathLen int) (string, func()) {
 	return unixSocketPath, func() { os.RemoveAll(subDir) }
 
 }
-func testConnectUnixgram(t *testing.T, sourcePathLen int) error {
+func testConnectUnixgram(t *testing.T, sourcePathLen int, stateDir string) (*VirtioNet, error) {
 	unixSocketPath, closer := sourceSocketPath(t, sourcePathLen)
 	defer closer()
 
@@ -40,28 +40,39 @@ func testConnectUnixgram(t *testing.T, sourcePathLen int) error {
 	defer l.Close()
 
 	dev := &VirtioNet{
-		&config.VirtioNet{
+		VirtioNet: &config.VirtioNet{
 			UnixSocketPath: unixSocketPath,
 		},
-		&net.UnixAddr{},
+		localAddr: &net.UnixAddr{},
 	}
 
-	return dev.connectUnixPath()
+	return dev, dev.connectUnixPath(stateDir)
 }
 
 func TestConnectUnixPath(t *testing.T) {
 	t.Run("Successful connection - no error", func(t *testing.T) {
 		// 50 is an arbitrary number, small enough for the 104 bytes limit not to be exceeded
-		err := testConnectUnixgram(t, 50)
+		_, err := testConnectUnixgram(t, 50, "")
 		require.NoError(t, err)
 	})
 
 	t.Run("Failed connection - End socket longer than 104 bytes", func(t *testing.T) {
-		err := testConnectUnixgram(t, maxUnixgramPathLen)
+		_, err := testConnectUnixgram(t, maxUnixgramPathLen, "")
 		// It should return an error
 		require.Error(t, err)
 		require.ErrorContains(t, err, "is too long")
 	})
+
+	t.Run("State directory - End socket created in it", func(t *testing.T) {
+		stateDir, err := os.MkdirTemp("/tmp", "vfkit-state")
+		require.NoError(t, err)
+		defer os.RemoveAll(stateDir)
+		// the state directory is short enough for the local socket, even
+		// if the directory of the source socket is not
+		dev, err := testConnectUnixgram(t, maxUnixgramPathLen, stateDir)
+		require.NoError(t, err)
+		require.Equal(t, stateDir, filepath.Dir(dev.localAddr.Name))
+	})
 }
 
 func TestLocalUnixSocketPath(t *testing.T) {
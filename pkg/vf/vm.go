@@ -12,16 +12,51 @@ import (
 
 	"github.com/Code-Hex/vz/v3"
 	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/crc-org/vfkit/pkg/pcap"
+	"github.com/crc-org/vfkit/pkg/portforward"
+	"github.com/crc-org/vfkit/pkg/snapshot"
+	"github.com/crc-org/vfkit/pkg/usernet"
+	"github.com/crc-org/vfkit/pkg/util"
 )
 
 type VirtualMachine struct {
 	*vz.VirtualMachine
 	vfConfig *VirtualMachineConfiguration
+	forwards *portforward.Manager
+	// hardware is computed from the configuration before the virtual
+	// machine is created, which changes the devices
+	hardware snapshot.Hardware
+	// machineIdentifier is the data representation of the generic machine
+	// identifier, nil with the macOS bootloader
+	machineIdentifier []byte
 }
 
 var PlatformType string
 
 func NewVirtualMachine(vmConfig config.VirtualMachine) (*VirtualMachine, error) {
+	return newVirtualMachine(vmConfig, nil)
+}
+
+// NewRestoredVirtualMachine creates a virtual machine whose state will be
+// restored from a state file. The virtual machine reuses the machine
+// identifier and the MAC addresses generated for the saved virtual machine.
+func NewRestoredVirtualMachine(vmConfig config.VirtualMachine, generated snapshot.Generated) (*VirtualMachine, error) {
+	return newVirtualMachine(vmConfig, &generated)
+}
+
+func newVirtualMachine(vmConfig config.VirtualMachine, generated *snapshot.Generated) (*VirtualMachine, error) {
+	hardware, err := snapshot.NewHardware(&vmConfig)
+	if err != nil {
+		return nil, err
+	}
+	var machineIdentifier []byte
+	if generated != nil {
+		if err := generated.Apply(&vmConfig); err != nil {
+			return nil, err
+		}
+		machineIdentifier = generated.MachineIdentifier
+	}
+
 	vfConfig, err := NewVirtualMachineConfiguration(&vmConfig)
 	if err != nil {
 		return nil, err
@@ -41,10 +76,11 @@ func NewVirtualMachine(vmConfig config.VirtualMachine) (*VirtualMachine, error)
 
 		vfConfig.SetPlatformVirtualMachineConfiguration(platformConfig)
 	} else {
-		platformConfig, err := NewGenericPlatformConfiguration(vmConfig)
+		platformConfig, err := newGenericPlatformConfiguration(vmConfig, machineIdentifier)
 		if err != nil {
 			return nil, fmt.Errorf("error creating generic platform configuration: %v", err)
 		}
+		machineIdentifier = platformConfig.MachineIdentifier().DataRepresentation()
 
 		PlatformType = "linux"
 
@@ -52,11 +88,18 @@ func NewVirtualMachine(vmConfig config.VirtualMachine) (*VirtualMachine, error)
 	}
 
 	vm := &VirtualMachine{
-		vfConfig: vfConfig,
+		vfConfig:          vfConfig,
+		forwards:          portforward.NewManager(),
+		hardware:          hardware,
+		machineIdentifier: machineIdentifier,
 	}
 	if err := vm.toVz(); err != nil {
 		return nil, err
 	}
+	util.RegisterExitHandler(func() { _ = vm.forwards.Close() })
+	if err := vm.addConfigPortForwards(); err != nil {
+		return nil, err
+	}
 	return vm, nil
 }
 
@@ -78,6 +121,18 @@ func (vm *VirtualMachine) Config() *config.VirtualMachine {
 	return vm.vfConfig.config
 }
 
+// Hardware returns the hardware configuration of the virtual machine, as it
+// was before the virtual machine was created
+func (vm *VirtualMachine) Hardware() snapshot.Hardware {
+	return vm.hardware
+}
+
+// Generated returns the machine identifier and the MAC addresses generated
+// for the virtual machine
+func (vm *VirtualMachine) Generated() snapshot.Generated {
+	return snapshot.NewGenerated(vm.Config(), vm.machineIdentifier)
+}
+
 type VirtualMachineConfiguration struct {
 	*vz.VirtualMachineConfiguration                             // wrapper for Objective-C type
 	config                               *config.VirtualMachine // go-friendly virtual machine configuration definition
@@ -87,6 +142,8 @@ type VirtualMachineConfiguration struct {
 	pointingDevicesConfiguration         []vz.PointingDeviceConfiguration
 	graphicsDevicesConfiguration         []vz.GraphicsDeviceConfiguration
 	networkDevicesConfiguration          []*vz.VirtioNetworkDeviceConfiguration
+	networkCaptures                      []*pcap.Capture  // one per network device, nil when its frames are not relayed
+	networkStacks                        []*usernet.Stack // one per network device, nil when it doesn't use the 'usermode' type
 	entropyDevicesConfiguration          []*vz.VirtioEntropyDeviceConfiguration
 	serialPortsConfiguration             []*vz.VirtioConsoleDeviceSerialPortConfiguration
 	socketDevicesConfiguration           []vz.SocketDeviceConfiguration
@@ -94,7 +151,7 @@ type VirtualMachineConfiguration struct {
 }
 
 func NewVirtualMachineConfiguration(vmConfig *config.VirtualMachine) (*VirtualMachineConfiguration, error) {
-	vzBootloader, err := toVzBootloader(vmConfig.Bootloader)
+	vzBootloader, err := toVzBootloader(vmConfig.Bootloader, vmConfig.Devices, vmConfig.StateDir)
 	if err != nil {
 		return nil, err
 	}
@@ -111,7 +168,22 @@ func NewVirtualMachineConfiguration(vmConfig *config.VirtualMachine) (*VirtualMa
 }
 
 func NewGenericPlatformConfiguration(vmConfig config.VirtualMachine) (vz.PlatformConfiguration, error) {
-	identifier, err := vz.NewGenericMachineIdentifier()
+	return newGenericPlatformConfiguration(vmConfig, nil)
+}
+
+// newGenericPlatformConfiguration creates a generic platform configuration
+// with the machine identifier whose data representation is
+// machineIdentifier, a new identifier is generated when it's nil
+func newGenericPlatformConfiguration(vmConfig config.VirtualMachine, machineIdentifier []byte) (*vz.GenericPlatformConfiguration, error) {
+	var (
+		identifier *vz.GenericMachineIdentifier
+		err        error
+	)
+	if machineIdentifier != nil {
+		identifier, err = vz.NewGenericMachineIdentifierWithData(machineIdentifier)
+	} else {
+		identifier, err = vz.NewGenericMachineIdentifier()
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error generating vz identifier: %v", err)
 	}
@@ -137,6 +209,13 @@ func (cfg *VirtualMachineConfiguration) toVz() (*vz.VirtualMachineConfiguration,
 			return nil, err
 		}
 	}
+	// the cloud-init device is added after the virtio-net devices, which
+	// set the MAC addresses used in the generated network-config
+	if cfg.config.CloudInit != nil {
+		if err := cfg.addCloudInitDevice(); err != nil {
+			return nil, err
+		}
+	}
 	if cfg.config.Timesync != nil && cfg.config.Timesync.VsockPort != 0 {
 		// automatically add the vsock device we'll need for communication over VsockPort
 		vsockDev := VirtioVsock{
@@ -159,6 +238,17 @@ func (cfg *VirtualMachineConfiguration) toVz() (*vz.VirtualMachineConfiguration,
 		}
 	}
 
+	if cfg.config.MetadataService != nil {
+		// automatically add the vsock device the metadata service listens on
+		vsockDev := VirtioVsock{
+			Port:   cfg.config.MetadataService.VsockPort,
+			Listen: false,
+		}
+		if err := vsockDev.AddToVirtualMachineConfig(cfg); err != nil {
+			return nil, err
+		}
+	}
+
 	cfg.SetStorageDevicesVirtualMachineConfiguration(cfg.storageDevicesConfiguration)
 	cfg.SetDirectorySharingDevicesVirtualMachineConfiguration(cfg.directorySharingDevicesConfiguration)
 	cfg.SetPointingDevicesVirtualMachineConfiguration(cfg.pointingDevicesConfiguration)